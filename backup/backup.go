@@ -0,0 +1,194 @@
+// Package backup writes a zip archive of a whole install: a consistent copy of
+// every site's database, the settings file and the media directories. The
+// files keep their paths relative to the install, so unzipping the archive in
+// an empty directory restores it.
+package backup
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cms/sites"
+)
+
+// Report lists what went into a backup
+type Report struct {
+	CreatedAt  string   `json:"created_at"`
+	Databases  []string `json:"databases"`
+	Settings   string   `json:"settings,omitempty"`
+	MediaDirs  []string `json:"media_dirs"`
+	MediaFiles int      `json:"media_files"`
+}
+
+// Write archives every site of the registry, and settingsFile, to w
+func Write(w io.Writer, reg *sites.Registry, settingsFile string) (*Report, error) {
+	report := &Report{
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Databases: []string{},
+		MediaDirs: []string{},
+	}
+	list, err := reg.Sites()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.MkdirTemp("", "cms-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	zw := zip.NewWriter(w)
+	seenDB := map[string]bool{}
+	var dirs []string
+	for _, s := range list {
+		if !seenDB[s.Database] {
+			seenDB[s.Database] = true
+			database, err := reg.Database(s)
+			if err != nil {
+				return nil, fmt.Errorf("site %s: %w", s.Hostname, err)
+			}
+			snapshot := filepath.Join(tmp, fmt.Sprintf("%d.db", s.ID))
+			if err := snapshotDatabase(database, snapshot); err != nil {
+				return nil, fmt.Errorf("site %s: copying database: %w", s.Hostname, err)
+			}
+			if err := addFile(zw, snapshot, archiveName(s.Database), zip.Deflate); err != nil {
+				return nil, fmt.Errorf("site %s: %w", s.Hostname, err)
+			}
+			os.Remove(snapshot)
+			report.Databases = append(report.Databases, s.Database)
+		}
+
+		cfg, err := reg.Settings(s)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", s.Hostname, err)
+		}
+		dirs = append(dirs, filepath.Clean(cfg.Media.StorageDir))
+	}
+
+	// Sites other than the main one keep their media under the main site's
+	// directory, which already brings them into the archive
+	for _, dir := range mediaDirs(dirs) {
+		n, err := addDir(zw, dir)
+		if err != nil {
+			return nil, fmt.Errorf("media %s: %w", dir, err)
+		}
+		report.MediaDirs = append(report.MediaDirs, dir)
+		report.MediaFiles += n
+	}
+
+	if _, err := os.Stat(settingsFile); err == nil {
+		if err := addFile(zw, settingsFile, archiveName(settingsFile), zip.Deflate); err != nil {
+			return nil, err
+		}
+		report.Settings = settingsFile
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return report, zw.Close()
+}
+
+// mediaDirs returns dirs without duplicates and without directories inside
+// another one of them, in the order given
+func mediaDirs(dirs []string) []string {
+	var kept []string
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		nested := false
+		for _, other := range dirs {
+			if within(dir, other) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			kept = append(kept, dir)
+		}
+	}
+	return kept
+}
+
+// within reports whether dir is inside parent
+func within(dir, parent string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// snapshotDatabase copies a database as of one moment, even while the server
+// is writing to it
+func snapshotDatabase(database *sql.DB, path string) error {
+	_, err := database.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// addDir adds the files under dir, returning how many. A directory that
+// doesn't exist yet has nothing to back up.
+func addDir(zw *zip.Writer, dir string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == dir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		// Media is mostly already compressed, so it's stored as is
+		if err := addFile(zw, p, archiveName(p), zip.Store); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func addFile(zw *zip.Writer, path, name string, method uint16) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = method
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// archiveName is a file's name inside the archive: its path as configured,
+// made relative for files kept outside the install
+func archiveName(path string) string {
+	name := filepath.ToSlash(filepath.Clean(path))
+	name = strings.TrimPrefix(name, filepath.ToSlash(filepath.VolumeName(path)))
+	for strings.HasPrefix(name, "../") {
+		name = strings.TrimPrefix(name, "../")
+	}
+	return strings.TrimLeft(name, "/")
+}
@@ -0,0 +1,231 @@
+// Package bundle moves a site's content between installs. A bundle is a JSON
+// document holding the site's settings and the rows of its content tables,
+// either on its own or in a zip archive alongside the media files.
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"cms/storage"
+)
+
+// Format and Version identify the bundle layout. Version goes up whenever a
+// change would stop older releases reading newer bundles correctly.
+const (
+	Format  = "corecms-site"
+	Version = 1
+)
+
+// Tables are the tables a bundle carries, in the order they're imported so
+// that every row's references are already in place
+var Tables = []string{
+	"media",
+	"templates",
+	"code_blocks",
+	"pages",
+	"codeblocks_ordering",
+	"page_translations",
+	"code_block_translations",
+}
+
+// Names of the files inside a zip bundle
+const (
+	documentName = "site.json"
+	mediaDir     = "media"
+)
+
+// Row is one table row, column name to value
+type Row map[string]interface{}
+
+// Bundle is an exported site
+type Bundle struct {
+	Format     string           `json:"format"`
+	Version    int              `json:"version"`
+	ExportedAt string           `json:"exported_at"`
+	Site       string           `json:"site"`
+	Settings   json.RawMessage  `json:"settings"`
+	Tables     map[string][]Row `json:"tables"`
+
+	// Media files, when read from a zip
+	files map[string]*zip.File
+}
+
+// Export writes a site's bundle to w. Zipped bundles include the media
+// files; plain JSON ones only describe them.
+func Export(w io.Writer, db *sql.DB, store storage.Storage, site string, settings json.RawMessage, zipped bool) error {
+	b := Bundle{
+		Format:     Format,
+		Version:    Version,
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Site:       site,
+		Settings:   settings,
+		Tables:     map[string][]Row{},
+	}
+	if len(b.Settings) == 0 {
+		b.Settings = json.RawMessage("{}")
+	}
+	for _, table := range Tables {
+		rows, err := readTable(db, table)
+		if err != nil {
+			return fmt.Errorf("exporting %s: %w", table, err)
+		}
+		b.Tables[table] = rows
+	}
+
+	if !zipped {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	}
+
+	zw := zip.NewWriter(w)
+	doc, err := zw.Create(documentName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(doc)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(b); err != nil {
+		return err
+	}
+	for _, m := range b.Tables["media"] {
+		key, _ := m["storage_key"].(string)
+		if err := addMediaFile(zw, store, key); err != nil {
+			return fmt.Errorf("exporting media file %s: %w", key, err)
+		}
+	}
+	return zw.Close()
+}
+
+// addMediaFile copies one stored file into the zip. Files missing from
+// storage are left out; the import reports them.
+func addMediaFile(zw *zip.Writer, store storage.Storage, key string) error {
+	f, err := store.Open(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Media is mostly already compressed, so it's stored as is
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: path.Join(mediaDir, key), Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// readTable selects every row of a table, keeping whatever columns it has so
+// bundles carry columns added by later migrations
+func readTable(db *sql.DB, table string) ([]Row, error) {
+	rows, err := db.Query("SELECT * FROM " + table + " ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	list := []Row{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := Row{}
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[column] = values[i]
+		}
+		list = append(list, row)
+	}
+	return list, rows.Err()
+}
+
+// Read parses a bundle, either a zip archive or a plain JSON document
+func Read(data []byte) (*Bundle, error) {
+	var b Bundle
+	doc := data
+	if bytes.HasPrefix(data, []byte("PK")) {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("reading zip: %w", err)
+		}
+		b.files = map[string]*zip.File{}
+		doc = nil
+		for _, f := range zr.File {
+			if f.Name == documentName {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				doc, err = io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					return nil, err
+				}
+			} else if key, ok := strings.CutPrefix(f.Name, mediaDir+"/"); ok {
+				b.files[key] = f
+			}
+		}
+		if doc == nil {
+			return nil, fmt.Errorf("zip has no %s", documentName)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&b); err != nil {
+		return nil, fmt.Errorf("parsing bundle: %w", err)
+	}
+	if b.Format != Format {
+		return nil, fmt.Errorf("not a site bundle")
+	}
+	if b.Version < 1 || b.Version > Version {
+		return nil, fmt.Errorf("bundle version %d is not supported, this release reads up to version %d", b.Version, Version)
+	}
+	if len(b.Settings) == 0 {
+		b.Settings = json.RawMessage("{}")
+	}
+	for _, rows := range b.Tables {
+		for _, row := range rows {
+			for column, value := range row {
+				row[column] = fromJSON(value)
+			}
+		}
+	}
+	return &b, nil
+}
+
+// fromJSON turns the json.Numbers the decoder produced back into the integers
+// and floats SQLite stored
+func fromJSON(v interface{}) interface{} {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
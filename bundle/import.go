@@ -0,0 +1,847 @@
+package bundle
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"cms/storage"
+)
+
+// Import modes. Merge adds the bundle's content next to the site's, with new
+// IDs; replace deletes the site's content first and keeps the bundle's IDs.
+const (
+	Merge   = "merge"
+	Replace = "replace"
+)
+
+// What a merge does when a code block title or page URL is already taken:
+// stop without importing anything, use the site's existing block or page in
+// place of the bundle's, or import the bundle's under a new name
+const (
+	ConflictFail   = "fail"
+	ConflictSkip   = "skip"
+	ConflictRename = "rename"
+)
+
+// ErrConflicts is returned when a merge finds conflicts and was told to fail
+var ErrConflicts = errors.New("bundle: conflicts with existing content")
+
+// Options control an import
+type Options struct {
+	Mode       string
+	OnConflict string
+	DryRun     bool
+}
+
+// Check fills in the default mode and conflict handling and rejects unknown
+// ones
+func (o *Options) Check() error {
+	if o.Mode == "" {
+		o.Mode = Merge
+	}
+	if o.Mode != Merge && o.Mode != Replace {
+		return fmt.Errorf("mode must be merge or replace")
+	}
+	if o.OnConflict == "" {
+		o.OnConflict = ConflictFail
+	}
+	if o.OnConflict != ConflictFail && o.OnConflict != ConflictSkip && o.OnConflict != ConflictRename {
+		return fmt.Errorf("conflicts must be fail, skip or rename")
+	}
+	return nil
+}
+
+// Conflict is a bundle row whose title or URL the site already uses
+type Conflict struct {
+	Table      string `json:"table"`
+	Field      string `json:"field"`
+	Value      string `json:"value"`
+	ID         int64  `json:"id"`
+	ExistingID int64  `json:"existing_id"`
+	Resolution string `json:"resolution,omitempty"`
+}
+
+// Report describes what an import did, or would do on a dry run
+type Report struct {
+	Mode         string                     `json:"mode"`
+	OnConflict   string                     `json:"on_conflict,omitempty"`
+	DryRun       bool                       `json:"dry_run"`
+	Created      map[string]int             `json:"created"`
+	Reused       map[string]int             `json:"reused"`
+	Deleted      map[string]int             `json:"deleted,omitempty"`
+	Conflicts    []Conflict                 `json:"conflicts"`
+	MissingFiles []string                   `json:"missing_files"`
+	IDs          map[string]map[int64]int64 `json:"ids"`
+
+	// On replace, references from content the bundle doesn't carry, such as
+	// menu items and collections, pointed at the imported page or media
+	// with the same URL or checksum, and those left without one
+	Relinked map[string]int `json:"relinked,omitempty"`
+	Unlinked map[string]int `json:"unlinked,omitempty"`
+
+	// How the bundle's settings were applied, "replaced" or "merged", and
+	// the instance-level ones left out
+	Settings        string   `json:"settings,omitempty"`
+	SettingsIgnored []string `json:"settings_ignored,omitempty"`
+}
+
+// Tables cleared along with the bundle's on replace, since they hold copies
+// of or references to the content being replaced
+var replaceDependents = []string{"published_pages", "published_translations", "search_index", "asset_bundles"}
+
+// Columns of tables a bundle doesn't carry that refer to pages or media, and
+// the value meaning "none" for each
+var replaceRefs = []struct {
+	table, column, target string
+	none                  interface{}
+}{
+	{"menu_items", "page_id", "pages", -1},
+	{"collections", "list_page_id", "pages", -1},
+	{"collections", "detail_page_id", "pages", -1},
+	{"vocabularies", "list_page_id", "pages", nil},
+	{"posts", "image_id", "media", nil},
+}
+
+// mediaRef matches the code block helpers that take a media ID, e.g.
+// {{ image 12 }}, so merged blocks can point at the media's new ID
+var mediaRef = regexp.MustCompile(`(\{\{-?\s*(?:media|image|srcset|responsiveImage)\s+)(\d+)`)
+
+type importer struct {
+	tx     *sql.Tx
+	b      *Bundle
+	store  storage.Storage
+	opts   Options
+	report *Report
+
+	columns map[string][]string
+	// Bundle rows stood in for by existing ones after a skipped conflict
+	skipped map[string]map[int64]bool
+	// Titles, URLs and storage keys given to renamed rows
+	renamed map[string]map[int64]string
+	// Page translations left out after a skipped conflict, and the URLs
+	// given to renamed ones
+	skippedTranslations map[pageLocale]bool
+	renamedTranslations map[pageLocale]string
+	// The URLs of the site's pages and checksums of its media before a
+	// replace, by ID
+	oldPages map[int64]string
+	oldMedia map[int64]string
+}
+
+// pageLocale identifies a page translation in the bundle
+type pageLocale struct {
+	page   int64
+	locale string
+}
+
+// Import loads a bundle into a site's database. Media files from a zipped
+// bundle are written to store once the rows are committed. Nothing is
+// changed on a dry run, or when conflicts stop a merge.
+func Import(db *sql.DB, store storage.Storage, b *Bundle, opts Options) (*Report, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Mode:         opts.Mode,
+		DryRun:       opts.DryRun,
+		Created:      map[string]int{},
+		Reused:       map[string]int{},
+		Conflicts:    []Conflict{},
+		MissingFiles: []string{},
+		IDs:          map[string]map[int64]int64{},
+	}
+	if opts.Mode == Merge {
+		report.OnConflict = opts.OnConflict
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	im := &importer{
+		tx:      tx,
+		b:       b,
+		store:   store,
+		opts:    opts,
+		report:  report,
+		columns: map[string][]string{},
+		skipped: map[string]map[int64]bool{"media": {}, "code_blocks": {}, "pages": {}},
+		renamed: map[string]map[int64]string{"media": {}, "code_blocks": {}, "pages": {}},
+
+		skippedTranslations: map[pageLocale]bool{},
+		renamedTranslations: map[pageLocale]string{},
+	}
+	for _, table := range Tables {
+		report.IDs[table] = map[int64]int64{}
+	}
+
+	var oldKeys []string
+	if opts.Mode == Replace {
+		if oldKeys, err = im.clear(); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := im.findConflicts(); err != nil {
+			return nil, err
+		}
+		if len(report.Conflicts) > 0 && opts.OnConflict == ConflictFail {
+			return report, ErrConflicts
+		}
+	}
+
+	steps := []func() error{im.media, im.templates, im.codeBlocks, im.pages, im.orderings, im.translations}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Mode == Replace {
+		if err := im.relink(); err != nil {
+			return nil, err
+		}
+	}
+	// Tables without an id column have no mapping worth reporting
+	delete(report.IDs, "page_translations")
+	delete(report.IDs, "code_block_translations")
+
+	if opts.DryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := im.saveFiles(); err != nil {
+		return report, err
+	}
+	kept := map[string]bool{}
+	for _, m := range b.Tables["media"] {
+		key, _ := m["storage_key"].(string)
+		kept[key] = true
+	}
+	for _, key := range oldKeys {
+		if !kept[key] {
+			store.Delete(key)
+		}
+	}
+	return report, nil
+}
+
+// clear deletes the site's content ahead of a replace and returns the
+// storage keys of the media it had
+func (im *importer) clear() ([]string, error) {
+	var keys []string
+	im.oldMedia = map[int64]string{}
+	rows, err := im.tx.Query("SELECT id, storage_key, checksum FROM media")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var key, checksum string
+		if err := rows.Scan(&id, &key, &checksum); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+		im.oldMedia[id] = checksum
+	}
+	rows.Close()
+
+	im.oldPages = map[int64]string{}
+	rows, err = im.tx.Query("SELECT id, url FROM pages")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var url string
+		if err := rows.Scan(&id, &url); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		im.oldPages[id] = url
+	}
+	rows.Close()
+
+	im.report.Deleted = map[string]int{}
+	tables := append(append([]string{}, replaceDependents...), Tables...)
+	for _, table := range tables {
+		var exists int
+		im.tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = ?", table).Scan(&exists)
+		if exists == 0 {
+			continue
+		}
+		result, err := im.tx.Exec("DELETE FROM " + table)
+		if err != nil {
+			return nil, fmt.Errorf("clearing %s: %w", table, err)
+		}
+		n, _ := result.RowsAffected()
+		im.report.Deleted[table] = int(n)
+	}
+	if _, err := im.tx.Exec("DELETE FROM term_assignments WHERE object_type = 'page'"); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// relink points the references in replaceRefs, which still hold the IDs of
+// the site's old pages and media, at the imported rows with the same URL or
+// checksum, or at none when the bundle has no such row
+func (im *importer) relink() error {
+	im.report.Relinked = map[string]int{}
+	im.report.Unlinked = map[string]int{}
+	for _, ref := range replaceRefs {
+		rows, err := im.tx.Query("SELECT id, " + ref.column + " FROM " + ref.table + " WHERE " + ref.column + " > 0")
+		if err != nil {
+			return err
+		}
+		links := map[int64]int64{}
+		for rows.Next() {
+			var id, target int64
+			if err := rows.Scan(&id, &target); err != nil {
+				rows.Close()
+				return err
+			}
+			links[id] = target
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		name := ref.table + "." + ref.column
+		for id, target := range links {
+			var value interface{} = ref.none
+			var found bool
+			var newID int64
+			var err error
+			if ref.target == "pages" {
+				if url, ok := im.oldPages[target]; ok {
+					err = im.tx.QueryRow("SELECT id FROM pages WHERE url = ? ORDER BY id LIMIT 1", url).Scan(&newID)
+					found = err == nil
+				}
+			} else if checksum, ok := im.oldMedia[target]; ok {
+				err = im.tx.QueryRow("SELECT id FROM media WHERE checksum = ? ORDER BY id LIMIT 1", checksum).Scan(&newID)
+				found = err == nil
+			}
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if found {
+				if newID == target {
+					continue
+				}
+				value = newID
+				im.report.Relinked[name]++
+			} else {
+				im.report.Unlinked[name]++
+			}
+			if _, err := im.tx.Exec("UPDATE "+ref.table+" SET "+ref.column+" = ? WHERE id = ?", value, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findConflicts checks the bundle's code block titles and page URLs against
+// the site's, and with the rename option picks the new names
+func (im *importer) findConflicts() error {
+	if err := im.findMediaConflicts(); err != nil {
+		return err
+	}
+	checks := []struct{ table, field string }{
+		{"code_blocks", "title"},
+		{"pages", "url"},
+	}
+	for _, c := range checks {
+		taken := map[string]bool{}
+		for _, row := range im.b.Tables[c.table] {
+			value, _ := row[c.field].(string)
+			taken[value] = true
+		}
+		for _, row := range im.b.Tables[c.table] {
+			value, _ := row[c.field].(string)
+			id, _ := toInt(row["id"])
+
+			var existing int64
+			err := im.tx.QueryRow("SELECT id FROM "+c.table+" WHERE "+c.field+" = ? ORDER BY id LIMIT 1", value).Scan(&existing)
+			if err == sql.ErrNoRows {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			conflict := Conflict{Table: c.table, Field: c.field, Value: value, ID: id, ExistingID: existing}
+			switch im.opts.OnConflict {
+			case ConflictSkip:
+				conflict.Resolution = "using existing"
+				im.skipped[c.table][id] = true
+				im.report.IDs[c.table][id] = existing
+			case ConflictRename:
+				name, err := im.freeName(c.table, c.field, value, taken)
+				if err != nil {
+					return err
+				}
+				taken[name] = true
+				conflict.Resolution = "renamed to " + name
+				im.renamed[c.table][id] = name
+			}
+			im.report.Conflicts = append(im.report.Conflicts, conflict)
+		}
+	}
+	return im.findTranslationConflicts()
+}
+
+// findMediaConflicts checks the bundle's storage keys against the site's.
+// Media the site already has by checksum is reused, so only a key holding a
+// different file conflicts.
+func (im *importer) findMediaConflicts() error {
+	taken := map[string]bool{}
+	for _, row := range im.b.Tables["media"] {
+		key, _ := row["storage_key"].(string)
+		taken[key] = true
+	}
+	for _, row := range im.b.Tables["media"] {
+		key, _ := row["storage_key"].(string)
+		id, _ := toInt(row["id"])
+
+		var existing int64
+		var checksum string
+		err := im.tx.QueryRow("SELECT id, checksum FROM media WHERE storage_key = ?", key).Scan(&existing, &checksum)
+		if err == sql.ErrNoRows || checksum == row["checksum"] {
+			continue
+		} else if err != nil {
+			return err
+		}
+		var reused int
+		if err := im.tx.QueryRow("SELECT COUNT(*) FROM media WHERE checksum = ?", row["checksum"]).Scan(&reused); err != nil {
+			return err
+		}
+		if reused > 0 {
+			continue
+		}
+
+		conflict := Conflict{Table: "media", Field: "storage_key", Value: key, ID: id, ExistingID: existing}
+		switch im.opts.OnConflict {
+		case ConflictSkip:
+			conflict.Resolution = "using existing"
+			im.skipped["media"][id] = true
+			im.report.IDs["media"][id] = existing
+		case ConflictRename:
+			name, err := im.freeName("media", "storage_key", key, taken)
+			if err != nil {
+				return err
+			}
+			taken[name] = true
+			conflict.Resolution = "renamed to " + name
+			im.renamed["media"][id] = name
+		}
+		im.report.Conflicts = append(im.report.Conflicts, conflict)
+	}
+	return nil
+}
+
+// findTranslationConflicts checks the translated URLs of the bundle's pages
+// against the site's in the same locale. Translations of pages the site's
+// own stand in for aren't imported, so they can't conflict.
+func (im *importer) findTranslationConflicts() error {
+	taken := map[string]bool{}
+	for _, row := range im.b.Tables["page_translations"] {
+		url, _ := row["url"].(string)
+		taken[url] = true
+	}
+	for _, row := range im.b.Tables["page_translations"] {
+		url, _ := row["url"].(string)
+		locale, _ := row["locale"].(string)
+		pageID, _ := toInt(row["page_id"])
+		if im.skipped["pages"][pageID] {
+			continue
+		}
+
+		var existing int64
+		err := im.tx.QueryRow("SELECT page_id FROM page_translations WHERE locale = ? AND url = ?", locale, url).Scan(&existing)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		key := pageLocale{pageID, locale}
+		conflict := Conflict{Table: "page_translations", Field: "url", Value: url, ID: pageID, ExistingID: existing}
+		switch im.opts.OnConflict {
+		case ConflictSkip:
+			conflict.Resolution = "left out"
+			im.skippedTranslations[key] = true
+		case ConflictRename:
+			name, err := im.freeName("page_translations", "url", url, taken)
+			if err != nil {
+				return err
+			}
+			taken[name] = true
+			conflict.Resolution = "renamed to " + name
+			im.renamedTranslations[key] = name
+		}
+		im.report.Conflicts = append(im.report.Conflicts, conflict)
+	}
+	return nil
+}
+
+// freeName finds an unused variant of a title, "Footer (2)", URL,
+// "/about-2", or storage key, "2024/05/photo-2.jpg"
+func (im *importer) freeName(table, field, value string, taken map[string]bool) (string, error) {
+	for n := 2; ; n++ {
+		var name string
+		if field == "storage_key" {
+			ext := path.Ext(value)
+			name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(value, ext), n, ext)
+		} else if field == "url" {
+			base := strings.TrimSuffix(value, "/")
+			if base == "" {
+				base = "/index"
+			}
+			name = fmt.Sprintf("%s-%d", base, n)
+		} else {
+			name = fmt.Sprintf("%s (%d)", value, n)
+		}
+		if taken[name] {
+			continue
+		}
+		var exists int
+		if err := im.tx.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+field+" = ?", name).Scan(&exists); err != nil {
+			return "", err
+		}
+		if exists == 0 {
+			return name, nil
+		}
+	}
+}
+
+// tableColumns lists a table's columns in the site's schema
+func (im *importer) tableColumns(table string) ([]string, error) {
+	if cols, ok := im.columns[table]; ok {
+		return cols, nil
+	}
+	rows, err := im.tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	im.columns[table] = cols
+	return cols, rows.Err()
+}
+
+// insert adds a bundle row with some columns replaced. Columns the site's
+// schema lacks are dropped, and the row keeps its ID only on replace.
+func (im *importer) insert(table string, row Row, set Row) (int64, error) {
+	cols, err := im.tableColumns(table)
+	if err != nil {
+		return 0, err
+	}
+	var names, marks []string
+	var values []interface{}
+	for _, col := range cols {
+		if col == "id" && im.opts.Mode != Replace {
+			continue
+		}
+		value, ok := set[col]
+		if !ok {
+			if value, ok = row[col]; !ok {
+				continue
+			}
+		}
+		names = append(names, col)
+		marks = append(marks, "?")
+		values = append(values, value)
+	}
+
+	result, err := im.tx.Exec("INSERT INTO "+table+" ("+strings.Join(names, ", ")+") VALUES ("+strings.Join(marks, ", ")+")", values...)
+	if err != nil {
+		return 0, fmt.Errorf("importing %s: %w", table, err)
+	}
+	im.report.Created[table]++
+	return result.LastInsertId()
+}
+
+// ref maps a reference to a bundle row onto the imported row. Zero and
+// negative IDs mean "none" in this schema and are kept; references to rows
+// missing from the bundle become none.
+func (im *importer) ref(table string, v, none interface{}) interface{} {
+	id, ok := toInt(v)
+	if !ok {
+		return none
+	}
+	if id <= 0 {
+		return v
+	}
+	if mapped, ok := im.report.IDs[table][id]; ok {
+		return mapped
+	}
+	return none
+}
+
+// mediaRefs points {{ image N }} and friends at the media's imported IDs.
+// Only template blocks call helpers; other blocks keep their text as is.
+func (im *importer) mediaRefs(content, blockType interface{}) interface{} {
+	s, ok := content.(string)
+	if !ok || im.opts.Mode == Replace || blockType != "template" {
+		return content
+	}
+	return mediaRef.ReplaceAllStringFunc(s, func(m string) string {
+		parts := mediaRef.FindStringSubmatch(m)
+		var id int64
+		fmt.Sscan(parts[2], &id)
+		if mapped, ok := im.report.IDs["media"][id]; ok {
+			return fmt.Sprintf("%s%d", parts[1], mapped)
+		}
+		return m
+	})
+}
+
+// media imports media rows. A merge reuses any file the site already has,
+// matched by checksum.
+func (im *importer) media() error {
+	for _, row := range im.b.Tables["media"] {
+		id, _ := toInt(row["id"])
+		key, _ := row["storage_key"].(string)
+		if im.skipped["media"][id] {
+			im.report.Reused["media"]++
+			continue
+		}
+
+		if im.opts.Mode == Merge {
+			var existing int64
+			err := im.tx.QueryRow("SELECT id FROM media WHERE checksum = ?", row["checksum"]).Scan(&existing)
+			if err == nil {
+				im.report.IDs["media"][id] = existing
+				im.report.Reused["media"]++
+				im.skipped["media"][id] = true
+				continue
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		// A renamed row's old key holds the site's own file
+		var set Row
+		_, zipped := im.b.files[key]
+		if name, ok := im.renamed["media"][id]; ok {
+			set = Row{"storage_key": name}
+			if !zipped {
+				im.report.MissingFiles = append(im.report.MissingFiles, key)
+			}
+		} else if !zipped && !im.store.Exists(key) {
+			im.report.MissingFiles = append(im.report.MissingFiles, key)
+		}
+		newID, err := im.insert("media", row, set)
+		if err != nil {
+			return err
+		}
+		im.report.IDs["media"][id] = newID
+	}
+	return nil
+}
+
+// templates imports templates, then links each to its parent once every
+// template has its new ID
+func (im *importer) templates() error {
+	rows := im.b.Tables["templates"]
+	for _, row := range rows {
+		id, _ := toInt(row["id"])
+		newID, err := im.insert("templates", row, Row{"parent_template_id": nil})
+		if err != nil {
+			return err
+		}
+		im.report.IDs["templates"][id] = newID
+	}
+	for _, row := range rows {
+		if row["parent_template_id"] == nil {
+			continue
+		}
+		id, _ := toInt(row["id"])
+		_, err := im.tx.Exec("UPDATE templates SET parent_template_id = ? WHERE id = ?",
+			im.ref("templates", row["parent_template_id"], nil), im.report.IDs["templates"][id])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// codeBlocks imports code blocks. Links to the shared library aren't kept,
+// since the library belongs to the install the bundle came from.
+func (im *importer) codeBlocks() error {
+	for _, row := range im.b.Tables["code_blocks"] {
+		id, _ := toInt(row["id"])
+		if im.skipped["code_blocks"][id] {
+			im.report.Reused["code_blocks"]++
+			continue
+		}
+		set := Row{"content": im.mediaRefs(row["content"], row["type"]), "shared_id": nil, "overridden": 0}
+		if name, ok := im.renamed["code_blocks"][id]; ok {
+			set["title"] = name
+		}
+		newID, err := im.insert("code_blocks", row, set)
+		if err != nil {
+			return err
+		}
+		im.report.IDs["code_blocks"][id] = newID
+	}
+	return nil
+}
+
+// pages imports pages, then links each to its parent once every page has its
+// new ID
+func (im *importer) pages() error {
+	var imported []Row
+	for _, row := range im.b.Tables["pages"] {
+		id, _ := toInt(row["id"])
+		if im.skipped["pages"][id] {
+			im.report.Reused["pages"]++
+			continue
+		}
+		set := Row{
+			"parent_page": -1,
+			"template_id": im.ref("templates", row["template_id"], -1),
+			"og_image_id": im.ref("media", row["og_image_id"], nil),
+		}
+		if name, ok := im.renamed["pages"][id]; ok {
+			set["url"] = name
+		}
+		newID, err := im.insert("pages", row, set)
+		if err != nil {
+			return err
+		}
+		im.report.IDs["pages"][id] = newID
+		imported = append(imported, row)
+	}
+	for _, row := range imported {
+		id, _ := toInt(row["id"])
+		_, err := im.tx.Exec("UPDATE pages SET parent_page = ? WHERE id = ?",
+			im.ref("pages", row["parent_page"], -1), im.report.IDs["pages"][id])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderings places the imported code blocks on the imported pages and
+// templates. A page merged into an existing one keeps its own blocks.
+func (im *importer) orderings() error {
+	for _, row := range im.b.Tables["codeblocks_ordering"] {
+		pageID, _ := toInt(row["page_id"])
+		if im.skipped["pages"][pageID] {
+			continue
+		}
+		blockID := im.ref("code_blocks", row["codeblock_id"], nil)
+		if blockID == nil {
+			continue
+		}
+		id, _ := toInt(row["id"])
+		newID, err := im.insert("codeblocks_ordering", row, Row{
+			"page_id":      im.ref("pages", row["page_id"], -1),
+			"template_id":  im.ref("templates", row["template_id"], -1),
+			"codeblock_id": blockID,
+		})
+		if err != nil {
+			return err
+		}
+		im.report.IDs["codeblocks_ordering"][id] = newID
+	}
+	return nil
+}
+
+// translations imports the translations of the imported pages and code
+// blocks. Existing rows that stood in for the bundle's keep theirs.
+func (im *importer) translations() error {
+	for _, row := range im.b.Tables["page_translations"] {
+		pageID, _ := toInt(row["page_id"])
+		mapped := im.ref("pages", row["page_id"], nil)
+		locale, _ := row["locale"].(string)
+		key := pageLocale{pageID, locale}
+		if im.skipped["pages"][pageID] || im.skippedTranslations[key] || mapped == nil {
+			continue
+		}
+		set := Row{"page_id": mapped}
+		if name, ok := im.renamedTranslations[key]; ok {
+			set["url"] = name
+		}
+		if _, err := im.insert("page_translations", row, set); err != nil {
+			return err
+		}
+	}
+	for _, row := range im.b.Tables["code_block_translations"] {
+		blockID, _ := toInt(row["codeblock_id"])
+		mapped := im.ref("code_blocks", row["codeblock_id"], nil)
+		if im.skipped["code_blocks"][blockID] || mapped == nil {
+			continue
+		}
+		set := Row{"codeblock_id": mapped, "content": im.mediaRefs(row["content"], im.blockType(blockID))}
+		if _, err := im.insert("code_block_translations", row, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockType returns the type of one of the bundle's code blocks
+func (im *importer) blockType(id int64) interface{} {
+	for _, row := range im.b.Tables["code_blocks"] {
+		if rowID, _ := toInt(row["id"]); rowID == id {
+			return row["type"]
+		}
+	}
+	return nil
+}
+
+// saveFiles writes the zipped media files of the imported rows to storage
+func (im *importer) saveFiles() error {
+	for _, row := range im.b.Tables["media"] {
+		id, _ := toInt(row["id"])
+		key, _ := row["storage_key"].(string)
+		f, ok := im.b.files[key]
+		if !ok || im.skipped["media"][id] {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("media file %s: %w", key, err)
+		}
+		if name, ok := im.renamed["media"][id]; ok {
+			key = name
+		}
+		_, err = im.store.Save(key, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("media file %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), n == float64(int64(n))
+	}
+	return 0, false
+}
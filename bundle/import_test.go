@@ -0,0 +1,377 @@
+package bundle
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"cms/db"
+	"cms/storage"
+)
+
+// openSite creates an empty site database and media store
+func openSite(t *testing.T) (*sql.DB, *storage.Local) {
+	t.Helper()
+	dir := t.TempDir()
+	database, err := db.Open(filepath.Join(dir, "cms.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	store, err := storage.NewLocal(filepath.Join(dir, "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database, store
+}
+
+func mustExec(t *testing.T, database *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := database.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func queryString(t *testing.T, database *sql.DB, query string, args ...interface{}) string {
+	t.Helper()
+	var s string
+	if err := database.QueryRow(query, args...).Scan(&s); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return s
+}
+
+// sourceBundle builds a small site and exports it. Block 1 is a template
+// pointing at media 1, block 2 an HTML block whose braces aren't helpers.
+func sourceBundle(t *testing.T, zipped bool) *Bundle {
+	t.Helper()
+	src, store := openSite(t)
+	mustExec(t, src, `INSERT INTO media (id, filename, storage_key, mime_type, size, checksum)
+		VALUES (1, 'a.png', '2024/a.png', 'image/png', 3, 'aaa')`)
+	mustExec(t, src, "INSERT INTO templates (id, title) VALUES (1, 'Base')")
+	mustExec(t, src, `INSERT INTO code_blocks (id, title, type, content) VALUES
+		(1, 'Hero', 'template', '<img src="{{ image 1 }}">'),
+		(2, 'App', 'html', '<p>{{ image 1 }}</p>')`)
+	mustExec(t, src, `INSERT INTO pages (id, title, url, parent_page, template_id, og_image_id) VALUES
+		(1, 'About', '/about', -1, 1, 1),
+		(2, 'Team', '/about/team', 1, 1, NULL)`)
+	mustExec(t, src, "INSERT INTO codeblocks_ordering (page_id, codeblock_id, ordering, active) VALUES (1, 1, 0, 1), (2, 2, 0, 1)")
+	mustExec(t, src, "INSERT INTO page_translations (page_id, locale, title, url) VALUES (1, 'fr', 'À propos', '/fr/a-propos')")
+	mustExec(t, src, "INSERT INTO code_block_translations (codeblock_id, locale, content) VALUES (1, 'fr', '{{ image 1 }}')")
+	if _, err := store.Save("2024/a.png", bytes.NewReader([]byte("png"))); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Export(&buf, src, store, "source", nil, zipped); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Read(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// targetSite is a site with content of its own, so merged rows get new IDs
+func targetSite(t *testing.T) (*sql.DB, *storage.Local) {
+	t.Helper()
+	dst, store := openSite(t)
+	mustExec(t, dst, `INSERT INTO media (id, filename, storage_key, mime_type, size, checksum)
+		VALUES (1, 'old.png', '2023/old.png', 'image/png', 3, 'zzz')`)
+	mustExec(t, dst, "INSERT INTO code_blocks (id, title, content) VALUES (1, 'Footer', '<footer></footer>')")
+	mustExec(t, dst, "INSERT INTO pages (id, title, url) VALUES (1, 'Home', '/')")
+	if _, err := store.Save("2023/old.png", bytes.NewReader([]byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+	return dst, store
+}
+
+func readFile(t *testing.T, store storage.Storage, key string) string {
+	t.Helper()
+	f, err := store.Open(key)
+	if err != nil {
+		t.Fatalf("opening %s: %v", key, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestImportMerge(t *testing.T) {
+	b := sourceBundle(t, true)
+	dst, store := targetSite(t)
+
+	report, err := Import(dst, store, b, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCreated := map[string]int{"media": 1, "templates": 1, "code_blocks": 2, "pages": 2,
+		"codeblocks_ordering": 2, "page_translations": 1, "code_block_translations": 1}
+	if !reflect.DeepEqual(report.Created, wantCreated) {
+		t.Errorf("Created = %v, want %v", report.Created, wantCreated)
+	}
+	if report.IDs["media"][1] != 2 || report.IDs["code_blocks"][1] != 2 || report.IDs["pages"][1] != 2 || report.IDs["pages"][2] != 3 {
+		t.Errorf("IDs = %v", report.IDs)
+	}
+
+	// Helpers in template blocks follow the media to its new ID; HTML
+	// blocks are left alone
+	if got := queryString(t, dst, "SELECT content FROM code_blocks WHERE title = 'Hero'"); got != `<img src="{{ image 2 }}">` {
+		t.Errorf("template block content = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT content FROM code_blocks WHERE title = 'App'"); got != "<p>{{ image 1 }}</p>" {
+		t.Errorf("HTML block content = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT content FROM code_block_translations WHERE codeblock_id = 2"); got != "{{ image 2 }}" {
+		t.Errorf("translated template block content = %q", got)
+	}
+
+	if got := queryString(t, dst, "SELECT parent_page || ' ' || template_id FROM pages WHERE url = '/about/team'"); got != "2 1" {
+		t.Errorf("team page parent and template = %q, want %q", got, "2 1")
+	}
+	if got := queryString(t, dst, "SELECT og_image_id FROM pages WHERE url = '/about'"); got != "2" {
+		t.Errorf("og_image_id = %s, want 2", got)
+	}
+	if got := queryString(t, dst, "SELECT group_concat(page_id || ':' || codeblock_id, ' ') FROM (SELECT * FROM codeblocks_ordering ORDER BY id)"); got != "2:2 3:3" {
+		t.Errorf("orderings = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT page_id FROM page_translations WHERE locale = 'fr'"); got != "2" {
+		t.Errorf("page translation page_id = %s, want 2", got)
+	}
+	if got := readFile(t, store, "2024/a.png"); got != "png" {
+		t.Errorf("imported media file = %q", got)
+	}
+	if got := readFile(t, store, "2023/old.png"); got != "old" {
+		t.Errorf("existing media file = %q", got)
+	}
+}
+
+func TestImportMergeConflicts(t *testing.T) {
+	b := sourceBundle(t, true)
+	dst, store := targetSite(t)
+	if _, err := Import(dst, store, b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Importing the same bundle again conflicts on every title and URL,
+	// translated ones included
+	report, err := Import(dst, store, b, Options{})
+	if !errors.Is(err, ErrConflicts) {
+		t.Fatalf("second import = %v, want ErrConflicts", err)
+	}
+	if len(report.Conflicts) != 5 {
+		t.Errorf("Conflicts = %+v, want 5", report.Conflicts)
+	}
+	if got := queryString(t, dst, "SELECT COUNT(*) FROM pages"); got != "3" {
+		t.Errorf("a failed import left %s pages, want 3", got)
+	}
+
+	report, err = Import(dst, store, b, Options{OnConflict: ConflictSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantReused := map[string]int{"media": 1, "code_blocks": 2, "pages": 2}
+	if !reflect.DeepEqual(report.Reused, wantReused) {
+		t.Errorf("Reused = %v, want %v", report.Reused, wantReused)
+	}
+	if report.Created["pages"] != 0 || report.Created["code_blocks"] != 0 || report.Created["codeblocks_ordering"] != 0 {
+		t.Errorf("skipping conflicts created %v", report.Created)
+	}
+
+	report, err = Import(dst, store, b, Options{OnConflict: ConflictRename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Created["pages"] != 2 || report.Created["code_blocks"] != 2 || report.Created["page_translations"] != 1 {
+		t.Errorf("renaming conflicts created %v", report.Created)
+	}
+	if got := queryString(t, dst, "SELECT group_concat(url, ' ') FROM (SELECT url FROM page_translations ORDER BY page_id)"); got != "/fr/a-propos /fr/a-propos-2" {
+		t.Errorf("translated URLs = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT group_concat(title, ', ') FROM (SELECT title FROM code_blocks ORDER BY id)"); got != "Footer, Hero, App, Hero (2), App (2)" {
+		t.Errorf("code block titles = %q", got)
+	}
+	team := queryString(t, dst, "SELECT parent_page FROM pages WHERE url = '/about/team-2'")
+	if about := queryString(t, dst, "SELECT id FROM pages WHERE url = '/about-2'"); team != about {
+		t.Errorf("renamed team page has parent %s, want the renamed about page %s", team, about)
+	}
+	// The media was reused by checksum, so the renamed block points at it
+	if got := queryString(t, dst, "SELECT content FROM code_blocks WHERE title = 'Hero (2)'"); got != `<img src="{{ image 2 }}">` {
+		t.Errorf("renamed template block content = %q", got)
+	}
+}
+
+func TestImportReplace(t *testing.T) {
+	b := sourceBundle(t, true)
+	dst, store := targetSite(t)
+	mustExec(t, dst, "INSERT INTO published_pages (page_id, url, title, html) VALUES (1, '/', 'Home', '<html></html>')")
+
+	report, err := Import(dst, store, b, Options{Mode: Replace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted["media"] != 1 || report.Deleted["code_blocks"] != 1 || report.Deleted["pages"] != 1 || report.Deleted["published_pages"] != 1 {
+		t.Errorf("Deleted = %v", report.Deleted)
+	}
+
+	// Rows keep the bundle's IDs, so content needs no rewriting
+	if got := queryString(t, dst, "SELECT group_concat(id || ':' || title, ' ') FROM (SELECT id, title FROM code_blocks ORDER BY id)"); got != "1:Hero 2:App" {
+		t.Errorf("code blocks = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT content FROM code_blocks WHERE id = 1"); got != `<img src="{{ image 1 }}">` {
+		t.Errorf("template block content = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT group_concat(id || ':' || url || ':' || parent_page, ' ') FROM (SELECT * FROM pages ORDER BY id)"); got != "1:/about:-1 2:/about/team:1" {
+		t.Errorf("pages = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT id || ':' || storage_key FROM media"); got != "1:2024/a.png" {
+		t.Errorf("media = %q", got)
+	}
+	if got := readFile(t, store, "2024/a.png"); got != "png" {
+		t.Errorf("imported media file = %q", got)
+	}
+	if store.Exists("2023/old.png") {
+		t.Error("the replaced site's media file is still stored")
+	}
+}
+
+func TestImportReplaceRelinks(t *testing.T) {
+	b := sourceBundle(t, true)
+	dst, store := targetSite(t)
+	// Content the bundle doesn't carry, pointing at pages and media the
+	// bundle has by URL or checksum and at ones it doesn't
+	mustExec(t, dst, "INSERT INTO pages (id, title, url) VALUES (5, 'About', '/about')")
+	mustExec(t, dst, `INSERT INTO media (id, filename, storage_key, mime_type, size, checksum)
+		VALUES (7, 'a.png', '2023/a.png', 'image/png', 3, 'aaa')`)
+	mustExec(t, dst, "INSERT INTO menus (id, name) VALUES (1, 'main')")
+	mustExec(t, dst, `INSERT INTO menu_items (id, menu_id, label, page_id) VALUES
+		(1, 1, 'About', 5),
+		(2, 1, 'Home', 1)`)
+	mustExec(t, dst, `INSERT INTO collections (id, name, title, base_path, list_page_id, detail_page_id)
+		VALUES (1, 'blog', 'Blog', '/blog', 5, 1)`)
+	mustExec(t, dst, "INSERT INTO vocabularies (id, name, title, list_page_id) VALUES (1, 'tags', 'Tags', 1)")
+	mustExec(t, dst, `INSERT INTO posts (id, collection_id, title, slug, image_id) VALUES
+		(1, 1, 'Kept', 'kept', 7),
+		(2, 1, 'Lost', 'lost', 1)`)
+
+	report, err := Import(dst, store, b, Options{Mode: Replace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRelinked := map[string]int{"menu_items.page_id": 1, "collections.list_page_id": 1, "posts.image_id": 1}
+	if !reflect.DeepEqual(report.Relinked, wantRelinked) {
+		t.Errorf("Relinked = %v, want %v", report.Relinked, wantRelinked)
+	}
+	wantUnlinked := map[string]int{"menu_items.page_id": 1, "collections.detail_page_id": 1,
+		"vocabularies.list_page_id": 1, "posts.image_id": 1}
+	if !reflect.DeepEqual(report.Unlinked, wantUnlinked) {
+		t.Errorf("Unlinked = %v, want %v", report.Unlinked, wantUnlinked)
+	}
+
+	// Old page 5 was /about, now page 1; old page 1 was /, which the
+	// bundle doesn't have, so nothing may point at the new page 1 for it
+	if got := queryString(t, dst, "SELECT group_concat(id || ':' || page_id, ' ') FROM (SELECT * FROM menu_items ORDER BY id)"); got != "1:1 2:-1" {
+		t.Errorf("menu items = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT list_page_id || ' ' || detail_page_id FROM collections"); got != "1 -1" {
+		t.Errorf("collection pages = %q", got)
+	}
+	if got := queryString(t, dst, "SELECT IFNULL(list_page_id, 'none') FROM vocabularies"); got != "none" {
+		t.Errorf("vocabulary list page = %s", got)
+	}
+	if got := queryString(t, dst, "SELECT group_concat(id || ':' || IFNULL(image_id, 'none'), ' ') FROM (SELECT * FROM posts ORDER BY id)"); got != "1:1 2:none" {
+		t.Errorf("post images = %q", got)
+	}
+}
+
+func TestImportMergeStorageKeyConflicts(t *testing.T) {
+	b := sourceBundle(t, true)
+	for _, policy := range []string{ConflictFail, ConflictSkip, ConflictRename} {
+		// The site has a different file under the bundle's storage key
+		dst, store := openSite(t)
+		mustExec(t, dst, `INSERT INTO media (id, filename, storage_key, mime_type, size, checksum)
+			VALUES (3, 'a.png', '2024/a.png', 'image/png', 5, 'other')`)
+		if _, err := store.Save("2024/a.png", bytes.NewReader([]byte("other"))); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := Import(dst, store, b, Options{OnConflict: policy})
+		if policy == ConflictFail {
+			if !errors.Is(err, ErrConflicts) || len(report.Conflicts) != 1 || report.Conflicts[0].Field != "storage_key" {
+				t.Errorf("fail: Import = %v with conflicts %+v", err, report.Conflicts)
+			}
+			if got := queryString(t, dst, "SELECT COUNT(*) FROM pages"); got != "0" {
+				t.Errorf("fail: %s pages were imported", got)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		if got := readFile(t, store, "2024/a.png"); got != "other" {
+			t.Errorf("%s: the site's file was replaced with %q", policy, got)
+		}
+
+		switch policy {
+		case ConflictSkip:
+			if got := queryString(t, dst, "SELECT og_image_id FROM pages WHERE url = '/about'"); got != "3" {
+				t.Errorf("skip: og_image_id = %s, want the existing media 3", got)
+			}
+			if got := queryString(t, dst, "SELECT COUNT(*) FROM media"); got != "1" {
+				t.Errorf("skip: %s media rows, want 1", got)
+			}
+		case ConflictRename:
+			id := queryString(t, dst, "SELECT id FROM media WHERE storage_key = '2024/a-2.png'")
+			if got := queryString(t, dst, "SELECT og_image_id FROM pages WHERE url = '/about'"); got != id {
+				t.Errorf("rename: og_image_id = %s, want the renamed media %s", got, id)
+			}
+			if got := readFile(t, store, "2024/a-2.png"); got != "png" {
+				t.Errorf("rename: the bundle's file under the new key = %q", got)
+			}
+		}
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	b := sourceBundle(t, true)
+	dst, store := targetSite(t)
+
+	for _, mode := range []string{Merge, Replace} {
+		report, err := Import(dst, store, b, Options{Mode: mode, DryRun: true})
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if !report.DryRun || report.Created["pages"] != 2 {
+			t.Errorf("%s report = %+v", mode, report)
+		}
+		if got := queryString(t, dst, "SELECT group_concat(url, ' ') FROM pages"); got != "/" {
+			t.Errorf("%s dry run changed the pages to %q", mode, got)
+		}
+		if store.Exists("2024/a.png") || !store.Exists("2023/old.png") {
+			t.Errorf("%s dry run changed the stored files", mode)
+		}
+	}
+}
+
+func TestImportMissingFiles(t *testing.T) {
+	// A plain JSON bundle only describes its media
+	b := sourceBundle(t, false)
+	dst, store := openSite(t)
+
+	report, err := Import(dst, store, b, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.MissingFiles, []string{"2024/a.png"}) {
+		t.Errorf("MissingFiles = %q", report.MissingFiles)
+	}
+	if report.Created["media"] != 1 {
+		t.Errorf("Created = %v", report.Created)
+	}
+}
@@ -0,0 +1,78 @@
+package bundle
+
+import (
+	"database/sql"
+	"io"
+
+	"cms/settings"
+	"cms/sites"
+	"cms/storage"
+)
+
+// ExportSite writes one site's bundle, with its own settings overrides
+func ExportSite(w io.Writer, reg *sites.Registry, s sites.Site, zipped bool) error {
+	db, store, err := open(reg, s)
+	if err != nil {
+		return err
+	}
+	return Export(w, db, store, s.Hostname, s.Settings, zipped)
+}
+
+// ImportSite loads a bundle into a site. Its settings replace the site's
+// overrides on replace and are merged into them on merge. Settings that
+// belong to the whole instance, such as the media directory, are left out:
+// they describe the install the bundle came from. So is a mail address the
+// site may not send as.
+func ImportSite(reg *sites.Registry, s sites.Site, b *Bundle, opts Options) (*Report, error) {
+	db, store, err := open(reg, s)
+	if err != nil {
+		return nil, err
+	}
+	bundleSettings, ignored, err := settings.StripInstance(b.Settings)
+	if err != nil {
+		return nil, err
+	}
+	// The mail address of the site the bundle came from is usually at that
+	// site's domain, which this one may not send as
+	if cfg, err := reg.Base().ForSite(bundleSettings); err != nil {
+		return nil, err
+	} else if reg.CheckMailFrom(s, cfg.Mail.From) != nil {
+		if bundleSettings, err = settings.MergeOverrides(bundleSettings, []byte(`{"mail": {"from": null}}`)); err != nil {
+			return nil, err
+		}
+		ignored = append(ignored, "mail.from")
+	}
+	report, err := Import(db, store, b, opts)
+	if report != nil {
+		report.SettingsIgnored = ignored
+	}
+	if err != nil || opts.DryRun {
+		return report, err
+	}
+
+	overrides := bundleSettings
+	report.Settings = "replaced"
+	if report.Mode == Merge {
+		if overrides, err = settings.MergeOverrides(s.Settings, bundleSettings); err != nil {
+			return report, err
+		}
+		report.Settings = "merged"
+	}
+	return report, reg.SaveSettings(s, overrides)
+}
+
+func open(reg *sites.Registry, s sites.Site) (*sql.DB, storage.Storage, error) {
+	db, err := reg.Database(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := reg.Settings(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := reg.Storage(s, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, store, nil
+}
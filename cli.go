@@ -0,0 +1,941 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cms/backup"
+	"cms/bundle"
+	"cms/db"
+	"cms/handlers"
+	"cms/settings"
+	"cms/sites"
+	"cms/storage"
+	"cms/wordpress"
+)
+
+// The settings file every site's settings are applied over
+const settingsFile = "website_settings.json"
+
+// Exit codes for the command-line subcommands
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const commandUsage = `Usage: cms [command] [flags]
+
+With no command, cms runs the server. Commands exit with 0 on success, 1 when
+they fail and 2 when they're used wrongly.
+
+Commands:
+  serve [-addr address]
+        run the server
+  migrate
+        create missing tables and columns in every site's database
+  user add [-superuser] [-sites host,...] username
+        add an admin user, reading the password from standard input
+  user passwd username
+        change a user's password, reading it from standard input
+  page list [-site host] [-json]
+        list a site's pages
+  page create [-site host] -title title -url url -template id [-active]
+        add a page and print its ID
+  page publish [-site host] [-all] [id|url ...]
+        publish pages, or every active page with -all
+  block export [-site host] [-o file] [id|title ...]
+        write code blocks, or all of them, as JSON
+  block import [-site host] [-update] file ...
+        add the code blocks in block export's JSON, or one per .html, .tmpl,
+        .css, .js or .md file named after it; -update replaces blocks with
+        the same title instead of failing
+  export [-site host] [-format zip|json] [-o file]
+        write a site's bundle
+  import [-site host] [-mode merge|replace] [-conflicts fail|skip|rename] [-dry-run] file
+        load a bundle into a site
+  wordpress [-site host] -template id [-collection name] [-ordering n] [-media-dir dir] [-download] file
+        import pages, posts and media from a WordPress export (WXR)
+  static [-site host] [-o dir] [-full]
+        render a site's published pages into a directory for static hosting
+  backup [-o file]
+        archive every site's database, the settings file and the media into
+        a zip
+`
+
+// runCommand runs a subcommand and returns the process exit code
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		return serveCommand(nil)
+	}
+	switch args[0] {
+	case "serve":
+		return serveCommand(args[1:])
+	case "migrate":
+		return migrateCommand(args[1:])
+	case "user":
+		return subcommand("user", args[1:], map[string]func([]string) int{
+			"add":    userAddCommand,
+			"passwd": userPasswdCommand,
+		})
+	case "page":
+		return subcommand("page", args[1:], map[string]func([]string) int{
+			"list":    pageListCommand,
+			"create":  pageCreateCommand,
+			"publish": pagePublishCommand,
+		})
+	case "block":
+		return subcommand("block", args[1:], map[string]func([]string) int{
+			"export": blockExportCommand,
+			"import": blockImportCommand,
+		})
+	case "export":
+		return exportCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	case "wordpress":
+		return wordpressCommand(args[1:])
+	case "static":
+		return staticCommand(args[1:])
+	case "backup":
+		return backupCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(commandUsage)
+		return exitOK
+	}
+	fmt.Fprintf(os.Stderr, "cms: unknown command %q\n\n%s", args[0], commandUsage)
+	return exitUsage
+}
+
+// subcommand runs one of a command's subcommands, such as user add
+func subcommand(name string, args []string, commands map[string]func([]string) int) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "cms %s: expected a subcommand\n\n%s", name, commandUsage)
+		return exitUsage
+	}
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cms %s: unknown subcommand %q\n\n%s", name, args[0], commandUsage)
+		return exitUsage
+	}
+	return run(args[1:])
+}
+
+// openRegistry opens the main database and the sites it lists, for commands
+// that work on sites without serving them
+func openRegistry() (*sites.Registry, func(), error) {
+	cfg, err := settings.Load(settingsFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	database := db.Connect()
+	registry, err := sites.NewRegistry(database, "cms.db", cfg, nil)
+	if err != nil {
+		database.Close()
+		return nil, nil, err
+	}
+	return registry, func() {
+		registry.Close()
+		database.Close()
+	}, nil
+}
+
+// lookupSite finds the site a command's -site flag names
+func lookupSite(registry *sites.Registry, host string) (sites.Site, error) {
+	s, err := registry.Lookup(host)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, fmt.Errorf("no site has the hostname %s", host)
+	}
+	return s, err
+}
+
+// openSite opens the database, settings and media storage of the site a
+// command's -site flag names
+func openSite(registry *sites.Registry, host string) (*sql.DB, *settings.Settings, storage.Storage, error) {
+	s, err := lookupSite(registry, host)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	database, err := registry.Database(s)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cfg, err := registry.Settings(s)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	store, err := registry.Storage(s, cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return database, cfg, store, nil
+}
+
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site to export")
+	format := fs.String("format", "zip", "zip, with media files, or json")
+	out := fs.String("o", "", "file to write, - for standard output (default {site}-{date}.{format})")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *format != "zip" && *format != "json" {
+		fmt.Fprintln(os.Stderr, "cms export: -format must be zip or json")
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms export: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	s, err := lookupSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms export: %v\n", err)
+		return exitError
+	}
+
+	if *out == "" {
+		name := strings.ReplaceAll(s.Hostname, sites.FallbackHost, "site")
+		*out = fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102"), *format)
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cms export: %v\n", err)
+			return exitError
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := bundle.ExportSite(w, registry, s, *format == "zip"); err != nil {
+		fmt.Fprintf(os.Stderr, "cms export: %v\n", err)
+		return exitError
+	}
+	if *out != "-" {
+		fmt.Fprintf(os.Stderr, "Exported %s to %s\n", s.Hostname, *out)
+	}
+	return exitOK
+}
+
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site to import into")
+	var opts bundle.Options
+	fs.StringVar(&opts.Mode, "mode", bundle.Merge, "merge or replace")
+	fs.StringVar(&opts.OnConflict, "conflicts", bundle.ConflictFail, "on a merge, what to do with taken titles and URLs: fail, skip or rename")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "report what would change without changing anything")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "cms import: expected one bundle file")
+		return exitUsage
+	}
+	if err := opts.Check(); err != nil {
+		fmt.Fprintf(os.Stderr, "cms import: %v\n", err)
+		return exitUsage
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms import: %v\n", err)
+		return exitError
+	}
+	b, err := bundle.Read(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms import: %v\n", err)
+		return exitError
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms import: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	s, err := lookupSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms import: %v\n", err)
+		return exitError
+	}
+
+	report, err := bundle.ImportSite(registry, s, b, opts)
+	if report != nil {
+		printJSON(report)
+	}
+	if errors.Is(err, bundle.ErrConflicts) {
+		fmt.Fprintln(os.Stderr, "cms import: nothing imported, the bundle conflicts with existing content; see -conflicts")
+		return exitError
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "cms import: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func wordpressCommand(args []string) int {
+	fs := flag.NewFlagSet("wordpress", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site to import into")
+	var opts handlers.WordPressOptions
+	fs.IntVar(&opts.TemplateID, "template", 0, "ID of the template imported pages use")
+	fs.StringVar(&opts.Collection, "collection", "", "name of the collection posts go into; posts are skipped without one")
+	fs.IntVar(&opts.Ordering, "ordering", handlers.DefaultWordPressOrdering, "position of each page's content among its template's code blocks")
+	fs.StringVar(&opts.MediaDir, "media-dir", "", "copy of the old site's wp-content/uploads directory")
+	fs.BoolVar(&opts.Download, "download", false, "download attachments not found in -media-dir from the old site")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "cms wordpress: expected one export file")
+		return exitUsage
+	}
+	if opts.TemplateID == 0 {
+		fmt.Fprintln(os.Stderr, "cms wordpress: -template is required")
+		return exitUsage
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms wordpress: %v\n", err)
+		return exitError
+	}
+	defer f.Close()
+	export, err := wordpress.Parse(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms wordpress: %v\n", err)
+		return exitError
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms wordpress: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	database, cfg, store, err := openSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms wordpress: %v\n", err)
+		return exitError
+	}
+
+	report, err := handlers.ImportWordPress(database, cfg, store, export, opts)
+	if report != nil {
+		printJSON(report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms wordpress: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func staticCommand(args []string) int {
+	fs := flag.NewFlagSet("static", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site to render")
+	out := fs.String("o", "public", "directory to write the site to")
+	full := fs.Bool("full", false, "re-render every page, not just the ones that changed")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "cms static: unexpected arguments; use -o to choose the directory")
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms static: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	database, cfg, store, err := openSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms static: %v\n", err)
+		return exitError
+	}
+
+	report, err := handlers.BuildStatic(database, cfg, store, *out, *full)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms static: %v\n", err)
+		return exitError
+	}
+	printJSON(report)
+	return exitOK
+}
+
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "cms migrate: unexpected arguments")
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms migrate: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	list, err := registry.Sites()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms migrate: %v\n", err)
+		return exitError
+	}
+
+	code := exitOK
+	for _, s := range list {
+		// Opening a database brings its tables up to date
+		if _, err := registry.Database(s); err != nil {
+			fmt.Fprintf(os.Stderr, "cms migrate: site %s: %v\n", s.Hostname, err)
+			code = exitError
+			continue
+		}
+		fmt.Printf("Migrated %s (%s)\n", s.Hostname, s.Database)
+	}
+	return code
+}
+
+// readPassword reads a password from the first line of standard input,
+// prompting for it when that's a terminal
+func readPassword() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("no password on standard input")
+	}
+	return line, nil
+}
+
+func userAddCommand(args []string) int {
+	fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+	superuser := fs.Bool("superuser", false, "let the user manage every site and the other users")
+	siteList := fs.String("sites", "", "comma-separated hostnames of the sites the user may manage")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "cms user add: expected one username")
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms user add: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+
+	u := handlers.NewUser{Username: fs.Arg(0)}
+	if *superuser {
+		u.Superuser = 1
+	}
+	for _, host := range strings.Split(*siteList, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		s, err := lookupSite(registry, host)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cms user add: %v\n", err)
+			return exitError
+		}
+		u.Sites = append(u.Sites, s.ID)
+	}
+	if u.Password, err = readPassword(); err != nil {
+		fmt.Fprintf(os.Stderr, "cms user add: %v\n", err)
+		return exitError
+	}
+	if err := handlers.CheckNewUser(registry.Main(), u); err != nil {
+		fmt.Fprintf(os.Stderr, "cms user add: %v\n", err)
+		return exitError
+	}
+
+	created, err := handlers.AddUser(registry.Main(), u)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms user add: %v\n", err)
+		return exitError
+	}
+	printJSON(created)
+	return exitOK
+}
+
+func userPasswdCommand(args []string) int {
+	fs := flag.NewFlagSet("user passwd", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "cms user passwd: expected one username")
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms user passwd: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+
+	var id int
+	err = registry.Main().QueryRow("SELECT id FROM users WHERE username = ?", fs.Arg(0)).Scan(&id)
+	if err == sql.ErrNoRows {
+		fmt.Fprintf(os.Stderr, "cms user passwd: no user is named %s\n", fs.Arg(0))
+		return exitError
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "cms user passwd: %v\n", err)
+		return exitError
+	}
+	password, err := readPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms user passwd: %v\n", err)
+		return exitError
+	}
+	if err := handlers.SetPassword(registry.Main(), id, password); err != nil {
+		fmt.Fprintf(os.Stderr, "cms user passwd: %v\n", err)
+		return exitError
+	}
+	fmt.Fprintf(os.Stderr, "Changed the password of %s\n", fs.Arg(0))
+	return exitOK
+}
+
+func pageListCommand(args []string) int {
+	fs := flag.NewFlagSet("page list", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site")
+	asJSON := fs.Bool("json", false, "print the pages as JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "cms page list: unexpected arguments")
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page list: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	database, _, _, err := openSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page list: %v\n", err)
+		return exitError
+	}
+
+	pages, err := handlers.ListPages(database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page list: %v\n", err)
+		return exitError
+	}
+	if *asJSON {
+		printJSON(pages)
+		return exitOK
+	}
+	published, err := handlers.PublishedTimes(database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page list: %v\n", err)
+		return exitError
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tURL\tTITLE\tACTIVE\tPUBLISHED")
+	for _, p := range pages {
+		active, at := "no", published[p.ID]
+		if p.Active == 1 {
+			active = "yes"
+		}
+		if at == "" {
+			at = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", p.ID, p.Url, p.Title, active, at)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func pageCreateCommand(args []string) int {
+	fs := flag.NewFlagSet("page create", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site")
+	var page handlers.Page
+	fs.StringVar(&page.Title, "title", "", "the page's title")
+	fs.StringVar(&page.Url, "url", "", "the page's URL, e.g. /about")
+	fs.IntVar(&page.TemplateID, "template", 0, "ID of the page's template")
+	active := fs.Bool("active", false, "make the page active, so it's served once published")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "cms page create: unexpected arguments")
+		return exitUsage
+	}
+	if page.Title == "" || page.Url == "" || page.TemplateID == 0 {
+		fmt.Fprintln(os.Stderr, "cms page create: -title, -url and -template are required")
+		return exitUsage
+	}
+	if *active {
+		page.Active = 1
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page create: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	database, _, _, err := openSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page create: %v\n", err)
+		return exitError
+	}
+
+	id, err := handlers.InsertPage(database, page)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page create: %v\n", err)
+		return exitError
+	}
+	fmt.Println(id)
+	return exitOK
+}
+
+func pagePublishCommand(args []string) int {
+	fs := flag.NewFlagSet("page publish", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site")
+	all := fs.Bool("all", false, "publish every active page")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *all == (fs.NArg() > 0) {
+		fmt.Fprintln(os.Stderr, "cms page publish: expected page IDs or URLs, or -all")
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page publish: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	database, cfg, _, err := openSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms page publish: %v\n", err)
+		return exitError
+	}
+
+	var pages []handlers.Page
+	if *all {
+		list, err := handlers.ListPages(database)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cms page publish: %v\n", err)
+			return exitError
+		}
+		for _, p := range list {
+			if p.Active == 1 {
+				pages = append(pages, p)
+			}
+		}
+	}
+	for _, ref := range fs.Args() {
+		p, err := handlers.FindPage(database, ref)
+		if err == sql.ErrNoRows {
+			fmt.Fprintf(os.Stderr, "cms page publish: no page %s\n", ref)
+			return exitError
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "cms page publish: %v\n", err)
+			return exitError
+		}
+		pages = append(pages, p)
+	}
+
+	// Every page is attempted, so one broken page doesn't hold back the rest
+	code := exitOK
+	for _, p := range pages {
+		if err := handlers.Publish(database, cfg, p.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "cms page publish: %s: %v\n", p.Url, err)
+			code = exitError
+			continue
+		}
+		fmt.Printf("Published %s\n", p.Url)
+	}
+	return code
+}
+
+func blockExportCommand(args []string) int {
+	fs := flag.NewFlagSet("block export", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site")
+	out := fs.String("o", "-", "file to write, - for standard output")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms block export: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	database, _, _, err := openSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms block export: %v\n", err)
+		return exitError
+	}
+
+	blocks, err := handlers.ListCodeBlocks(database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms block export: %v\n", err)
+		return exitError
+	}
+	if fs.NArg() > 0 {
+		var picked []handlers.CodeBlock
+		for _, ref := range fs.Args() {
+			found := false
+			for _, cb := range blocks {
+				if ref == cb.Title || ref == strconv.Itoa(cb.ID) {
+					picked = append(picked, cb)
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "cms block export: no code block %s\n", ref)
+				return exitError
+			}
+		}
+		blocks = picked
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cms block export: %v\n", err)
+			return exitError
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(blocks); err != nil {
+		fmt.Fprintf(os.Stderr, "cms block export: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// blockFileTypes maps the extensions of files block import reads as a
+// single block to the block's type
+var blockFileTypes = map[string]string{
+	".html":     handlers.CodeBlockHTML,
+	".htm":      handlers.CodeBlockHTML,
+	".tmpl":     handlers.CodeBlockTemplate,
+	".css":      handlers.CodeBlockCSS,
+	".js":       handlers.CodeBlockJS,
+	".md":       handlers.CodeBlockMarkdown,
+	".markdown": handlers.CodeBlockMarkdown,
+}
+
+// readBlockFile reads the code blocks in a file for block import: a JSON list
+// or single block, or the content of one block named after the file
+func readBlockFile(name string) ([]handlers.CodeBlock, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".json" {
+		var blocks []handlers.CodeBlock
+		if err := json.Unmarshal(data, &blocks); err != nil {
+			var cb handlers.CodeBlock
+			if json.Unmarshal(data, &cb) != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			blocks = []handlers.CodeBlock{cb}
+		}
+		return blocks, nil
+	}
+	blockType, ok := blockFileTypes[ext]
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a .json, .html, .tmpl, .css, .js or .md file", name)
+	}
+	title := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	return []handlers.CodeBlock{{Title: title, Content: string(data), Type: blockType}}, nil
+}
+
+// blockImportReport lists the titles of the blocks block import saved
+type blockImportReport struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+}
+
+func blockImportCommand(args []string) int {
+	fs := flag.NewFlagSet("block import", flag.ContinueOnError)
+	host := fs.String("site", sites.FallbackHost, "hostname of the site")
+	update := fs.Bool("update", false, "replace the content of blocks with the same title instead of failing")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "cms block import: expected one or more files")
+		return exitUsage
+	}
+
+	// Everything is read and checked before anything is saved
+	var blocks []handlers.CodeBlock
+	seen := map[string]bool{}
+	for _, name := range fs.Args() {
+		list, err := readBlockFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cms block import: %v\n", err)
+			return exitError
+		}
+		for _, cb := range list {
+			if cb.Title == "" {
+				fmt.Fprintf(os.Stderr, "cms block import: %s: a code block has no title\n", name)
+				return exitError
+			}
+			if seen[cb.Title] {
+				fmt.Fprintf(os.Stderr, "cms block import: more than one code block is titled %q\n", cb.Title)
+				return exitError
+			}
+			seen[cb.Title] = true
+			if err := cb.Check(); err != nil {
+				fmt.Fprintf(os.Stderr, "cms block import: %s: %v\n", cb.Title, err)
+				return exitError
+			}
+			blocks = append(blocks, cb)
+		}
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms block import: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+	database, _, _, err := openSite(registry, *host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms block import: %v\n", err)
+		return exitError
+	}
+
+	existing, err := handlers.ListCodeBlocks(database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms block import: %v\n", err)
+		return exitError
+	}
+	ids := map[string]int{}
+	for _, cb := range existing {
+		ids[cb.Title] = cb.ID
+	}
+	if !*update {
+		var taken []string
+		for _, cb := range blocks {
+			if _, ok := ids[cb.Title]; ok {
+				taken = append(taken, cb.Title)
+			}
+		}
+		if len(taken) > 0 {
+			fmt.Fprintf(os.Stderr, "cms block import: nothing imported, code blocks already exist: %s; see -update\n", strings.Join(taken, ", "))
+			return exitError
+		}
+	}
+
+	report := blockImportReport{Created: []string{}, Updated: []string{}}
+	for _, cb := range blocks {
+		if id, ok := ids[cb.Title]; ok {
+			err = handlers.ReplaceCodeBlock(database, id, cb)
+			report.Updated = append(report.Updated, cb.Title)
+		} else {
+			err = handlers.InsertCodeBlock(database, &cb)
+			report.Created = append(report.Created, cb.Title)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cms block import: %s: %v\n", cb.Title, err)
+			return exitError
+		}
+	}
+	printJSON(report)
+	return exitOK
+}
+
+func backupCommand(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "", "file to write, - for standard output (default cms-backup-{date}-{time}.zip)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "cms backup: unexpected arguments; use -o to choose the file")
+		return exitUsage
+	}
+
+	registry, closeAll, err := openRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms backup: %v\n", err)
+		return exitError
+	}
+	defer closeAll()
+
+	if *out == "" {
+		*out = fmt.Sprintf("cms-backup-%s.zip", time.Now().Format("20060102-150405"))
+	}
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "-" {
+		if f, err = os.Create(*out); err != nil {
+			fmt.Fprintf(os.Stderr, "cms backup: %v\n", err)
+			return exitError
+		}
+		w = f
+	}
+
+	report, err := backup.Write(w, registry, settingsFile)
+	if f != nil {
+		// A failed flush means the archive is incomplete
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cms backup: %v\n", err)
+		if f != nil {
+			os.Remove(*out)
+		}
+		return exitError
+	}
+	if *out != "-" {
+		printJSON(report)
+		fmt.Fprintf(os.Stderr, "Backed up to %s\n", *out)
+	}
+	return exitOK
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
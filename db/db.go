@@ -2,28 +2,47 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// Connect inits and returns a SQLite db connection
+// Connect opens the main database, cms.db. It holds the default site's
+// content along with the sites and admin users of the whole instance.
 func Connect() *sql.DB {
-	db, err := sql.Open("sqlite3", "cms.db")
+	db, err := Open("cms.db")
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
-
-	// Create tables if not exist
-	createTables(db)
-
+	if err := createInstanceTables(db); err != nil {
+		log.Fatalf("Failed to create tables: %v", err)
+	}
 	return db
 }
 
+// Open opens a site's database, creating its tables if needed
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := createTables(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating tables: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	createSearchIndex(db)
+	return db, nil
+}
+
 // Implement a history table
 // - id, table, column, CRUD function, datetime, content
 
-func createTables(db *sql.DB) {
+func createTables(db *sql.DB) error {
 	pageTable := `
 	CREATE TABLE IF NOT EXISTS pages (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -70,8 +89,360 @@ func createTables(db *sql.DB) {
 		FOREIGN KEY (codeblock_id) REFERENCES codeblocks(id)
 	);
 	`
-	_, err := db.Exec(pageTable + codeBlockTable + templateTable + codeblocksOrdering)
+	mediaTable := `
+	CREATE TABLE IF NOT EXISTS media (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename TEXT NOT NULL,
+		storage_key TEXT NOT NULL UNIQUE,
+		mime_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		width INTEGER,
+		height INTEGER,
+		alt_text TEXT,
+		checksum TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	// Compiled CSS/JS bundles, keyed by a hash of their content
+	assetBundles := `
+	CREATE TABLE IF NOT EXISTS asset_bundles (
+		hash TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		content TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	// The compiled HTML the public site is served from, written by the publish step
+	publishedPages := `
+	CREATE TABLE IF NOT EXISTS published_pages (
+		page_id INTEGER PRIMARY KEY,
+		url TEXT NOT NULL,
+		title TEXT NOT NULL,
+		html TEXT NOT NULL,
+		published_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (page_id) REFERENCES pages (id)
+	);
+	CREATE INDEX IF NOT EXISTS published_pages_url ON published_pages (url);
+	`
+	// Named menus curated by hand, separate from the page tree
+	menusTable := `
+	CREATE TABLE IF NOT EXISTS menus (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		title TEXT
+	);
+	CREATE TABLE IF NOT EXISTS menu_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		menu_id INTEGER NOT NULL,
+		parent_id INTEGER DEFAULT -1,
+		label TEXT NOT NULL,
+		page_id INTEGER,
+		url TEXT,
+		new_tab INTEGER DEFAULT 0,
+		ordering INTEGER DEFAULT 0,
+		FOREIGN KEY (menu_id) REFERENCES menus (id),
+		FOREIGN KEY (page_id) REFERENCES pages (id)
+	);
+	`
+	// Sources ending in * match any path with that prefix
+	redirectsTable := `
+	CREATE TABLE IF NOT EXISTS redirects (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		source TEXT NOT NULL UNIQUE,
+		target TEXT NOT NULL,
+		status_code INTEGER DEFAULT 301,
+		hits INTEGER DEFAULT 0,
+		last_hit_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	// Developer-defined content types; fields holds the JSON field definitions
+	// and each entry's data is validated against them
+	contentTypesTable := `
+	CREATE TABLE IF NOT EXISTS content_types (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		title TEXT NOT NULL,
+		fields TEXT NOT NULL DEFAULT '[]',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS content_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type_id INTEGER NOT NULL,
+		data TEXT NOT NULL DEFAULT '{}',
+		sort_order INTEGER DEFAULT 0,
+		active INTEGER DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (type_id) REFERENCES content_types (id)
+	);
+	CREATE INDEX IF NOT EXISTS content_entries_type ON content_entries (type_id, sort_order);
+	`
+	// Collections serve posts under a base path, rendered through a list page
+	// and a detail page used as layouts
+	collectionsTable := `
+	CREATE TABLE IF NOT EXISTS collections (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		title TEXT NOT NULL,
+		base_path TEXT NOT NULL UNIQUE,
+		list_page_id INTEGER NOT NULL,
+		detail_page_id INTEGER NOT NULL,
+		per_page INTEGER DEFAULT 10,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (list_page_id) REFERENCES pages (id),
+		FOREIGN KEY (detail_page_id) REFERENCES pages (id)
+	);
+	CREATE TABLE IF NOT EXISTS posts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		collection_id INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		slug TEXT NOT NULL,
+		author TEXT,
+		excerpt TEXT,
+		body TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '[]',
+		image_id INTEGER,
+		status TEXT NOT NULL DEFAULT 'draft',
+		published_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (collection_id, slug),
+		FOREIGN KEY (collection_id) REFERENCES collections (id),
+		FOREIGN KEY (image_id) REFERENCES media (id)
+	);
+	CREATE INDEX IF NOT EXISTS posts_published ON posts (collection_id, status, published_at);
+	`
+	// Vocabularies group terms (tags, categories); terms attach to pages and
+	// posts through term_assignments, keyed by object_type and object_id
+	taxonomyTables := `
+	CREATE TABLE IF NOT EXISTS vocabularies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		title TEXT NOT NULL,
+		hierarchical INTEGER DEFAULT 0,
+		base_path TEXT UNIQUE,
+		list_page_id INTEGER,
+		FOREIGN KEY (list_page_id) REFERENCES pages (id)
+	);
+	CREATE TABLE IF NOT EXISTS terms (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		vocabulary_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		slug TEXT NOT NULL,
+		description TEXT,
+		parent_id INTEGER DEFAULT -1,
+		sort_order INTEGER DEFAULT 0,
+		UNIQUE (vocabulary_id, slug),
+		FOREIGN KEY (vocabulary_id) REFERENCES vocabularies (id)
+	);
+	CREATE TABLE IF NOT EXISTS term_assignments (
+		term_id INTEGER NOT NULL,
+		object_type TEXT NOT NULL,
+		object_id INTEGER NOT NULL,
+		PRIMARY KEY (term_id, object_type, object_id),
+		FOREIGN KEY (term_id) REFERENCES terms (id)
+	);
+	CREATE INDEX IF NOT EXISTS term_assignments_object ON term_assignments (object_type, object_id);
+	`
+
+	formsTables := `
+	CREATE TABLE IF NOT EXISTS forms (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		title TEXT NOT NULL,
+		fields TEXT NOT NULL DEFAULT '[]',
+		submit_label TEXT NOT NULL DEFAULT 'Send',
+		success_message TEXT NOT NULL DEFAULT 'Thank you, your message has been sent.',
+		redirect_url TEXT,
+		notify_email TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS form_submissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		form_id INTEGER NOT NULL,
+		data TEXT NOT NULL,
+		ip TEXT,
+		user_agent TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (form_id) REFERENCES forms (id)
+	);
+	CREATE INDEX IF NOT EXISTS form_submissions_form ON form_submissions (form_id, created_at);
+	`
+
+	// Translations hold the other locales' versions of a page's or code
+	// block's text; the page and block rows themselves are the default locale
+	translationTables := `
+	CREATE TABLE IF NOT EXISTS page_translations (
+		page_id INTEGER NOT NULL,
+		locale TEXT NOT NULL,
+		title TEXT NOT NULL,
+		url TEXT NOT NULL,
+		meta_title TEXT,
+		meta_description TEXT,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (page_id, locale),
+		UNIQUE (locale, url),
+		FOREIGN KEY (page_id) REFERENCES pages (id)
+	);
+	CREATE TABLE IF NOT EXISTS code_block_translations (
+		codeblock_id INTEGER NOT NULL,
+		locale TEXT NOT NULL,
+		content TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (codeblock_id, locale),
+		FOREIGN KEY (codeblock_id) REFERENCES code_blocks (id)
+	);
+	CREATE TABLE IF NOT EXISTS published_translations (
+		page_id INTEGER NOT NULL,
+		locale TEXT NOT NULL,
+		url TEXT NOT NULL,
+		title TEXT NOT NULL,
+		html TEXT NOT NULL,
+		published_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (page_id, locale),
+		FOREIGN KEY (page_id) REFERENCES pages (id)
+	);
+	CREATE INDEX IF NOT EXISTS published_translations_url ON published_translations (url);
+	`
+	_, err := db.Exec(pageTable + codeBlockTable + templateTable + codeblocksOrdering + mediaTable + assetBundles + publishedPages + menusTable + redirectsTable + contentTypesTable + collectionsTable + taxonomyTables + formsTables + translationTables)
+	return err
+}
+
+// createInstanceTables sets up the tables only the main database has: the
+// sites served by this instance, the admin users who may manage them and the
+// code blocks the sites share
+func createInstanceTables(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS sites (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hostname TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		aliases TEXT NOT NULL DEFAULT '[]',
+		database TEXT NOT NULL UNIQUE,
+		settings TEXT NOT NULL DEFAULT '{}',
+		active INTEGER DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		superuser INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS user_sites (
+		user_id INTEGER NOT NULL,
+		site_id INTEGER NOT NULL,
+		PRIMARY KEY (user_id, site_id),
+		FOREIGN KEY (user_id) REFERENCES users (id),
+		FOREIGN KEY (site_id) REFERENCES sites (id)
+	);
+	CREATE TABLE IF NOT EXISTS shared_code_blocks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL UNIQUE,
+		description TEXT,
+		content TEXT NOT NULL,
+		type TEXT NOT NULL DEFAULT 'html',
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	return err
+}
+
+// migrate adds columns introduced after a table was first created, so existing
+// databases pick them up without losing data
+func migrate(db *sql.DB) error {
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"code_blocks", "type", "TEXT NOT NULL DEFAULT 'html'"},
+		{"code_blocks", "shared_id", "INTEGER"},
+		{"code_blocks", "overridden", "INTEGER DEFAULT 0"},
+		{"code_blocks", "rendered", "TEXT"},
+		{"code_blocks", "rendered_hash", "TEXT"},
+		{"code_blocks", "metadata", "TEXT"},
+		{"code_block_translations", "rendered", "TEXT"},
+		{"code_block_translations", "rendered_hash", "TEXT"},
+		{"pages", "meta_title", "TEXT"},
+		{"pages", "meta_description", "TEXT"},
+		{"pages", "canonical_url", "TEXT"},
+		{"pages", "noindex", "INTEGER DEFAULT 0"},
+		{"pages", "og_image_id", "INTEGER REFERENCES media (id)"},
+		{"pages", "sort_order", "INTEGER DEFAULT 0"},
+	}
+
+	for _, c := range columns {
+		if err := addColumn(db, c.table, c.column, c.definition); err != nil {
+			return fmt.Errorf("migrating %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	if err := uniqueMediaChecksums(db); err != nil {
+		return fmt.Errorf("migrating media checksums: %w", err)
+	}
+	return nil
+}
+
+// uniqueMediaChecksums indexes media by checksum, uniquely so that two
+// uploads of the same file racing each other can't both be stored. A
+// database already holding duplicates keeps a plain index until they're
+// deleted.
+func uniqueMediaChecksums(db *sql.DB) error {
+	var duplicates int
+	err := db.QueryRow("SELECT COUNT(*) FROM (SELECT checksum FROM media GROUP BY checksum HAVING COUNT(*) > 1)").Scan(&duplicates)
 	if err != nil {
-		log.Fatalf("Failed to create tables: %v", err)
+		return err
+	}
+	if duplicates > 0 {
+		log.Printf("%d media checksums are shared by more than one file; uploads won't be deduplicated reliably until the copies are deleted", duplicates)
+		_, err = db.Exec("CREATE INDEX IF NOT EXISTS media_checksum ON media (checksum)")
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS media_checksum_unique ON media (checksum);
+		DROP INDEX IF EXISTS media_checksum;`)
+	return err
+}
+
+// addColumn runs ALTER TABLE ... ADD COLUMN unless the column already exists
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// createSearchIndex sets up the FTS5 table behind site search. FTS5 is only
+// compiled into go-sqlite3 with the sqlite_fts5 build tag, so a missing module
+// disables search instead of stopping the server.
+func createSearchIndex(db *sql.DB) {
+	_, err := db.Exec(`
+	CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5(
+		title,
+		url,
+		content,
+		page_id UNINDEXED,
+		tokenize = 'porter unicode61'
+	);`)
+	if err != nil {
+		log.Printf("Site search disabled, build with -tags sqlite_fts5 to enable it: %v", err)
 	}
 }
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// indexes lists the names of a table's indexes, unique ones marked with a
+// trailing "!"
+func indexes(t *testing.T, database *sql.DB, table string) map[string]bool {
+	t.Helper()
+	rows, err := database.Query("SELECT name, \"unique\" FROM pragma_index_list(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	list := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var unique int
+		if err := rows.Scan(&name, &unique); err != nil {
+			t.Fatal(err)
+		}
+		list[name] = unique == 1
+	}
+	return list
+}
+
+func TestUniqueMediaChecksums(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cms.db")
+	database, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := indexes(t, database, "media")
+	if unique, ok := list["media_checksum_unique"]; !ok || !unique {
+		t.Errorf("media indexes = %v, want a unique checksum index", list)
+	}
+	if _, ok := list["media_checksum"]; ok {
+		t.Errorf("the plain checksum index is still there alongside the unique one")
+	}
+	database.Close()
+
+	// A database from before the index that holds duplicates still opens
+	old, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "old.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	_, err = old.Exec(`
+		CREATE TABLE media (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			filename TEXT NOT NULL,
+			storage_key TEXT NOT NULL UNIQUE,
+			mime_type TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			width INTEGER,
+			height INTEGER,
+			alt_text TEXT,
+			checksum TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX media_checksum ON media (checksum);
+		INSERT INTO media (filename, storage_key, mime_type, size, checksum) VALUES
+			('a.txt', 'a.txt', 'text/plain', 1, 'abc'),
+			('b.txt', 'b.txt', 'text/plain', 1, 'abc');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createTables(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(old); err != nil {
+		t.Fatalf("migrating a database with duplicate checksums: %v", err)
+	}
+	list = indexes(t, old, "media")
+	unique, plain := list["media_checksum"]
+	if _, ok := list["media_checksum_unique"]; ok || !plain || unique {
+		t.Errorf("media indexes = %v, want the plain checksum index only", list)
+	}
+}
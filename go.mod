@@ -5,4 +5,6 @@ go 1.22.0
 require (
 	github.com/go-chi/chi/v5 v5.2.0 // direct
 	github.com/mattn/go-sqlite3 v1.14.24 // direct
+	github.com/yuin/goldmark v1.8.2 // direct
+	golang.org/x/image v0.24.0 // direct
 )
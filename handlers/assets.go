@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/utils"
+)
+
+// Public URL prefix for CSS/JS bundles, e.g. /assets/3f2a9c0d1b7e4a55.css
+const assetsPath = "/assets/"
+
+var bundleContentTypes = map[string]string{
+	CodeBlockCSS: "text/css; charset=utf-8",
+	CodeBlockJS:  "text/javascript; charset=utf-8",
+}
+
+// assetBundle is a CSS or JS bundle, stored under a hash of its content
+type assetBundle struct {
+	Hash, Type, Content string
+}
+
+// Name is the bundle's file name under /assets/
+func (a assetBundle) Name() string {
+	return a.Hash + "." + a.Type
+}
+
+// bundleTag joins the blocks into one bundle and returns the tag that loads
+// it from its fingerprinted URL. Identical bundles share a URL. Renders that
+// are stored keep the bundle for the publisher to save; other renders
+// write nothing, so a bundle that was never published goes inline instead.
+func (rd *renderer) bundleTag(bundleType string, blocks []string) (string, error) {
+	content := strings.Join(blocks, "\n")
+	if rd.cfg.Assets.Minify {
+		if bundleType == CodeBlockCSS {
+			content = utils.MinifyCSS(content)
+		} else {
+			content = utils.MinifyJS(content)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(bundleType + "\x00" + content))
+	bundle := assetBundle{Hash: hex.EncodeToString(sum[:8]), Type: bundleType, Content: content}
+
+	stored := rd.stored
+	if stored {
+		rd.bundles = append(rd.bundles, bundle)
+	} else {
+		err := rd.db.QueryRow("SELECT 1 FROM asset_bundles WHERE hash = ? AND type = ?", bundle.Hash, bundle.Type).Scan(new(int))
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		stored = err == nil
+	}
+
+	switch {
+	case bundleType == CodeBlockCSS && stored:
+		return fmt.Sprintf(`<link rel="stylesheet" href="%s">`, assetsPath+bundle.Name()), nil
+	case bundleType == CodeBlockCSS:
+		return "<style>" + content + "</style>", nil
+	case stored:
+		return fmt.Sprintf(`<script src="%s"></script>`, assetsPath+bundle.Name()), nil
+	default:
+		return "<script>" + content + "</script>", nil
+	}
+}
+
+// saveBundles stores the bundles a published page links to, and deletes
+// those no published page or translation links to any more
+func saveBundles(tx *sql.Tx, bundles []assetBundle) error {
+	for _, b := range bundles {
+		_, err := tx.Exec("INSERT OR IGNORE INTO asset_bundles (hash, type, content) VALUES (?, ?, ?)", b.Hash, b.Type, b.Content)
+		if err != nil {
+			return err
+		}
+	}
+	return pruneBundles(tx)
+}
+
+// pruneBundles deletes the bundles no published HTML refers to
+func pruneBundles(db interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}) error {
+	_, err := db.Exec(`
+		DELETE FROM asset_bundles
+		WHERE NOT EXISTS (SELECT 1 FROM published_pages WHERE instr(html, ? || hash || '.' || type) > 0)
+			AND NOT EXISTS (SELECT 1 FROM published_translations WHERE instr(html, ? || hash || '.' || type) > 0)`,
+		assetsPath, assetsPath)
+	return err
+}
+
+// ServeAsset serves a CSS or JS bundle. The URL changes whenever the content
+// does, so bundles can be cached forever.
+func ServeAsset(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "bundle")
+		dot := strings.LastIndex(name, ".")
+		if dot < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		hash, ext := name[:dot], name[dot+1:]
+
+		var content string
+		err := db.QueryRow("SELECT content FROM asset_bundles WHERE hash = ? AND type = ?", hash, ext).Scan(&content)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, "Failed to load bundle", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", bundleContentTypes[ext])
+		w.Header().Set("Cache-Control", immutableCacheControl)
+		w.Write([]byte(content))
+	}
+}
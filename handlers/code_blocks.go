@@ -3,7 +3,9 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -14,6 +16,132 @@ type CodeBlock struct {
 	Active      int     `json:"active"`
 	Description *string `json:"description,omitempty"`
 	Content     string  `json:"content"`
+	Type        string  `json:"type"`
+
+	// Set when the block is a copy of a shared block. Overridden blocks keep
+	// their own content when the shared block changes.
+	SharedID   *int `json:"shared_id,omitempty"`
+	Overridden int  `json:"overridden,omitempty"`
+
+	// Markdown blocks: the HTML made from Content and the keys of its front
+	// matter, cached when the block is saved
+	Rendered *string           `json:"rendered,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Code block types. HTML, template and Markdown blocks render in place; CSS
+// and JS blocks are collected into per-page bundles. Only template blocks run
+// as html/template, so HTML blocks can hold braces meant for the browser.
+const (
+	CodeBlockHTML     = "html"
+	CodeBlockTemplate = "template"
+	CodeBlockCSS      = "css"
+	CodeBlockJS       = "js"
+	CodeBlockMarkdown = "markdown"
+)
+
+func validCodeBlockType(t string) bool {
+	return t == CodeBlockHTML || t == CodeBlockTemplate || t == CodeBlockCSS || t == CodeBlockJS || t == CodeBlockMarkdown
+}
+
+const codeBlockColumns = "id, title, active, description, content, type, shared_id, IFNULL(overridden, 0), rendered, metadata"
+
+func scanCodeBlock(row interface{ Scan(...interface{}) error }) (CodeBlock, error) {
+	var cb CodeBlock
+	var metadata sql.NullString
+	if err := row.Scan(
+		&cb.ID,
+		&cb.Title,
+		&cb.Active,
+		&cb.Description,
+		&cb.Content,
+		&cb.Type,
+		&cb.SharedID,
+		&cb.Overridden,
+		&cb.Rendered,
+		&metadata,
+	); err != nil {
+		return cb, err
+	}
+	cb.Metadata = decodeMetadata(metadata)
+	return cb, nil
+}
+
+// Check fills in the default type and validates a block before it's saved,
+// rendering Markdown to catch front matter that can't be read
+func (cb *CodeBlock) Check() error {
+	if cb.Type == "" {
+		cb.Type = CodeBlockHTML
+	}
+	if !validCodeBlockType(cb.Type) {
+		return fmt.Errorf("type must be html, template, css, js or markdown")
+	}
+	if _, _, _, err := markdownCache(cb.Type, cb.Content); err != nil {
+		return fmt.Errorf("invalid Markdown: %w", err)
+	}
+	return nil
+}
+
+// InsertCodeBlock saves a new block that passed Check, setting its ID and
+// rendered output
+func InsertCodeBlock(db *sql.DB, cb *CodeBlock) error {
+	rendered, hash, metadata, err := markdownCache(cb.Type, cb.Content)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec("INSERT INTO code_blocks (title, description, content, type, rendered, rendered_hash, metadata) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		cb.Title, cb.Description, cb.Content, cb.Type, rendered, hash, metadata)
+	if err != nil {
+		return err
+	}
+	lastID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	cb.ID = int(lastID)
+	cb.Rendered, cb.Metadata = nil, nil
+	if cb.Type == CodeBlockMarkdown {
+		html := rendered.(string)
+		cb.Rendered = &html
+		cb.Metadata = decodeMetadata(sql.NullString{String: metadata.(string), Valid: true})
+	}
+	return nil
+}
+
+// ReplaceCodeBlock overwrites a block's description, content and type with
+// those of cb, which passed Check. As with an edit through the API, a copy of
+// a shared block stops following it.
+func ReplaceCodeBlock(db *sql.DB, id int, cb CodeBlock) error {
+	rendered, hash, metadata, err := markdownCache(cb.Type, cb.Content)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		UPDATE code_blocks SET description = ?, content = ?, type = ?, overridden = (shared_id IS NOT NULL),
+			rendered = ?, rendered_hash = ?, metadata = ?
+		WHERE id = ?`,
+		cb.Description, cb.Content, cb.Type, rendered, hash, metadata, id)
+	return err
+}
+
+// ListCodeBlocks returns every code block in ID order
+func ListCodeBlocks(db *sql.DB) ([]CodeBlock, error) {
+	rows, err := db.Query("SELECT " + codeBlockColumns + " FROM code_blocks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []CodeBlock{}
+	for rows.Next() {
+		cb, err := scanCodeBlock(rows)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, cb)
+	}
+	return blocks, rows.Err()
 }
 
 func CreateCodeBlock(db *sql.DB) http.HandlerFunc {
@@ -23,21 +151,16 @@ func CreateCodeBlock(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-
-		result, err := db.Exec("INSERT INTO code_blocks (title, description, content) VALUES (?, ?, ?)", cb.Title, cb.Description, cb.Content)
-		if err != nil {
-			http.Error(w, "Failed to create code block", http.StatusInternalServerError)
+		if err := cb.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		lastID, err := result.LastInsertId()
-		if err != nil {
-			http.Error(w, "Failed to retrieve last inserted ID", http.StatusInternalServerError)
+		if err := InsertCodeBlock(db, &cb); err != nil {
+			http.Error(w, "Failed to create code block", http.StatusInternalServerError)
 			return
 		}
 
-		cb.ID = int(lastID)
-
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(cb)
@@ -46,7 +169,20 @@ func CreateCodeBlock(db *sql.DB) http.HandlerFunc {
 
 func GetCodeBlocks(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, title, active, description, content FROM code_blocks ORDER BY id DESC")
+		query := "SELECT " + codeBlockColumns + " FROM code_blocks WHERE 1 = 1"
+		params := []interface{}{}
+		if t := r.URL.Query().Get("type"); t != "" {
+			query += " AND type = ?"
+			params = append(params, t)
+		}
+		// Admin search across titles, descriptions and content
+		if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+			query += " AND (title LIKE ? OR description LIKE ? OR content LIKE ?)"
+			like := "%" + q + "%"
+			params = append(params, like, like, like)
+		}
+
+		rows, err := db.Query(query+" ORDER BY id DESC", params...)
 		if err != nil {
 			http.Error(w, "Failed to retrieve code blocks", http.StatusInternalServerError)
 			return
@@ -55,14 +191,8 @@ func GetCodeBlocks(db *sql.DB) http.HandlerFunc {
 
 		var codeBlocks []CodeBlock
 		for rows.Next() {
-			var cb CodeBlock
-			if err := rows.Scan(
-				&cb.ID,
-				&cb.Title,
-				&cb.Active,
-				&cb.Description,
-				&cb.Content,
-			); err != nil {
+			cb, err := scanCodeBlock(rows)
+			if err != nil {
 				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
 				return
 			}
@@ -77,16 +207,9 @@ func GetCodeBlocks(db *sql.DB) http.HandlerFunc {
 func GetCodeBlock(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		codeBlockID := chi.URLParam(r, "codeBlockID")
-		var codeBlock CodeBlock
-
-		row := db.QueryRow("SELECT id, title, active, description, content FROM code_blocks WHERE id = ?", codeBlockID)
-		if err := row.Scan(
-			&codeBlock.ID,
-			&codeBlock.Title,
-			&codeBlock.Active,
-			&codeBlock.Description,
-			&codeBlock.Content,
-		); err != nil {
+
+		codeBlock, err := scanCodeBlock(db.QueryRow("SELECT "+codeBlockColumns+" FROM code_blocks WHERE id = ?", codeBlockID))
+		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "Code block not found", http.StatusNotFound)
 			} else {
@@ -110,6 +233,7 @@ func UpdateCodeBlock(db *sql.DB) http.HandlerFunc {
 			Active      *int    `json:"active"`
 			Description *string `json:"description"`
 			Content     *string `json:"content"`
+			Type        *string `json:"type"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -133,9 +257,43 @@ func UpdateCodeBlock(db *sql.DB) http.HandlerFunc {
 			params = append(params, *input.Description)
 		}
 		if input.Content != nil {
-			query += " content = ?,"
+			// A copy of a shared block stops following it once edited
+			query += " content = ?, overridden = (shared_id IS NOT NULL),"
 			params = append(params, *input.Content)
 		}
+		if input.Type != nil {
+			if !validCodeBlockType(*input.Type) {
+				http.Error(w, "Type must be html, template, css, js or markdown", http.StatusBadRequest)
+				return
+			}
+			query += " type = ?,"
+			params = append(params, *input.Type)
+		}
+		if input.Content != nil || input.Type != nil {
+			// Re-render Markdown with whichever of content and type isn't changing
+			var content, blockType string
+			err := db.QueryRow("SELECT content, type FROM code_blocks WHERE id = ?", codeBlockID).Scan(&content, &blockType)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Code block not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, "Failed to retrieve code block", http.StatusInternalServerError)
+				return
+			}
+			if input.Content != nil {
+				content = *input.Content
+			}
+			if input.Type != nil {
+				blockType = *input.Type
+			}
+			rendered, hash, metadata, err := markdownCache(blockType, content)
+			if err != nil {
+				http.Error(w, "Invalid Markdown: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			query += " rendered = ?, rendered_hash = ?, metadata = ?,"
+			params = append(params, rendered, hash, metadata)
+		}
 
 		// Removes trailing comma
 		query = query[:len(query)-1] + " WHERE id = ?"
@@ -162,6 +320,10 @@ func DeleteCodeBlock(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Failed to delete code block", http.StatusInternalServerError)
 			return
 		}
+		if _, err := db.Exec("DELETE FROM code_block_translations WHERE codeblock_id = ?", codeBlockID); err != nil {
+			http.Error(w, "Failed to delete code block translations", http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Code block deleted successfully"))
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cms/settings"
+)
+
+// CollectionView is what a collection's list page sees as .Collection
+type CollectionView struct {
+	Collection Collection
+	Posts      []Post
+	Archives   []Archive
+	Title      string
+	URL        string
+
+	Page, TotalPages, Total int
+	PrevURL, NextURL        string
+
+	Year, Month int
+	Tag         string
+}
+
+// collectionForPath finds the collection whose base path contains path,
+// preferring the longest base path
+func collectionForPath(db *sql.DB, path string) (*Collection, string, error) {
+	rows, err := db.Query("SELECT " + collectionColumns + " FROM collections ORDER BY LENGTH(base_path) DESC")
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanCollection(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		if path == c.BasePath || strings.HasPrefix(path, c.BasePath+"/") {
+			return &c, strings.Trim(strings.TrimPrefix(path, c.BasePath), "/"), nil
+		}
+	}
+	return nil, "", rows.Err()
+}
+
+// parseCollectionPath splits what follows a collection's base path into a
+// listing (filter and page number) or a post slug. It recognises
+//
+//	/page/2, /2024, /2024/03, /tag/news, any of those followed by /page/N,
+//	/feed.xml (RSS), /atom.xml and /{slug}
+func parseCollectionPath(rest string) (f postFilter, page int, slug, feed string, ok bool) {
+	segments := []string{}
+	if rest != "" {
+		segments = strings.Split(rest, "/")
+	}
+
+	page = 1
+	if n := len(segments); n >= 2 && segments[n-2] == "page" {
+		p, err := strconv.Atoi(segments[n-1])
+		if err != nil || p < 1 {
+			return f, 0, "", "", false
+		}
+		page = p
+		segments = segments[:n-2]
+	}
+
+	switch {
+	case len(segments) == 0:
+		return f, page, "", "", true
+	case len(segments) == 1 && segments[0] == "feed.xml" && page == 1:
+		return f, page, "", FeedRSS, true
+	case len(segments) == 1 && segments[0] == "atom.xml" && page == 1:
+		return f, page, "", FeedAtom, true
+	case len(segments) == 2 && segments[0] == "tag":
+		f.Tag = segments[1]
+		return f, page, "", "", true
+	}
+
+	if year, err := strconv.Atoi(segments[0]); err == nil && len(segments[0]) == 4 && len(segments) <= 2 {
+		f.Year = year
+		if len(segments) == 2 {
+			month, err := strconv.Atoi(segments[1])
+			if err != nil || month < 1 || month > 12 {
+				return f, 0, "", "", false
+			}
+			f.Month = month
+		}
+		return f, page, "", "", true
+	}
+
+	if len(segments) == 1 && page == 1 {
+		return f, page, segments[0], "", true
+	}
+	return f, 0, "", "", false
+}
+
+// listingURL builds the URL of a listing page, leaving off /page/1
+func listingURL(c Collection, f postFilter, page int) string {
+	url := c.BasePath
+	switch {
+	case f.Tag != "":
+		url += "/tag/" + f.Tag
+	case f.Month > 0:
+		url += fmt.Sprintf("/%04d/%02d", f.Year, f.Month)
+	case f.Year > 0:
+		url += fmt.Sprintf("/%04d", f.Year)
+	}
+	if page > 1 {
+		url += "/page/" + strconv.Itoa(page)
+	}
+	return url
+}
+
+// collectionView loads one page of a listing. It returns nil when the page
+// number is past the end.
+func collectionView(db *sql.DB, c Collection, f postFilter, page int) (*CollectionView, error) {
+	posts, total, err := listPosts(db, c, f, c.PerPage, (page-1)*c.PerPage)
+	if err != nil {
+		return nil, err
+	}
+	totalPages := (total + c.PerPage - 1) / c.PerPage
+	if page > 1 && page > totalPages {
+		return nil, nil
+	}
+	// Archive and tag listings with no posts are 404s rather than empty pages
+	if total == 0 && (f.Year > 0 || f.Tag != "") {
+		return nil, nil
+	}
+
+	archives, err := listArchives(db, c)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &CollectionView{
+		Collection: c,
+		Posts:      posts,
+		Archives:   archives,
+		Title:      c.Title,
+		URL:        listingURL(c, f, page),
+		Page:       page,
+		TotalPages: max(totalPages, 1),
+		Total:      total,
+		Year:       f.Year,
+		Month:      f.Month,
+		Tag:        f.Tag,
+	}
+	switch {
+	case f.Tag != "":
+		view.Title = c.Title + ": " + f.Tag
+	case f.Month > 0:
+		view.Title = fmt.Sprintf("%s: %s %d", c.Title, time.Month(f.Month), f.Year)
+	case f.Year > 0:
+		view.Title = fmt.Sprintf("%s: %d", c.Title, f.Year)
+	}
+	if page > 1 {
+		view.PrevURL = listingURL(c, f, page-1)
+		view.Title += fmt.Sprintf(" (page %d)", page)
+	}
+	if page < totalPages {
+		view.NextURL = listingURL(c, f, page+1)
+	}
+	return view, nil
+}
+
+// renderCollection renders a collection layout page with a listing or a post.
+// The layout's own title, URL and canonical are replaced by the listing's or
+// post's so SEO tags describe what is actually shown.
+func (rd *renderer) renderCollection(c Collection, pageID int, view *CollectionView, post *Post) (string, error) {
+	page, err := getPage(rd.db, pageID)
+	if err != nil {
+		return "", fmt.Errorf("layout page %d: %w", pageID, err)
+	}
+	if err := rd.loadCodeBlocks(&page); err != nil {
+		return "", err
+	}
+
+	page.CanonicalURL = nil
+	if post != nil {
+		page.Title = post.Title
+		page.Url = post.URL
+		page.MetaTitle = nil
+		if post.Excerpt != nil && *post.Excerpt != "" {
+			page.MetaDescription = post.Excerpt
+		}
+		if post.ImageID != nil {
+			page.OGImageID = post.ImageID
+		}
+	} else {
+		page.Title = view.Title
+		page.Url = view.URL
+	}
+
+	rd.current = &c
+	rd.collection = view
+	rd.post = post
+	return rd.renderPage(&page)
+}
+
+// serveCollection answers paths under a collection's base path. It reports
+// false for paths it doesn't recognise, such as an unknown slug, so other
+// pages and redirects under the base path still work.
+func serveCollection(db *sql.DB, cfg *settings.Settings, w http.ResponseWriter, r *http.Request) (bool, error) {
+	c, rest, err := collectionForPath(db, r.URL.Path)
+	if err != nil || c == nil {
+		return false, err
+	}
+	f, page, slug, feed, ok := parseCollectionPath(rest)
+	if !ok {
+		return false, nil
+	}
+
+	if feed != "" {
+		doc, err := collectionFeed(db, cfg, *c)
+		if err != nil {
+			return false, err
+		}
+		writeFeed(w, r, cfg, doc, feed)
+		return true, nil
+	}
+
+	rd := newRenderer(db, cfg)
+	var html string
+	if slug != "" {
+		post, err := scanPost(db.QueryRow("SELECT "+postColumns+" FROM posts WHERE collection_id = ? AND slug = ? AND "+livePosts, c.ID, slug), *c)
+		if err == sql.ErrNoRows {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if html, err = rd.renderCollection(*c, c.DetailPageID, nil, &post); err != nil {
+			return false, err
+		}
+	} else {
+		view, err := collectionView(db, *c, f, page)
+		if err != nil || view == nil {
+			return false, err
+		}
+		if html, err = rd.renderCollection(*c, c.ListPageID, view, nil); err != nil {
+			return false, err
+		}
+	}
+
+	writeHTML(w, r, html)
+	return true, nil
+}
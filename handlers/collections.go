@@ -0,0 +1,683 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/utils"
+)
+
+// Post statuses. Only published posts dated in the past appear on the site.
+const (
+	PostDraft     = "draft"
+	PostPublished = "published"
+)
+
+// How post dates are stored, matching SQLite's CURRENT_TIMESTAMP so they
+// compare and strftime() correctly
+const sqliteTime = "2006-01-02 15:04:05"
+
+type Collection struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Title        string `json:"title"`
+	BasePath     string `json:"base_path"`
+	ListPageID   int    `json:"list_page_id"`
+	DetailPageID int    `json:"detail_page_id"`
+	PerPage      int    `json:"per_page"`
+	CreatedAt    string `json:"created_at"`
+}
+
+type Post struct {
+	ID           int           `json:"id"`
+	CollectionID int           `json:"collection_id"`
+	Title        string        `json:"title"`
+	Slug         string        `json:"slug"`
+	Author       *string       `json:"author,omitempty"`
+	Excerpt      *string       `json:"excerpt,omitempty"`
+	Body         template.HTML `json:"body"`
+	Tags         []string      `json:"tags"`
+	ImageID      *int          `json:"image_id,omitempty"`
+	Status       string        `json:"status"`
+	PublishedAt  string        `json:"published_at"`
+	CreatedAt    string        `json:"created_at"`
+	UpdatedAt    string        `json:"updated_at"`
+	URL          string        `json:"url"`
+
+	basePath string
+}
+
+// Date formats the post's publish date for templates: {{ .Post.Date "Jan 2, 2006" }}
+func (p Post) Date(layout string) string {
+	t, err := time.Parse(time.RFC3339, p.PublishedAt)
+	if err != nil {
+		return p.PublishedAt
+	}
+	return t.Format(layout)
+}
+
+// TagURL links to the listing of posts with a tag
+func (p Post) TagURL(tag string) string {
+	return p.basePath + "/tag/" + tag
+}
+
+const collectionColumns = "id, name, title, base_path, list_page_id, detail_page_id, per_page, created_at"
+
+func scanCollection(row interface{ Scan(...interface{}) error }) (Collection, error) {
+	var c Collection
+	err := row.Scan(&c.ID, &c.Name, &c.Title, &c.BasePath, &c.ListPageID, &c.DetailPageID, &c.PerPage, &c.CreatedAt)
+	return c, err
+}
+
+func getCollection(db *sql.DB, name string) (Collection, error) {
+	return scanCollection(db.QueryRow("SELECT "+collectionColumns+" FROM collections WHERE name = ?", name))
+}
+
+const postColumns = "id, collection_id, title, slug, author, excerpt, body, tags, image_id, status, published_at, created_at, updated_at"
+
+func scanPost(row interface{ Scan(...interface{}) error }, c Collection) (Post, error) {
+	var p Post
+	var tags string
+	err := row.Scan(&p.ID, &p.CollectionID, &p.Title, &p.Slug, &p.Author, &p.Excerpt, &p.Body, &tags,
+		&p.ImageID, &p.Status, &p.PublishedAt, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal([]byte(tags), &p.Tags); err != nil || p.Tags == nil {
+		p.Tags = []string{}
+	}
+	p.basePath = c.BasePath
+	p.URL = c.BasePath + "/" + p.Slug
+	return p, nil
+}
+
+// livePosts is the condition for posts the public site shows
+const livePosts = "status = 'published' AND published_at <= CURRENT_TIMESTAMP"
+
+// postFilter narrows a collection's live posts to an archive or tag listing
+type postFilter struct {
+	Year, Month int
+	Tag         string
+}
+
+func (f postFilter) where() (string, []interface{}) {
+	where := ""
+	var params []interface{}
+	if f.Year > 0 {
+		where += " AND strftime('%Y', published_at) = ?"
+		params = append(params, fmt.Sprintf("%04d", f.Year))
+	}
+	if f.Month > 0 {
+		where += " AND strftime('%m', published_at) = ?"
+		params = append(params, fmt.Sprintf("%02d", f.Month))
+	}
+	if f.Tag != "" {
+		where += " AND EXISTS (SELECT 1 FROM json_each(posts.tags) WHERE value = ?)"
+		params = append(params, f.Tag)
+	}
+	return where, params
+}
+
+// listPosts returns one page of a collection's live posts, newest first, along
+// with the total number that match
+func listPosts(db *sql.DB, c Collection, f postFilter, limit, offset int) ([]Post, int, error) {
+	where, params := f.where()
+	where = " FROM posts WHERE collection_id = ? AND " + livePosts + where
+	params = append([]interface{}{c.ID}, params...)
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*)"+where, params...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query("SELECT "+postColumns+where+" ORDER BY published_at DESC, id DESC LIMIT ? OFFSET ?",
+		append(params, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		p, err := scanPost(rows, c)
+		if err != nil {
+			return nil, 0, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, total, rows.Err()
+}
+
+// Archive is one month of a collection's posts
+type Archive struct {
+	Year  int    `json:"year"`
+	Month int    `json:"month"`
+	Count int    `json:"count"`
+	Label string `json:"label"`
+	URL   string `json:"url"`
+}
+
+// listArchives counts a collection's live posts per month, newest first
+func listArchives(db *sql.DB, c Collection) ([]Archive, error) {
+	rows, err := db.Query(`
+		SELECT CAST(strftime('%Y', published_at) AS INTEGER) AS y, CAST(strftime('%m', published_at) AS INTEGER) AS m, COUNT(*)
+		FROM posts
+		WHERE collection_id = ? AND `+livePosts+`
+		GROUP BY y, m
+		ORDER BY y DESC, m DESC`, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var archives []Archive
+	for rows.Next() {
+		var a Archive
+		if err := rows.Scan(&a.Year, &a.Month, &a.Count); err != nil {
+			return nil, err
+		}
+		a.Label = time.Month(a.Month).String() + fmt.Sprintf(" %d", a.Year)
+		a.URL = fmt.Sprintf("%s/%04d/%02d", c.BasePath, a.Year, a.Month)
+		archives = append(archives, a)
+	}
+	return archives, rows.Err()
+}
+
+// parsePostTime accepts a date, a date and time or RFC 3339 and returns it in
+// the stored format
+func parsePostTime(s string) (string, error) {
+	for _, layout := range []string{time.RFC3339, sqliteTime, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format(sqliteTime), nil
+		}
+	}
+	return "", fmt.Errorf("published_at must be a date (YYYY-MM-DD) or an RFC 3339 time")
+}
+
+// normalizeBasePath trims a trailing slash and checks the path can be routed
+func normalizeBasePath(path string) (string, error) {
+	path = strings.TrimRight(path, "/")
+	if !strings.HasPrefix(path, "/") || path == "" {
+		return "", fmt.Errorf("base_path must be a path such as /news")
+	}
+	return path, nil
+}
+
+// collectionFor loads the collection named in the URL, writing the error
+// response and returning false if it can't
+func collectionFor(db *sql.DB, w http.ResponseWriter, r *http.Request) (Collection, bool) {
+	c, err := getCollection(db, chi.URLParam(r, "collectionName"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve collection", http.StatusInternalServerError)
+		}
+		return c, false
+	}
+	return c, true
+}
+
+func GetCollections(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT " + collectionColumns + " FROM collections ORDER BY name")
+		if err != nil {
+			http.Error(w, "Failed to retrieve collections", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		collections := []Collection{}
+		for rows.Next() {
+			c, err := scanCollection(rows)
+			if err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			collections = append(collections, c)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collections)
+	}
+}
+
+func GetCollection(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := collectionFor(db, w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+func CreateCollection(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c Collection
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !contentName.MatchString(c.Name) {
+			http.Error(w, "Collection name must be lowercase letters, digits and underscores", http.StatusBadRequest)
+			return
+		}
+		basePath, err := normalizeBasePath(c.BasePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c.Title == "" {
+			c.Title = c.Name
+		}
+		if c.PerPage <= 0 {
+			c.PerPage = 10
+		}
+		for _, id := range []int{c.ListPageID, c.DetailPageID} {
+			if _, err := getPage(db, id); err != nil {
+				http.Error(w, fmt.Sprintf("Layout page %d not found", id), http.StatusBadRequest)
+				return
+			}
+		}
+
+		result, err := db.Exec(`
+			INSERT INTO collections (name, title, base_path, list_page_id, detail_page_id, per_page)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			c.Name, c.Title, basePath, c.ListPageID, c.DetailPageID, c.PerPage,
+		)
+		if err != nil {
+			http.Error(w, "Failed to create collection: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve new collection ID", http.StatusInternalServerError)
+			return
+		}
+
+		created, err := scanCollection(db.QueryRow("SELECT "+collectionColumns+" FROM collections WHERE id = ?", id))
+		if err != nil {
+			http.Error(w, "Failed to load collection", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+func UpdateCollection(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := collectionFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		var input struct {
+			Title        *string `json:"title"`
+			BasePath     *string `json:"base_path"`
+			ListPageID   *int    `json:"list_page_id"`
+			DetailPageID *int    `json:"detail_page_id"`
+			PerPage      *int    `json:"per_page"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Build the query to update only the fields that are provided
+		query := "UPDATE collections SET"
+		params := []interface{}{}
+
+		if input.Title != nil {
+			query += " title = ?,"
+			params = append(params, *input.Title)
+		}
+		if input.BasePath != nil {
+			basePath, err := normalizeBasePath(*input.BasePath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query += " base_path = ?,"
+			params = append(params, basePath)
+		}
+		for _, field := range []struct {
+			column string
+			value  *int
+		}{{"list_page_id", input.ListPageID}, {"detail_page_id", input.DetailPageID}} {
+			if field.value == nil {
+				continue
+			}
+			if _, err := getPage(db, *field.value); err != nil {
+				http.Error(w, fmt.Sprintf("Layout page %d not found", *field.value), http.StatusBadRequest)
+				return
+			}
+			query += " " + field.column + " = ?,"
+			params = append(params, *field.value)
+		}
+		if input.PerPage != nil {
+			if *input.PerPage <= 0 {
+				http.Error(w, "per_page must be positive", http.StatusBadRequest)
+				return
+			}
+			query += " per_page = ?,"
+			params = append(params, *input.PerPage)
+		}
+		if len(params) == 0 {
+			http.Error(w, "No fields to update", http.StatusBadRequest)
+			return
+		}
+
+		// Remove trailing comma and add the WHERE clause
+		query = query[:len(query)-1] + " WHERE id = ?"
+		params = append(params, c.ID)
+
+		if _, err := db.Exec(query, params...); err != nil {
+			http.Error(w, "Failed to update collection: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Collection updated successfully"))
+	}
+}
+
+// DeleteCollection removes a collection and all of its posts
+func DeleteCollection(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := collectionFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to delete collection", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM term_assignments WHERE object_type = 'post' AND object_id IN (SELECT id FROM posts WHERE collection_id = ?)", c.ID); err != nil {
+			http.Error(w, "Failed to delete post terms", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM posts WHERE collection_id = ?", c.ID); err != nil {
+			http.Error(w, "Failed to delete posts", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM collections WHERE id = ?", c.ID); err != nil {
+			http.Error(w, "Failed to delete collection", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete collection", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Collection deleted successfully"))
+	}
+}
+
+// GetPosts lists every post in a collection, drafts included, newest first.
+// ?status=draft or ?status=published filters by status.
+func GetPosts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := collectionFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		query := "SELECT " + postColumns + " FROM posts WHERE collection_id = ?"
+		params := []interface{}{c.ID}
+		if status := r.URL.Query().Get("status"); status != "" {
+			query += " AND status = ?"
+			params = append(params, status)
+		}
+
+		rows, err := db.Query(query+" ORDER BY published_at DESC, id DESC", params...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve posts", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		posts := []Post{}
+		for rows.Next() {
+			p, err := scanPost(rows, c)
+			if err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			posts = append(posts, p)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(posts)
+	}
+}
+
+func GetPost(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := collectionFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		p, err := scanPost(db.QueryRow("SELECT "+postColumns+" FROM posts WHERE id = ? AND collection_id = ?", chi.URLParam(r, "postID"), c.ID), c)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Post not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve post", http.StatusInternalServerError)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// postInput is the body of a post create or update; nil fields are left alone
+type postInput struct {
+	Title       *string   `json:"title"`
+	Slug        *string   `json:"slug"`
+	Author      *string   `json:"author"`
+	Excerpt     *string   `json:"excerpt"`
+	Body        *string   `json:"body"`
+	Tags        *[]string `json:"tags"`
+	ImageID     *int      `json:"image_id"`
+	Status      *string   `json:"status"`
+	PublishedAt *string   `json:"published_at"`
+}
+
+// columns validates the input and returns the columns and values to save
+func (in postInput) columns(db *sql.DB) ([]string, []interface{}, error) {
+	var cols []string
+	var vals []interface{}
+	set := func(col string, val interface{}) {
+		cols = append(cols, col)
+		vals = append(vals, val)
+	}
+
+	if in.Title != nil {
+		if strings.TrimSpace(*in.Title) == "" {
+			return nil, nil, fmt.Errorf("title is required")
+		}
+		set("title", *in.Title)
+	}
+	if in.Slug != nil {
+		slug := utils.Slugify(*in.Slug)
+		if slug == "" {
+			return nil, nil, fmt.Errorf("slug must contain letters or digits")
+		}
+		set("slug", slug)
+	}
+	if in.Author != nil {
+		set("author", *in.Author)
+	}
+	if in.Excerpt != nil {
+		set("excerpt", *in.Excerpt)
+	}
+	if in.Body != nil {
+		set("body", *in.Body)
+	}
+	if in.Tags != nil {
+		tags := []string{}
+		for _, tag := range *in.Tags {
+			if tag = utils.Slugify(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		raw, _ := json.Marshal(tags)
+		set("tags", string(raw))
+	}
+	if in.ImageID != nil {
+		if *in.ImageID > 0 {
+			if _, err := getMedia(db, *in.ImageID); err != nil {
+				return nil, nil, fmt.Errorf("media %d not found", *in.ImageID)
+			}
+		}
+		// 0 clears the image
+		cols = append(cols, "image_id")
+		vals = append(vals, sql.NullInt64{Int64: int64(*in.ImageID), Valid: *in.ImageID > 0})
+	}
+	if in.Status != nil {
+		if *in.Status != PostDraft && *in.Status != PostPublished {
+			return nil, nil, fmt.Errorf("status must be draft or published")
+		}
+		set("status", *in.Status)
+	}
+	if in.PublishedAt != nil {
+		ts, err := parsePostTime(*in.PublishedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		set("published_at", ts)
+	}
+	return cols, vals, nil
+}
+
+func CreatePost(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := collectionFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		var input postInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Title == nil {
+			http.Error(w, "title is required", http.StatusBadRequest)
+			return
+		}
+		if input.Slug == nil {
+			input.Slug = input.Title
+		}
+
+		cols, vals, err := input.columns(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cols = append(cols, "collection_id")
+		vals = append(vals, c.ID)
+
+		result, err := db.Exec("INSERT INTO posts ("+strings.Join(cols, ", ")+") VALUES (?"+strings.Repeat(", ?", len(cols)-1)+")", vals...)
+		if err != nil {
+			http.Error(w, "Failed to create post: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve new post ID", http.StatusInternalServerError)
+			return
+		}
+
+		p, err := scanPost(db.QueryRow("SELECT "+postColumns+" FROM posts WHERE id = ?", id), c)
+		if err != nil {
+			http.Error(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+func UpdatePost(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := collectionFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		var input postInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		cols, vals, err := input.columns(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query := "UPDATE posts SET updated_at = CURRENT_TIMESTAMP"
+		for _, col := range cols {
+			query += ", " + col + " = ?"
+		}
+		result, err := db.Exec(query+" WHERE id = ? AND collection_id = ?", append(vals, chi.URLParam(r, "postID"), c.ID)...)
+		if err != nil {
+			http.Error(w, "Failed to update post: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Post updated successfully"))
+	}
+}
+
+func DeletePost(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := collectionFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		postID := chi.URLParam(r, "postID")
+		result, err := db.Exec("DELETE FROM posts WHERE id = ? AND collection_id = ?", postID, c.ID)
+		if err != nil {
+			http.Error(w, "Failed to delete post", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		if err := deleteTermAssignments(db, TermObjectPost, postID); err != nil {
+			http.Error(w, "Post deleted but its terms could not be removed", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Post deleted successfully"))
+	}
+}
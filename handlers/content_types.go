@@ -0,0 +1,624 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Field types an entry value can have
+const (
+	FieldText     = "text"
+	FieldTextarea = "textarea"
+	FieldHTML     = "html"
+	FieldNumber   = "number"
+	FieldBoolean  = "boolean"
+	FieldDate     = "date"
+	FieldURL      = "url"
+	FieldMedia    = "media"
+	FieldSelect   = "select"
+)
+
+var fieldTypes = map[string]bool{
+	FieldText: true, FieldTextarea: true, FieldHTML: true, FieldNumber: true, FieldBoolean: true,
+	FieldDate: true, FieldURL: true, FieldMedia: true, FieldSelect: true,
+}
+
+// Type and field names are used as template identifiers (.Data.name)
+var contentName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+type Field struct {
+	Name      string   `json:"name"`
+	Label     string   `json:"label,omitempty"`
+	Type      string   `json:"type"`
+	Required  bool     `json:"required,omitempty"`
+	MaxLength int      `json:"max_length,omitempty"`
+	Options   []string `json:"options,omitempty"`
+}
+
+type ContentType struct {
+	ID        int     `json:"id"`
+	Name      string  `json:"name"`
+	Title     string  `json:"title"`
+	Fields    []Field `json:"fields"`
+	CreatedAt string  `json:"created_at"`
+}
+
+type Entry struct {
+	ID        int                    `json:"id"`
+	Type      string                 `json:"type"`
+	Data      map[string]interface{} `json:"data"`
+	SortOrder int                    `json:"sort_order"`
+	Active    int                    `json:"active"`
+	CreatedAt string                 `json:"created_at"`
+	UpdatedAt string                 `json:"updated_at"`
+}
+
+func getContentType(db *sql.DB, name string) (ContentType, error) {
+	var ct ContentType
+	var fields string
+	err := db.QueryRow("SELECT id, name, title, fields, created_at FROM content_types WHERE name = ?", name).
+		Scan(&ct.ID, &ct.Name, &ct.Title, &fields, &ct.CreatedAt)
+	if err != nil {
+		return ct, err
+	}
+	if err := json.Unmarshal([]byte(fields), &ct.Fields); err != nil {
+		return ct, fmt.Errorf("content type %s has invalid fields: %w", name, err)
+	}
+	return ct, nil
+}
+
+// validateFields checks a content type's field definitions
+func validateFields(fields []Field) error {
+	seen := map[string]bool{}
+	for _, f := range fields {
+		if !contentName.MatchString(f.Name) {
+			return fmt.Errorf("field name %q must be lowercase letters, digits and underscores", f.Name)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("duplicate field %q", f.Name)
+		}
+		seen[f.Name] = true
+		if !fieldTypes[f.Type] {
+			return fmt.Errorf("field %s has unknown type %q", f.Name, f.Type)
+		}
+		if f.Type == FieldSelect && len(f.Options) == 0 {
+			return fmt.Errorf("select field %s needs options", f.Name)
+		}
+	}
+	return nil
+}
+
+// validateEntry checks submitted values against the type's fields and returns
+// them in their stored form. Unknown fields are rejected so typos don't
+// silently disappear.
+func validateEntry(db *sql.DB, fields []Field, data map[string]interface{}) (map[string]interface{}, error) {
+	known := map[string]bool{}
+	for _, f := range fields {
+		known[f.Name] = true
+	}
+	for name := range data {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+	}
+
+	clean := map[string]interface{}{}
+	for _, f := range fields {
+		value, ok := data[f.Name]
+		if !ok || value == nil || value == "" {
+			if f.Required {
+				return nil, fmt.Errorf("%s is required", f.Name)
+			}
+			continue
+		}
+
+		switch f.Type {
+		case FieldText, FieldTextarea, FieldHTML, FieldURL, FieldDate, FieldSelect:
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a string", f.Name)
+			}
+			if f.MaxLength > 0 && len([]rune(s)) > f.MaxLength {
+				return nil, fmt.Errorf("%s is longer than %d characters", f.Name, f.MaxLength)
+			}
+			switch f.Type {
+			case FieldURL:
+				if u, err := url.Parse(s); err != nil || (!u.IsAbs() && s[0] != '/') {
+					return nil, fmt.Errorf("%s must be an absolute URL or a site path", f.Name)
+				}
+			case FieldDate:
+				if _, err := time.Parse("2006-01-02", s); err != nil {
+					return nil, fmt.Errorf("%s must be a date in YYYY-MM-DD format", f.Name)
+				}
+			case FieldSelect:
+				valid := false
+				for _, opt := range f.Options {
+					valid = valid || opt == s
+				}
+				if !valid {
+					return nil, fmt.Errorf("%s must be one of %v", f.Name, f.Options)
+				}
+			}
+			clean[f.Name] = s
+
+		case FieldNumber:
+			n, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a number", f.Name)
+			}
+			clean[f.Name] = n
+
+		case FieldBoolean:
+			b, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s must be true or false", f.Name)
+			}
+			clean[f.Name] = b
+
+		case FieldMedia:
+			n, ok := value.(float64)
+			if !ok || n != math.Trunc(n) {
+				return nil, fmt.Errorf("%s must be a media ID", f.Name)
+			}
+			if _, err := getMedia(db, int(n)); err != nil {
+				return nil, fmt.Errorf("%s: media %d not found", f.Name, int(n))
+			}
+			clean[f.Name] = int(n)
+		}
+	}
+	return clean, nil
+}
+
+// entryValues converts stored JSON values to the Go types templates need:
+// media IDs become ints so they can be passed to image/srcset, and HTML fields
+// are marked safe so they render unescaped
+func entryValues(fields []Field, data map[string]interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, f := range fields {
+		value, ok := data[f.Name]
+		if !ok {
+			continue
+		}
+		switch f.Type {
+		case FieldMedia:
+			if n, ok := value.(float64); ok {
+				value = int(n)
+			}
+		case FieldHTML:
+			if s, ok := value.(string); ok {
+				value = template.HTML(s)
+			}
+		}
+		values[f.Name] = value
+	}
+	return values
+}
+
+const entryColumns = "id, data, sort_order, active, created_at, updated_at"
+
+func scanEntry(row interface{ Scan(...interface{}) error }, ct ContentType) (Entry, error) {
+	e := Entry{Type: ct.Name}
+	var data string
+	if err := row.Scan(&e.ID, &data, &e.SortOrder, &e.Active, &e.CreatedAt, &e.UpdatedAt); err != nil {
+		return e, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return e, err
+	}
+	e.Data = entryValues(ct.Fields, raw)
+	return e, nil
+}
+
+// listEntries returns a type's entries in sort order. Only active entries are
+// included unless all is set; limit <= 0 means no limit.
+func listEntries(db *sql.DB, ct ContentType, all bool, limit int) ([]Entry, error) {
+	query := "SELECT " + entryColumns + " FROM content_entries WHERE type_id = ?"
+	if !all {
+		query += " AND active = 1"
+	}
+	query += " ORDER BY sort_order, id"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := db.Query(query, ct.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		e, err := scanEntry(rows, ct)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func getEntry(db *sql.DB, ct ContentType, id interface{}) (Entry, error) {
+	return scanEntry(db.QueryRow("SELECT "+entryColumns+" FROM content_entries WHERE id = ? AND type_id = ?", id, ct.ID), ct)
+}
+
+// contentTypeFor loads the type named in the URL, writing the error response
+// and returning false if it can't
+func contentTypeFor(db *sql.DB, w http.ResponseWriter, r *http.Request) (ContentType, bool) {
+	ct, err := getContentType(db, chi.URLParam(r, "typeName"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Content type not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve content type: "+err.Error(), http.StatusInternalServerError)
+		}
+		return ct, false
+	}
+	return ct, true
+}
+
+func GetContentTypes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT name FROM content_types ORDER BY name")
+		if err != nil {
+			http.Error(w, "Failed to retrieve content types", http.StatusInternalServerError)
+			return
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+
+		types := []ContentType{}
+		for _, name := range names {
+			ct, err := getContentType(db, name)
+			if err != nil {
+				http.Error(w, "Failed to retrieve content type: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			types = append(types, ct)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(types)
+	}
+}
+
+func GetContentType(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := contentTypeFor(db, w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ct)
+	}
+}
+
+func CreateContentType(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ct ContentType
+		if err := json.NewDecoder(r.Body).Decode(&ct); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !contentName.MatchString(ct.Name) {
+			http.Error(w, "Content type name must be lowercase letters, digits and underscores", http.StatusBadRequest)
+			return
+		}
+		if ct.Title == "" {
+			ct.Title = ct.Name
+		}
+		if ct.Fields == nil {
+			ct.Fields = []Field{}
+		}
+		if err := validateFields(ct.Fields); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fields, _ := json.Marshal(ct.Fields)
+		if _, err := db.Exec("INSERT INTO content_types (name, title, fields) VALUES (?, ?, ?)", ct.Name, ct.Title, string(fields)); err != nil {
+			http.Error(w, "Failed to create content type: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		created, err := getContentType(db, ct.Name)
+		if err != nil {
+			http.Error(w, "Failed to load content type", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// UpdateContentType changes a type's title or fields. Existing entries are
+// left as they are; values for removed fields are hidden, and new required
+// fields are enforced the next time an entry is saved.
+func UpdateContentType(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := contentTypeFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		var input struct {
+			Title  *string  `json:"title"`
+			Fields *[]Field `json:"fields"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Title != nil {
+			ct.Title = *input.Title
+		}
+		if input.Fields != nil {
+			if err := validateFields(*input.Fields); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ct.Fields = *input.Fields
+		}
+
+		fields, _ := json.Marshal(ct.Fields)
+		if _, err := db.Exec("UPDATE content_types SET title = ?, fields = ? WHERE id = ?", ct.Title, string(fields), ct.ID); err != nil {
+			http.Error(w, "Failed to update content type", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Content type updated successfully"))
+	}
+}
+
+// DeleteContentType removes a type along with all of its entries
+func DeleteContentType(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := contentTypeFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to delete content type", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM content_entries WHERE type_id = ?", ct.ID); err != nil {
+			http.Error(w, "Failed to delete entries", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM content_types WHERE id = ?", ct.ID); err != nil {
+			http.Error(w, "Failed to delete content type", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete content type", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Content type deleted successfully"))
+	}
+}
+
+// GetEntries lists a type's entries, including inactive ones; ?active=1 limits
+// the list to what the site shows
+func GetEntries(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := contentTypeFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		entries, err := listEntries(db, ct, r.URL.Query().Get("active") != "1", 0)
+		if err != nil {
+			http.Error(w, "Failed to retrieve entries: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+func GetEntry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := contentTypeFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		e, err := getEntry(db, ct, chi.URLParam(r, "entryID"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Entry not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve entry", http.StatusInternalServerError)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+	}
+}
+
+func CreateEntry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := contentTypeFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		input := struct {
+			Data      map[string]interface{} `json:"data"`
+			SortOrder int                    `json:"sort_order"`
+			Active    *int                   `json:"active"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		active := 1
+		if input.Active != nil {
+			active = *input.Active
+		}
+
+		clean, err := validateEntry(db, ct.Fields, input.Data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := json.Marshal(clean)
+
+		result, err := db.Exec("INSERT INTO content_entries (type_id, data, sort_order, active) VALUES (?, ?, ?, ?)",
+			ct.ID, string(data), input.SortOrder, active)
+		if err != nil {
+			http.Error(w, "Failed to create entry: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve new entry ID", http.StatusInternalServerError)
+			return
+		}
+
+		e, err := getEntry(db, ct, id)
+		if err != nil {
+			http.Error(w, "Failed to load entry", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(e)
+	}
+}
+
+// UpdateEntry merges the submitted data into the entry's existing values (a
+// null clears a field) and validates the result as a whole
+func UpdateEntry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := contentTypeFor(db, w, r)
+		if !ok {
+			return
+		}
+		entryID := chi.URLParam(r, "entryID")
+
+		var stored string
+		err := db.QueryRow("SELECT data FROM content_entries WHERE id = ? AND type_id = ?", entryID, ct.ID).Scan(&stored)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Entry not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve entry", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var input struct {
+			Data      map[string]interface{} `json:"data"`
+			SortOrder *int                   `json:"sort_order"`
+			Active    *int                   `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Build the query to update only the fields that are provided
+		query := "UPDATE content_entries SET updated_at = CURRENT_TIMESTAMP,"
+		params := []interface{}{}
+
+		if input.Data != nil {
+			merged := map[string]interface{}{}
+			json.Unmarshal([]byte(stored), &merged)
+
+			// Values for fields the type no longer has are dropped on save
+			current := map[string]bool{}
+			for _, f := range ct.Fields {
+				current[f.Name] = true
+			}
+			for name := range merged {
+				if !current[name] {
+					delete(merged, name)
+				}
+			}
+			for name, value := range input.Data {
+				merged[name] = value
+			}
+
+			clean, err := validateEntry(db, ct.Fields, merged)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := json.Marshal(clean)
+			query += " data = ?,"
+			params = append(params, string(data))
+		}
+		if input.SortOrder != nil {
+			query += " sort_order = ?,"
+			params = append(params, *input.SortOrder)
+		}
+		if input.Active != nil {
+			query += " active = ?,"
+			params = append(params, *input.Active)
+		}
+
+		// Remove trailing comma and add the WHERE clause
+		query = query[:len(query)-1] + " WHERE id = ?"
+		params = append(params, entryID)
+
+		if _, err := db.Exec(query, params...); err != nil {
+			http.Error(w, "Failed to update entry", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Entry updated successfully"))
+	}
+}
+
+func DeleteEntry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, ok := contentTypeFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM content_entries WHERE id = ? AND type_id = ?", chi.URLParam(r, "entryID"), ct.ID)
+		if err != nil {
+			http.Error(w, "Failed to delete entry", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Entry deleted successfully"))
+	}
+}
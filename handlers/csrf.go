@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Forms are protected with a double-submit cookie: each visitor gets a random
+// token in a cookie, and a submission must echo it back in the _csrf field
+// (or an X-CSRF-Token header). Published pages are rendered once for everyone,
+// so forms carry csrfPlaceholder and writeHTML swaps in the visitor's token.
+const (
+	csrfCookie      = "cms_csrf"
+	csrfField       = "_csrf"
+	csrfHeader      = "X-CSRF-Token"
+	csrfPlaceholder = "__CMS_CSRF_TOKEN__"
+)
+
+var csrfTokenFormat = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// csrfToken returns the visitor's token, issuing a new cookie if they don't
+// have a valid one yet
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	// The cookie value ends up in the page, so only ever reuse well-formed tokens
+	if c, err := r.Cookie(csrfCookie); err == nil && csrfTokenFormat.MatchString(c.Value) {
+		return c.Value
+	}
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// validCSRF reports whether a submission carries the token from its cookie
+func validCSRF(r *http.Request) bool {
+	sent := r.PostFormValue(csrfField)
+	if sent == "" {
+		sent = r.Header.Get(csrfHeader)
+	}
+	return matchesCSRFCookie(r, sent)
+}
+
+// matchesCSRFCookie reports whether sent is the token in the request's cookie
+func matchesCSRFCookie(r *http.Request, sent string) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || !csrfTokenFormat.MatchString(c.Value) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(c.Value)) == 1
+}
+
+// simpleContentTypes are the bodies a page on another site can post without
+// the browser asking this server first (a CORS preflight, never approved here)
+var simpleContentTypes = map[string]bool{
+	"":                                  true,
+	"text/plain":                        true,
+	"application/x-www-form-urlencoded": true,
+	"multipart/form-data":               true,
+}
+
+// RequireAdminCSRF stops pages on other sites from making admin changes with
+// the basic auth credentials a browser sends along on its own. Changes must
+// be sent as JSON or another type a cross-site form can't post, or else, like
+// media uploads, carry the X-CSRF-Token header from GET /csrf. The header is
+// read rather than the _csrf field so uploads aren't parsed early.
+func RequireAdminCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if (err != nil || simpleContentTypes[mediaType]) && !matchesCSRFCookie(r, r.Header.Get(csrfHeader)) {
+			http.Error(w, "Send JSON, or the X-CSRF-Token header from GET /csrf", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminCSRFToken issues the token for admin changes posted as forms or uploads
+func AdminCSRFToken(w http.ResponseWriter, r *http.Request) {
+	token := csrfToken(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// writeHTML sends a rendered page, filling in the CSRF token for any forms
+func writeHTML(w http.ResponseWriter, r *http.Request, html string) {
+	if strings.Contains(html, csrfPlaceholder) {
+		html = strings.ReplaceAll(html, csrfPlaceholder, csrfToken(w, r))
+		// The page now holds this visitor's token, so shared caches mustn't keep it
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(html))
+}
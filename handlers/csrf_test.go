@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidCSRF(t *testing.T) {
+	token := strings.Repeat("ab", 32)
+	other := strings.Repeat("cd", 32)
+	tests := []struct {
+		name          string
+		cookie        string
+		field, header string
+		want          bool
+	}{
+		{"field matches cookie", token, token, "", true},
+		{"header matches cookie", token, "", token, true},
+		{"field wins over header", token, token, other, true},
+		{"wrong field", token, other, "", false},
+		{"wrong field, right header", token, other, token, false},
+		{"nothing sent", token, "", "", false},
+		{"no cookie", "", token, "", false},
+		{"malformed cookie echoed back", "x", "x", "", false},
+		{"uppercase cookie", strings.ToUpper(token), strings.ToUpper(token), "", false},
+		{"prefix of the token", token, token[:32], "", false},
+	}
+	for _, tt := range tests {
+		form := url.Values{}
+		if tt.field != "" {
+			form.Set(csrfField, tt.field)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+		}
+		if tt.header != "" {
+			r.Header.Set(csrfHeader, tt.header)
+		}
+		if got := validCSRF(r); got != tt.want {
+			t.Errorf("%s: validCSRF = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	token := strings.Repeat("0f", 32)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	w := httptest.NewRecorder()
+	if got := csrfToken(w, r); got != token {
+		t.Errorf("csrfToken = %q, want the cookie's %q", got, token)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("a valid cookie was replaced with %v", cookies)
+	}
+
+	// A malformed cookie is never echoed into the page
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: `"><script>`})
+	w = httptest.NewRecorder()
+	got := csrfToken(w, r)
+	if !csrfTokenFormat.MatchString(got) {
+		t.Errorf("csrfToken = %q, want a new token", got)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || cookies[0].Value != got || !cookies[0].HttpOnly {
+		t.Errorf("cookies = %v, want the new token", cookies)
+	}
+}
+
+func TestRequireAdminCSRF(t *testing.T) {
+	token := strings.Repeat("ab", 32)
+	tests := []struct {
+		method, contentType string
+		cookie, header      string
+		want                int
+	}{
+		{http.MethodGet, "", "", "", http.StatusOK},
+		{http.MethodPost, "application/json", "", "", http.StatusOK},
+		{http.MethodPatch, "application/json; charset=utf-8", "", "", http.StatusOK},
+		{http.MethodPost, "application/zip", "", "", http.StatusOK},
+		{http.MethodPost, "application/xml", "", "", http.StatusOK},
+		// What a form on another site can post
+		{http.MethodPost, "text/plain", "", "", http.StatusForbidden},
+		{http.MethodPost, "Text/Plain; charset=utf-8", "", "", http.StatusForbidden},
+		{http.MethodPost, "application/x-www-form-urlencoded", "", "", http.StatusForbidden},
+		{http.MethodPost, "multipart/form-data; boundary=x", "", "", http.StatusForbidden},
+		{http.MethodPost, "", "", "", http.StatusForbidden},
+		{http.MethodDelete, "", "", "", http.StatusForbidden},
+		{http.MethodPost, "not a type", "", "", http.StatusForbidden},
+		// Uploads echo the cookie's token
+		{http.MethodPost, "multipart/form-data; boundary=x", token, token, http.StatusOK},
+		{http.MethodDelete, "", token, token, http.StatusOK},
+		{http.MethodPost, "multipart/form-data; boundary=x", token, strings.Repeat("cd", 32), http.StatusForbidden},
+		{http.MethodPost, "multipart/form-data; boundary=x", "", token, http.StatusForbidden},
+	}
+	h := RequireAdminCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/media/", strings.NewReader("{}"))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+		}
+		if tt.header != "" {
+			r.Header.Set(csrfHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s as %q with cookie %v and header %v = %d, want %d", tt.method, tt.contentType, tt.cookie != "", tt.header != "", w.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminCSRFToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	AdminCSRFToken(w, httptest.NewRequest(http.MethodGet, "/csrf", nil))
+	var body struct{ Token string }
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != body.Token || !csrfTokenFormat.MatchString(body.Token) {
+		t.Errorf("token %q with cookies %v", body.Token, cookies)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	token := strings.Repeat("0f", 32)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	w := httptest.NewRecorder()
+	writeHTML(w, r, `<form><input name="_csrf" value="`+csrfPlaceholder+`"></form>`)
+	if got := w.Body.String(); got != `<form><input name="_csrf" value="`+token+`"></form>` {
+		t.Errorf("body = %q", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	// Pages without forms stay cacheable and set no cookie
+	w = httptest.NewRecorder()
+	writeHTML(w, httptest.NewRequest(http.MethodGet, "/", nil), "<p>hi</p>")
+	if w.Header().Get("Cache-Control") != "" || len(w.Result().Cookies()) != 0 {
+		t.Errorf("a page without forms got headers %v", w.Header())
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cms/bundle"
+	"cms/sites"
+)
+
+// Largest bundle POST /import accepts
+const maxImportSize = 512 << 20
+
+// ExportSite downloads the current site as a bundle: a zip with its media
+// files, or with ?format=json the JSON document alone
+func ExportSite(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, _ := sites.FromContext(r.Context())
+		zipped := true
+		ext := "zip"
+		switch r.URL.Query().Get("format") {
+		case "", "zip":
+			w.Header().Set("Content-Type", "application/zip")
+		case "json":
+			zipped = false
+			ext = "json"
+			w.Header().Set("Content-Type", "application/json")
+		default:
+			http.Error(w, "Format must be zip or json", http.StatusBadRequest)
+			return
+		}
+
+		name := strings.ReplaceAll(s.Hostname, sites.FallbackHost, "site")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, name, time.Now().Format("20060102"), ext))
+		if err := bundle.ExportSite(w, reg, s, zipped); err != nil {
+			// The response has already started, so all that's left is to log it
+			log.Printf("Failed to export site %s: %v", s.Hostname, err)
+		}
+	}
+}
+
+// ImportSite loads a bundle, zip or JSON, posted as the request body into the
+// current site. ?mode=merge (the default) or replace, ?conflicts=fail (the
+// default), skip or rename, and ?dry_run=1 to only report what would change.
+func ImportSite(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, _ := sites.FromContext(r.Context())
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+		if err != nil {
+			http.Error(w, "Failed to read bundle: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, err := bundle.Read(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		opts := bundle.Options{
+			Mode:       q.Get("mode"),
+			OnConflict: q.Get("conflicts"),
+			DryRun:     q.Get("dry_run") == "1" || q.Get("dry_run") == "true",
+		}
+		if err := opts.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report, err := bundle.ImportSite(reg, s, b, opts)
+		if errors.Is(err, bundle.ErrConflicts) {
+			// Nothing was imported; the report lists the conflicts
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(report)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to import bundle: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/settings"
+	"cms/utils"
+)
+
+// Feed formats
+const (
+	FeedRSS  = "rss"
+	FeedAtom = "atom"
+)
+
+var feedContentTypes = map[string]string{
+	FeedRSS:  "application/rss+xml; charset=utf-8",
+	FeedAtom: "application/atom+xml; charset=utf-8",
+}
+
+// Posts per collection feed
+const feedSize = 20
+
+// Summaries made from page text are cut to this many characters
+const feedSummaryLength = 300
+
+// feedDoc is a feed before it's written as RSS or Atom. All URLs are absolute.
+type feedDoc struct {
+	Title    string
+	Subtitle string
+	Link     string
+	Updated  time.Time
+	Entries  []feedEntry
+	selfURLs map[string]string
+}
+
+type feedEntry struct {
+	Title      string
+	URL        string
+	Author     string
+	Summary    string
+	Content    string
+	Categories []string
+	Published  time.Time
+	Updated    time.Time
+}
+
+// parseTimestamp reads a timestamp as the SQLite driver returns it
+func parseTimestamp(ts string) time.Time {
+	for _, layout := range []string{time.RFC3339, sqliteTime} {
+		if t, err := time.Parse(layout, ts); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// summarize shortens text to about n characters, breaking at a word
+func summarize(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	cut := string(runes[:n])
+	if i := strings.LastIndex(cut, " "); i > n/2 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// collectionFeed builds the feed of a collection's latest live posts
+func collectionFeed(db *sql.DB, cfg *settings.Settings, c Collection) (*feedDoc, error) {
+	posts, _, err := listPosts(db, c, postFilter{}, feedSize, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &feedDoc{
+		Title:    c.Title + " - " + cfg.SiteName,
+		Subtitle: cfg.SiteDescription,
+		Link:     absoluteURL(cfg, c.BasePath),
+		selfURLs: collectionFeedURLs(cfg, c),
+	}
+	for _, p := range posts {
+		e := feedEntry{
+			Title:      p.Title,
+			URL:        absoluteURL(cfg, p.URL),
+			Content:    string(p.Body),
+			Categories: p.Tags,
+			Published:  parseTimestamp(p.PublishedAt),
+			Updated:    parseTimestamp(p.UpdatedAt),
+		}
+		if p.Author != nil {
+			e.Author = *p.Author
+		}
+		if p.Excerpt != nil && *p.Excerpt != "" {
+			e.Summary = *p.Excerpt
+		} else {
+			e.Summary = summarize(utils.HTMLToText(e.Content), feedSummaryLength)
+		}
+		// A post scheduled in the past goes live later than its last edit
+		if e.Published.After(e.Updated) {
+			e.Updated = e.Published
+		}
+		doc.add(e)
+	}
+	return doc, nil
+}
+
+func collectionFeedURLs(cfg *settings.Settings, c Collection) map[string]string {
+	return map[string]string{
+		FeedRSS:  absoluteURL(cfg, c.BasePath+"/feed.xml"),
+		FeedAtom: absoluteURL(cfg, c.BasePath+"/atom.xml"),
+	}
+}
+
+func pageFeedURLs(cfg *settings.Settings, f settings.Feed) map[string]string {
+	return map[string]string{
+		FeedRSS:  absoluteURL(cfg, "/feeds/"+f.Name+".rss"),
+		FeedAtom: absoluteURL(cfg, "/feeds/"+f.Name+".atom"),
+	}
+}
+
+// pageFeed builds a feed of the published pages anywhere below the feed's
+// parent page, most recently published first
+func pageFeed(db *sql.DB, cfg *settings.Settings, f settings.Feed) (*feedDoc, error) {
+	doc := &feedDoc{
+		Title:    f.Title,
+		Subtitle: cfg.SiteDescription,
+		Link:     absoluteURL(cfg, "/"),
+		selfURLs: pageFeedURLs(cfg, f),
+	}
+	if doc.Title == "" {
+		doc.Title = cfg.SiteName
+	}
+	var parentURL string
+	if err := db.QueryRow("SELECT url FROM pages WHERE id = ?", f.ParentPage).Scan(&parentURL); err == nil {
+		doc.Link = absoluteURL(cfg, parentURL)
+	}
+
+	rows, err := db.Query(`
+		WITH RECURSIVE subtree (id) AS (
+			SELECT id FROM pages WHERE parent_page = ?
+			UNION
+			SELECT p.id FROM pages p JOIN subtree s ON p.parent_page = s.id
+		)
+		SELECT p.title, p.url, p.meta_description, pp.html, pp.published_at
+		FROM subtree s
+		JOIN pages p ON p.id = s.id
+		JOIN published_pages pp ON pp.page_id = p.id
+		WHERE p.active = 1 AND p.hidden != 1 AND IFNULL(p.link, '') = ''
+		ORDER BY pp.published_at DESC
+		LIMIT ?`, f.ParentPage, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var title, url, html, publishedAt string
+		var description *string
+		if err := rows.Scan(&title, &url, &description, &html, &publishedAt); err != nil {
+			return nil, err
+		}
+
+		published := parseTimestamp(publishedAt)
+		e := feedEntry{
+			Title:     title,
+			URL:       absoluteURL(cfg, url),
+			Summary:   summarize(utils.HTMLToText(html), feedSummaryLength),
+			Published: published,
+			Updated:   published,
+		}
+		if description != nil && *description != "" {
+			e.Summary = *description
+		}
+		doc.add(e)
+	}
+	return doc, rows.Err()
+}
+
+// add appends an entry and keeps the feed's updated time current
+func (doc *feedDoc) add(e feedEntry) {
+	doc.Entries = append(doc.Entries, e)
+	if e.Updated.After(doc.Updated) {
+		doc.Updated = e.Updated
+	}
+}
+
+type rssFeed struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	XMLNSAtom string     `xml:"xmlns:atom,attr"`
+	XMLNSDC   string     `xml:"xmlns:dc,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string       `xml:"title"`
+	Link          string       `xml:"link"`
+	Description   string       `xml:"description"`
+	LastBuildDate string       `xml:"lastBuildDate,omitempty"`
+	Self          atomLinkElem `xml:"atom:link"`
+	Items         []rssItem    `xml:"item"`
+}
+
+type atomLinkElem struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Author      string   `xml:"dc:creator,omitempty"`
+	Description string   `xml:"description,omitempty"`
+	Categories  []string `xml:"category"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+func (doc *feedDoc) rss() interface{} {
+	feed := rssFeed{
+		Version:   "2.0",
+		XMLNSAtom: "http://www.w3.org/2005/Atom",
+		XMLNSDC:   "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       doc.Title,
+			Link:        doc.Link,
+			Description: doc.Subtitle,
+			Self:        atomLinkElem{Href: doc.selfURLs[FeedRSS], Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+
+	if !doc.Updated.IsZero() {
+		feed.Channel.LastBuildDate = doc.Updated.Format(time.RFC1123Z)
+	}
+	for _, e := range doc.Entries {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.URL,
+			GUID:        rssGUID{Value: e.URL, IsPermaLink: true},
+			PubDate:     e.Published.Format(time.RFC1123Z),
+			Author:      e.Author,
+			Description: e.Summary,
+			Categories:  e.Categories,
+		})
+	}
+	return feed
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   atomAuthor  `xml:"author"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Link       atomLink       `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     *atomAuthor    `xml:"author,omitempty"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+	Categories []atomCategory `xml:"category"`
+}
+
+func (doc *feedDoc) atom(siteName string) interface{} {
+	updated := doc.Updated
+	if updated.IsZero() {
+		updated = time.Unix(0, 0).UTC()
+	}
+	feed := atomFeed{
+		Title:    doc.Title,
+		Subtitle: doc.Subtitle,
+		ID:       doc.selfURLs[FeedAtom],
+		Updated:  updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: doc.selfURLs[FeedAtom], Rel: "self", Type: "application/atom+xml"},
+			{Href: doc.Link, Rel: "alternate", Type: "text/html"},
+		},
+		// Atom requires an author; entries without their own inherit the site
+		Author: atomAuthor{Name: siteName},
+	}
+	for _, e := range doc.Entries {
+		entry := atomEntry{
+			Title:     e.Title,
+			ID:        e.URL,
+			Link:      atomLink{Href: e.URL, Rel: "alternate", Type: "text/html"},
+			Published: e.Published.Format(time.RFC3339),
+			Updated:   e.Updated.Format(time.RFC3339),
+		}
+		if e.Author != "" {
+			entry.Author = &atomAuthor{Name: e.Author}
+		}
+		if e.Summary != "" {
+			entry.Summary = &atomText{Type: "text", Value: e.Summary}
+		}
+		if e.Content != "" {
+			entry.Content = &atomText{Type: "html", Value: e.Content}
+		}
+		for _, tag := range e.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+// writeFeed encodes the feed and serves it with Last-Modified and an ETag so
+// feed readers polling with If-Modified-Since or If-None-Match get a 304 when
+// nothing changed
+func writeFeed(w http.ResponseWriter, r *http.Request, cfg *settings.Settings, doc *feedDoc, format string) {
+	data, err := encodeFeed(cfg, doc, format)
+	if err != nil {
+		http.Error(w, "Failed to encode feed", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	w.Header().Set("Content-Type", feedContentTypes[format])
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	http.ServeContent(w, r, "", doc.Updated, bytes.NewReader(data))
+}
+
+// encodeFeed renders the feed as RSS or Atom
+func encodeFeed(cfg *settings.Settings, doc *feedDoc, format string) ([]byte, error) {
+	if format == FeedAtom {
+		return marshalXML(doc.atom(cfg.SiteName))
+	}
+	return marshalXML(doc.rss())
+}
+
+// PageFeed serves the feeds configured in website_settings.json:
+// /feeds/{name}.rss and /feeds/{name}.atom
+func PageFeed(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file := chi.URLParam(r, "feed")
+		dot := strings.LastIndex(file, ".")
+		if dot < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		name, format := file[:dot], file[dot+1:]
+		if _, ok := feedContentTypes[format]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		for _, f := range cfg.Feeds {
+			if f.Name != name {
+				continue
+			}
+			doc, err := pageFeed(db, cfg, f)
+			if err != nil {
+				http.Error(w, "Failed to build feed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeFeed(w, r, cfg, doc, format)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+// feedLinks returns the autodiscovery <link> tags for a page: its
+// collection's feeds when rendering a listing or post, and every configured
+// page feed whose parent is the page or one of its ancestors
+func (rd *renderer) feedLinks(page *Page) (string, error) {
+	var links []string
+	add := func(title string, urls map[string]string) {
+		for _, format := range []string{FeedRSS, FeedAtom} {
+			links = append(links, fmt.Sprintf(`<link rel="alternate" type="%s" title="%s" href="%s">`,
+				strings.SplitN(feedContentTypes[format], ";", 2)[0],
+				template.HTMLEscapeString(title), template.HTMLEscapeString(urls[format])))
+		}
+	}
+
+	if rd.current != nil {
+		add(rd.current.Title, collectionFeedURLs(rd.cfg, *rd.current))
+	}
+
+	if len(rd.cfg.Feeds) > 0 && page.ID > 0 {
+		ancestors, err := pageAncestorIDs(rd.db, page.ID)
+		if err != nil {
+			return "", err
+		}
+		for _, f := range rd.cfg.Feeds {
+			if f.ParentPage == page.ID || ancestors[f.ParentPage] {
+				add(f.Title, pageFeedURLs(rd.cfg, f))
+			}
+		}
+	}
+	return strings.Join(links, "\n"), nil
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"cms/mailer"
+	"cms/settings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Largest submission body accepted
+const maxSubmissionBytes = 64 << 10
+
+type Submission struct {
+	ID        int               `json:"id"`
+	Data      map[string]string `json:"data"`
+	IP        *string           `json:"ip"`
+	UserAgent *string           `json:"user_agent"`
+	CreatedAt string            `json:"created_at"`
+}
+
+// listSubmissions returns a form's submissions, newest first; limit <= 0
+// means no limit
+func listSubmissions(db *sql.DB, f Form, limit, offset int) ([]Submission, error) {
+	query := "SELECT id, data, ip, user_agent, created_at FROM form_submissions WHERE form_id = ? ORDER BY created_at DESC, id DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	}
+	rows, err := db.Query(query, f.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	submissions := []Submission{}
+	for rows.Next() {
+		var s Submission
+		var data string
+		if err := rows.Scan(&s.ID, &data, &s.IP, &s.UserAgent, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &s.Data); err != nil {
+			return nil, fmt.Errorf("submission %d has invalid data: %w", s.ID, err)
+		}
+		submissions = append(submissions, s)
+	}
+	return submissions, rows.Err()
+}
+
+// wantsJSON reports whether a submission came from script rather than a plain
+// HTML form post
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// submissionResponse answers a submission: JSON for scripts, otherwise a
+// redirect to the form's redirect_url or a plain text message
+func submissionResponse(w http.ResponseWriter, r *http.Request, f Form, status int, message string, errs map[string]string) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": message, "errors": errs})
+		return
+	}
+	if status == http.StatusOK && f.RedirectURL != nil && *f.RedirectURL != "" {
+		http.Redirect(w, r, *f.RedirectURL, http.StatusSeeOther)
+		return
+	}
+	if len(errs) > 0 {
+		for _, field := range f.Fields {
+			if msg, ok := errs[field.Name]; ok {
+				message += "\n" + msg
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
+
+// SubmitForm is the public endpoint forms post to. Submissions need the
+// visitor's CSRF token; ones that fill in the honeypot get the normal success
+// response but are dropped.
+func SubmitForm(db *sql.DB, cfg *settings.Settings, queue *mailer.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := formFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionBytes)
+		if err := r.ParseMultipartForm(maxSubmissionBytes); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, "Invalid form submission", http.StatusBadRequest)
+			return
+		}
+		if !validCSRF(r) {
+			submissionResponse(w, r, f, http.StatusForbidden, "Your session has expired, please reload the page and try again.", nil)
+			return
+		}
+		if r.PostForm.Get(honeypotField) != "" {
+			log.Printf("Dropped form %s submission from %s: honeypot filled in", f.Name, clientIP(r))
+			submissionResponse(w, r, f, http.StatusOK, f.SuccessMessage, nil)
+			return
+		}
+
+		data, errs := validateSubmission(f, r.PostForm)
+		if len(errs) > 0 {
+			submissionResponse(w, r, f, http.StatusBadRequest, "Please correct the following:", errs)
+			return
+		}
+
+		encoded, _ := json.Marshal(data)
+		result, err := db.Exec("INSERT INTO form_submissions (form_id, data, ip, user_agent) VALUES (?, ?, ?, ?)",
+			f.ID, string(encoded), clientIP(r), r.UserAgent())
+		if err != nil {
+			http.Error(w, "Failed to save submission", http.StatusInternalServerError)
+			return
+		}
+		id, _ := result.LastInsertId()
+
+		if f.NotifyEmail != nil && *f.NotifyEmail != "" {
+			if err := queue.Enqueue(notification(cfg, f, data, id)); err != nil {
+				log.Printf("Failed to queue notification for form %s submission %d: %v", f.Name, id, err)
+			}
+		}
+
+		submissionResponse(w, r, f, http.StatusOK, f.SuccessMessage, nil)
+	}
+}
+
+// notification is the email telling a form's recipients about a submission.
+// Replies go to the first email field so staff can answer directly.
+func notification(cfg *settings.Settings, f Form, data map[string]string, id int64) mailer.Message {
+	msg := mailer.Message{
+		From:    cfg.Mail.From,
+		Subject: fmt.Sprintf("New %s submission on %s", f.Title, cfg.SiteName),
+	}
+	if addrs, err := mail.ParseAddressList(*f.NotifyEmail); err == nil {
+		for _, addr := range addrs {
+			msg.To = append(msg.To, addr.String())
+		}
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "A new submission (#%d) was received through the %s form.\n\n", id, f.Title)
+	for _, field := range f.Fields {
+		value, ok := data[field.Name]
+		if !ok {
+			continue
+		}
+		if field.Type == FormFieldEmail && msg.ReplyTo == "" {
+			msg.ReplyTo = value
+		}
+		if field.Type == FieldTextarea {
+			fmt.Fprintf(&body, "%s:\n%s\n\n", field.label(), value)
+		} else {
+			fmt.Fprintf(&body, "%s: %s\n", field.label(), value)
+		}
+	}
+	msg.Body = body.String()
+	return msg
+}
+
+// clientIP is the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// GetSubmissions lists a form's submissions, newest first, 50 at a time by
+// default; ?limit= and ?offset= page through them
+func GetSubmissions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := formFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		limit, offset := 50, 0
+		if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+			limit = v
+		}
+		if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v > 0 {
+			offset = v
+		}
+
+		submissions, err := listSubmissions(db, f, limit, offset)
+		if err != nil {
+			http.Error(w, "Failed to retrieve submissions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(submissions)
+	}
+}
+
+// ExportSubmissions downloads every submission as CSV, one column per field
+func ExportSubmissions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := formFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		submissions, err := listSubmissions(db, f, 0, 0)
+		if err != nil {
+			http.Error(w, "Failed to retrieve submissions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-submissions.csv"`, f.Name))
+
+		out := csv.NewWriter(w)
+		header := []string{"id", "submitted_at", "ip"}
+		for _, field := range f.Fields {
+			header = append(header, field.label())
+		}
+		out.Write(header)
+		for _, s := range submissions {
+			ip := ""
+			if s.IP != nil {
+				ip = *s.IP
+			}
+			record := []string{strconv.Itoa(s.ID), s.CreatedAt, ip}
+			for _, field := range f.Fields {
+				record = append(record, csvCell(s.Data[field.Name]))
+			}
+			out.Write(record)
+		}
+		out.Flush()
+	}
+}
+
+// csvCell stops submitted values being run as formulas when the export is
+// opened in a spreadsheet
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func DeleteSubmission(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := formFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM form_submissions WHERE id = ? AND form_id = ?", chi.URLParam(r, "submissionID"), f.ID)
+		if err != nil {
+			http.Error(w, "Failed to delete submission", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Submission not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Submission deleted successfully"))
+	}
+}
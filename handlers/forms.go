@@ -0,0 +1,431 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Form field types on top of the content field types they share
+const (
+	FormFieldEmail    = "email"
+	FormFieldTel      = "tel"
+	FormFieldCheckbox = "checkbox"
+)
+
+var formFieldTypes = map[string]bool{
+	FieldText: true, FieldTextarea: true, FieldNumber: true, FieldDate: true, FieldURL: true, FieldSelect: true,
+	FormFieldEmail: true, FormFieldTel: true, FormFieldCheckbox: true,
+}
+
+// honeypotField is rendered hidden from people; bots that fill in every
+// input give themselves away by setting it
+const honeypotField = "website"
+
+type FormField struct {
+	Name        string   `json:"name"`
+	Label       string   `json:"label,omitempty"`
+	Type        string   `json:"type"`
+	Required    bool     `json:"required,omitempty"`
+	MaxLength   int      `json:"max_length,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Options     []string `json:"options,omitempty"`
+	Placeholder string   `json:"placeholder,omitempty"`
+}
+
+func (f FormField) label() string {
+	if f.Label != "" {
+		return f.Label
+	}
+	return f.Name
+}
+
+type Form struct {
+	ID             int         `json:"id"`
+	Name           string      `json:"name"`
+	Title          string      `json:"title"`
+	Fields         []FormField `json:"fields"`
+	SubmitLabel    string      `json:"submit_label"`
+	SuccessMessage string      `json:"success_message"`
+	RedirectURL    *string     `json:"redirect_url"`
+	// Comma-separated addresses told about each submission
+	NotifyEmail *string `json:"notify_email"`
+	CreatedAt   string  `json:"created_at"`
+}
+
+const formColumns = "id, name, title, fields, submit_label, success_message, redirect_url, notify_email, created_at"
+
+func scanForm(row interface{ Scan(...interface{}) error }) (Form, error) {
+	var f Form
+	var fields string
+	err := row.Scan(&f.ID, &f.Name, &f.Title, &fields, &f.SubmitLabel, &f.SuccessMessage, &f.RedirectURL, &f.NotifyEmail, &f.CreatedAt)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal([]byte(fields), &f.Fields); err != nil {
+		return f, fmt.Errorf("form %s has invalid fields: %w", f.Name, err)
+	}
+	return f, nil
+}
+
+func getForm(db *sql.DB, name string) (Form, error) {
+	return scanForm(db.QueryRow("SELECT "+formColumns+" FROM forms WHERE name = ?", name))
+}
+
+// formFor loads the form named in the URL, writing the error response and
+// returning false if it can't
+func formFor(db *sql.DB, w http.ResponseWriter, r *http.Request) (Form, bool) {
+	f, err := getForm(db, chi.URLParam(r, "formName"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Form not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve form: "+err.Error(), http.StatusInternalServerError)
+		}
+		return f, false
+	}
+	return f, true
+}
+
+// validateForm checks a form's settings and field definitions
+func validateForm(f Form) error {
+	if !contentName.MatchString(f.Name) {
+		return fmt.Errorf("form name must be lowercase letters, digits and underscores")
+	}
+	seen := map[string]bool{}
+	for _, field := range f.Fields {
+		if !contentName.MatchString(field.Name) {
+			return fmt.Errorf("field name %q must be lowercase letters, digits and underscores", field.Name)
+		}
+		if field.Name == honeypotField {
+			return fmt.Errorf("field name %q is reserved", field.Name)
+		}
+		if seen[field.Name] {
+			return fmt.Errorf("duplicate field %q", field.Name)
+		}
+		seen[field.Name] = true
+		if !formFieldTypes[field.Type] {
+			return fmt.Errorf("field %s has unknown type %q", field.Name, field.Type)
+		}
+		if field.Type == FieldSelect && len(field.Options) == 0 {
+			return fmt.Errorf("select field %s needs options", field.Name)
+		}
+		if field.Pattern != "" {
+			if _, err := regexp.Compile("^(?:" + field.Pattern + ")$"); err != nil {
+				return fmt.Errorf("field %s has an invalid pattern: %w", field.Name, err)
+			}
+		}
+	}
+	if f.RedirectURL != nil && *f.RedirectURL != "" {
+		if u, err := url.Parse(*f.RedirectURL); err != nil || (!u.IsAbs() && !strings.HasPrefix(*f.RedirectURL, "/")) {
+			return fmt.Errorf("redirect_url must be an absolute URL or a site path")
+		}
+	}
+	if f.NotifyEmail != nil && *f.NotifyEmail != "" {
+		if _, err := mail.ParseAddressList(*f.NotifyEmail); err != nil {
+			return fmt.Errorf("notify_email must be a comma-separated list of addresses: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateSubmission checks submitted values against the form's fields. It
+// returns the cleaned values and a message for each field that failed.
+func validateSubmission(f Form, values url.Values) (map[string]string, map[string]string) {
+	data := map[string]string{}
+	errs := map[string]string{}
+	for _, field := range f.Fields {
+		value := strings.TrimSpace(values.Get(field.Name))
+		if field.Type == FormFieldCheckbox {
+			if value != "" {
+				value = "yes"
+			}
+		}
+		if value == "" {
+			if field.Required {
+				errs[field.Name] = field.label() + " is required"
+			}
+			continue
+		}
+		if field.MaxLength > 0 && len([]rune(value)) > field.MaxLength {
+			errs[field.Name] = fmt.Sprintf("%s must be at most %d characters", field.label(), field.MaxLength)
+			continue
+		}
+
+		var problem string
+		switch field.Type {
+		case FormFieldEmail:
+			if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+				problem = "must be an email address"
+			}
+		case FieldURL:
+			if u, err := url.Parse(value); err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+				problem = "must be a web address"
+			}
+		case FieldNumber:
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				problem = "must be a number"
+			}
+		case FieldDate:
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				problem = "must be a date in YYYY-MM-DD format"
+			}
+		case FieldSelect:
+			valid := false
+			for _, opt := range field.Options {
+				valid = valid || opt == value
+			}
+			if !valid {
+				problem = "must be one of the listed options"
+			}
+		}
+		if problem == "" && field.Pattern != "" {
+			if !regexp.MustCompile("^(?:" + field.Pattern + ")$").MatchString(value) {
+				problem = "is not in the expected format"
+			}
+		}
+		if problem != "" {
+			errs[field.Name] = field.label() + " " + problem
+			continue
+		}
+		data[field.Name] = value
+	}
+	return data, errs
+}
+
+// formHTML renders a form for {{ form "name" }}. The CSRF token is left as a
+// placeholder for writeHTML to fill in per visitor.
+func formHTML(f Form) template.HTML {
+	esc := template.HTMLEscapeString
+	var b strings.Builder
+	fmt.Fprintf(&b, `<form class="cms-form" id="form-%s" method="post" action="/forms/%s/submit">`, f.Name, f.Name)
+	fmt.Fprintf(&b, `<input type="hidden" name="%s" value="%s">`, csrfField, csrfPlaceholder)
+	fmt.Fprintf(&b, `<div class="cms-form-hp" aria-hidden="true" style="position:absolute;left:-10000px">`+
+		`<label>Leave this empty <input type="text" name="%s" tabindex="-1" autocomplete="off"></label></div>`, honeypotField)
+
+	for _, field := range f.Fields {
+		id := f.Name + "-" + field.Name
+		attrs := fmt.Sprintf(` id="%s" name="%s"`, id, field.Name)
+		if field.Required {
+			attrs += " required"
+		}
+		if field.MaxLength > 0 && field.Type != FieldSelect && field.Type != FormFieldCheckbox {
+			attrs += fmt.Sprintf(` maxlength="%d"`, field.MaxLength)
+		}
+		if field.Pattern != "" {
+			attrs += fmt.Sprintf(` pattern="%s"`, esc(field.Pattern))
+		}
+		if field.Placeholder != "" {
+			attrs += fmt.Sprintf(` placeholder="%s"`, esc(field.Placeholder))
+		}
+
+		fmt.Fprintf(&b, `<div class="cms-form-field cms-form-%s">`, field.Type)
+		switch field.Type {
+		case FormFieldCheckbox:
+			fmt.Fprintf(&b, `<label><input type="checkbox" value="yes"%s> %s</label>`, attrs, esc(field.label()))
+		case FieldTextarea:
+			fmt.Fprintf(&b, `<label for="%s">%s</label><textarea%s></textarea>`, id, esc(field.label()), attrs)
+		case FieldSelect:
+			fmt.Fprintf(&b, `<label for="%s">%s</label><select%s><option value="">Choose…</option>`, id, esc(field.label()), attrs)
+			for _, opt := range field.Options {
+				fmt.Fprintf(&b, `<option>%s</option>`, esc(opt))
+			}
+			b.WriteString(`</select>`)
+		default:
+			fmt.Fprintf(&b, `<label for="%s">%s</label><input type="%s"%s>`, id, esc(field.label()), field.Type, attrs)
+		}
+		b.WriteString(`</div>`)
+	}
+
+	fmt.Fprintf(&b, `<button type="submit">%s</button></form>`, esc(f.SubmitLabel))
+	return template.HTML(b.String())
+}
+
+// formInput is the body of create and update requests; nil fields are left
+// unchanged on update
+type formInput struct {
+	Name           *string      `json:"name"`
+	Title          *string      `json:"title"`
+	Fields         *[]FormField `json:"fields"`
+	SubmitLabel    *string      `json:"submit_label"`
+	SuccessMessage *string      `json:"success_message"`
+	RedirectURL    *string      `json:"redirect_url"`
+	NotifyEmail    *string      `json:"notify_email"`
+}
+
+func (in formInput) apply(f *Form) {
+	if in.Name != nil {
+		f.Name = *in.Name
+	}
+	if in.Title != nil {
+		f.Title = *in.Title
+	}
+	if in.Fields != nil {
+		f.Fields = *in.Fields
+	}
+	if in.SubmitLabel != nil {
+		f.SubmitLabel = *in.SubmitLabel
+	}
+	if in.SuccessMessage != nil {
+		f.SuccessMessage = *in.SuccessMessage
+	}
+	if in.RedirectURL != nil {
+		f.RedirectURL = in.RedirectURL
+	}
+	if in.NotifyEmail != nil {
+		f.NotifyEmail = in.NotifyEmail
+	}
+}
+
+func GetForms(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT " + formColumns + " FROM forms ORDER BY name")
+		if err != nil {
+			http.Error(w, "Failed to retrieve forms", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		forms := []Form{}
+		for rows.Next() {
+			f, err := scanForm(rows)
+			if err != nil {
+				http.Error(w, "Failed to scan row: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			forms = append(forms, f)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(forms)
+	}
+}
+
+func GetForm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := formFor(db, w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+	}
+}
+
+func CreateForm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input formInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		f := Form{
+			Fields:         []FormField{},
+			SubmitLabel:    "Send",
+			SuccessMessage: "Thank you, your message has been sent.",
+		}
+		input.apply(&f)
+		if f.Title == "" {
+			f.Title = f.Name
+		}
+		if err := validateForm(f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fields, _ := json.Marshal(f.Fields)
+		_, err := db.Exec(`INSERT INTO forms (name, title, fields, submit_label, success_message, redirect_url, notify_email)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			f.Name, f.Title, string(fields), f.SubmitLabel, f.SuccessMessage, f.RedirectURL, f.NotifyEmail)
+		if err != nil {
+			http.Error(w, "Failed to create form: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		created, err := getForm(db, f.Name)
+		if err != nil {
+			http.Error(w, "Failed to load form", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// UpdateForm changes a form's settings or fields. Stored submissions keep the
+// values they were sent with.
+func UpdateForm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := formFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		var input formInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		input.apply(&f)
+		if err := validateForm(f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fields, _ := json.Marshal(f.Fields)
+		_, err := db.Exec(`UPDATE forms SET name = ?, title = ?, fields = ?, submit_label = ?, success_message = ?,
+			redirect_url = ?, notify_email = ? WHERE id = ?`,
+			f.Name, f.Title, string(fields), f.SubmitLabel, f.SuccessMessage, f.RedirectURL, f.NotifyEmail, f.ID)
+		if err != nil {
+			http.Error(w, "Failed to update form: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Form updated successfully"))
+	}
+}
+
+// DeleteForm removes a form along with its submissions
+func DeleteForm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := formFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to delete form", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM form_submissions WHERE form_id = ?", f.ID); err != nil {
+			http.Error(w, "Failed to delete submissions", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM forms WHERE id = ?", f.ID); err != nil {
+			http.Error(w, "Failed to delete form", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete form", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Form deleted successfully"))
+	}
+}
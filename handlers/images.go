@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/imaging"
+	"cms/settings"
+	"cms/storage"
+)
+
+// Public URL prefix resized image variants are served from, e.g.
+// /images/640/2024/05/1a2b3c4d5e6f-photo.jpg
+const imageVariantsPath = "/images/"
+
+// Variants are immutable because the storage key embeds the file checksum
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// Storage key prefix variants are kept under, one directory per width
+const variantsDir = "variants"
+
+func variantKey(m Media, width int) string {
+	return path.Join(variantsDir, strconv.Itoa(width), m.StorageKey)
+}
+
+func variantURL(m Media, width int) string {
+	return imageVariantsPath + strconv.Itoa(width) + "/" + m.StorageKey
+}
+
+// variantLocks stops two requests from resizing the same image at the same time
+var variantLocks = struct {
+	sync.Mutex
+	keys map[string]*sync.Mutex
+}{keys: map[string]*sync.Mutex{}}
+
+func lockVariant(key string) func() {
+	variantLocks.Lock()
+	mu, ok := variantLocks.keys[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		variantLocks.keys[key] = mu
+	}
+	variantLocks.Unlock()
+
+	mu.Lock()
+	return func() {
+		mu.Unlock()
+		variantLocks.Lock()
+		delete(variantLocks.keys, key)
+		variantLocks.Unlock()
+	}
+}
+
+// ensureVariant generates and stores the resized copy of m if it isn't cached yet
+func ensureVariant(store storage.Storage, m Media, width, quality int) (string, error) {
+	key := variantKey(m, width)
+	if store.Exists(key) {
+		return key, nil
+	}
+	if m.Width != nil && m.Height != nil && !imaging.Fits(*m.Width, *m.Height) {
+		return "", imaging.ErrTooLarge
+	}
+
+	unlock := lockVariant(key)
+	defer unlock()
+	if store.Exists(key) {
+		return key, nil
+	}
+
+	f, err := store.Open(m.StorageKey)
+	if err != nil {
+		return "", err
+	}
+	src, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	v, err := imaging.Resize(src, m.MimeType, width, quality)
+	if err != nil {
+		return "", err
+	}
+	if _, err := store.Save(key, bytes.NewReader(v.Data)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// variantWidths returns the configured widths smaller than the original image,
+// smallest first. Larger presets would only upscale, and images too large to
+// resize have none.
+func variantWidths(m Media, cfg settings.Media) []int {
+	if !imaging.CanResize(m.MimeType) || m.Width == nil {
+		return nil
+	}
+	if m.Height != nil && !imaging.Fits(*m.Width, *m.Height) {
+		return nil
+	}
+	var widths []int
+	for _, w := range cfg.ImageWidths {
+		if w > 0 && w < *m.Width {
+			widths = append(widths, w)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+// generateVariants builds every configured width for a freshly uploaded image
+func generateVariants(store storage.Storage, m Media, cfg settings.Media) error {
+	for _, w := range variantWidths(m, cfg) {
+		if _, err := ensureVariant(store, m, w, cfg.JPEGQuality); err != nil {
+			return fmt.Errorf("generating %dpx variant: %w", w, err)
+		}
+	}
+	return nil
+}
+
+// deleteVariants removes any cached variants of m, including widths that have
+// since been dropped from the settings
+func deleteVariants(store storage.Storage, m Media) {
+	widths, _ := store.List(variantsDir)
+	for _, name := range widths {
+		if w, err := strconv.Atoi(name); err == nil {
+			store.Delete(variantKey(m, w))
+		}
+	}
+}
+
+// srcset lists every variant of m plus the original at its full width
+func srcset(m Media, cfg settings.Media) template.Srcset {
+	var parts []string
+	for _, w := range variantWidths(m, cfg) {
+		parts = append(parts, fmt.Sprintf("%s %dw", variantURL(m, w), w))
+	}
+	if m.Width != nil {
+		parts = append(parts, fmt.Sprintf("%s %dw", m.URL, *m.Width))
+	}
+	return template.Srcset(strings.Join(parts, ", "))
+}
+
+// ServeImageVariant serves a resized copy of an uploaded image, generating it on
+// first request. Only widths listed in the settings are accepted.
+func ServeImageVariant(db *sql.DB, store storage.Storage, cfg settings.Media) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		width, err := strconv.Atoi(chi.URLParam(r, "width"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		allowed := false
+		for _, preset := range cfg.ImageWidths {
+			if preset == width {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			http.Error(w, "Unsupported image width", http.StatusNotFound)
+			return
+		}
+
+		m, err := scanMedia(db.QueryRow("SELECT "+mediaColumns+" FROM media WHERE storage_key = ?", chi.URLParam(r, "*")))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, "Failed to retrieve media", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Nothing to resize (it's already small enough, or too large to
+		// decode): send the original
+		key, contentType := m.StorageKey, m.MimeType
+		if imaging.CanResize(m.MimeType) && (m.Width == nil || width < *m.Width) {
+			variant, err := ensureVariant(store, m, width, cfg.JPEGQuality)
+			if err == nil {
+				key, contentType = variant, imaging.OutputType(m.MimeType)
+			} else if !errors.Is(err, imaging.ErrTooLarge) {
+				http.Error(w, "Failed to resize image: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		f, err := store.Open(key)
+		if err != nil {
+			http.Error(w, "Failed to open image", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", immutableCacheControl)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, path.Base(key), time.Time{}, f)
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"cms/markdown"
+)
+
+// markdownCache renders a block's source for the rendered, rendered_hash and
+// metadata columns kept alongside it. Blocks of other types cache nothing, so
+// all three are NULL for them.
+func markdownCache(blockType, content string) (rendered, hash, metadata interface{}, err error) {
+	if blockType != CodeBlockMarkdown {
+		return nil, nil, nil, nil
+	}
+	res, err := markdown.Render(content)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	meta, err := json.Marshal(res.Meta)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return res.HTML, markdown.Hash(content), string(meta), nil
+}
+
+// decodeMetadata reads a block's metadata column
+func decodeMetadata(raw sql.NullString) map[string]string {
+	var meta map[string]string
+	if raw.Valid {
+		json.Unmarshal([]byte(raw.String), &meta)
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// markdownHTML returns a Markdown block's HTML, from the cache when it was
+// made from this content, otherwise rendering it and refreshing the cache.
+// Copies of shared blocks, imported blocks and translations can have their
+// source change without going through the code block handlers, so the cache
+// is checked on every render.
+func markdownHTML(db *sql.DB, blockID int, locale string, content string, cached, cachedHash sql.NullString) (string, error) {
+	hash := markdown.Hash(content)
+	if cached.Valid && cachedHash.String == hash {
+		return cached.String, nil
+	}
+
+	res, err := markdown.Render(content)
+	if err != nil {
+		return "", err
+	}
+	if locale != "" {
+		_, err = db.Exec("UPDATE code_block_translations SET rendered = ?, rendered_hash = ? WHERE codeblock_id = ? AND locale = ?",
+			res.HTML, hash, blockID, locale)
+	} else {
+		meta, _ := json.Marshal(res.Meta)
+		_, err = db.Exec("UPDATE code_blocks SET rendered = ?, rendered_hash = ?, metadata = ? WHERE id = ?",
+			res.HTML, hash, string(meta), blockID)
+	}
+	return res.HTML, err
+}
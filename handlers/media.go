@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/imaging"
+	"cms/settings"
+	"cms/storage"
+)
+
+// Public URL prefix media files are served from
+const mediaFilesPath = "/uploads/"
+
+type Media struct {
+	ID         int     `json:"id"`
+	Filename   string  `json:"filename"`
+	StorageKey string  `json:"storage_key"`
+	MimeType   string  `json:"mime_type"`
+	Size       int64   `json:"size"`
+	Width      *int    `json:"width,omitempty"`
+	Height     *int    `json:"height,omitempty"`
+	AltText    *string `json:"alt_text,omitempty"`
+	Checksum   string  `json:"checksum"`
+	CreatedAt  string  `json:"created_at"`
+	URL        string  `json:"url"`
+}
+
+// Types that may be uploaded. HTML and scripts are left out on purpose since
+// the files are served from the site's own origin. SVGs can carry scripts
+// too, so ServeMediaFile serves them sandboxed.
+var allowedMediaTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/svg+xml":   true,
+	"application/pdf": true,
+	"video/mp4":       true,
+	"audio/mpeg":      true,
+	"text/plain":      true,
+	"text/csv":        true,
+}
+
+const mediaColumns = "id, filename, storage_key, mime_type, size, width, height, alt_text, checksum, created_at"
+
+func scanMedia(row interface{ Scan(...interface{}) error }) (Media, error) {
+	var m Media
+	err := row.Scan(
+		&m.ID,
+		&m.Filename,
+		&m.StorageKey,
+		&m.MimeType,
+		&m.Size,
+		&m.Width,
+		&m.Height,
+		&m.AltText,
+		&m.Checksum,
+		&m.CreatedAt,
+	)
+	m.URL = mediaFilesPath + m.StorageKey
+	return m, err
+}
+
+func getMedia(db *sql.DB, id interface{}) (Media, error) {
+	return scanMedia(db.QueryRow("SELECT "+mediaColumns+" FROM media WHERE id = ?", id))
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// mediaStorageKey builds a key like "2024/05/1a2b3c4d5e6f-my-photo.jpg"
+func mediaStorageKey(filename, checksum string, now time.Time) string {
+	name := strings.ToLower(filepath.Base(filename))
+	name = strings.Trim(unsafeFilenameChars.ReplaceAllString(name, "-"), "-.")
+	if name == "" {
+		name = "file"
+	}
+	return path.Join(now.Format("2006"), now.Format("01"), checksum[:12]+"-"+name)
+}
+
+// detectMediaType sniffs the content, falling back to the file extension for
+// types the sniffer doesn't know about (svg, csv)
+func detectMediaType(head []byte, filename string) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if sniffed != "application/octet-stream" && sniffed != "text/plain" && sniffed != "text/xml" {
+		return sniffed
+	}
+	if byExt, _, err := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))); err == nil && byExt != "" {
+		return byExt
+	}
+	return sniffed
+}
+
+func UploadMedia(db *sql.DB, store storage.Storage, cfg settings.Media) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxBytes := cfg.MaxUploadSizeMB << 20
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1<<20)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "A file field is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		if header.Size > maxBytes {
+			http.Error(w, fmt.Sprintf("File is larger than %d MB", cfg.MaxUploadSizeMB), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, "Failed to read upload", http.StatusBadRequest)
+			return
+		}
+
+		mimeType := detectMediaType(data, header.Filename)
+		if !allowedMediaTypes[mimeType] {
+			http.Error(w, "Unsupported file type: "+mimeType, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		sum := sha256.Sum256(data)
+		checksum := hex.EncodeToString(sum[:])
+
+		// The same file uploaded twice points at the existing record
+		existing, err := scanMedia(db.QueryRow("SELECT "+mediaColumns+" FROM media WHERE checksum = ?", checksum))
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(existing)
+			return
+		} else if err != sql.ErrNoRows {
+			http.Error(w, "Failed to check for duplicates", http.StatusInternalServerError)
+			return
+		}
+
+		var width, height *int
+		if strings.HasPrefix(mimeType, "image/") {
+			if wd, ht, err := imaging.Dimensions(bytes.NewReader(data), mimeType); err == nil {
+				width, height = &wd, &ht
+			}
+		}
+
+		var altText *string
+		if alt := r.FormValue("alt_text"); alt != "" {
+			altText = &alt
+		}
+
+		key := mediaStorageKey(header.Filename, checksum, time.Now())
+		size, err := store.Save(key, bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, "Failed to store file", http.StatusInternalServerError)
+			return
+		}
+
+		m, duplicate, err := insertMedia(db, store, Media{
+			Filename:   header.Filename,
+			StorageKey: key,
+			MimeType:   mimeType,
+			Size:       size,
+			Width:      width,
+			Height:     height,
+			AltText:    altText,
+			Checksum:   checksum,
+		})
+		if err != nil {
+			http.Error(w, "Failed to save media record: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if duplicate {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(m)
+			return
+		}
+
+		if cfg.ResizeOnUpload {
+			if err := generateVariants(store, m, cfg); err != nil {
+				http.Error(w, "Media saved but resizing failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(m)
+	}
+}
+
+// insertMedia stores the record of a file already saved under m.StorageKey
+// and returns it as saved. When a concurrent upload of the same file got its
+// record in first, that one is returned with existing set and the copy just
+// saved is deleted.
+func insertMedia(db *sql.DB, store storage.Storage, m Media) (Media, bool, error) {
+	result, err := db.Exec(`
+		INSERT INTO media (filename, storage_key, mime_type, size, width, height, alt_text, checksum)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Filename, m.StorageKey, m.MimeType, m.Size, m.Width, m.Height, m.AltText, m.Checksum,
+	)
+	if err != nil {
+		existing, lerr := scanMedia(db.QueryRow("SELECT "+mediaColumns+" FROM media WHERE checksum = ?", m.Checksum))
+		if lerr != nil {
+			store.Delete(m.StorageKey)
+			return Media{}, false, err
+		}
+		if existing.StorageKey != m.StorageKey {
+			store.Delete(m.StorageKey)
+		}
+		return existing, true, nil
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Media{}, false, err
+	}
+	saved, err := getMedia(db, id)
+	return saved, false, err
+}
+
+// GetMediaList lists media, newest first. ?q= searches filenames and alt text,
+// ?type= filters by MIME type or prefix ("image", "application/pdf").
+func GetMediaList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := "SELECT " + mediaColumns + " FROM media WHERE 1 = 1"
+		params := []interface{}{}
+
+		if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+			query += " AND (filename LIKE ? OR alt_text LIKE ?)"
+			params = append(params, "%"+q+"%", "%"+q+"%")
+		}
+		if t := r.URL.Query().Get("type"); t != "" {
+			if strings.Contains(t, "/") {
+				query += " AND mime_type = ?"
+				params = append(params, t)
+			} else {
+				query += " AND mime_type LIKE ?"
+				params = append(params, t+"/%")
+			}
+		}
+		query += " ORDER BY id DESC"
+
+		rows, err := db.Query(query, params...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve media", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		media := []Media{}
+		for rows.Next() {
+			m, err := scanMedia(rows)
+			if err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			media = append(media, m)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(media)
+	}
+}
+
+func GetMedia(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, err := getMedia(db, chi.URLParam(r, "mediaID"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Media not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve media", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	}
+}
+
+func UpdateMedia(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaID := chi.URLParam(r, "mediaID")
+		var input struct {
+			AltText *string `json:"alt_text"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.AltText == nil {
+			http.Error(w, "No fields to update", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("UPDATE media SET alt_text = ? WHERE id = ?", *input.AltText, mediaID)
+		if err != nil {
+			http.Error(w, "Failed to update media", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Media updated successfully"))
+	}
+}
+
+func DeleteMedia(db *sql.DB, store storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, err := getMedia(db, chi.URLParam(r, "mediaID"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Media not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve media", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM media WHERE id = ?", m.ID); err != nil {
+			http.Error(w, "Failed to delete media", http.StatusInternalServerError)
+			return
+		}
+		deleteVariants(store, m)
+		if err := store.Delete(m.StorageKey); err != nil {
+			http.Error(w, "Media record deleted but the file could not be removed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Media deleted successfully"))
+	}
+}
+
+// ServeMediaFile serves uploaded files from storage under mediaFilesPath
+func ServeMediaFile(store storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "*")
+
+		f, err := store.Open(key)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, "Failed to open file", http.StatusInternalServerError)
+			}
+			return
+		}
+		defer f.Close()
+
+		// Keys embed the checksum so a given URL never changes content
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		// Scripts in an SVG opened directly would run on the site's origin;
+		// <img> tags showing it are unaffected
+		if strings.HasPrefix(mime.TypeByExtension(strings.ToLower(path.Ext(key))), "image/svg+xml") {
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		http.ServeContent(w, r, path.Base(key), time.Time{}, f)
+	}
+}
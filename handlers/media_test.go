@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"cms/settings"
+	"cms/storage"
+)
+
+// upload posts one file to the upload handler and decodes the record it
+// answers with
+func upload(t *testing.T, h http.HandlerFunc, filename, content string) (int, Media) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/media/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	var m Media
+	if w.Code == http.StatusOK || w.Code == http.StatusCreated {
+		if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		t.Fatalf("upload %s: %d %s", filename, w.Code, w.Body)
+	}
+	return w.Code, m
+}
+
+func countMedia(t *testing.T, database *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := database.QueryRow("SELECT COUNT(*) FROM media").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestUploadMediaDeduplicates(t *testing.T) {
+	database := openTestDB(t)
+	store, err := storage.NewLocal(filepath.Join(t.TempDir(), "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := UploadMedia(database, store, settings.Media{MaxUploadSizeMB: 1})
+
+	code, first := upload(t, h, "notes.txt", "hello")
+	if code != http.StatusCreated {
+		t.Errorf("first upload answered %d, want 201", code)
+	}
+	code, again := upload(t, h, "copy.txt", "hello")
+	if code != http.StatusOK || again.ID != first.ID {
+		t.Errorf("second upload answered %d with ID %d, want 200 with ID %d", code, again.ID, first.ID)
+	}
+	if n := countMedia(t, database); n != 1 {
+		t.Errorf("%d media rows, want 1", n)
+	}
+
+	// The checksum is unique, so a second row for the file can't be stored
+	// even when the duplicate check has already passed
+	if _, err := database.Exec(`INSERT INTO media (filename, storage_key, mime_type, size, checksum)
+		VALUES ('b.txt', 'b.txt', 'text/plain', 5, ?)`, first.Checksum); err == nil {
+		t.Error("a second row with the same checksum was stored")
+	}
+}
+
+func TestInsertMediaRace(t *testing.T) {
+	database := openTestDB(t)
+	store, err := storage.NewLocal(filepath.Join(t.TempDir(), "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A concurrent upload of the same file stored its record between this
+	// upload's duplicate check and its insert
+	mustExec(t, database, `INSERT INTO media (filename, storage_key, mime_type, size, checksum)
+		VALUES ('theirs.txt', 'theirs.txt', 'text/plain', 5, 'abc')`)
+	for _, key := range []string{"theirs.txt", "mine.txt"} {
+		if _, err := store.Save(key, bytes.NewReader([]byte("hello"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, duplicate, err := insertMedia(database, store, Media{
+		Filename: "mine.txt", StorageKey: "mine.txt", MimeType: "text/plain", Size: 5, Checksum: "abc",
+	})
+	if err != nil || !duplicate || m.Filename != "theirs.txt" {
+		t.Errorf("insertMedia = %+v, %v, %v, want the concurrent upload's record", m, duplicate, err)
+	}
+	if n := countMedia(t, database); n != 1 {
+		t.Errorf("%d media rows, want 1", n)
+	}
+	if !store.Exists("theirs.txt") || store.Exists("mine.txt") {
+		t.Error("want the concurrent upload's file kept and the copy deleted")
+	}
+
+	// Both uploads may have saved the file under the same key, which the
+	// kept record still needs
+	m, duplicate, err = insertMedia(database, store, Media{
+		Filename: "theirs.txt", StorageKey: "theirs.txt", MimeType: "text/plain", Size: 5, Checksum: "abc",
+	})
+	if err != nil || !duplicate || m.StorageKey != "theirs.txt" || !store.Exists("theirs.txt") {
+		t.Errorf("insertMedia with the same key = %+v, %v, %v, and the file was deleted", m, duplicate, err)
+	}
+
+	// Other failures still clean up the saved file
+	if _, err := store.Save("bad.txt", bytes.NewReader([]byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	closed := openTestDB(t)
+	closed.Close()
+	if _, _, err := insertMedia(closed, store, Media{Filename: "bad.txt", StorageKey: "bad.txt", MimeType: "text/plain", Checksum: "def"}); err == nil {
+		t.Error("insertMedia into a closed database succeeded")
+	}
+	if store.Exists("bad.txt") {
+		t.Error("the file of a failed insert was kept")
+	}
+}
@@ -0,0 +1,482 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The menu name that falls back to the page tree when no curated menu uses it
+const pageTreeMenuName = "main"
+
+type Menu struct {
+	ID    int         `json:"id"`
+	Name  string      `json:"name"`
+	Title *string     `json:"title,omitempty"`
+	Items []*MenuItem `json:"items,omitempty"`
+}
+
+type MenuItem struct {
+	ID       int         `json:"id,omitempty"`
+	Label    string      `json:"label"`
+	URL      string      `json:"url"`
+	PageID   *int        `json:"page_id,omitempty"`
+	NewTab   bool        `json:"new_tab"`
+	Current  bool        `json:"current,omitempty"`
+	Ancestor bool        `json:"ancestor,omitempty"`
+	Children []*MenuItem `json:"children,omitempty"`
+}
+
+// pageLink returns where a page's menu entry should point: its external link
+// if it has one, otherwise its own URL
+func pageLink(url string, link *string, linkNewTab *int) (string, bool) {
+	if link != nil && *link != "" {
+		return *link, linkNewTab != nil && *linkNewTab == 1
+	}
+	return url, false
+}
+
+// pageTreeMenu builds a menu from every active, non-hidden page nested by
+// parent_page. Children of hidden or inactive pages are left out with them.
+func pageTreeMenu(db *sql.DB) ([]*MenuItem, error) {
+	rows, err := db.Query(`
+		SELECT id, title, url, link, link_new_tab, parent_page
+		FROM pages
+		WHERE active = 1 AND hidden != 1
+		ORDER BY parent_page, sort_order, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := map[int]*MenuItem{}
+	parents := map[int]int{}
+	var order []int
+	for rows.Next() {
+		var id, parent int
+		var title, url string
+		var link *string
+		var linkNewTab *int
+		if err := rows.Scan(&id, &title, &url, &link, &linkNewTab, &parent); err != nil {
+			return nil, err
+		}
+
+		pageID := id
+		href, newTab := pageLink(url, link, linkNewTab)
+		items[id] = &MenuItem{Label: title, URL: href, PageID: &pageID, NewTab: newTab}
+		parents[id] = parent
+		order = append(order, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var roots []*MenuItem
+	for _, id := range order {
+		parent := parents[id]
+		if parent <= 0 {
+			roots = append(roots, items[id])
+		} else if p, ok := items[parent]; ok {
+			p.Children = append(p.Children, items[id])
+		}
+	}
+	return roots, nil
+}
+
+// curatedMenu loads a named menu's items as a tree. ok is false when no menu
+// has that name.
+func curatedMenu(db *sql.DB, name string) (items []*MenuItem, ok bool, err error) {
+	var menuID int
+	err = db.QueryRow("SELECT id FROM menus WHERE name = ?", name).Scan(&menuID)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	// Items linked to a page follow its title and URL, and disappear with it
+	rows, err := db.Query(`
+		SELECT mi.id, mi.parent_id, mi.label, mi.page_id, mi.url, mi.new_tab,
+			p.title, p.url, p.link, p.link_new_tab, IFNULL(p.active, 0)
+		FROM menu_items mi
+		LEFT JOIN pages p ON p.id = mi.page_id
+		WHERE mi.menu_id = ?
+		ORDER BY mi.parent_id, mi.ordering, mi.id`, menuID)
+	if err != nil {
+		return nil, true, err
+	}
+	defer rows.Close()
+
+	byID := map[int]*MenuItem{}
+	parents := map[int]int{}
+	var order []int
+	for rows.Next() {
+		var item MenuItem
+		var parent, newTab, pageActive int
+		var url, pageTitle, pageURL, pageLinkURL *string
+		var pageLinkNewTab *int
+		if err := rows.Scan(&item.ID, &parent, &item.Label, &item.PageID, &url, &newTab,
+			&pageTitle, &pageURL, &pageLinkURL, &pageLinkNewTab, &pageActive); err != nil {
+			return nil, true, err
+		}
+
+		item.NewTab = newTab == 1
+		if url != nil {
+			item.URL = *url
+		}
+		if item.PageID != nil {
+			if pageURL == nil || pageActive != 1 {
+				continue
+			}
+			href, pageNewTab := pageLink(*pageURL, pageLinkURL, pageLinkNewTab)
+			item.URL = href
+			item.NewTab = item.NewTab || pageNewTab
+			if item.Label == "" && pageTitle != nil {
+				item.Label = *pageTitle
+			}
+		}
+
+		byID[item.ID] = &item
+		parents[item.ID] = parent
+		order = append(order, item.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, true, err
+	}
+
+	for _, id := range order {
+		parent := parents[id]
+		if parent <= 0 {
+			items = append(items, byID[id])
+		} else if p, ok := byID[parent]; ok {
+			p.Children = append(p.Children, byID[id])
+		}
+	}
+	return items, true, nil
+}
+
+// loadMenu returns the curated menu called name, or the page tree for "main"
+func loadMenu(db *sql.DB, name string) ([]*MenuItem, error) {
+	items, ok, err := curatedMenu(db, name)
+	if err != nil || ok {
+		return items, err
+	}
+	if name == pageTreeMenuName {
+		return pageTreeMenu(db)
+	}
+	return nil, fmt.Errorf("menu %q not found", name)
+}
+
+// markCurrent flags the item for the current page and the items above it.
+// Items without a page match on URL.
+func markCurrent(items []*MenuItem, current *Page, ancestors map[int]bool) bool {
+	found := false
+	for _, item := range items {
+		if item.PageID != nil {
+			item.Current = *item.PageID == current.ID
+			item.Ancestor = ancestors[*item.PageID]
+		} else {
+			item.Current = item.URL == current.Url
+		}
+		if markCurrent(item.Children, current, ancestors) {
+			item.Ancestor = true
+		}
+		if item.Current || item.Ancestor {
+			found = true
+		}
+	}
+	return found
+}
+
+// trimDepth drops items nested deeper than depth levels (depth <= 0 keeps all)
+func trimDepth(items []*MenuItem, depth int) {
+	if depth <= 0 {
+		return
+	}
+	for _, item := range items {
+		if depth == 1 {
+			item.Children = nil
+		} else {
+			trimDepth(item.Children, depth-1)
+		}
+	}
+}
+
+// menuHTML renders a menu as nested lists inside a <nav>
+func menuHTML(name string, items []*MenuItem) template.HTML {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<nav class="menu menu-%s">`, template.HTMLEscapeString(name))
+	writeMenuList(&b, items)
+	b.WriteString("</nav>")
+	return template.HTML(b.String())
+}
+
+func writeMenuList(b *strings.Builder, items []*MenuItem) {
+	if len(items) == 0 {
+		return
+	}
+	b.WriteString("<ul>")
+	for _, item := range items {
+		var classes []string
+		if item.Current {
+			classes = append(classes, "current")
+		}
+		if item.Ancestor {
+			classes = append(classes, "ancestor")
+		}
+		if len(item.Children) > 0 {
+			classes = append(classes, "has-children")
+		}
+
+		b.WriteString("<li")
+		if len(classes) > 0 {
+			fmt.Fprintf(b, ` class="%s"`, strings.Join(classes, " "))
+		}
+		fmt.Fprintf(b, `><a href="%s"`, template.HTMLEscapeString(item.URL))
+		if item.Current {
+			b.WriteString(` aria-current="page"`)
+		}
+		if item.NewTab {
+			b.WriteString(` target="_blank" rel="noopener noreferrer"`)
+		}
+		fmt.Fprintf(b, ">%s</a>", template.HTMLEscapeString(item.Label))
+		writeMenuList(b, item.Children)
+		b.WriteString("</li>")
+	}
+	b.WriteString("</ul>")
+}
+
+// renderMenu backs the {{ menu "main" }} template function. An optional
+// second argument limits the depth.
+func (rd *renderer) renderMenu(page *Page, name string, depth ...int) (template.HTML, error) {
+	items, err := loadMenu(rd.db, name)
+	if err != nil {
+		return "", err
+	}
+	if page != nil {
+		ancestors, err := pageAncestorIDs(rd.db, page.ID)
+		if err != nil {
+			return "", err
+		}
+		markCurrent(items, page, ancestors)
+	}
+	if len(depth) > 0 {
+		trimDepth(items, depth[0])
+	}
+	return menuHTML(name, items), nil
+}
+
+func GetMenus(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT id, name, title FROM menus ORDER BY name")
+		if err != nil {
+			http.Error(w, "Failed to retrieve menus", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		menus := []Menu{}
+		for rows.Next() {
+			var m Menu
+			if err := rows.Scan(&m.ID, &m.Name, &m.Title); err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			menus = append(menus, m)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(menus)
+	}
+}
+
+// GetMenu returns a menu as a tree. ?depth= limits nesting and ?page_id= marks
+// the current page and its ancestors.
+func GetMenu(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		items, err := loadMenu(db, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if pageID, err := strconv.Atoi(r.URL.Query().Get("page_id")); err == nil {
+			page, err := getPage(db, pageID)
+			if err != nil {
+				http.Error(w, "Page not found", http.StatusNotFound)
+				return
+			}
+			ancestors, err := pageAncestorIDs(db, pageID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			markCurrent(items, &page, ancestors)
+		}
+		if depth, err := strconv.Atoi(r.URL.Query().Get("depth")); err == nil {
+			trimDepth(items, depth)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Menu{Name: name, Items: items})
+	}
+}
+
+func CreateMenu(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Name  string  `json:"name"`
+			Title *string `json:"title"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Name == "" {
+			http.Error(w, "Menu name is required", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO menus (name, title) VALUES (?, ?)", input.Name, input.Title)
+		if err != nil {
+			http.Error(w, "Failed to create menu: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve new menu ID", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(Menu{ID: int(id), Name: input.Name, Title: input.Title})
+	}
+}
+
+type menuItemInput struct {
+	Label    string          `json:"label"`
+	PageID   *int            `json:"page_id"`
+	URL      *string         `json:"url"`
+	NewTab   bool            `json:"new_tab"`
+	Children []menuItemInput `json:"children"`
+}
+
+// insertMenuItems saves a level of the submitted tree and recurses into children
+func insertMenuItems(tx *sql.Tx, menuID, parentID int, items []menuItemInput) error {
+	for i, item := range items {
+		if item.PageID == nil && (item.URL == nil || *item.URL == "") {
+			return fmt.Errorf("menu item %q needs a page_id or a url", item.Label)
+		}
+		if item.PageID == nil && item.Label == "" {
+			return fmt.Errorf("menu items linking to a url need a label")
+		}
+
+		newTab := 0
+		if item.NewTab {
+			newTab = 1
+		}
+		result, err := tx.Exec(`
+			INSERT INTO menu_items (menu_id, parent_id, label, page_id, url, new_tab, ordering)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			menuID, parentID, item.Label, item.PageID, item.URL, newTab, i,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if err := insertMenuItems(tx, menuID, int(id), item.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateMenuItems replaces every item in a menu with the nested list in the body
+func UpdateMenuItems(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var menuID int
+		err := db.QueryRow("SELECT id FROM menus WHERE name = ?", chi.URLParam(r, "name")).Scan(&menuID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Menu not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve menu", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var items []menuItemInput
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM menu_items WHERE menu_id = ?", menuID); err != nil {
+			http.Error(w, "Failed to clear menu items", http.StatusInternalServerError)
+			return
+		}
+		if err := insertMenuItems(tx, menuID, -1, items); err != nil {
+			http.Error(w, "Failed to save menu items: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to save menu items", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Menu updated successfully"))
+	}
+}
+
+func DeleteMenu(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM menu_items WHERE menu_id IN (SELECT id FROM menus WHERE name = ?)", name); err != nil {
+			http.Error(w, "Failed to delete menu items", http.StatusInternalServerError)
+			return
+		}
+		result, err := tx.Exec("DELETE FROM menus WHERE name = ?", name)
+		if err != nil {
+			http.Error(w, "Failed to delete menu", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Menu not found", http.StatusNotFound)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete menu", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Menu deleted successfully"))
+	}
+}
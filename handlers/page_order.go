@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// pageParents maps every page ID to its parent_page. Callers that go on to
+// move pages read it through their transaction, so the tree they check is
+// the one they write to.
+func pageParents(tx *sql.Tx) (map[int]int, error) {
+	rows, err := tx.Query("SELECT id, parent_page FROM pages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parents := map[int]int{}
+	for rows.Next() {
+		var id, parent int
+		if err := rows.Scan(&id, &parent); err != nil {
+			return nil, err
+		}
+		parents[id] = parent
+	}
+	return parents, rows.Err()
+}
+
+// checkPageTree makes sure pageID's parent exists and that walking up from it
+// never comes back around, i.e. the page isn't its own ancestor
+func checkPageTree(parents map[int]int, pageID int) error {
+	parent := parents[pageID]
+	if parent > 0 {
+		if _, ok := parents[parent]; !ok {
+			return fmt.Errorf("parent page %d does not exist", parent)
+		}
+	}
+
+	seen := map[int]bool{pageID: true}
+	for id := parent; id > 0; id = parents[id] {
+		if seen[id] {
+			return fmt.Errorf("page %d cannot be moved under its own descendant", pageID)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+type pageOrderNode struct {
+	ID       int             `json:"id"`
+	Children []pageOrderNode `json:"children"`
+}
+
+// flattenPageOrder walks the submitted tree recording each page's new parent
+// and position among its siblings
+func flattenPageOrder(nodes []pageOrderNode, parent int, parents, order map[int]int) error {
+	for i, node := range nodes {
+		if _, dup := order[node.ID]; dup {
+			return fmt.Errorf("page %d appears more than once", node.ID)
+		}
+		if _, ok := parents[node.ID]; !ok {
+			return fmt.Errorf("page %d does not exist", node.ID)
+		}
+		parents[node.ID] = parent
+		order[node.ID] = i
+		if err := flattenPageOrder(node.Children, node.ID, parents, order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReorderPages takes a nested tree of page IDs, as produced by a drag-and-drop
+// tree, and saves every page's parent and sort order in one transaction. The
+// tree goes under ?parent_page= (the root by default); pages left out of it
+// keep their current place.
+func ReorderPages(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		root := -1
+		if p := r.URL.Query().Get("parent_page"); p != "" {
+			var err error
+			if root, err = strconv.Atoi(p); err != nil {
+				http.Error(w, "Invalid parent_page", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var tree []pageOrderNode
+		if err := json.NewDecoder(r.Body).Decode(&tree); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		parents, err := pageParents(tx)
+		if err != nil {
+			http.Error(w, "Failed to load page tree", http.StatusInternalServerError)
+			return
+		}
+		if _, ok := parents[root]; root > 0 && !ok {
+			http.Error(w, "Parent page not found", http.StatusNotFound)
+			return
+		}
+
+		order := map[int]int{}
+		if err := flattenPageOrder(tree, root, parents, order); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The payload can't loop on its own, but combined with pages it leaves
+		// out (or a non-root parent_page) it can
+		for id := range order {
+			if err := checkPageTree(parents, id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		for id, position := range order {
+			if _, err := tx.Exec("UPDATE pages SET parent_page = ?, sort_order = ? WHERE id = ?", parents[id], position, id); err != nil {
+				http.Error(w, "Failed to reorder pages: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to reorder pages", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Pages reordered successfully"))
+	}
+}
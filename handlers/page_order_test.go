@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/settings"
+)
+
+func TestCheckPageTree(t *testing.T) {
+	// 1 ─ 2 ─ 3, and 4 at the root
+	tree := map[int]int{1: -1, 2: 1, 3: 2, 4: -1}
+	tests := []struct {
+		page, parent int
+		ok           bool
+	}{
+		{3, 4, true},
+		{2, -1, true},
+		{4, 3, true},
+		{1, 1, false},
+		{1, 3, false},
+		{2, 3, false},
+		{1, 9, false},
+	}
+	for _, tt := range tests {
+		parents := map[int]int{}
+		for id, parent := range tree {
+			parents[id] = parent
+		}
+		parents[tt.page] = tt.parent
+		err := checkPageTree(parents, tt.page)
+		if tt.ok && err != nil {
+			t.Errorf("moving %d under %d: %v", tt.page, tt.parent, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%d was moved under %d", tt.page, tt.parent)
+		}
+	}
+}
+
+// pageTree inserts pages 1 ─ 2 ─ 3 and 4 at the root
+func pageTree(t *testing.T) *sql.DB {
+	t.Helper()
+	database := openTestDB(t)
+	mustExec(t, database, `INSERT INTO pages (id, title, url, parent_page) VALUES
+		(1, 'One', '/one', -1),
+		(2, 'Two', '/two', 1),
+		(3, 'Three', '/three', 2),
+		(4, 'Four', '/four', -1)`)
+	return database
+}
+
+// treeOf reads each page's parent and sort order
+func treeOf(t *testing.T, database *sql.DB) map[int][2]int {
+	t.Helper()
+	rows, err := database.Query("SELECT id, parent_page, IFNULL(sort_order, 0) FROM pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	tree := map[int][2]int{}
+	for rows.Next() {
+		var id, parent, position int
+		if err := rows.Scan(&id, &parent, &position); err != nil {
+			t.Fatal(err)
+		}
+		tree[id] = [2]int{parent, position}
+	}
+	return tree
+}
+
+func TestReorderPages(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		body   string
+		want   int
+		result map[int][2]int
+	}{
+		{"whole tree", "", `[{"id": 4, "children": [{"id": 3}]}, {"id": 1, "children": [{"id": 2}]}]`, http.StatusOK,
+			map[int][2]int{1: {-1, 1}, 2: {1, 0}, 3: {4, 0}, 4: {-1, 0}}},
+		{"under a parent", "?parent_page=4", `[{"id": 3}, {"id": 2}]`, http.StatusOK,
+			map[int][2]int{1: {-1, 0}, 2: {4, 1}, 3: {4, 0}, 4: {-1, 0}}},
+		{"page listed twice", "", `[{"id": 1, "children": [{"id": 1}]}]`, http.StatusBadRequest, nil},
+		{"unknown page", "", `[{"id": 9}]`, http.StatusBadRequest, nil},
+		{"unknown parent", "?parent_page=9", `[{"id": 1}]`, http.StatusNotFound, nil},
+		// The payload alone is a tree, but 3 still sits under 2
+		{"under a page left out", "?parent_page=3", `[{"id": 1}]`, http.StatusBadRequest, nil},
+		{"under itself", "?parent_page=1", `[{"id": 1}]`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		database := pageTree(t)
+		before := treeOf(t, database)
+		r := httptest.NewRequest(http.MethodPost, "/pages/reorder"+tt.query, strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		ReorderPages(database)(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, w.Code, w.Body, tt.want)
+			continue
+		}
+		want := tt.result
+		if want == nil {
+			want = before
+		}
+		if got := treeOf(t, database); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: tree is %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestUpdatePageParent(t *testing.T) {
+	tests := []struct {
+		page, body string
+		want       int
+	}{
+		{"3", `{"parent_page": 4}`, http.StatusOK},
+		{"1", `{"parent_page": 3}`, http.StatusBadRequest},
+		{"1", `{"parent_page": 1}`, http.StatusBadRequest},
+		{"2", `{"parent_page": 9}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		database := pageTree(t)
+		router := chi.NewRouter()
+		router.Patch("/pages/{pageID}", UpdatePage(database, &settings.Settings{}))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/pages/"+tt.page, strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("moving page %s with %s: %d %s, want %d", tt.page, tt.body, w.Code, w.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// buildPageTree nests pages under their parent_page, keeping the order they
+// came in. Pages whose parent no longer exists, and pages whose parents lead
+// back to themselves, are put at the root so they can't disappear from the
+// admin tree.
+func buildPageTree(pages []Page) []*Page {
+	byID := make(map[int]*Page, len(pages))
+	for i := range pages {
+		byID[pages[i].ID] = &pages[i]
+	}
+	inCycle := func(page *Page) bool {
+		seen := map[int]bool{}
+		for id := page.ParentPage; !seen[id]; {
+			parent, ok := byID[id]
+			if !ok {
+				return false
+			}
+			if id == page.ID {
+				return true
+			}
+			seen[id] = true
+			id = parent.ParentPage
+		}
+		return false
+	}
+
+	roots := []*Page{}
+	for i := range pages {
+		page := &pages[i]
+		if parent, ok := byID[page.ParentPage]; ok && !inCycle(page) {
+			parent.Children = append(parent.Children, page)
+		} else {
+			roots = append(roots, page)
+		}
+	}
+	return roots
+}
+
+// pageAncestors returns the pages above pageID, starting at the top of the tree
+func pageAncestors(db *sql.DB, pageID int) ([]Page, error) {
+	var ancestors []Page
+	seen := map[int]bool{pageID: true}
+
+	page, err := getPage(db, pageID)
+	if err != nil {
+		return nil, err
+	}
+	for parent := page.ParentPage; parent > 0 && !seen[parent]; parent = page.ParentPage {
+		seen[parent] = true
+		page, err = getPage(db, parent)
+		if err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		ancestors = append([]Page{page}, ancestors...)
+	}
+	return ancestors, nil
+}
+
+// pageAncestorIDs returns the IDs of every page above pageID in the tree
+func pageAncestorIDs(db *sql.DB, pageID int) (map[int]bool, error) {
+	ancestors, err := pageAncestors(db, pageID)
+	if err == sql.ErrNoRows {
+		return map[int]bool{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[int]bool, len(ancestors))
+	for _, a := range ancestors {
+		ids[a.ID] = true
+	}
+	return ids, nil
+}
+
+func GetPageAncestors(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pageID, err := strconv.Atoi(chi.URLParam(r, "pageID"))
+		if err != nil {
+			http.Error(w, "Invalid page ID", http.StatusBadRequest)
+			return
+		}
+
+		ancestors, err := pageAncestors(db, pageID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Page not found", http.StatusNotFound)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if ancestors == nil {
+			ancestors = []Page{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ancestors)
+	}
+}
+
+// renderBreadcrumbs backs {{ breadcrumbs }}: a trail of links from the top of
+// the tree down to the current page. Inactive ancestors are skipped.
+func (rd *renderer) renderBreadcrumbs(page *Page) (template.HTML, error) {
+	if page == nil {
+		return "", nil
+	}
+	ancestors, err := pageAncestors(rd.db, page.ID)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	esc := template.HTMLEscapeString
+	var b strings.Builder
+	b.WriteString(`<nav class="breadcrumbs" aria-label="Breadcrumb"><ol>`)
+	for _, a := range ancestors {
+		if a.Active != 1 {
+			continue
+		}
+		href, _ := pageLink(a.Url, a.Link, a.LinkNewTab)
+		fmt.Fprintf(&b, `<li><a href="%s">%s</a></li>`, esc(href), esc(a.Title))
+	}
+	fmt.Fprintf(&b, `<li aria-current="page">%s</li>`, esc(page.Title))
+	b.WriteString("</ol></nav>")
+	return template.HTML(b.String()), nil
+}
@@ -8,9 +8,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
-	"strings"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
+
+	"cms/settings"
 )
 
 type Page struct {
@@ -22,9 +24,18 @@ type Page struct {
 	Link       *string             `json:"link,omitempty"`
 	LinkNewTab *int                `json:"link_new_tab,omitempty"`
 	ParentPage int                 `json:"parent_page"`
+	SortOrder  int                 `json:"sort_order"`
 	Settings   *string             `json:"settings,omitempty"`
 	TemplateID int                 `json:"template_id"`
 	CodeBlocks []CodeBlockOrdering `json:"codeblocks"`
+	Children   []*Page             `json:"children,omitempty"`
+
+	// SEO fields; anything left empty falls back to the site-wide defaults
+	MetaTitle       *string `json:"meta_title,omitempty"`
+	MetaDescription *string `json:"meta_description,omitempty"`
+	CanonicalURL    *string `json:"canonical_url,omitempty"`
+	NoIndex         int     `json:"noindex"`
+	OGImageID       *int    `json:"og_image_id,omitempty"`
 }
 
 func CreatePage(db *sql.DB) http.HandlerFunc {
@@ -55,23 +66,12 @@ func CreatePage(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Insert the new page into the database
-		result, err := db.Exec(`
-            INSERT INTO pages (title, url, template_id) VALUES (?, ?, ?)`,
-			requestData.Title, requestData.Url, requestData.TemplateID,
-		)
+		newPageID, err := InsertPage(db, Page{Title: requestData.Title, Url: requestData.Url, TemplateID: requestData.TemplateID})
 		if err != nil {
 			http.Error(w, "Failed to create page: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Get the ID of the newly created page
-		newPageID, err := result.LastInsertId()
-		if err != nil {
-			http.Error(w, "Failed to retrieve new page ID: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
 		// Respond with the created page ID
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -82,9 +82,94 @@ func CreatePage(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// InsertPage creates a page from its title, URL, template and active flag
+// and returns its ID
+func InsertPage(db *sql.DB, page Page) (int64, error) {
+	result, err := db.Exec("INSERT INTO pages (title, url, template_id, active) VALUES (?, ?, ?, ?)",
+		page.Title, page.Url, page.TemplateID, page.Active)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+const pageColumns = "id, title, url, hidden, active, link, link_new_tab, parent_page, settings, template_id, meta_title, meta_description, canonical_url, IFNULL(noindex, 0), og_image_id, IFNULL(sort_order, 0)"
+
+func scanPage(row interface{ Scan(...interface{}) error }) (Page, error) {
+	var page Page
+	err := row.Scan(
+		&page.ID,
+		&page.Title,
+		&page.Url,
+		&page.Hidden,
+		&page.Active,
+		&page.Link,
+		&page.LinkNewTab,
+		&page.ParentPage,
+		&page.Settings,
+		&page.TemplateID,
+		&page.MetaTitle,
+		&page.MetaDescription,
+		&page.CanonicalURL,
+		&page.NoIndex,
+		&page.OGImageID,
+		&page.SortOrder,
+	)
+	return page, err
+}
+
+func getPage(db *sql.DB, id interface{}) (Page, error) {
+	return scanPage(db.QueryRow("SELECT "+pageColumns+" FROM pages WHERE id = ?", id))
+}
+
+// ListPages returns every page in URL order
+func ListPages(db *sql.DB) ([]Page, error) {
+	rows, err := db.Query("SELECT " + pageColumns + " FROM pages ORDER BY url")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pages := []Page{}
+	for rows.Next() {
+		page, err := scanPage(rows)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	return pages, rows.Err()
+}
+
+// FindPage finds a page by its ID or its URL
+func FindPage(db *sql.DB, ref string) (Page, error) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		return getPage(db, id)
+	}
+	return scanPage(db.QueryRow("SELECT "+pageColumns+" FROM pages WHERE url = ?", ref))
+}
+
 func GetPages(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT * FROM pages")
+		query := "SELECT " + pageColumns + " FROM pages"
+		var params []interface{}
+
+		// ?term=topics/go limits the list to pages with that term or one below it
+		if ref := r.URL.Query().Get("term"); ref != "" {
+			ids, err := termAndDescendants(db, ref)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Term not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			in, args := inList(ids)
+			query += " WHERE id IN (SELECT object_id FROM term_assignments WHERE object_type = 'page' AND term_id IN (" + in + "))"
+			params = append(params, args...)
+		}
+
+		rows, err := db.Query(query+" ORDER BY parent_page, sort_order, id", params...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -93,19 +178,8 @@ func GetPages(db *sql.DB) http.HandlerFunc {
 
 		var pages []Page
 		for rows.Next() {
-			var page Page
-			if err := rows.Scan(
-				&page.ID,
-				&page.Title,
-				&page.Url,
-				&page.Hidden,
-				&page.Active,
-				&page.Link,
-				&page.LinkNewTab,
-				&page.ParentPage,
-				&page.Settings,
-				&page.TemplateID,
-			); err != nil {
+			page, err := scanPage(rows)
+			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -113,6 +187,10 @@ func GetPages(db *sql.DB) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("view") == "tree" {
+			json.NewEncoder(w).Encode(buildPageTree(pages))
+			return
+		}
 		json.NewEncoder(w).Encode(pages)
 	}
 }
@@ -152,7 +230,7 @@ func GetPage(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func UpdatePage(db *sql.DB) http.HandlerFunc {
+func UpdatePage(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		pageID := chi.URLParam(r, "pageID")
 
@@ -164,8 +242,15 @@ func UpdatePage(db *sql.DB) http.HandlerFunc {
 			Link       *string `json:"link"`
 			LinkNewTab *int    `json:"link_new_tab"`
 			ParentPage *int    `json:"parent_page"`
+			SortOrder  *int    `json:"sort_order"`
 			Settings   *string `json:"settings"`
 			TemplateID *int    `json:"template_id"`
+
+			MetaTitle       *string `json:"meta_title"`
+			MetaDescription *string `json:"meta_description"`
+			CanonicalURL    *string `json:"canonical_url"`
+			NoIndex         *int    `json:"noindex"`
+			OGImageID       *int    `json:"og_image_id"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -202,9 +287,14 @@ func UpdatePage(db *sql.DB) http.HandlerFunc {
 			params = append(params, *input.LinkNewTab)
 		}
 		if input.ParentPage != nil {
+			// Checked against the tree inside the transaction below
 			query += " parent_page = ?,"
 			params = append(params, *input.ParentPage)
 		}
+		if input.SortOrder != nil {
+			query += " sort_order = ?,"
+			params = append(params, *input.SortOrder)
+		}
 		if input.Settings != nil {
 			query += " settings = ?,"
 			params = append(params, *input.Settings)
@@ -213,16 +303,94 @@ func UpdatePage(db *sql.DB) http.HandlerFunc {
 			query += " template_id = ?,"
 			params = append(params, *input.TemplateID)
 		}
+		if input.MetaTitle != nil {
+			query += " meta_title = ?,"
+			params = append(params, *input.MetaTitle)
+		}
+		if input.MetaDescription != nil {
+			query += " meta_description = ?,"
+			params = append(params, *input.MetaDescription)
+		}
+		if input.CanonicalURL != nil {
+			query += " canonical_url = ?,"
+			params = append(params, *input.CanonicalURL)
+		}
+		if input.NoIndex != nil {
+			query += " noindex = ?,"
+			params = append(params, *input.NoIndex)
+		}
+		if input.OGImageID != nil {
+			// 0 clears the page's image so the site default is used again
+			query += " og_image_id = NULLIF(?, 0),"
+			params = append(params, *input.OGImageID)
+		}
 
 		// Remove trailing comma and add the WHERE clause
 		query = query[:len(query)-1] + " WHERE id = ?"
 		params = append(params, pageID)
 
-		_, err := db.Exec(query, params...)
+		var oldURL string
+		if err := db.QueryRow("SELECT url FROM pages WHERE id = ?", pageID).Scan(&oldURL); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Page not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve page", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		tx, err := db.Begin()
 		if err != nil {
 			http.Error(w, "Failed to update page", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback()
+
+		if input.ParentPage != nil {
+			id, _ := strconv.Atoi(pageID)
+			parents, err := pageParents(tx)
+			if err != nil {
+				http.Error(w, "Failed to load page tree", http.StatusInternalServerError)
+				return
+			}
+			parents[id] = *input.ParentPage
+			if err := checkPageTree(parents, id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if _, err := tx.Exec(query, params...); err != nil {
+			http.Error(w, "Failed to update page", http.StatusInternalServerError)
+			return
+		}
+
+		// Moving a page leaves a redirect behind so old links keep working
+		urlChanged := input.Url != nil && *input.Url != oldURL
+		if urlChanged {
+			if err := redirectPageURL(tx, oldURL, *input.Url); err != nil {
+				http.Error(w, "Failed to add redirect: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to update page", http.StatusInternalServerError)
+			return
+		}
+
+		// A published page moves to its new URL straight away
+		if urlChanged {
+			var published int
+			db.QueryRow("SELECT COUNT(*) FROM published_pages WHERE page_id = ?", pageID).Scan(&published)
+			if published > 0 {
+				id, _ := strconv.Atoi(pageID)
+				if err := Publish(db, cfg, id); err != nil {
+					http.Error(w, "Page updated but failed to republish: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
 
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Page updated successfully"))
@@ -235,7 +403,7 @@ func UpdatePage(db *sql.DB) http.HandlerFunc {
 // 	return string(jsonData)
 // }
 
-func RenderPage(db *sql.DB) http.HandlerFunc {
+func RenderPage(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
 	// Needs to:
 	// if link, then 301 redirect to link
 	// if no link, then return list of codeblock ids
@@ -247,22 +415,7 @@ func RenderPage(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Fetch the page data
-		var page Page
-
-		row := db.QueryRow(`
-			SELECT id, title, url, hidden, active, link, link_new_tab, parent_page, settings, template_id FROM pages WHERE id = ?`, pageID)
-		err := row.Scan(
-			&page.ID,
-			&page.Title,
-			&page.Url,
-			&page.Hidden,
-			&page.Active,
-			&page.Link,
-			&page.LinkNewTab,
-			&page.ParentPage,
-			&page.Settings,
-			&page.TemplateID,
-		)
+		page, err := getPage(db, pageID)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "Page not found", http.StatusNotFound)
@@ -272,32 +425,20 @@ func RenderPage(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Fetch ordered codeblocks
-		rows, err := db.Query("SELECT id, page_id, template_id, codeblock_id, ordering, active FROM codeblocks_ordering WHERE page_id = ? OR template_id = ? ORDER BY ordering", pageID, &page.TemplateID)
-		if err != nil {
+		rd := newRenderer(db, cfg)
+		if err := rd.loadCodeBlocks(&page); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var cb CodeBlockOrdering
-			if err := rows.Scan(&cb.ID, &cb.PageID, &cb.TemplateID, &cb.CodeBlockID, &cb.Ordering); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			page.CodeBlocks = append(page.CodeBlocks, cb)
-		}
 
-		renderedBlocks, err := renderCodeBlocks(db, page.CodeBlocks)
+		html, err := rd.renderPage(&page)
 		if err != nil {
 			http.Error(w, "Error rendering code blocks: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Serve the final rendered content
-		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(strings.Join(renderedBlocks, "")))
+		writeHTML(w, r, html)
 	}
 }
 
@@ -334,23 +475,6 @@ func RenderPage(db *sql.DB) http.HandlerFunc {
 // 	return *template.TemplateCodeBlocks, nil
 // }
 
-// Helper function to render code blocks based on their IDs
-func renderCodeBlocks(db *sql.DB, blockIDs []CodeBlockOrdering) ([]string, error) {
-	var renderedBlocks []string
-
-	for _, blockID := range blockIDs {
-		var content string
-		err := db.QueryRow(`
-			SELECT content FROM code_blocks WHERE id = ?`, blockID.CodeBlockID).Scan(&content)
-		if err != nil {
-			return nil, err
-		}
-		renderedBlocks = append(renderedBlocks, content)
-	}
-
-	return renderedBlocks, nil
-}
-
 // func fetchInheritedCodeBlocksForPage(db *sql.DB, pageID int) ([]int, error) {
 // 	var inheritedCodeBlocks []int
 // 	var templateID int
@@ -449,6 +573,21 @@ func DeletePage(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Take it off the public site too
+		id, _ := strconv.Atoi(pageID)
+		if err := Unpublish(db, id); err != nil {
+			http.Error(w, "Page deleted but could not be unpublished: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := deleteTermAssignments(db, TermObjectPage, id); err != nil {
+			http.Error(w, "Page deleted but its terms could not be removed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM page_translations WHERE page_id = ?", id); err != nil {
+			http.Error(w, "Page deleted but its translations could not be removed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		// Return success
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Page deleted successfully"))
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/settings"
+	"cms/utils"
+)
+
+// Publish renders a page, and each of its translations, and stores the
+// compiled HTML that the public site serves, then refreshes the page's entry
+// in the search index
+func Publish(db *sql.DB, cfg *settings.Settings, pageID int) error {
+	page, err := getPage(db, pageID)
+	if err != nil {
+		return err
+	}
+
+	rd := newRenderer(db, cfg)
+	rd.stored = true
+	if err := rd.loadCodeBlocks(&page); err != nil {
+		return err
+	}
+	html, err := rd.renderPage(&page)
+	if err != nil {
+		return err
+	}
+	translations, err := renderTranslations(db, cfg, page)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO published_pages (page_id, url, title, html, published_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (page_id) DO UPDATE SET
+			url = excluded.url,
+			title = excluded.title,
+			html = excluded.html,
+			published_at = excluded.published_at`,
+		page.ID, page.Url, page.Title, html,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Translations are replaced wholesale so removed ones come down too
+	if _, err := tx.Exec("DELETE FROM published_translations WHERE page_id = ?", page.ID); err != nil {
+		return err
+	}
+	bundles := rd.bundles
+	for _, t := range translations {
+		_, err := tx.Exec("INSERT INTO published_translations (page_id, locale, url, title, html) VALUES (?, ?, ?, ?, ?)",
+			page.ID, t.Locale, t.URL, t.Title, t.HTML)
+		if err != nil {
+			return err
+		}
+		bundles = append(bundles, t.Bundles...)
+	}
+	if err := saveBundles(tx, bundles); err != nil {
+		return err
+	}
+
+	if searchAvailable(db) {
+		if _, err := tx.Exec("DELETE FROM search_index WHERE page_id = ?", page.ID); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO search_index (title, url, content, page_id) VALUES (?, ?, ?, ?)",
+			page.Title, page.Url, utils.HTMLToText(html), page.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Unpublish takes a page off the public site and out of the search index,
+// along with the bundles only it linked to
+func Unpublish(db *sql.DB, pageID int) error {
+	if _, err := db.Exec("DELETE FROM published_pages WHERE page_id = ?", pageID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM published_translations WHERE page_id = ?", pageID); err != nil {
+		return err
+	}
+	if searchAvailable(db) {
+		if _, err := db.Exec("DELETE FROM search_index WHERE page_id = ?", pageID); err != nil {
+			return err
+		}
+	}
+	return pruneBundles(db)
+}
+
+// PublishedTimes maps the ID of each published page to when it was published
+func PublishedTimes(db *sql.DB) (map[int]string, error) {
+	rows, err := db.Query("SELECT page_id, published_at FROM published_pages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	times := map[int]string{}
+	for rows.Next() {
+		var id int
+		var at string
+		if err := rows.Scan(&id, &at); err != nil {
+			return nil, err
+		}
+		times[id] = at
+	}
+	return times, rows.Err()
+}
+
+func PublishPage(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pageID, err := strconv.Atoi(chi.URLParam(r, "pageID"))
+		if err != nil {
+			http.Error(w, "Invalid page ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := Publish(db, cfg, pageID); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Page not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to publish page: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Page published successfully"))
+	}
+}
+
+func UnpublishPage(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pageID, err := strconv.Atoi(chi.URLParam(r, "pageID"))
+		if err != nil {
+			http.Error(w, "Invalid page ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := Unpublish(db, pageID); err != nil {
+			http.Error(w, "Failed to unpublish page: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Page unpublished successfully"))
+	}
+}
+
+// ServePublishedPage is the public site: it serves collection listings, posts
+// and term listings under their base paths and translations under their
+// locale prefix, otherwise looks up the request path among published, active
+// pages and serves the compiled HTML, falling back to the redirect rules
+// before giving up with a 404
+func ServePublishedPage(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if served, err := serveCollection(db, cfg, w, r); err != nil {
+			http.Error(w, "Failed to render collection: "+err.Error(), http.StatusInternalServerError)
+			return
+		} else if served {
+			return
+		}
+		if served, err := serveTaxonomy(db, cfg, w, r); err != nil {
+			http.Error(w, "Failed to render term listing: "+err.Error(), http.StatusInternalServerError)
+			return
+		} else if served {
+			return
+		}
+		if served, err := serveTranslation(db, cfg, w, r); err != nil {
+			http.Error(w, "Failed to load page: "+err.Error(), http.StatusInternalServerError)
+			return
+		} else if served {
+			return
+		}
+
+		var html string
+		var link sql.NullString
+		err := db.QueryRow(`
+			SELECT pp.html, p.link
+			FROM published_pages pp
+			JOIN pages p ON p.id = pp.page_id
+			WHERE pp.url = ? AND p.active = 1
+			ORDER BY pp.published_at DESC
+			LIMIT 1`, r.URL.Path).Scan(&html, &link)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				// Nothing published here, but the path may have moved
+				if sent, err := serveRedirect(db, w, r); err != nil {
+					http.Error(w, "Failed to look up redirects", http.StatusInternalServerError)
+				} else if !sent {
+					http.NotFound(w, r)
+				}
+			} else {
+				http.Error(w, "Failed to load page", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Link pages just point somewhere else
+		if link.Valid && link.String != "" {
+			http.Redirect(w, r, link.String, http.StatusMovedPermanently)
+			return
+		}
+
+		writeHTML(w, r, html)
+	}
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type Redirect struct {
+	ID         int     `json:"id"`
+	Source     string  `json:"source"`
+	Target     string  `json:"target"`
+	StatusCode int     `json:"status_code"`
+	Hits       int     `json:"hits"`
+	LastHitAt  *string `json:"last_hit_at,omitempty"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+const redirectColumns = "id, source, target, status_code, hits, last_hit_at, created_at"
+
+func scanRedirect(row interface{ Scan(...interface{}) error }) (Redirect, error) {
+	var rd Redirect
+	err := row.Scan(&rd.ID, &rd.Source, &rd.Target, &rd.StatusCode, &rd.Hits, &rd.LastHitAt, &rd.CreatedAt)
+	return rd, err
+}
+
+// The longest chain followed when checking a new rule for loops
+const maxRedirectHops = 20
+
+func validRedirectStatus(code int) bool {
+	return code == http.StatusMovedPermanently || code == http.StatusFound ||
+		code == http.StatusTemporaryRedirect || code == http.StatusPermanentRedirect
+}
+
+// isPattern reports whether a source matches by prefix ("/blog/*")
+func isPattern(source string) bool {
+	return strings.HasSuffix(source, "*")
+}
+
+// resolveRedirect applies a rule to path. For patterns a "*" in the target is
+// replaced with whatever the source's "*" matched.
+func resolveRedirect(rule Redirect, path string) (string, bool) {
+	if !isPattern(rule.Source) {
+		return rule.Target, rule.Source == path
+	}
+	prefix := strings.TrimSuffix(rule.Source, "*")
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	return strings.Replace(rule.Target, "*", strings.TrimPrefix(path, prefix), 1), true
+}
+
+// matchRedirect finds the rule for path: an exact source first, otherwise the
+// pattern with the longest prefix. excludeID skips one rule, used when
+// checking an edit against the other rules.
+func matchRedirect(db *sql.DB, path string, excludeID int) (*Redirect, string, error) {
+	rule, err := scanRedirect(db.QueryRow("SELECT "+redirectColumns+" FROM redirects WHERE source = ? AND id != ?", path, excludeID))
+	if err == nil {
+		return &rule, rule.Target, nil
+	} else if err != sql.ErrNoRows {
+		return nil, "", err
+	}
+
+	rows, err := db.Query(`
+		SELECT `+redirectColumns+` FROM redirects
+		WHERE source LIKE '%*' AND id != ?
+		ORDER BY LENGTH(source) DESC`, excludeID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rule, err := scanRedirect(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		if target, ok := resolveRedirect(rule, path); ok {
+			return &rule, target, nil
+		}
+	}
+	return nil, "", rows.Err()
+}
+
+// externalTarget reports whether a redirect target leaves the site, with a
+// scheme ("https://example.com/x") or protocol-relative ("//example.com/x")
+func externalTarget(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme != "" || u.Host != "")
+}
+
+// checkRedirectLoop follows the chain starting at the new rule's target through
+// the existing rules and fails if it ever comes back to a path already visited
+func checkRedirectLoop(db *sql.DB, rule Redirect) error {
+	start := rule.Source
+	if isPattern(start) {
+		// Check the pattern with a representative path it would match
+		start = strings.TrimSuffix(start, "*") + "__loop_check__"
+	}
+	target, _ := resolveRedirect(rule, start)
+
+	seen := map[string]bool{start: true}
+	for hops := 0; hops < maxRedirectHops; hops++ {
+		if externalTarget(target) {
+			return nil
+		}
+		path := strings.SplitN(target, "?", 2)[0]
+		if seen[path] {
+			return fmt.Errorf("redirect from %s to %s would create a loop", rule.Source, rule.Target)
+		}
+		seen[path] = true
+
+		// The rule being saved applies too, in case the chain comes back under it
+		if next, ok := resolveRedirect(rule, path); ok {
+			target = next
+			continue
+		}
+		next, nextTarget, err := matchRedirect(db, path, rule.ID)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		target = nextTarget
+	}
+	return fmt.Errorf("redirect from %s to %s chains through more than %d redirects", rule.Source, rule.Target, maxRedirectHops)
+}
+
+// validateRedirect fills in defaults and checks a rule before it's saved
+func validateRedirect(db *sql.DB, rule *Redirect) error {
+	if rule.StatusCode == 0 {
+		rule.StatusCode = http.StatusMovedPermanently
+	}
+	if !strings.HasPrefix(rule.Source, "/") {
+		return fmt.Errorf("source must be a path starting with /")
+	}
+	if rule.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if !validRedirectStatus(rule.StatusCode) {
+		return fmt.Errorf("status_code must be 301, 302, 307 or 308")
+	}
+	if strings.Count(rule.Source, "*") > 1 || strings.Contains(strings.TrimSuffix(rule.Source, "*"), "*") {
+		return fmt.Errorf("only a single trailing * is supported in source")
+	}
+	return checkRedirectLoop(db, *rule)
+}
+
+// redirectPageURL is called when a page's URL changes: it adds a 301 from the
+// old URL, points existing redirects straight at the new URL instead of
+// chaining, and drops any rule that would now shadow the new URL
+func redirectPageURL(tx *sql.Tx, oldURL, newURL string) error {
+	if oldURL == newURL || oldURL == "" {
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM redirects WHERE source = ?", newURL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE redirects SET target = ? WHERE target = ?", newURL, oldURL); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO redirects (source, target, status_code) VALUES (?, ?, 301)
+		ON CONFLICT (source) DO UPDATE SET target = excluded.target, status_code = 301`,
+		oldURL, newURL,
+	)
+	return err
+}
+
+// serveRedirect answers r from the redirect rules if one matches, recording
+// the hit. It reports whether a redirect was sent.
+func serveRedirect(db *sql.DB, w http.ResponseWriter, r *http.Request) (bool, error) {
+	rule, target, err := matchRedirect(db, r.URL.Path, 0)
+	if err != nil || rule == nil {
+		return false, err
+	}
+
+	if _, err := db.Exec("UPDATE redirects SET hits = hits + 1, last_hit_at = CURRENT_TIMESTAMP WHERE id = ?", rule.ID); err != nil {
+		return false, err
+	}
+
+	// Keep the query string unless the target has its own
+	if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, rule.StatusCode)
+	return true, nil
+}
+
+func GetRedirects(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT " + redirectColumns + " FROM redirects ORDER BY source")
+		if err != nil {
+			http.Error(w, "Failed to retrieve redirects", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		redirects := []Redirect{}
+		for rows.Next() {
+			rule, err := scanRedirect(rows)
+			if err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			redirects = append(redirects, rule)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(redirects)
+	}
+}
+
+func CreateRedirect(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rule Redirect
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		rule.ID = 0
+		if err := validateRedirect(db, &rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO redirects (source, target, status_code) VALUES (?, ?, ?)", rule.Source, rule.Target, rule.StatusCode)
+		if err != nil {
+			http.Error(w, "Failed to create redirect: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve new redirect ID", http.StatusInternalServerError)
+			return
+		}
+
+		created, err := scanRedirect(db.QueryRow("SELECT "+redirectColumns+" FROM redirects WHERE id = ?", id))
+		if err != nil {
+			http.Error(w, "Failed to load redirect", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+func UpdateRedirect(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rule, err := scanRedirect(db.QueryRow("SELECT "+redirectColumns+" FROM redirects WHERE id = ?", chi.URLParam(r, "redirectID")))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Redirect not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve redirect", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var input struct {
+			Source     *string `json:"source"`
+			Target     *string `json:"target"`
+			StatusCode *int    `json:"status_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Source != nil {
+			rule.Source = *input.Source
+		}
+		if input.Target != nil {
+			rule.Target = *input.Target
+		}
+		if input.StatusCode != nil {
+			rule.StatusCode = *input.StatusCode
+		}
+		if err := validateRedirect(db, &rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = db.Exec("UPDATE redirects SET source = ?, target = ?, status_code = ? WHERE id = ?", rule.Source, rule.Target, rule.StatusCode, rule.ID)
+		if err != nil {
+			http.Error(w, "Failed to update redirect: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Redirect updated successfully"))
+	}
+}
+
+func DeleteRedirect(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := db.Exec("DELETE FROM redirects WHERE id = ?", chi.URLParam(r, "redirectID"))
+		if err != nil {
+			http.Error(w, "Failed to delete redirect", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Redirect not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Redirect deleted successfully"))
+	}
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cms/db"
+)
+
+// openTestDB creates an empty site database
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	database, err := db.Open(filepath.Join(t.TempDir(), "cms.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func mustExec(t *testing.T, database *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := database.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func TestExternalTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"https://example.com/x", true},
+		{"http://example.com", true},
+		{"//example.com/x", true},
+		{"mailto:team@example.com", true},
+		{"/x", false},
+		{"/x?next=https://example.com", false},
+		{"/a//b", false},
+		{"/%zz", false},
+	}
+	for _, tt := range tests {
+		if got := externalTarget(tt.target); got != tt.want {
+			t.Errorf("externalTarget(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRedirectLoop(t *testing.T) {
+	database := openTestDB(t)
+	mustExec(t, database, `INSERT INTO redirects (source, target, status_code) VALUES
+		('/a', '/b', 301),
+		('/old/*', '/new/*', 301),
+		('/c', '/d', 301),
+		('/d', '/e', 301)`)
+
+	tests := []struct {
+		source, target string
+		loop           bool
+	}{
+		{"/b", "/a", true},
+		{"/b", "/a?utm=x", true},
+		{"/e", "/c", true},
+		{"/x", "/x", true},
+		{"/new/*", "/old/*", true},
+		{"/*", "/a/*", true},
+		{"/b", "/c", false},
+		{"/b", "https://example.com/a", false},
+		{"/b", "//example.com/a", false},
+		// A pattern whose target stays under its own source only ends
+		// when the target is recognised as leaving the site
+		{"/*", "//example.com/*", false},
+		{"/*", "https://example.com/*", false},
+		{"/legacy/*", "/new/*", false},
+	}
+	for _, tt := range tests {
+		err := checkRedirectLoop(database, Redirect{Source: tt.source, Target: tt.target, StatusCode: 301})
+		if tt.loop && err == nil {
+			t.Errorf("%s -> %s: no loop found", tt.source, tt.target)
+		} else if !tt.loop && err != nil {
+			t.Errorf("%s -> %s: %v", tt.source, tt.target, err)
+		}
+	}
+
+	// An edit is checked against the other rules, not its old self
+	var id int
+	if err := database.QueryRow("SELECT id FROM redirects WHERE source = '/a'").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRedirectLoop(database, Redirect{ID: id, Source: "/a", Target: "/c"}); err != nil {
+		t.Errorf("editing /a to point at /c: %v", err)
+	}
+	err := checkRedirectLoop(database, Redirect{Source: "/loop/*", Target: "/loop/x/*"})
+	if err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("a pattern redirecting into itself = %v, want a chain too long", err)
+	}
+}
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"strings"
+
+	"cms/settings"
+)
+
+// renderer turns code blocks into HTML
+type renderer struct {
+	db  *sql.DB
+	cfg *settings.Settings
+
+	// Set when rendering a collection listing or post
+	current    *Collection
+	collection *CollectionView
+	post       *Post
+
+	// Set when rendering a term listing
+	term *TermView
+
+	// Set when rendering a translation; empty for the default locale
+	locale string
+
+	// Set when the HTML is stored, by publishing or a static build. The CSS
+	// and JS bundles it links to are collected in bundles for saving.
+	stored  bool
+	bundles []assetBundle
+}
+
+func newRenderer(db *sql.DB, cfg *settings.Settings) *renderer {
+	return &renderer{db: db, cfg: cfg}
+}
+
+// localeOrDefault is the locale being rendered
+func (rd *renderer) localeOrDefault() string {
+	if rd.locale != "" {
+		return rd.locale
+	}
+	return rd.cfg.Locales.Default
+}
+
+// blockData is what code block templates see as "."
+type blockData struct {
+	Page       *Page
+	Collection *CollectionView
+	Post       *Post
+	Term       *TermView
+	Locale     string
+}
+
+// funcs returns the helpers code blocks can call, e.g. {{ media 3 }}. page is
+// the page being rendered.
+func (rd *renderer) funcs(page *Page) template.FuncMap {
+	return template.FuncMap{
+		"menu": func(name string, depth ...int) (template.HTML, error) {
+			return rd.renderMenu(page, name, depth...)
+		},
+		"breadcrumbs": func() (template.HTML, error) {
+			return rd.renderBreadcrumbs(page)
+		},
+		"entries": func(typeName string, limit ...int) ([]Entry, error) {
+			ct, err := getContentType(rd.db, typeName)
+			if err != nil {
+				return nil, fmt.Errorf("content type %s: %w", typeName, err)
+			}
+			n := 0
+			if len(limit) > 0 {
+				n = limit[0]
+			}
+			return listEntries(rd.db, ct, false, n)
+		},
+		"entry": func(typeName string, id int) (Entry, error) {
+			ct, err := getContentType(rd.db, typeName)
+			if err != nil {
+				return Entry{}, fmt.Errorf("content type %s: %w", typeName, err)
+			}
+			e, err := getEntry(rd.db, ct, id)
+			if err != nil {
+				return Entry{}, fmt.Errorf("%s entry %d: %w", typeName, id, err)
+			}
+			return e, nil
+		},
+		"posts": func(name string, limit ...int) ([]Post, error) {
+			c, err := getCollection(rd.db, name)
+			if err != nil {
+				return nil, fmt.Errorf("collection %s: %w", name, err)
+			}
+			n := c.PerPage
+			if len(limit) > 0 {
+				n = limit[0]
+			}
+			posts, _, err := listPosts(rd.db, c, postFilter{}, n, 0)
+			return posts, err
+		},
+		"archives": func(name string) ([]Archive, error) {
+			c, err := getCollection(rd.db, name)
+			if err != nil {
+				return nil, fmt.Errorf("collection %s: %w", name, err)
+			}
+			return listArchives(rd.db, c)
+		},
+		"terms": func(vocab string) ([]*Term, error) {
+			v, err := getVocabulary(rd.db, vocab)
+			if err != nil {
+				return nil, fmt.Errorf("vocabulary %s: %w", vocab, err)
+			}
+			terms, err := vocabularyTerms(rd.db, v)
+			if err != nil {
+				return nil, err
+			}
+			return buildTermTree(terms), nil
+		},
+		"pageTerms": func(vocab string) ([]Term, error) {
+			objectType, objectID := rd.renderedObject(page)
+			terms, err := objectTerms(rd.db, objectType, objectID, vocab)
+			if err != nil {
+				return nil, err
+			}
+			return terms[vocab], nil
+		},
+		"termItems": func(vocab, slug string, limit ...int) ([]TermItem, error) {
+			ids, err := termAndDescendants(rd.db, vocab+"/"+slug)
+			if err != nil {
+				return nil, fmt.Errorf("term %s/%s: %w", vocab, slug, err)
+			}
+			n := termPageSize
+			if len(limit) > 0 {
+				n = limit[0]
+			}
+			items, _, err := termItems(rd.db, ids, n, 0)
+			return items, err
+		},
+		"related": func(limit ...int) ([]TermItem, error) {
+			n := 5
+			if len(limit) > 0 {
+				n = limit[0]
+			}
+			objectType, objectID := rd.renderedObject(page)
+			return relatedItems(rd.db, objectType, objectID, n)
+		},
+		"form": func(name string) (template.HTML, error) {
+			f, err := getForm(rd.db, name)
+			if err != nil {
+				return "", fmt.Errorf("form %s: %w", name, err)
+			}
+			return formHTML(f), nil
+		},
+		"media": func(id int) (string, error) {
+			m, err := getMedia(rd.db, id)
+			if err != nil {
+				return "", fmt.Errorf("media %d: %w", id, err)
+			}
+			return m.URL, nil
+		},
+		"image": func(id int) (template.HTML, error) {
+			m, err := getMedia(rd.db, id)
+			if err != nil {
+				return "", fmt.Errorf("media %d: %w", id, err)
+			}
+			return imageTag(m, ""), nil
+		},
+		"srcset": func(id int) (template.Srcset, error) {
+			m, err := getMedia(rd.db, id)
+			if err != nil {
+				return "", fmt.Errorf("media %d: %w", id, err)
+			}
+			return srcset(m, rd.cfg.Media), nil
+		},
+		"responsiveImage": func(id int, sizes string) (template.HTML, error) {
+			m, err := getMedia(rd.db, id)
+			if err != nil {
+				return "", fmt.Errorf("media %d: %w", id, err)
+			}
+			extra := fmt.Sprintf(` srcset="%s" sizes="%s"`,
+				template.HTMLEscapeString(string(srcset(m, rd.cfg.Media))),
+				template.HTMLEscapeString(sizes))
+			return imageTag(m, extra), nil
+		},
+	}
+}
+
+// imageTag builds an <img> for a media item. extra is inserted as-is and must
+// already be escaped.
+func imageTag(m Media, extra string) template.HTML {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<img src="%s"`, template.HTMLEscapeString(m.URL))
+	alt := ""
+	if m.AltText != nil {
+		alt = *m.AltText
+	}
+	fmt.Fprintf(&b, ` alt="%s"`, template.HTMLEscapeString(alt))
+	if m.Width != nil && m.Height != nil {
+		fmt.Fprintf(&b, ` width="%d" height="%d"`, *m.Width, *m.Height)
+	}
+	b.WriteString(extra)
+	b.WriteString(">")
+	return template.HTML(b.String())
+}
+
+// renderCodeBlock executes a template block's content as an html/template
+func (rd *renderer) renderCodeBlock(name, content string, data blockData) (string, error) {
+	tmpl, err := template.New(name).Funcs(rd.funcs(data.Page)).Parse(content)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// templateChain returns templateID followed by its parent templates
+func templateChain(db *sql.DB, templateID int) ([]int, error) {
+	var chain []int
+	seen := map[int]bool{}
+
+	for id := templateID; id > 0 && !seen[id]; {
+		seen[id] = true
+		chain = append(chain, id)
+
+		var parent sql.NullInt64
+		err := db.QueryRow("SELECT parent_template_id FROM templates WHERE id = ?", id).Scan(&parent)
+		if err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		id = int(parent.Int64)
+	}
+	return chain, nil
+}
+
+// loadCodeBlocks fills page.CodeBlocks with the blocks placed on the page and
+// on every template in its chain, in display order
+func (rd *renderer) loadCodeBlocks(page *Page) error {
+	chain, err := templateChain(rd.db, page.TemplateID)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT id, page_id, template_id, codeblock_id, ordering, IFNULL(active, 1) FROM codeblocks_ordering WHERE page_id = ?"
+	params := []interface{}{page.ID}
+	if len(chain) > 0 {
+		query += " OR template_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(chain)), ",") + ")"
+		for _, id := range chain {
+			params = append(params, id)
+		}
+	}
+
+	rows, err := rd.db.Query(query+" ORDER BY ordering", params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	page.CodeBlocks = nil
+	for rows.Next() {
+		var cb CodeBlockOrdering
+		if err := rows.Scan(&cb.ID, &cb.PageID, &cb.TemplateID, &cb.CodeBlockID, &cb.Ordering, &cb.Active); err != nil {
+			return err
+		}
+		page.CodeBlocks = append(page.CodeBlocks, cb)
+	}
+	return rows.Err()
+}
+
+// renderPage renders the page's HTML, template and Markdown blocks in order, adds its
+// SEO tags, bundles its CSS and JS blocks and links the bundles into the head and
+// footer. Inactive blocks, and blocks whose placement is inactive, are left out.
+func (rd *renderer) renderPage(page *Page) (string, error) {
+	var body strings.Builder
+	var css, js []string
+
+	for _, placement := range page.CodeBlocks {
+		if placement.Active == 0 {
+			continue
+		}
+		var title, content, blockType string
+		var active, translated bool
+		var cached, cachedHash sql.NullString
+		// Blocks not yet translated fall back to the default locale's content
+		err := rd.db.QueryRow(`
+			SELECT cb.title, IFNULL(t.content, cb.content), cb.type, IFNULL(cb.active, 1), t.content IS NOT NULL,
+				CASE WHEN t.content IS NULL THEN cb.rendered ELSE t.rendered END,
+				CASE WHEN t.content IS NULL THEN cb.rendered_hash ELSE t.rendered_hash END
+			FROM code_blocks cb
+			LEFT JOIN code_block_translations t ON t.codeblock_id = cb.id AND t.locale = ?
+			WHERE cb.id = ?`, rd.locale, placement.CodeBlockID).Scan(&title, &content, &blockType, &active, &translated, &cached, &cachedHash)
+		if err != nil {
+			return "", err
+		}
+		if !active {
+			continue
+		}
+
+		switch blockType {
+		case CodeBlockCSS:
+			css = append(css, content)
+		case CodeBlockJS:
+			js = append(js, content)
+		case CodeBlockMarkdown:
+			// Markdown is not a template: its HTML goes in as rendered
+			locale := ""
+			if translated {
+				locale = rd.locale
+			}
+			rendered, err := markdownHTML(rd.db, placement.CodeBlockID, locale, content, cached, cachedHash)
+			if err != nil {
+				return "", fmt.Errorf("code block %q: %w", title, err)
+			}
+			body.WriteString(rendered)
+		case CodeBlockTemplate:
+			rendered, err := rd.renderCodeBlock(title, content, blockData{Page: page, Collection: rd.collection, Post: rd.post, Term: rd.term, Locale: rd.localeOrDefault()})
+			if err != nil {
+				return "", err
+			}
+			body.WriteString(rendered)
+		default:
+			body.WriteString(content)
+		}
+	}
+
+	html := rd.injectSEO(page, body.String())
+	feeds, err := rd.feedLinks(page)
+	if err != nil {
+		return "", err
+	}
+	if feeds != "" {
+		html = injectHead(html, feeds)
+	}
+	alternates, err := rd.hreflangLinks(page)
+	if err != nil {
+		return "", err
+	}
+	if alternates != "" {
+		html = injectHead(html, alternates)
+	}
+	if len(css) > 0 {
+		tag, err := rd.bundleTag(CodeBlockCSS, css)
+		if err != nil {
+			return "", err
+		}
+		html = injectHead(html, tag)
+	}
+	if len(js) > 0 {
+		tag, err := rd.bundleTag(CodeBlockJS, js)
+		if err != nil {
+			return "", err
+		}
+		html = injectFooter(html, tag)
+	}
+	return html, nil
+}
+
+// injectHead places snippet just before </head>, or at the very start when
+// the page has no head
+func injectHead(html, snippet string) string {
+	if i := strings.LastIndex(strings.ToLower(html), "</head>"); i >= 0 {
+		return html[:i] + snippet + "\n" + html[i:]
+	}
+	return snippet + "\n" + html
+}
+
+// injectFooter places snippet just before </body>, or at the very end
+func injectFooter(html, snippet string) string {
+	if i := strings.LastIndex(strings.ToLower(html), "</body>"); i >= 0 {
+		return html[:i] + snippet + "\n" + html[i:]
+	}
+	return html + "\n" + snippet
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type SearchResult struct {
+	PageID  int     `json:"page_id"`
+	Title   string  `json:"title"`
+	Url     string  `json:"url"`
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Page    int            `json:"page"`
+	PerPage int            `json:"per_page"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+}
+
+// searchAvailable reports whether the FTS5 index exists in this database
+func searchAvailable(db *sql.DB) bool {
+	var name string
+	err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'search_index'").Scan(&name)
+	return err == nil
+}
+
+// ftsQuery turns free text into a safe FTS5 expression: every word is quoted so
+// operators and punctuation in the input can't cause syntax errors, and the last
+// word matches as a prefix so results show up while typing
+func ftsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	for i, word := range words {
+		words[i] = `"` + word + `"`
+	}
+	words[len(words)-1] += "*"
+	return strings.Join(words, " ")
+}
+
+// Snippet markers that can't appear in page text, swapped for <mark> after escaping
+const (
+	snippetOpen  = "\x01"
+	snippetClose = "\x02"
+)
+
+// Search is the public site search: GET /search?q=...&page=2
+func Search(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !searchAvailable(db) {
+			http.Error(w, "Search is not available on this server", http.StatusServiceUnavailable)
+			return
+		}
+
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		resp := SearchResponse{Query: q, Page: 1, PerPage: 10, Results: []SearchResult{}}
+		if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+			resp.Page = p
+		}
+		if pp, err := strconv.Atoi(r.URL.Query().Get("per_page")); err == nil && pp > 0 && pp <= 50 {
+			resp.PerPage = pp
+		}
+
+		match := ftsQuery(q)
+		if match == "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		// Only pages that are still live; the index can briefly hold pages that
+		// were deactivated after publishing
+		const visible = `
+			FROM search_index s
+			JOIN pages p ON p.id = s.page_id
+			WHERE search_index MATCH ? AND p.active = 1 AND p.hidden != 1`
+
+		if err := db.QueryRow("SELECT COUNT(*)"+visible, match).Scan(&resp.Total); err != nil {
+			http.Error(w, "Search failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Title matches weigh more than URL matches, which weigh more than body text
+		rows, err := db.Query(`
+			SELECT s.page_id, s.title, s.url,
+				snippet(search_index, 2, ?, ?, '…', 24),
+				bm25(search_index, 10.0, 4.0, 1.0) AS rank`+visible+`
+			ORDER BY rank
+			LIMIT ? OFFSET ?`,
+			snippetOpen, snippetClose, match, resp.PerPage, (resp.Page-1)*resp.PerPage,
+		)
+		if err != nil {
+			http.Error(w, "Search failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var res SearchResult
+			var pageID sql.NullInt64
+			if err := rows.Scan(&pageID, &res.Title, &res.Url, &res.Snippet, &res.Rank); err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			res.PageID = int(pageID.Int64)
+			res.Snippet = strings.NewReplacer(snippetOpen, "<mark>", snippetClose, "</mark>").
+				Replace(template.HTMLEscapeString(res.Snippet))
+			resp.Results = append(resp.Results, res)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// pageSEO is a page's SEO metadata after falling back to the site defaults
+type pageSEO struct {
+	Title       string
+	Description string
+	Canonical   string
+	NoIndex     bool
+	Image       *Media
+	ImageURL    string
+}
+
+// seoFor resolves a page's SEO fields against the site settings
+func (rd *renderer) seoFor(page *Page) pageSEO {
+	seo := pageSEO{
+		Title:       page.Title + rd.cfg.SEO.TitleSuffix,
+		Description: rd.cfg.SiteDescription,
+		Canonical:   absoluteURL(rd.cfg, page.Url),
+		NoIndex:     page.NoIndex == 1,
+	}
+	if page.MetaTitle != nil && *page.MetaTitle != "" {
+		seo.Title = *page.MetaTitle
+	}
+	if page.MetaDescription != nil && *page.MetaDescription != "" {
+		seo.Description = *page.MetaDescription
+	}
+	if page.CanonicalURL != nil && *page.CanonicalURL != "" {
+		seo.Canonical = absoluteURL(rd.cfg, *page.CanonicalURL)
+	}
+
+	imageID := rd.cfg.SEO.DefaultOGImageID
+	if page.OGImageID != nil {
+		imageID = *page.OGImageID
+	}
+	if imageID > 0 {
+		if m, err := getMedia(rd.db, imageID); err == nil {
+			seo.Image = &m
+			seo.ImageURL = absoluteURL(rd.cfg, ogImageURL(m, rd.cfg.Media.ImageWidths))
+		}
+	}
+	return seo
+}
+
+// ogImageURL picks the smallest configured variant that is still at least
+// 1200px wide (what social networks display), or the original image
+func ogImageURL(m Media, widths []int) string {
+	best := 0
+	for _, w := range widths {
+		if w >= 1200 && m.Width != nil && w < *m.Width && (best == 0 || w < best) {
+			best = w
+		}
+	}
+	if best == 0 {
+		return m.URL
+	}
+	return variantURL(m, best)
+}
+
+var titleTag = regexp.MustCompile(`(?is)<title[^>]*>.*?</title>`)
+
+// injectSEO writes the page's <title>, description, canonical, robots, Open
+// Graph and Twitter tags into the head. An existing <title> is replaced so
+// layouts can keep one for pages rendered before SEO fields existed.
+func (rd *renderer) injectSEO(page *Page, html string) string {
+	seo := rd.seoFor(page)
+	esc := template.HTMLEscapeString
+
+	var tags []string
+	meta := func(attr, key, value string) {
+		if value != "" {
+			tags = append(tags, fmt.Sprintf(`<meta %s="%s" content="%s">`, attr, key, esc(value)))
+		}
+	}
+
+	title := "<title>" + esc(seo.Title) + "</title>"
+	if titleTag.MatchString(html) {
+		replaced := false
+		html = titleTag.ReplaceAllStringFunc(html, func(string) string {
+			if replaced {
+				return ""
+			}
+			replaced = true
+			return title
+		})
+	} else {
+		tags = append(tags, title)
+	}
+
+	meta("name", "description", seo.Description)
+	tags = append(tags, fmt.Sprintf(`<link rel="canonical" href="%s">`, esc(seo.Canonical)))
+	if seo.NoIndex {
+		meta("name", "robots", "noindex, follow")
+	}
+
+	meta("property", "og:type", "website")
+	meta("property", "og:site_name", rd.cfg.SiteName)
+	meta("property", "og:title", seo.Title)
+	meta("property", "og:description", seo.Description)
+	meta("property", "og:url", seo.Canonical)
+
+	card := "summary"
+	if seo.Image != nil {
+		card = "summary_large_image"
+		meta("property", "og:image", seo.ImageURL)
+		if seo.Image.AltText != nil {
+			meta("property", "og:image:alt", *seo.Image.AltText)
+		}
+	}
+	meta("name", "twitter:card", card)
+	meta("name", "twitter:site", rd.cfg.SEO.TwitterSite)
+
+	return injectHead(html, strings.Join(tags, "\n"))
+}
@@ -0,0 +1,549 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/settings"
+	"cms/sites"
+)
+
+// SharedCodeBlock is a code block kept in the main database for every site to
+// use. A site links one by taking a copy into its own code blocks, which
+// follows the shared block's content until the site overrides it.
+type SharedCodeBlock struct {
+	ID          int     `json:"id"`
+	Title       string  `json:"title"`
+	Description *string `json:"description,omitempty"`
+	Content     string  `json:"content"`
+	Type        string  `json:"type"`
+	UpdatedAt   string  `json:"updated_at"`
+}
+
+const sharedBlockColumns = "id, title, description, content, type, updated_at"
+
+func scanSharedBlock(row interface{ Scan(...interface{}) error }) (SharedCodeBlock, error) {
+	var b SharedCodeBlock
+	err := row.Scan(&b.ID, &b.Title, &b.Description, &b.Content, &b.Type, &b.UpdatedAt)
+	return b, err
+}
+
+func getSharedBlock(main *sql.DB, id interface{}) (SharedCodeBlock, error) {
+	return scanSharedBlock(main.QueryRow("SELECT "+sharedBlockColumns+" FROM shared_code_blocks WHERE id = ?", id))
+}
+
+// sharedBlockFor loads the shared block named in the URL, writing the error
+// response and returning false if it can't
+func sharedBlockFor(reg *sites.Registry, w http.ResponseWriter, r *http.Request) (SharedCodeBlock, bool) {
+	b, err := getSharedBlock(reg.Main(), chi.URLParam(r, "sharedID"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Shared code block not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve shared code block", http.StatusInternalServerError)
+		}
+		return b, false
+	}
+	return b, true
+}
+
+// UsageTemplate and UsagePage are the templates and pages that render a code
+// block, directly or through a parent template
+type UsageTemplate struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+}
+
+type UsagePage struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	URL       string `json:"url"`
+	Published bool   `json:"published"`
+}
+
+// SharedBlockUsage is one site's copy of a shared block and where it renders
+type SharedBlockUsage struct {
+	SiteID      int             `json:"site_id"`
+	Hostname    string          `json:"hostname"`
+	SiteName    string          `json:"site_name"`
+	CodeBlockID int             `json:"codeblock_id"`
+	Title       string          `json:"title"`
+	Overridden  int             `json:"overridden"`
+	Templates   []UsageTemplate `json:"templates"`
+	Pages       []UsagePage     `json:"pages"`
+}
+
+// codeBlockUsage finds the templates that render a code block, including
+// those inheriting it from a parent, and the pages that render it through
+// one of them or by placing it themselves
+func codeBlockUsage(db *sql.DB, codeBlockID int) ([]UsageTemplate, []UsagePage, error) {
+	const placed = `
+		WITH RECURSIVE placed(template_id) AS (
+			SELECT template_id FROM codeblocks_ordering WHERE codeblock_id = ? AND template_id > 0
+			UNION
+			SELECT t.id FROM templates t JOIN placed ON t.parent_template_id = placed.template_id
+		)`
+
+	rows, err := db.Query(placed+`
+		SELECT t.id, t.title FROM templates t
+		WHERE t.id IN (SELECT template_id FROM placed)
+		ORDER BY t.id`, codeBlockID)
+	if err != nil {
+		return nil, nil, err
+	}
+	templates := []UsageTemplate{}
+	for rows.Next() {
+		var t UsageTemplate
+		if err := rows.Scan(&t.ID, &t.Title); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		templates = append(templates, t)
+	}
+	rows.Close()
+
+	rows, err = db.Query(placed+`
+		SELECT p.id, p.title, p.url, EXISTS (SELECT 1 FROM published_pages pp WHERE pp.page_id = p.id)
+		FROM pages p
+		WHERE p.id IN (SELECT page_id FROM codeblocks_ordering WHERE codeblock_id = ? AND page_id > 0)
+			OR p.template_id IN (SELECT template_id FROM placed)
+		ORDER BY p.url`, codeBlockID, codeBlockID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	pages := []UsagePage{}
+	for rows.Next() {
+		var p UsagePage
+		if err := rows.Scan(&p.ID, &p.Title, &p.URL, &p.Published); err != nil {
+			return nil, nil, err
+		}
+		pages = append(pages, p)
+	}
+	return templates, pages, rows.Err()
+}
+
+// republishUsers republishes the published pages that render a code block,
+// so its new content goes live
+func republishUsers(db *sql.DB, cfg *settings.Settings, codeBlockID int) error {
+	_, pages, err := codeBlockUsage(db, codeBlockID)
+	if err != nil {
+		return err
+	}
+	for _, p := range pages {
+		if !p.Published {
+			continue
+		}
+		if err := republish(db, cfg, p.ID); err != nil {
+			return fmt.Errorf("republishing %s: %w", p.URL, err)
+		}
+	}
+	return nil
+}
+
+// siteCopies lists the IDs of a site's copies of a shared block, optionally
+// only those still following it
+func siteCopies(db *sql.DB, sharedID int, following bool) ([]int, error) {
+	query := "SELECT id FROM code_blocks WHERE shared_id = ?"
+	if following {
+		query += " AND IFNULL(overridden, 0) = 0"
+	}
+	rows, err := db.Query(query+" ORDER BY id", sharedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// syncSharedBlock copies a shared block's content into every site's copies
+// that haven't been overridden and republishes the pages showing them
+func syncSharedBlock(reg *sites.Registry, b SharedCodeBlock) error {
+	list, err := reg.Sites()
+	if err != nil {
+		return err
+	}
+	rendered, hash, metadata, err := markdownCache(b.Type, b.Content)
+	if err != nil {
+		return err
+	}
+	for _, s := range list {
+		db, err := reg.Database(s)
+		if err != nil {
+			return fmt.Errorf("site %s: %w", s.Hostname, err)
+		}
+		ids, err := siteCopies(db, b.ID, true)
+		if err != nil {
+			return fmt.Errorf("site %s: %w", s.Hostname, err)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		if _, err := db.Exec("UPDATE code_blocks SET content = ?, type = ?, rendered = ?, rendered_hash = ?, metadata = ? WHERE shared_id = ? AND IFNULL(overridden, 0) = 0",
+			b.Content, b.Type, rendered, hash, metadata, b.ID); err != nil {
+			return fmt.Errorf("site %s: %w", s.Hostname, err)
+		}
+
+		cfg, err := reg.Settings(s)
+		if err != nil {
+			return fmt.Errorf("site %s: %w", s.Hostname, err)
+		}
+		for _, id := range ids {
+			if err := republishUsers(db, cfg, id); err != nil {
+				return fmt.Errorf("site %s: %w", s.Hostname, err)
+			}
+		}
+	}
+	return nil
+}
+
+func GetSharedBlocks(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := reg.Main().Query("SELECT " + sharedBlockColumns + " FROM shared_code_blocks ORDER BY title")
+		if err != nil {
+			http.Error(w, "Failed to retrieve shared code blocks", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		blocks := []SharedCodeBlock{}
+		for rows.Next() {
+			b, err := scanSharedBlock(rows)
+			if err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			blocks = append(blocks, b)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blocks)
+	}
+}
+
+func GetSharedBlock(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := sharedBlockFor(reg, w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	}
+}
+
+func CreateSharedBlock(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var b SharedCodeBlock
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if b.Title == "" {
+			http.Error(w, "Shared code block title is required", http.StatusBadRequest)
+			return
+		}
+		if b.Type == "" {
+			b.Type = CodeBlockHTML
+		}
+		if !validCodeBlockType(b.Type) {
+			http.Error(w, "Type must be html, template, css, js or markdown", http.StatusBadRequest)
+			return
+		}
+		if _, _, _, err := markdownCache(b.Type, b.Content); err != nil {
+			http.Error(w, "Invalid Markdown: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := reg.Main().Exec("INSERT INTO shared_code_blocks (title, description, content, type) VALUES (?, ?, ?, ?)",
+			b.Title, b.Description, b.Content, b.Type)
+		if err != nil {
+			http.Error(w, "Failed to create shared code block: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve last inserted ID", http.StatusInternalServerError)
+			return
+		}
+		created, err := getSharedBlock(reg.Main(), id)
+		if err != nil {
+			http.Error(w, "Failed to load shared code block", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// UpdateSharedBlock edits a shared block. New content or type is copied to
+// every site's copy that hasn't been overridden, and published pages showing
+// those copies are republished.
+func UpdateSharedBlock(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := sharedBlockFor(reg, w, r)
+		if !ok {
+			return
+		}
+
+		var input struct {
+			Title       *string `json:"title"`
+			Description *string `json:"description"`
+			Content     *string `json:"content"`
+			Type        *string `json:"type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Title != nil {
+			if *input.Title == "" {
+				http.Error(w, "Shared code block title is required", http.StatusBadRequest)
+				return
+			}
+			b.Title = *input.Title
+		}
+		if input.Description != nil {
+			b.Description = input.Description
+		}
+		if input.Content != nil {
+			b.Content = *input.Content
+		}
+		if input.Type != nil {
+			if !validCodeBlockType(*input.Type) {
+				http.Error(w, "Type must be html, template, css, js or markdown", http.StatusBadRequest)
+				return
+			}
+			b.Type = *input.Type
+		}
+		if _, _, _, err := markdownCache(b.Type, b.Content); err != nil {
+			http.Error(w, "Invalid Markdown: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err := reg.Main().Exec("UPDATE shared_code_blocks SET title = ?, description = ?, content = ?, type = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			b.Title, b.Description, b.Content, b.Type, b.ID)
+		if err != nil {
+			http.Error(w, "Failed to update shared code block: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if input.Content != nil || input.Type != nil {
+			if err := syncSharedBlock(reg, b); err != nil {
+				http.Error(w, "Shared code block saved, but failed to update the sites using it: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Shared code block updated successfully"))
+	}
+}
+
+// DeleteSharedBlock removes a block from the library. Sites keep their copies
+// as ordinary code blocks.
+func DeleteSharedBlock(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := sharedBlockFor(reg, w, r)
+		if !ok {
+			return
+		}
+
+		list, err := reg.Sites()
+		if err != nil {
+			http.Error(w, "Failed to retrieve sites", http.StatusInternalServerError)
+			return
+		}
+		for _, s := range list {
+			db, err := reg.Database(s)
+			if err == nil {
+				_, err = db.Exec("UPDATE code_blocks SET shared_id = NULL, overridden = 0 WHERE shared_id = ?", b.ID)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to unlink site %s: %v", s.Hostname, err), http.StatusInternalServerError)
+				return
+			}
+		}
+		if _, err := reg.Main().Exec("DELETE FROM shared_code_blocks WHERE id = ?", b.ID); err != nil {
+			http.Error(w, "Failed to delete shared code block", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Shared code block deleted successfully"))
+	}
+}
+
+// GetSharedBlockUsage reports every site, template and page that renders a
+// shared block, to check before editing it
+func GetSharedBlockUsage(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := sharedBlockFor(reg, w, r)
+		if !ok {
+			return
+		}
+		list, err := reg.Sites()
+		if err != nil {
+			http.Error(w, "Failed to retrieve sites", http.StatusInternalServerError)
+			return
+		}
+
+		usage := []SharedBlockUsage{}
+		for _, s := range list {
+			db, err := reg.Database(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to open site %s: %v", s.Hostname, err), http.StatusInternalServerError)
+				return
+			}
+			rows, err := db.Query("SELECT id, title, IFNULL(overridden, 0) FROM code_blocks WHERE shared_id = ? ORDER BY id", b.ID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to read site %s: %v", s.Hostname, err), http.StatusInternalServerError)
+				return
+			}
+			var copies []SharedBlockUsage
+			for rows.Next() {
+				u := SharedBlockUsage{SiteID: s.ID, Hostname: s.Hostname, SiteName: s.Name}
+				if err := rows.Scan(&u.CodeBlockID, &u.Title, &u.Overridden); err != nil {
+					rows.Close()
+					http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+					return
+				}
+				copies = append(copies, u)
+			}
+			rows.Close()
+
+			for _, u := range copies {
+				u.Templates, u.Pages, err = codeBlockUsage(db, u.CodeBlockID)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Failed to read site %s: %v", s.Hostname, err), http.StatusInternalServerError)
+					return
+				}
+				usage = append(usage, u)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	}
+}
+
+// LinkSharedBlock copies a shared block into the current site's code blocks,
+// titled as in the library unless the body gives a title
+func LinkSharedBlock(db *sql.DB, reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := sharedBlockFor(reg, w, r)
+		if !ok {
+			return
+		}
+
+		var input struct {
+			Title string `json:"title"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Title == "" {
+			input.Title = b.Title
+		}
+
+		var taken int
+		db.QueryRow("SELECT COUNT(*) FROM code_blocks WHERE title = ?", input.Title).Scan(&taken)
+		if taken > 0 {
+			http.Error(w, fmt.Sprintf("A code block titled %q already exists", input.Title), http.StatusBadRequest)
+			return
+		}
+
+		rendered, hash, metadata, err := markdownCache(b.Type, b.Content)
+		if err != nil {
+			http.Error(w, "Invalid Markdown: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := db.Exec("INSERT INTO code_blocks (title, description, content, type, shared_id, overridden, rendered, rendered_hash, metadata) VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?)",
+			input.Title, b.Description, b.Content, b.Type, b.ID, rendered, hash, metadata)
+		if err != nil {
+			http.Error(w, "Failed to create code block", http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve last inserted ID", http.StatusInternalServerError)
+			return
+		}
+
+		sharedID := b.ID
+		cb := CodeBlock{
+			ID:          int(id),
+			Title:       input.Title,
+			Active:      1,
+			Description: b.Description,
+			Content:     b.Content,
+			Type:        b.Type,
+			SharedID:    &sharedID,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(cb)
+	}
+}
+
+// RevertCodeBlock drops a site's override of a shared block, so its copy
+// follows the library again
+func RevertCodeBlock(db *sql.DB, cfg *settings.Settings, reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var codeBlockID int
+		var sharedID sql.NullInt64
+		err := db.QueryRow("SELECT id, shared_id FROM code_blocks WHERE id = ?", chi.URLParam(r, "codeBlockID")).Scan(&codeBlockID, &sharedID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Code block not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve code block", http.StatusInternalServerError)
+			}
+			return
+		}
+		if !sharedID.Valid {
+			http.Error(w, "Code block is not a copy of a shared block", http.StatusBadRequest)
+			return
+		}
+		b, err := getSharedBlock(reg.Main(), sharedID.Int64)
+		if err != nil {
+			http.Error(w, "Failed to retrieve shared code block", http.StatusInternalServerError)
+			return
+		}
+
+		rendered, hash, metadata, err := markdownCache(b.Type, b.Content)
+		if err != nil {
+			http.Error(w, "Invalid Markdown: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec("UPDATE code_blocks SET content = ?, type = ?, overridden = 0, rendered = ?, rendered_hash = ?, metadata = ? WHERE id = ?",
+			b.Content, b.Type, rendered, hash, metadata, codeBlockID); err != nil {
+			http.Error(w, "Failed to update code block", http.StatusInternalServerError)
+			return
+		}
+		if err := republishUsers(db, cfg, codeBlockID); err != nil {
+			http.Error(w, "Failed to republish pages: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Code block override removed successfully"))
+	}
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/settings"
+)
+
+// PageSettings is the structure of the free-form settings JSON stored on a page
+type PageSettings struct {
+	SitemapExclude    bool     `json:"sitemap_exclude,omitempty"`
+	SitemapPriority   *float64 `json:"sitemap_priority,omitempty"`
+	SitemapChangeFreq string   `json:"sitemap_changefreq,omitempty"`
+}
+
+// parsePageSettings reads a page's settings column, treating missing or
+// malformed JSON as empty settings
+func parsePageSettings(raw *string) PageSettings {
+	var ps PageSettings
+	if raw != nil && *raw != "" {
+		json.Unmarshal([]byte(*raw), &ps)
+	}
+	return ps
+}
+
+const sitemapNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+	Priority   string `xml:"priority,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapRef struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapRef `xml:"sitemap"`
+}
+
+// absoluteURL joins the configured site URL with a site-relative path
+func absoluteURL(cfg *settings.Settings, path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return strings.TrimRight(cfg.SiteURL, "/") + path
+}
+
+// w3cDate converts a SQLite timestamp to the date format sitemaps expect
+func w3cDate(ts string) string {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, ts); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	return ""
+}
+
+// sitemapEntries lists every published, active, non-hidden page that isn't
+// noindex, excluded in its settings or pointing at an external link, followed
+// by every live collection post
+func sitemapEntries(db *sql.DB, cfg *settings.Settings) ([]sitemapURL, error) {
+	rows, err := db.Query(`
+		SELECT p.url, p.settings, pp.published_at
+		FROM pages p
+		JOIN published_pages pp ON pp.page_id = p.id
+		WHERE p.active = 1 AND p.hidden != 1 AND IFNULL(p.noindex, 0) = 0 AND IFNULL(p.link, '') = ''
+		ORDER BY p.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []sitemapURL
+	for rows.Next() {
+		var url, publishedAt string
+		var rawSettings *string
+		if err := rows.Scan(&url, &rawSettings, &publishedAt); err != nil {
+			return nil, err
+		}
+
+		ps := parsePageSettings(rawSettings)
+		if ps.SitemapExclude {
+			continue
+		}
+
+		entry := sitemapURL{
+			Loc:        absoluteURL(cfg, url),
+			LastMod:    w3cDate(publishedAt),
+			ChangeFreq: ps.SitemapChangeFreq,
+		}
+		if ps.SitemapPriority != nil {
+			entry.Priority = strconv.FormatFloat(*ps.SitemapPriority, 'f', 1, 64)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Collection posts, each under its collection's base path
+	posts, err := db.Query(`
+		SELECT c.base_path, p.slug, p.updated_at
+		FROM posts p
+		JOIN collections c ON c.id = p.collection_id
+		WHERE ` + livePosts + `
+		ORDER BY c.id, p.published_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer posts.Close()
+
+	for posts.Next() {
+		var basePath, slug, updatedAt string
+		if err := posts.Scan(&basePath, &slug, &updatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, sitemapURL{
+			Loc:     absoluteURL(cfg, basePath+"/"+slug),
+			LastMod: w3cDate(updatedAt),
+		})
+	}
+	return entries, posts.Err()
+}
+
+// marshalXML encodes v as an indented XML document
+func marshalXML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	data, err := marshalXML(v)
+	if err != nil {
+		http.Error(w, "Failed to encode XML", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(data)
+}
+
+// buildSitemapIndex splits entries into sitemaps of at most perFile URLs and
+// returns the index pointing at /sitemap-1.xml, /sitemap-2.xml, ...
+func buildSitemapIndex(cfg *settings.Settings, entries []sitemapURL, perFile int) sitemapIndex {
+	index := sitemapIndex{Xmlns: sitemapNS}
+	for n := 0; n*perFile < len(entries); n++ {
+		chunk := entries[n*perFile : min(len(entries), (n+1)*perFile)]
+
+		// The newest change in a chunk is that sitemap's lastmod
+		latest := ""
+		for _, e := range chunk {
+			if e.LastMod > latest {
+				latest = e.LastMod
+			}
+		}
+		index.Sitemaps = append(index.Sitemaps, sitemapRef{
+			Loc:     absoluteURL(cfg, fmt.Sprintf("/sitemap-%d.xml", n+1)),
+			LastMod: latest,
+		})
+	}
+	return index
+}
+
+// Sitemap serves /sitemap.xml. Sites with more URLs than fit in one sitemap get
+// a sitemap index pointing at /sitemap-1.xml, /sitemap-2.xml, ...
+func Sitemap(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := sitemapEntries(db, cfg)
+		if err != nil {
+			http.Error(w, "Failed to build sitemap: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		perFile := cfg.Sitemap.MaxURLs
+		if len(entries) <= perFile {
+			writeXML(w, sitemapURLSet{Xmlns: sitemapNS, URLs: entries})
+			return
+		}
+
+		writeXML(w, buildSitemapIndex(cfg, entries, perFile))
+	}
+}
+
+// SitemapPart serves one numbered sitemap from the index
+func SitemapPart(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimSuffix(chi.URLParam(r, "part"), ".xml"))
+		if err != nil || n < 1 {
+			http.NotFound(w, r)
+			return
+		}
+
+		entries, err := sitemapEntries(db, cfg)
+		if err != nil {
+			http.Error(w, "Failed to build sitemap: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		perFile := cfg.Sitemap.MaxURLs
+		start := (n - 1) * perFile
+		if start >= len(entries) {
+			http.NotFound(w, r)
+			return
+		}
+		writeXML(w, sitemapURLSet{Xmlns: sitemapNS, URLs: entries[start:min(len(entries), start+perFile)]})
+	}
+}
+
+// Robots serves /robots.txt
+func Robots(cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(robotsTxt(cfg)))
+	}
+}
+
+// robotsTxt builds robots.txt from the robots section of the settings and
+// points crawlers at the sitemap
+func robotsTxt(cfg *settings.Settings) string {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	if cfg.Robots.DisallowAll {
+		b.WriteString("Disallow: /\n")
+	} else {
+		for _, path := range cfg.Robots.Allow {
+			b.WriteString("Allow: " + path + "\n")
+		}
+		for _, path := range cfg.Robots.Disallow {
+			b.WriteString("Disallow: " + path + "\n")
+		}
+		if len(cfg.Robots.Allow) == 0 && len(cfg.Robots.Disallow) == 0 {
+			b.WriteString("Disallow:\n")
+		}
+	}
+	b.WriteString("\nSitemap: " + absoluteURL(cfg, "/sitemap.xml") + "\n")
+	return b.String()
+}
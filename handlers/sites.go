@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/settings"
+	"cms/sites"
+)
+
+// siteFor loads the site named in the URL, writing the error response and
+// returning false if it can't
+func siteFor(reg *sites.Registry, w http.ResponseWriter, r *http.Request) (sites.Site, bool) {
+	s, err := sites.Scan(reg.Main().QueryRow("SELECT "+sites.Columns+" FROM sites WHERE id = ?", chi.URLParam(r, "siteID")))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Site not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve site: "+err.Error(), http.StatusInternalServerError)
+		}
+		return s, false
+	}
+	return s, true
+}
+
+// validateSite checks a site's hostname, aliases and settings. Every
+// hostname and alias may only belong to one site.
+func validateSite(reg *sites.Registry, s sites.Site) error {
+	if !sites.ValidHostname(s.Hostname) {
+		return fmt.Errorf("hostname %q must be a lowercase domain name", s.Hostname)
+	}
+	for _, host := range append([]string{s.Hostname}, s.Aliases...) {
+		if host != s.Hostname && (host == sites.FallbackHost || !sites.ValidHostname(host)) {
+			return fmt.Errorf("alias %q must be a lowercase domain name", host)
+		}
+		var taken int
+		err := reg.Main().QueryRow(`
+			SELECT COUNT(*) FROM sites
+			WHERE id != ? AND (hostname = ? OR EXISTS (SELECT 1 FROM json_each(aliases) WHERE value = ?))`,
+			s.ID, host, host).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return fmt.Errorf("%s already belongs to another site", host)
+		}
+	}
+
+	var overrides map[string]interface{}
+	if err := json.Unmarshal(s.Settings, &overrides); err != nil || overrides == nil {
+		return fmt.Errorf("settings must be a JSON object")
+	}
+	if _, instance, _ := settings.StripInstance(s.Settings); len(instance) > 0 {
+		return fmt.Errorf("these settings belong to the whole instance and can't be set per site: %s", strings.Join(instance, ", "))
+	}
+	cfg, err := reg.Base().ForSite(s.Settings)
+	if err != nil {
+		return err
+	}
+	return reg.CheckMailFrom(s, cfg.Mail.From)
+}
+
+func GetSites(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := reg.Sites()
+		if err != nil {
+			http.Error(w, "Failed to retrieve sites: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if list == nil {
+			list = []sites.Site{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+func GetSite(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := siteFor(reg, w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	}
+}
+
+// CreateSite adds a site. Its database is created under site_data/ on the
+// first request for it unless a path is given.
+func CreateSite(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var s sites.Site
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if s.Hostname == sites.FallbackHost {
+			http.Error(w, "There is already a fallback site", http.StatusBadRequest)
+			return
+		}
+		if s.Name == "" {
+			s.Name = s.Hostname
+		}
+		if s.Aliases == nil {
+			s.Aliases = []string{}
+		}
+		if len(s.Settings) == 0 {
+			s.Settings = json.RawMessage("{}")
+		}
+		if s.Database == "" {
+			s.Database = sites.DatabasePath(s.Hostname)
+		}
+		if err := validateSite(reg, s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		aliases, _ := json.Marshal(s.Aliases)
+		result, err := reg.Main().Exec("INSERT INTO sites (hostname, name, aliases, database, settings) VALUES (?, ?, ?, ?, ?)",
+			s.Hostname, s.Name, string(aliases), s.Database, string(s.Settings))
+		if err != nil {
+			http.Error(w, "Failed to create site: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve new site ID", http.StatusInternalServerError)
+			return
+		}
+		reg.Reload(int(id))
+
+		created, err := sites.Scan(reg.Main().QueryRow("SELECT "+sites.Columns+" FROM sites WHERE id = ?", id))
+		if err != nil {
+			http.Error(w, "Failed to load site", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// UpdateSite changes a site's hostname, name, aliases, settings or active
+// flag. A site's database can't be moved once created.
+func UpdateSite(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := siteFor(reg, w, r)
+		if !ok {
+			return
+		}
+
+		var input struct {
+			Hostname *string          `json:"hostname"`
+			Name     *string          `json:"name"`
+			Aliases  *[]string        `json:"aliases"`
+			Settings *json.RawMessage `json:"settings"`
+			Active   *int             `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		fallback := s.Hostname == sites.FallbackHost
+		if input.Hostname != nil {
+			if fallback != (*input.Hostname == sites.FallbackHost) {
+				http.Error(w, "The fallback site keeps the hostname *", http.StatusBadRequest)
+				return
+			}
+			s.Hostname = *input.Hostname
+		}
+		if input.Name != nil {
+			s.Name = *input.Name
+		}
+		if input.Aliases != nil {
+			s.Aliases = *input.Aliases
+		}
+		if input.Settings != nil {
+			s.Settings = *input.Settings
+		}
+		if input.Active != nil {
+			if fallback && *input.Active != 1 {
+				http.Error(w, "The fallback site can't be deactivated", http.StatusBadRequest)
+				return
+			}
+			s.Active = *input.Active
+		}
+		if err := validateSite(reg, s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		aliases, _ := json.Marshal(s.Aliases)
+		_, err := reg.Main().Exec("UPDATE sites SET hostname = ?, name = ?, aliases = ?, settings = ?, active = ? WHERE id = ?",
+			s.Hostname, s.Name, string(aliases), string(s.Settings), s.Active, s.ID)
+		if err != nil {
+			http.Error(w, "Failed to update site: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reg.Reload(s.ID)
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Site updated successfully"))
+	}
+}
+
+// DeleteSite stops serving a site and removes users' access to it. Its
+// database and media are left on disk.
+func DeleteSite(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := siteFor(reg, w, r)
+		if !ok {
+			return
+		}
+		if reg.IsMain(s) {
+			http.Error(w, "The site in the main database can't be deleted", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := reg.Main().Begin()
+		if err != nil {
+			http.Error(w, "Failed to delete site", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM user_sites WHERE site_id = ?", s.ID); err != nil {
+			http.Error(w, "Failed to remove access to site", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM sites WHERE id = ?", s.ID); err != nil {
+			http.Error(w, "Failed to delete site", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete site", http.StatusInternalServerError)
+			return
+		}
+		reg.Reload(s.ID)
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Site deleted successfully"))
+	}
+}
+
+// GetSettings shows the settings the current site runs with: the settings
+// file with the site's own settings applied. Passwords are left out.
+func GetSettings(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, _ := sites.FromContext(r.Context())
+		cfg, err := reg.Settings(s)
+		if err != nil {
+			http.Error(w, "Failed to load settings: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cfg.Database.Password = ""
+		cfg.Mail.SMTPPassword = ""
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"site":     s,
+			"settings": cfg,
+		})
+	}
+}
+
+// UpdateSettings merges the submitted settings into the current site's own.
+// Objects are merged key by key and a null removes a setting, so the site
+// goes back to the settings file's value.
+func UpdateSettings(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, _ := sites.FromContext(r.Context())
+
+		changes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		// Silently keeping the instance's values would look like the change
+		// worked
+		if _, instance, err := settings.StripInstance(changes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if len(instance) > 0 {
+			http.Error(w, "These settings belong to the whole instance and can't be changed per site: "+strings.Join(instance, ", "), http.StatusBadRequest)
+			return
+		}
+		overrides, err := settings.MergeOverrides(s.Settings, changes)
+		if err == nil {
+			err = reg.SaveSettings(s, overrides)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Settings updated successfully"))
+	}
+}
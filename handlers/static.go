@@ -0,0 +1,703 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cms/markdown"
+	"cms/settings"
+	"cms/storage"
+)
+
+// A static build writes the public site to a directory that any web server or
+// static host can serve: every active, published page and its translations
+// as <url>/index.html, the CSS/JS bundles, media files, sitemap, robots.txt,
+// page feeds and redirects, both as meta-refresh pages and a _redirects file.
+//
+// The build keeps a manifest in the directory. Later builds only re-render
+// pages whose row, translations, template chain or code blocks changed, or
+// that were republished since.
+
+// Name of the manifest a build leaves in its output directory
+const staticManifestName = ".cms-static.json"
+
+// Raised whenever a change to the builder means old output must be rebuilt
+const staticManifestVersion = 1
+
+// Name of the redirect rules file read by Netlify, Cloudflare Pages and others
+const staticRedirectsName = "_redirects"
+
+type staticManifest struct {
+	Version  int                `json:"version"`
+	Settings string             `json:"settings"`
+	Pages    map[int]staticPage `json:"pages"`
+	// Everything else the build wrote: assets, media, redirects and the like
+	Files []string `json:"files"`
+}
+
+// staticPage records what was written for one page
+type staticPage struct {
+	Hash   string   `json:"hash"`
+	Files  []string `json:"files"`
+	Assets []string `json:"assets"`
+}
+
+// StaticReport describes what a static build did
+type StaticReport struct {
+	Dir       string   `json:"dir"`
+	Full      bool     `json:"full"`
+	Rendered  []string `json:"rendered"`
+	Unchanged int      `json:"unchanged"`
+	Redirects int      `json:"redirects"`
+	Removed   []string `json:"removed"`
+}
+
+type staticBuild struct {
+	db    *sql.DB
+	cfg   *settings.Settings
+	store storage.Storage
+	dir   string
+
+	old     staticManifest
+	before  map[string]bool
+	pages   map[int]staticPage
+	written map[string]bool
+	// Page files by path, so redirects never replace a page
+	claimed map[string]bool
+	// Content of the bundles this build's pages link to, by file name
+	bundles map[string]string
+	report  *StaticReport
+}
+
+var staticAssetRef = regexp.MustCompile(regexp.QuoteMeta(assetsPath) + `([0-9a-f]+\.(?:css|js))`)
+
+// BuildStatic renders the site into dir. Unless full is set, pages whose
+// inputs haven't changed since the last build into dir are left as they are.
+func BuildStatic(db *sql.DB, cfg *settings.Settings, store storage.Storage, dir string, full bool) (*StaticReport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	b := &staticBuild{
+		db:      db,
+		cfg:     cfg,
+		store:   store,
+		dir:     dir,
+		pages:   map[int]staticPage{},
+		written: map[string]bool{},
+		claimed: map[string]bool{},
+		bundles: map[string]string{},
+		report:  &StaticReport{Dir: dir, Rendered: []string{}, Removed: []string{}},
+	}
+
+	settingsHash, err := hashSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	b.readManifest()
+	// Settings reach every page through the SEO tags, so a change means a full rebuild
+	if b.old.Version != staticManifestVersion || b.old.Settings != settingsHash {
+		full = true
+	}
+	b.report.Full = full
+
+	if err := b.buildPages(full); err != nil {
+		return nil, err
+	}
+	if err := b.writeAssets(); err != nil {
+		return nil, fmt.Errorf("writing assets: %w", err)
+	}
+	if err := b.writeMedia(); err != nil {
+		return nil, fmt.Errorf("copying media: %w", err)
+	}
+	if err := b.writeRedirects(); err != nil {
+		return nil, fmt.Errorf("writing redirects: %w", err)
+	}
+	if err := b.writeSitemap(); err != nil {
+		return nil, fmt.Errorf("writing sitemap: %w", err)
+	}
+	if err := b.writeFeeds(); err != nil {
+		return nil, fmt.Errorf("writing feeds: %w", err)
+	}
+	b.removeStale()
+
+	return b.report, b.writeManifest(settingsHash)
+}
+
+func (b *staticBuild) readManifest() {
+	data, err := os.ReadFile(filepath.Join(b.dir, staticManifestName))
+	if err != nil || json.Unmarshal(data, &b.old) != nil {
+		b.old = staticManifest{}
+	}
+	if b.old.Pages == nil {
+		b.old.Pages = map[int]staticPage{}
+	}
+	b.before = map[string]bool{}
+	for _, name := range b.old.Files {
+		b.before[name] = true
+	}
+	for _, p := range b.old.Pages {
+		for _, name := range p.Files {
+			b.before[name] = true
+		}
+	}
+}
+
+func (b *staticBuild) writeManifest(settingsHash string) error {
+	m := staticManifest{Version: staticManifestVersion, Settings: settingsHash, Pages: b.pages, Files: []string{}}
+	for name := range b.written {
+		if !b.claimed[name] {
+			m.Files = append(m.Files, name)
+		}
+	}
+	sort.Strings(m.Files)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(b.dir, staticManifestName), data, 0o644)
+}
+
+// buildPages renders every active, published page that changed since the
+// last build, or all of them when full is set
+func (b *staticBuild) buildPages(full bool) error {
+	rows, err := b.db.Query(`
+		SELECT p.id, pp.published_at
+		FROM pages p
+		JOIN published_pages pp ON pp.page_id = p.id
+		WHERE p.active = 1
+		ORDER BY p.id`)
+	if err != nil {
+		return err
+	}
+	type published struct {
+		id int
+		at string
+	}
+	var list []published
+	for rows.Next() {
+		var p published
+		if err := rows.Scan(&p.id, &p.at); err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range list {
+		page, err := getPage(b.db, p.id)
+		if err != nil {
+			return err
+		}
+		sum, err := pageFingerprint(b.db, page, p.at)
+		if err != nil {
+			return fmt.Errorf("page %s: %w", page.Url, err)
+		}
+
+		if prev, ok := b.old.Pages[page.ID]; ok && !full && prev.Hash == sum && b.exists(prev.Files) && b.exists(assetFiles(prev.Assets)) {
+			b.pages[page.ID] = prev
+			for _, name := range prev.Files {
+				b.written[name] = true
+				b.claimed[name] = true
+			}
+			b.report.Unchanged++
+			continue
+		}
+
+		entry, err := b.renderPage(page)
+		if err != nil {
+			return fmt.Errorf("page %s: %w", page.Url, err)
+		}
+		// Rendering refreshes stale Markdown caches, which are part of the
+		// fingerprint
+		if sum, err = pageFingerprint(b.db, page, p.at); err != nil {
+			return fmt.Errorf("page %s: %w", page.Url, err)
+		}
+		entry.Hash = sum
+		b.pages[page.ID] = entry
+		b.report.Rendered = append(b.report.Rendered, page.Url)
+	}
+	return nil
+}
+
+// renderPage renders one page and its translations through the same pipeline
+// publishing uses and writes them out. Link pages become redirects.
+func (b *staticBuild) renderPage(page Page) (staticPage, error) {
+	entry := staticPage{Files: []string{}, Assets: []string{}}
+	add := func(url, html string) error {
+		name := staticFile(url)
+		// There's no visitor to issue a CSRF token to, so forms can't be
+		// submitted from a static build
+		html = strings.ReplaceAll(html, csrfPlaceholder, "")
+		if err := b.write(name, []byte(html)); err != nil {
+			return err
+		}
+		b.claimed[name] = true
+		entry.Files = append(entry.Files, name)
+		for _, m := range staticAssetRef.FindAllStringSubmatch(html, -1) {
+			entry.Assets = append(entry.Assets, m[1])
+		}
+		return nil
+	}
+
+	if page.Link != nil && *page.Link != "" {
+		return entry, add(page.Url, redirectPage(*page.Link))
+	}
+
+	rd := newRenderer(b.db, b.cfg)
+	rd.stored = true
+	if err := rd.loadCodeBlocks(&page); err != nil {
+		return entry, err
+	}
+	html, err := rd.renderPage(&page)
+	if err != nil {
+		return entry, err
+	}
+	if err := add(page.Url, html); err != nil {
+		return entry, err
+	}
+	b.addBundles(rd.bundles)
+
+	translations, err := renderTranslations(b.db, b.cfg, page)
+	if err != nil {
+		return entry, err
+	}
+	for _, t := range translations {
+		if err := add(t.URL, t.HTML); err != nil {
+			return entry, err
+		}
+		b.addBundles(t.Bundles)
+	}
+	return entry, nil
+}
+
+func (b *staticBuild) addBundles(bundles []assetBundle) {
+	for _, a := range bundles {
+		b.bundles[a.Name()] = a.Content
+	}
+}
+
+// assetFiles returns where bundles are written in the build
+func assetFiles(names []string) []string {
+	files := make([]string, len(names))
+	for i, name := range names {
+		files[i] = strings.TrimPrefix(assetsPath, "/") + name
+	}
+	return files
+}
+
+// writeAssets writes the CSS and JS bundles the pages link to. Bundle names
+// change with their content, so ones already written are left alone.
+func (b *staticBuild) writeAssets() error {
+	names := map[string]bool{}
+	for _, p := range b.pages {
+		for _, name := range p.Assets {
+			names[name] = true
+		}
+	}
+	for name := range names {
+		file := assetFiles([]string{name})[0]
+		if b.exists([]string{file}) {
+			b.written[file] = true
+			continue
+		}
+
+		// Pages are only left unchanged while their bundles are written, so
+		// every other bundle was rendered by this build
+		content, ok := b.bundles[name]
+		if !ok {
+			return fmt.Errorf("bundle %s wasn't rendered", name)
+		}
+		if err := b.write(file, []byte(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMedia copies every media file, and the resized variants of images,
+// generating any variants not made yet
+func (b *staticBuild) writeMedia() error {
+	rows, err := b.db.Query("SELECT " + mediaColumns + " FROM media ORDER BY id")
+	if err != nil {
+		return err
+	}
+	var list []Media
+	for rows.Next() {
+		m, err := scanMedia(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range list {
+		if err := b.copyStored(m.StorageKey, strings.TrimPrefix(m.URL, "/")); err != nil {
+			return fmt.Errorf("%s: %w", m.Filename, err)
+		}
+		for _, width := range variantWidths(m, b.cfg.Media) {
+			key, err := ensureVariant(b.store, m, width, b.cfg.Media.JPEGQuality)
+			if err != nil {
+				return fmt.Errorf("%s: %dpx variant: %w", m.Filename, width, err)
+			}
+			if err := b.copyStored(key, strings.TrimPrefix(variantURL(m, width), "/")); err != nil {
+				return fmt.Errorf("%s: %w", m.Filename, err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyStored copies a stored file into the output. Storage keys embed the
+// file's checksum, so a file already there is the same file.
+func (b *staticBuild) copyStored(key, name string) error {
+	if b.exists([]string{name}) {
+		b.written[name] = true
+		return nil
+	}
+	f, err := b.store.Open(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		// The server would answer with a 404 too
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return b.write(name, data)
+}
+
+// writeRedirects writes the redirect rules as a _redirects file, and each
+// exact rule and link page as a meta-refresh page for hosts that don't read it
+func (b *staticBuild) writeRedirects() error {
+	var lines []string
+	pages, err := b.db.Query(`
+		SELECT p.url, p.link
+		FROM pages p
+		JOIN published_pages pp ON pp.page_id = p.id
+		WHERE p.active = 1 AND IFNULL(p.link, '') != ''
+		ORDER BY p.id`)
+	if err != nil {
+		return err
+	}
+	defer pages.Close()
+	for pages.Next() {
+		var source, target string
+		if err := pages.Scan(&source, &target); err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%s %s 301", source, target))
+	}
+	if err := pages.Err(); err != nil {
+		return err
+	}
+
+	rows, err := b.db.Query("SELECT " + redirectColumns + " FROM redirects ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rule, err := scanRedirect(rows)
+		if err != nil {
+			return err
+		}
+		if isPattern(rule.Source) {
+			// Static hosts call the matched part a splat
+			target := strings.Replace(rule.Target, "*", ":splat", 1)
+			lines = append(lines, fmt.Sprintf("%s %s %d", rule.Source, target, rule.StatusCode))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %d", rule.Source, rule.Target, rule.StatusCode))
+
+		// Published pages win over redirects, as on the server
+		name := staticFile(rule.Source)
+		if b.claimed[name] {
+			continue
+		}
+		if err := b.write(name, []byte(redirectPage(rule.Target))); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	b.report.Redirects = len(lines)
+	if len(lines) == 0 {
+		return nil
+	}
+	return b.write(staticRedirectsName, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// writeSitemap writes the sitemap and robots.txt. Collection posts aren't part
+// of a static build, so the sitemap only lists pages.
+func (b *staticBuild) writeSitemap() error {
+	entries, err := sitemapEntries(b.db, b.cfg)
+	if err != nil {
+		return err
+	}
+	built := map[string]bool{}
+	for _, p := range b.pages {
+		for _, name := range p.Files {
+			built[name] = true
+		}
+	}
+	var pages []sitemapURL
+	for _, e := range entries {
+		url := strings.TrimPrefix(e.Loc, strings.TrimRight(b.cfg.SiteURL, "/"))
+		if built[staticFile(url)] {
+			pages = append(pages, e)
+		}
+	}
+
+	files := map[string]interface{}{}
+	perFile := b.cfg.Sitemap.MaxURLs
+	if len(pages) <= perFile {
+		files["sitemap.xml"] = sitemapURLSet{Xmlns: sitemapNS, URLs: pages}
+	} else {
+		files["sitemap.xml"] = buildSitemapIndex(b.cfg, pages, perFile)
+		for n := 0; n*perFile < len(pages); n++ {
+			files[fmt.Sprintf("sitemap-%d.xml", n+1)] = sitemapURLSet{Xmlns: sitemapNS, URLs: pages[n*perFile : min(len(pages), (n+1)*perFile)]}
+		}
+	}
+	for name, v := range files {
+		data, err := marshalXML(v)
+		if err != nil {
+			return err
+		}
+		if err := b.write(name, data); err != nil {
+			return err
+		}
+	}
+	return b.write("robots.txt", []byte(robotsTxt(b.cfg)))
+}
+
+// writeFeeds writes the page feeds configured in the settings
+func (b *staticBuild) writeFeeds() error {
+	for _, f := range b.cfg.Feeds {
+		doc, err := pageFeed(b.db, b.cfg, f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		for _, format := range []string{FeedRSS, FeedAtom} {
+			data, err := encodeFeed(b.cfg, doc, format)
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			if err := b.write("feeds/"+f.Name+"."+format, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeStale deletes whatever the last build wrote that this one didn't,
+// such as pages since unpublished, along with directories left empty
+func (b *staticBuild) removeStale() {
+	var old []string
+	for name := range b.before {
+		old = append(old, name)
+	}
+	sort.Strings(old)
+
+	for _, name := range old {
+		if b.written[name] || !validStaticName(b.dir, name) {
+			continue
+		}
+		file := filepath.Join(b.dir, filepath.FromSlash(name))
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		b.report.Removed = append(b.report.Removed, name)
+		for dir := filepath.Dir(file); dir != filepath.Clean(b.dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+}
+
+// write stores one file of the output, name being slash-separated and
+// relative to the output directory
+func (b *staticBuild) write(name string, data []byte) error {
+	file := filepath.Join(b.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		return err
+	}
+	b.written[name] = true
+	return nil
+}
+
+// exists reports whether the last build wrote every one of the files and
+// they're all still there
+func (b *staticBuild) exists(names []string) bool {
+	for _, name := range names {
+		if !b.before[name] {
+			return false
+		}
+		if _, err := os.Stat(filepath.Join(b.dir, filepath.FromSlash(name))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// staticFile is where a URL's page goes in the output: /about becomes
+// about/index.html, while a URL with an extension is written as is
+func staticFile(url string) string {
+	name := strings.TrimPrefix(path.Clean("/"+url), "/")
+	if name == "" {
+		return "index.html"
+	}
+	if path.Ext(name) != "" {
+		return name
+	}
+	return name + "/index.html"
+}
+
+// validStaticName guards removals against a tampered manifest: name must be
+// a clean relative path naming a file inside dir
+func validStaticName(dir, name string) bool {
+	if name == "" || name == "." || name == ".." || name == staticManifestName || path.IsAbs(name) ||
+		path.Clean(name) != name || strings.HasPrefix(name, "../") || strings.Contains(name, `\`) {
+		return false
+	}
+	rel, err := filepath.Rel(dir, filepath.Join(dir, filepath.FromSlash(name)))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// redirectPage is a page that sends browsers on to target
+func redirectPage(target string) string {
+	t := template.HTMLEscapeString(target)
+	return `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Redirecting</title>
+<meta name="robots" content="noindex">
+<link rel="canonical" href="` + t + `">
+<meta http-equiv="refresh" content="0; url=` + t + `">
+</head>
+<body>
+<p><a href="` + t + `">` + t + `</a></p>
+</body>
+</html>
+`
+}
+
+// pageFingerprint hashes everything a page's rendering depends on directly:
+// its row and translations, its template chain, the blocks placed on it and
+// their translations, when it was last published and the Markdown renderer's
+// version. Helpers such as menus and posts read other content, which only a
+// full build picks up, or republishing the page.
+func pageFingerprint(db *sql.DB, page Page, publishedAt string) (string, error) {
+	chain, err := templateChain(db, page.TemplateID)
+	if err != nil {
+		return "", err
+	}
+	placed := "page_id = ?"
+	params := []interface{}{page.ID}
+	if len(chain) > 0 {
+		placed += " OR template_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(chain)), ",") + ")"
+		for _, id := range chain {
+			params = append(params, id)
+		}
+	}
+	inChain := "id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(chain)), ",") + ")"
+	if len(chain) == 0 {
+		inChain = "0"
+	}
+	chainParams := params[1:]
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x1e%d\x1e", publishedAt, markdown.Version)
+	queries := []struct {
+		query  string
+		params []interface{}
+	}{
+		{"SELECT * FROM pages WHERE id = ?", []interface{}{page.ID}},
+		{"SELECT * FROM page_translations WHERE page_id = ? ORDER BY locale", []interface{}{page.ID}},
+		{"SELECT * FROM templates WHERE " + inChain + " ORDER BY id", chainParams},
+		{"SELECT * FROM codeblocks_ordering WHERE " + placed + " ORDER BY id", params},
+		{"SELECT * FROM code_blocks WHERE id IN (SELECT codeblock_id FROM codeblocks_ordering WHERE " + placed + ") ORDER BY id", params},
+		{"SELECT * FROM code_block_translations WHERE codeblock_id IN (SELECT codeblock_id FROM codeblocks_ordering WHERE " + placed + ") ORDER BY codeblock_id, locale", params},
+	}
+	for _, q := range queries {
+		if err := hashRows(h, db, q.query, q.params...); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashRows feeds every column of every row a query returns into h
+func hashRows(h hash.Hash, db *sql.DB, query string, params ...interface{}) error {
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for _, v := range values {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			fmt.Fprintf(h, "%v\x1f", v)
+		}
+		h.Write([]byte{'\x1e'})
+	}
+	h.Write([]byte{'\x1d'})
+	return rows.Err()
+}
+
+func hashSettings(cfg *settings.Settings) (string, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStaticFile(t *testing.T) {
+	tests := []struct{ url, want string }{
+		{"/", "index.html"},
+		{"", "index.html"},
+		{"/about", "about/index.html"},
+		{"/about/", "about/index.html"},
+		{"/docs/team", "docs/team/index.html"},
+		{"/404.html", "404.html"},
+		{"/feed.xml", "feed.xml"},
+		{"/../../etc/passwd", "etc/passwd/index.html"},
+		{"/a/../../b.html", "b.html"},
+		{"/..", "index.html"},
+		{"//about", "about/index.html"},
+	}
+	for _, tt := range tests {
+		if got := staticFile(tt.url); got != tt.want {
+			t.Errorf("staticFile(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestValidStaticName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "public")
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"index.html", true},
+		{"about/index.html", true},
+		{"assets/0123abcd.css", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../index.html", false},
+		{"../../etc/passwd", false},
+		{"a/../../b", false},
+		{"a/./b", false},
+		{"a//b", false},
+		{"/etc/passwd", false},
+		{`..\index.html`, false},
+		{staticManifestName, false},
+	}
+	for _, tt := range tests {
+		if got := validStaticName(dir, tt.name); got != tt.want {
+			t.Errorf("validStaticName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveStale(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "public")
+	files := []string{"index.html", "old/index.html", "docs/old/index.html", "docs/team/index.html"}
+	for _, name := range append(files, "../outside.txt") {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The manifest lists the last build's files, plus entries a tampered
+	// manifest could hold
+	b := &staticBuild{
+		dir:     dir,
+		before:  map[string]bool{".": true, "..": true, "../outside.txt": true, "/etc/passwd": true},
+		written: map[string]bool{"index.html": true, "docs/team/index.html": true},
+		report:  &StaticReport{},
+	}
+	for _, name := range files {
+		b.before[name] = true
+	}
+	b.removeStale()
+
+	want := []string{"docs/old/index.html", "old/index.html"}
+	if !reflect.DeepEqual(b.report.Removed, want) {
+		t.Errorf("Removed = %q, want %q", b.report.Removed, want)
+	}
+	for _, name := range []string{"index.html", "docs/team/index.html", "../outside.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+	// Directories left empty go too, but never the output directory itself
+	for _, name := range []string{"old", "docs/old"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("empty directory %s is still there", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "docs")); err != nil {
+		t.Errorf("docs was removed: %v", err)
+	}
+}
+
+func TestRemoveStaleKeepsEmptyOutputDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "public")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b := &staticBuild{
+		dir:     dir,
+		before:  map[string]bool{"index.html": true},
+		written: map[string]bool{},
+		report:  &StaticReport{},
+	}
+	b.removeStale()
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("the output directory was removed: %v", err)
+	}
+}
@@ -0,0 +1,806 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/utils"
+)
+
+// Kinds of content terms can be assigned to
+const (
+	TermObjectPage = "page"
+	TermObjectPost = "post"
+)
+
+type Vocabulary struct {
+	ID           int     `json:"id"`
+	Name         string  `json:"name"`
+	Title        string  `json:"title"`
+	Hierarchical bool    `json:"hierarchical"`
+	BasePath     *string `json:"base_path,omitempty"`
+	ListPageID   *int    `json:"list_page_id,omitempty"`
+}
+
+type Term struct {
+	ID           int     `json:"id"`
+	VocabularyID int     `json:"vocabulary_id"`
+	Vocabulary   string  `json:"vocabulary"`
+	Name         string  `json:"name"`
+	Slug         string  `json:"slug"`
+	Description  *string `json:"description,omitempty"`
+	ParentID     int     `json:"parent_id"`
+	SortOrder    int     `json:"sort_order"`
+	URL          string  `json:"url,omitempty"`
+	Children     []*Term `json:"children,omitempty"`
+}
+
+const vocabularyColumns = "id, name, title, hierarchical, base_path, list_page_id"
+
+func scanVocabulary(row interface{ Scan(...interface{}) error }) (Vocabulary, error) {
+	var v Vocabulary
+	var hierarchical int
+	err := row.Scan(&v.ID, &v.Name, &v.Title, &hierarchical, &v.BasePath, &v.ListPageID)
+	v.Hierarchical = hierarchical == 1
+	return v, err
+}
+
+func getVocabulary(db *sql.DB, name string) (Vocabulary, error) {
+	return scanVocabulary(db.QueryRow("SELECT "+vocabularyColumns+" FROM vocabularies WHERE name = ?", name))
+}
+
+// termURL is where a term's listing is served, if its vocabulary has one
+func termURL(v Vocabulary, slug string) string {
+	if v.BasePath == nil || v.ListPageID == nil {
+		return ""
+	}
+	return *v.BasePath + "/" + slug
+}
+
+const termColumns = "id, vocabulary_id, name, slug, description, parent_id, sort_order"
+
+func scanTerm(row interface{ Scan(...interface{}) error }, v Vocabulary) (Term, error) {
+	t := Term{Vocabulary: v.Name}
+	err := row.Scan(&t.ID, &t.VocabularyID, &t.Name, &t.Slug, &t.Description, &t.ParentID, &t.SortOrder)
+	t.URL = termURL(v, t.Slug)
+	return t, err
+}
+
+// vocabularyTerms returns every term of a vocabulary ordered by parent and
+// sort order
+func vocabularyTerms(db *sql.DB, v Vocabulary) ([]Term, error) {
+	rows, err := db.Query("SELECT "+termColumns+" FROM terms WHERE vocabulary_id = ? ORDER BY parent_id, sort_order, name", v.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	terms := []Term{}
+	for rows.Next() {
+		t, err := scanTerm(rows, v)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, t)
+	}
+	return terms, rows.Err()
+}
+
+// buildTermTree nests terms under their parents; terms whose parent is
+// missing are treated as top level
+func buildTermTree(terms []Term) []*Term {
+	nodes := make(map[int]*Term, len(terms))
+	for i := range terms {
+		t := terms[i]
+		t.Children = nil
+		nodes[t.ID] = &t
+	}
+
+	var roots []*Term
+	for i := range terms {
+		node := nodes[terms[i].ID]
+		if parent, ok := nodes[node.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+// termDescendantIDs returns id and the IDs of every term below it, so a
+// category listing includes its subcategories
+func termDescendantIDs(terms []Term, id int) []int {
+	children := map[int][]int{}
+	for _, t := range terms {
+		children[t.ParentID] = append(children[t.ParentID], t.ID)
+	}
+
+	ids := []int{id}
+	for i := 0; i < len(ids); i++ {
+		ids = append(ids, children[ids[i]]...)
+	}
+	return ids
+}
+
+// checkTermParent rejects a parent that would put term id under itself
+func checkTermParent(terms []Term, id, parent int) error {
+	parents := map[int]int{}
+	for _, t := range terms {
+		parents[t.ID] = t.ParentID
+	}
+	if parent != -1 {
+		if _, ok := parents[parent]; !ok {
+			return fmt.Errorf("parent term %d is not in this vocabulary", parent)
+		}
+	}
+	for p, steps := parent, 0; p != -1 && steps <= len(parents); p, steps = parents[p], steps+1 {
+		if p == id {
+			return fmt.Errorf("term %d can't be placed under its own descendant", id)
+		}
+	}
+	return nil
+}
+
+// findTerm resolves "vocabulary/slug" to the vocabulary and term
+func findTerm(db *sql.DB, ref string) (Vocabulary, Term, error) {
+	vocab, slug, ok := strings.Cut(ref, "/")
+	if !ok {
+		return Vocabulary{}, Term{}, fmt.Errorf("term must be given as vocabulary/slug")
+	}
+	v, err := getVocabulary(db, vocab)
+	if err != nil {
+		return v, Term{}, err
+	}
+	t, err := scanTerm(db.QueryRow("SELECT "+termColumns+" FROM terms WHERE vocabulary_id = ? AND slug = ?", v.ID, slug), v)
+	return v, t, err
+}
+
+// termAndDescendants resolves "vocabulary/slug" to the IDs of the term and
+// everything below it
+func termAndDescendants(db *sql.DB, ref string) ([]int, error) {
+	v, t, err := findTerm(db, ref)
+	if err != nil {
+		return nil, err
+	}
+	terms, err := vocabularyTerms(db, v)
+	if err != nil {
+		return nil, err
+	}
+	return termDescendantIDs(terms, t.ID), nil
+}
+
+// inList returns "?, ?, ?" and the matching arguments for an IN clause
+func inList(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", "), args
+}
+
+// objectTerms returns the terms assigned to a page or post, grouped by
+// vocabulary name. An empty vocab returns every vocabulary.
+func objectTerms(db *sql.DB, objectType string, objectID int, vocab string) (map[string][]Term, error) {
+	query := `
+		SELECT v.id, v.name, v.title, v.hierarchical, v.base_path, v.list_page_id,
+			t.id, t.vocabulary_id, t.name, t.slug, t.description, t.parent_id, t.sort_order
+		FROM term_assignments ta
+		JOIN terms t ON t.id = ta.term_id
+		JOIN vocabularies v ON v.id = t.vocabulary_id
+		WHERE ta.object_type = ? AND ta.object_id = ?`
+	params := []interface{}{objectType, objectID}
+	if vocab != "" {
+		query += " AND v.name = ?"
+		params = append(params, vocab)
+	}
+
+	rows, err := db.Query(query+" ORDER BY v.name, t.sort_order, t.name", params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grouped := map[string][]Term{}
+	for rows.Next() {
+		var v Vocabulary
+		var t Term
+		var hierarchical int
+		if err := rows.Scan(&v.ID, &v.Name, &v.Title, &hierarchical, &v.BasePath, &v.ListPageID,
+			&t.ID, &t.VocabularyID, &t.Name, &t.Slug, &t.Description, &t.ParentID, &t.SortOrder); err != nil {
+			return nil, err
+		}
+		t.Vocabulary = v.Name
+		t.URL = termURL(v, t.Slug)
+		grouped[v.Name] = append(grouped[v.Name], t)
+	}
+	return grouped, rows.Err()
+}
+
+// setObjectTerms replaces a page's or post's terms in the named vocabularies,
+// leaving other vocabularies alone. Terms are given by slug; in a flat
+// vocabulary (tags) unknown ones are created, in a hierarchical one they must
+// already exist.
+func setObjectTerms(db *sql.DB, objectType string, objectID int, input map[string][]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := assignObjectTerms(tx, objectType, objectID, input); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// assignObjectTerms does the work of setObjectTerms inside tx
+func assignObjectTerms(tx *sql.Tx, objectType string, objectID int, input map[string][]string) error {
+	for vocab, names := range input {
+		v, err := scanVocabulary(tx.QueryRow("SELECT "+vocabularyColumns+" FROM vocabularies WHERE name = ?", vocab))
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("vocabulary %s not found", vocab)
+		} else if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			DELETE FROM term_assignments
+			WHERE object_type = ? AND object_id = ? AND term_id IN (SELECT id FROM terms WHERE vocabulary_id = ?)`,
+			objectType, objectID, v.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			slug := utils.Slugify(name)
+			if slug == "" {
+				continue
+			}
+
+			var termID int64
+			err := tx.QueryRow("SELECT id FROM terms WHERE vocabulary_id = ? AND slug = ?", v.ID, slug).Scan(&termID)
+			if err == sql.ErrNoRows && !v.Hierarchical {
+				result, err := tx.Exec("INSERT INTO terms (vocabulary_id, name, slug) VALUES (?, ?, ?)", v.ID, name, slug)
+				if err != nil {
+					return err
+				}
+				termID, _ = result.LastInsertId()
+			} else if err == sql.ErrNoRows {
+				return fmt.Errorf("term %s/%s not found", vocab, slug)
+			} else if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("INSERT OR IGNORE INTO term_assignments (term_id, object_type, object_id) VALUES (?, ?, ?)",
+				termID, objectType, objectID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteTermAssignments drops every term from a page or post being deleted
+func deleteTermAssignments(db *sql.DB, objectType string, objectID interface{}) error {
+	_, err := db.Exec("DELETE FROM term_assignments WHERE object_type = ? AND object_id = ?", objectType, objectID)
+	return err
+}
+
+// vocabularyFor loads the vocabulary named in the URL, writing the error
+// response and returning false if it can't
+func vocabularyFor(db *sql.DB, w http.ResponseWriter, r *http.Request) (Vocabulary, bool) {
+	v, err := getVocabulary(db, chi.URLParam(r, "vocabulary"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Vocabulary not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve vocabulary", http.StatusInternalServerError)
+		}
+		return v, false
+	}
+	return v, true
+}
+
+type vocabularyInput struct {
+	Name         string  `json:"name"`
+	Title        *string `json:"title"`
+	Hierarchical *bool   `json:"hierarchical"`
+	BasePath     *string `json:"base_path"`
+	ListPageID   *int    `json:"list_page_id"`
+}
+
+// columns validates the input and returns the columns and values to save
+func (in vocabularyInput) columns(db *sql.DB) ([]string, []interface{}, error) {
+	var cols []string
+	var vals []interface{}
+
+	if in.Title != nil {
+		cols = append(cols, "title")
+		vals = append(vals, *in.Title)
+	}
+	if in.Hierarchical != nil {
+		hierarchical := 0
+		if *in.Hierarchical {
+			hierarchical = 1
+		}
+		cols = append(cols, "hierarchical")
+		vals = append(vals, hierarchical)
+	}
+	if in.BasePath != nil {
+		// An empty base path turns the term listings off
+		var basePath interface{}
+		if *in.BasePath != "" {
+			normalized, err := normalizeBasePath(*in.BasePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			basePath = normalized
+		}
+		cols = append(cols, "base_path")
+		vals = append(vals, basePath)
+	}
+	if in.ListPageID != nil {
+		if _, err := getPage(db, *in.ListPageID); err != nil {
+			return nil, nil, fmt.Errorf("layout page %d not found", *in.ListPageID)
+		}
+		cols = append(cols, "list_page_id")
+		vals = append(vals, *in.ListPageID)
+	}
+	return cols, vals, nil
+}
+
+func GetVocabularies(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT " + vocabularyColumns + " FROM vocabularies ORDER BY name")
+		if err != nil {
+			http.Error(w, "Failed to retrieve vocabularies", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		vocabularies := []Vocabulary{}
+		for rows.Next() {
+			v, err := scanVocabulary(rows)
+			if err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			vocabularies = append(vocabularies, v)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vocabularies)
+	}
+}
+
+func GetVocabulary(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vocabularyFor(db, w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func CreateVocabulary(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input vocabularyInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !contentName.MatchString(input.Name) {
+			http.Error(w, "Vocabulary name must be lowercase letters, digits and underscores", http.StatusBadRequest)
+			return
+		}
+		if input.Title == nil {
+			input.Title = &input.Name
+		}
+
+		cols, vals, err := input.columns(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cols = append(cols, "name")
+		vals = append(vals, input.Name)
+
+		if _, err := db.Exec("INSERT INTO vocabularies ("+strings.Join(cols, ", ")+") VALUES (?"+strings.Repeat(", ?", len(cols)-1)+")", vals...); err != nil {
+			http.Error(w, "Failed to create vocabulary: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		v, err := getVocabulary(db, input.Name)
+		if err != nil {
+			http.Error(w, "Failed to load vocabulary", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func UpdateVocabulary(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vocabularyFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		var input vocabularyInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		cols, vals, err := input.columns(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(cols) == 0 {
+			http.Error(w, "No fields to update", http.StatusBadRequest)
+			return
+		}
+
+		// Flattening a vocabulary moves every term to the top level
+		if input.Hierarchical != nil && !*input.Hierarchical {
+			if _, err := db.Exec("UPDATE terms SET parent_id = -1 WHERE vocabulary_id = ?", v.ID); err != nil {
+				http.Error(w, "Failed to flatten terms", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		query := "UPDATE vocabularies SET " + strings.Join(cols, " = ?, ") + " = ? WHERE id = ?"
+		if _, err := db.Exec(query, append(vals, v.ID)...); err != nil {
+			http.Error(w, "Failed to update vocabulary: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Vocabulary updated successfully"))
+	}
+}
+
+// DeleteVocabulary removes a vocabulary, its terms and their assignments
+func DeleteVocabulary(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vocabularyFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to delete vocabulary", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		for _, stmt := range []string{
+			"DELETE FROM term_assignments WHERE term_id IN (SELECT id FROM terms WHERE vocabulary_id = ?)",
+			"DELETE FROM terms WHERE vocabulary_id = ?",
+			"DELETE FROM vocabularies WHERE id = ?",
+		} {
+			if _, err := tx.Exec(stmt, v.ID); err != nil {
+				http.Error(w, "Failed to delete vocabulary: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete vocabulary", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Vocabulary deleted successfully"))
+	}
+}
+
+// GetTerms lists a vocabulary's terms; ?view=tree nests them under children
+func GetTerms(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vocabularyFor(db, w, r)
+		if !ok {
+			return
+		}
+		terms, err := vocabularyTerms(db, v)
+		if err != nil {
+			http.Error(w, "Failed to retrieve terms", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("view") == "tree" {
+			json.NewEncoder(w).Encode(buildTermTree(terms))
+			return
+		}
+		json.NewEncoder(w).Encode(terms)
+	}
+}
+
+func CreateTerm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vocabularyFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		t := Term{ParentID: -1}
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(t.Name) == "" {
+			http.Error(w, "Term name is required", http.StatusBadRequest)
+			return
+		}
+		if t.Slug = utils.Slugify(t.Slug); t.Slug == "" {
+			t.Slug = utils.Slugify(t.Name)
+		}
+		if t.ParentID != -1 {
+			if !v.Hierarchical {
+				http.Error(w, "Terms in a flat vocabulary can't have a parent", http.StatusBadRequest)
+				return
+			}
+			terms, err := vocabularyTerms(db, v)
+			if err != nil {
+				http.Error(w, "Failed to load terms", http.StatusInternalServerError)
+				return
+			}
+			if err := checkTermParent(terms, 0, t.ParentID); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		result, err := db.Exec("INSERT INTO terms (vocabulary_id, name, slug, description, parent_id, sort_order) VALUES (?, ?, ?, ?, ?, ?)",
+			v.ID, t.Name, t.Slug, t.Description, t.ParentID, t.SortOrder)
+		if err != nil {
+			http.Error(w, "Failed to create term: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Failed to retrieve new term ID", http.StatusInternalServerError)
+			return
+		}
+
+		created, err := scanTerm(db.QueryRow("SELECT "+termColumns+" FROM terms WHERE id = ?", id), v)
+		if err != nil {
+			http.Error(w, "Failed to load term", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+func UpdateTerm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vocabularyFor(db, w, r)
+		if !ok {
+			return
+		}
+		termID, err := strconv.Atoi(chi.URLParam(r, "termID"))
+		if err != nil {
+			http.Error(w, "Invalid term ID", http.StatusBadRequest)
+			return
+		}
+
+		var input struct {
+			Name        *string `json:"name"`
+			Slug        *string `json:"slug"`
+			Description *string `json:"description"`
+			ParentID    *int    `json:"parent_id"`
+			SortOrder   *int    `json:"sort_order"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Build the query to update only the fields that are provided
+		query := "UPDATE terms SET"
+		params := []interface{}{}
+
+		if input.Name != nil {
+			query += " name = ?,"
+			params = append(params, *input.Name)
+		}
+		if input.Slug != nil {
+			slug := utils.Slugify(*input.Slug)
+			if slug == "" {
+				http.Error(w, "slug must contain letters or digits", http.StatusBadRequest)
+				return
+			}
+			query += " slug = ?,"
+			params = append(params, slug)
+		}
+		if input.Description != nil {
+			query += " description = ?,"
+			params = append(params, *input.Description)
+		}
+		if input.ParentID != nil {
+			if *input.ParentID != -1 && !v.Hierarchical {
+				http.Error(w, "Terms in a flat vocabulary can't have a parent", http.StatusBadRequest)
+				return
+			}
+			terms, err := vocabularyTerms(db, v)
+			if err != nil {
+				http.Error(w, "Failed to load terms", http.StatusInternalServerError)
+				return
+			}
+			if err := checkTermParent(terms, termID, *input.ParentID); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query += " parent_id = ?,"
+			params = append(params, *input.ParentID)
+		}
+		if input.SortOrder != nil {
+			query += " sort_order = ?,"
+			params = append(params, *input.SortOrder)
+		}
+		if len(params) == 0 {
+			http.Error(w, "No fields to update", http.StatusBadRequest)
+			return
+		}
+
+		// Remove trailing comma and add the WHERE clause
+		query = query[:len(query)-1] + " WHERE id = ? AND vocabulary_id = ?"
+		params = append(params, termID, v.ID)
+
+		result, err := db.Exec(query, params...)
+		if err != nil {
+			http.Error(w, "Failed to update term: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Term not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Term updated successfully"))
+	}
+}
+
+// DeleteTerm removes a term and its assignments. Its children move up to the
+// deleted term's parent.
+func DeleteTerm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vocabularyFor(db, w, r)
+		if !ok {
+			return
+		}
+
+		t, err := scanTerm(db.QueryRow("SELECT "+termColumns+" FROM terms WHERE id = ? AND vocabulary_id = ?", chi.URLParam(r, "termID"), v.ID), v)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Term not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve term", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to delete term", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("UPDATE terms SET parent_id = ? WHERE parent_id = ? AND vocabulary_id = ?", t.ParentID, t.ID, v.ID); err != nil {
+			http.Error(w, "Failed to move child terms", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM term_assignments WHERE term_id = ?", t.ID); err != nil {
+			http.Error(w, "Failed to delete term assignments", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM terms WHERE id = ?", t.ID); err != nil {
+			http.Error(w, "Failed to delete term", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete term", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Term deleted successfully"))
+	}
+}
+
+// writeObjectTerms answers GET .../terms for a page or post
+func writeObjectTerms(db *sql.DB, w http.ResponseWriter, objectType string, objectID int) {
+	terms, err := objectTerms(db, objectType, objectID, "")
+	if err != nil {
+		http.Error(w, "Failed to retrieve terms", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(terms)
+}
+
+// updateObjectTerms answers PUT .../terms for a page or post. The body maps
+// vocabulary names to term slugs: {"topics": ["go", "web"], "tags": []}
+func updateObjectTerms(db *sql.DB, w http.ResponseWriter, r *http.Request, objectType string, objectID int) {
+	var input map[string][]string
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := setObjectTerms(db, objectType, objectID, input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Terms updated successfully"))
+}
+
+func GetPageTerms(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := getPage(db, chi.URLParam(r, "pageID"))
+		if err != nil {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+		writeObjectTerms(db, w, TermObjectPage, page.ID)
+	}
+}
+
+func UpdatePageTerms(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := getPage(db, chi.URLParam(r, "pageID"))
+		if err != nil {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+		updateObjectTerms(db, w, r, TermObjectPage, page.ID)
+	}
+}
+
+// postIDFor checks the post in the URL belongs to the collection in the URL
+func postIDFor(db *sql.DB, w http.ResponseWriter, r *http.Request) (int, bool) {
+	c, ok := collectionFor(db, w, r)
+	if !ok {
+		return 0, false
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM posts WHERE id = ? AND collection_id = ?", chi.URLParam(r, "postID"), c.ID).Scan(&id); err != nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+func GetPostTerms(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := postIDFor(db, w, r); ok {
+			writeObjectTerms(db, w, TermObjectPost, id)
+		}
+	}
+}
+
+func UpdatePostTerms(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := postIDFor(db, w, r); ok {
+			updateObjectTerms(db, w, r, TermObjectPost, id)
+		}
+	}
+}
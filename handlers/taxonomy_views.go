@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cms/settings"
+)
+
+// TermItem is a page or post tagged with a term, as listed on the site
+type TermItem struct {
+	Type        string `json:"type"`
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	PublishedAt string `json:"published_at"`
+}
+
+// Date formats when the item was published: {{ .Date "Jan 2, 2006" }}
+func (item TermItem) Date(layout string) string {
+	t := parseTimestamp(item.PublishedAt)
+	if t.IsZero() {
+		return item.PublishedAt
+	}
+	return t.Format(layout)
+}
+
+// liveItems is every page and post the public site shows, in one shape so
+// term listings can mix them
+const liveItems = `
+	SELECT 'page' AS object_type, p.id AS object_id, p.title AS title, p.url AS url, pp.published_at AS published_at
+	FROM pages p
+	JOIN published_pages pp ON pp.page_id = p.id
+	WHERE p.active = 1 AND p.hidden != 1
+	UNION ALL
+	SELECT 'post', po.id, po.title, c.base_path || '/' || po.slug, po.published_at
+	FROM posts po
+	JOIN collections c ON c.id = po.collection_id
+	WHERE po.status = 'published' AND po.published_at <= CURRENT_TIMESTAMP`
+
+func scanTermItems(rows *sql.Rows) ([]TermItem, error) {
+	defer rows.Close()
+
+	items := []TermItem{}
+	for rows.Next() {
+		var item TermItem
+		var publishedAt interface{}
+		if err := rows.Scan(&item.Type, &item.ID, &item.Title, &item.URL, &publishedAt); err != nil {
+			return nil, err
+		}
+		// Through the UNION the driver may hand back either a time or the raw text
+		switch v := publishedAt.(type) {
+		case time.Time:
+			item.PublishedAt = v.UTC().Format(time.RFC3339)
+		case string:
+			item.PublishedAt = parseTimestamp(v).Format(time.RFC3339)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// termItems lists the live pages and posts tagged with any of termIDs, newest
+// first, with the total that match
+func termItems(db *sql.DB, termIDs []int, limit, offset int) ([]TermItem, int, error) {
+	in, args := inList(termIDs)
+	from := `
+		FROM (` + liveItems + `) i
+		WHERE EXISTS (
+			SELECT 1 FROM term_assignments ta
+			WHERE ta.object_type = i.object_type AND ta.object_id = i.object_id AND ta.term_id IN (` + in + `)
+		)`
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*)"+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query("SELECT i.object_type, i.object_id, i.title, i.url, i.published_at"+from+
+		" ORDER BY i.published_at DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	items, err := scanTermItems(rows)
+	return items, total, err
+}
+
+// relatedItems lists live pages and posts sharing terms with the given one,
+// those with the most terms in common first
+func relatedItems(db *sql.DB, objectType string, objectID, limit int) ([]TermItem, error) {
+	rows, err := db.Query(`
+		SELECT i.object_type, i.object_id, i.title, i.url, i.published_at
+		FROM (`+liveItems+`) i
+		JOIN term_assignments ta ON ta.object_type = i.object_type AND ta.object_id = i.object_id
+		WHERE ta.term_id IN (SELECT term_id FROM term_assignments WHERE object_type = ? AND object_id = ?)
+			AND NOT (i.object_type = ? AND i.object_id = ?)
+		GROUP BY i.object_type, i.object_id
+		ORDER BY COUNT(*) DESC, i.published_at DESC
+		LIMIT ?`,
+		objectType, objectID, objectType, objectID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanTermItems(rows)
+}
+
+// TermView is what a vocabulary's list page sees as .Term: either one term's
+// listing, or the vocabulary's index of terms when Term is nil
+type TermView struct {
+	Vocabulary Vocabulary
+	Term       *Term
+	Ancestors  []Term
+	Terms      []*Term
+	Items      []TermItem
+	Title      string
+	URL        string
+
+	Page, TotalPages, Total int
+	PrevURL, NextURL        string
+}
+
+// Items per term listing page
+const termPageSize = 20
+
+// vocabularyForPath finds the vocabulary with listings whose base path
+// contains path
+func vocabularyForPath(db *sql.DB, path string) (*Vocabulary, string, error) {
+	rows, err := db.Query(`SELECT ` + vocabularyColumns + ` FROM vocabularies
+		WHERE base_path IS NOT NULL AND list_page_id IS NOT NULL
+		ORDER BY LENGTH(base_path) DESC`)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v, err := scanVocabulary(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		if path == *v.BasePath || strings.HasPrefix(path, *v.BasePath+"/") {
+			return &v, strings.Trim(strings.TrimPrefix(path, *v.BasePath), "/"), nil
+		}
+	}
+	return nil, "", rows.Err()
+}
+
+// termView loads a term's listing, or nil if the slug or page doesn't exist
+func termView(db *sql.DB, v Vocabulary, slug string, page int) (*TermView, error) {
+	terms, err := vocabularyTerms(db, v)
+	if err != nil {
+		return nil, err
+	}
+	view := &TermView{Vocabulary: v, Title: v.Title, URL: *v.BasePath, Page: 1, TotalPages: 1}
+	if slug == "" {
+		view.Terms = buildTermTree(terms)
+		return view, nil
+	}
+
+	byID := map[int]Term{}
+	var term *Term
+	for i := range terms {
+		byID[terms[i].ID] = terms[i]
+		if terms[i].Slug == slug {
+			term = &terms[i]
+		}
+	}
+	if term == nil {
+		return nil, nil
+	}
+	for p, ok := byID[term.ParentID]; ok; p, ok = byID[p.ParentID] {
+		view.Ancestors = append([]Term{p}, view.Ancestors...)
+	}
+	for _, node := range buildTermTree(terms) {
+		if found := findTermNode(node, term.ID); found != nil {
+			view.Terms = found.Children
+		}
+	}
+
+	items, total, err := termItems(db, termDescendantIDs(terms, term.ID), termPageSize, (page-1)*termPageSize)
+	if err != nil {
+		return nil, err
+	}
+	totalPages := max((total+termPageSize-1)/termPageSize, 1)
+	if page > totalPages {
+		return nil, nil
+	}
+
+	view.Term = term
+	view.Items = items
+	view.Title = v.Title + ": " + term.Name
+	view.URL = term.URL
+	view.Page, view.TotalPages, view.Total = page, totalPages, total
+	if page > 1 {
+		view.URL += "/page/" + strconv.Itoa(page)
+		view.Title += fmt.Sprintf(" (page %d)", page)
+		view.PrevURL = term.URL
+		if page > 2 {
+			view.PrevURL += "/page/" + strconv.Itoa(page-1)
+		}
+	}
+	if page < totalPages {
+		view.NextURL = term.URL + "/page/" + strconv.Itoa(page+1)
+	}
+	return view, nil
+}
+
+func findTermNode(node *Term, id int) *Term {
+	if node.ID == id {
+		return node
+	}
+	for _, child := range node.Children {
+		if found := findTermNode(child, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// serveTaxonomy answers a vocabulary's base path with its term index and
+// {base}/{slug}[/page/N] with a term's listing. Unknown paths report false so
+// pages and redirects under the base path still work.
+func serveTaxonomy(db *sql.DB, cfg *settings.Settings, w http.ResponseWriter, r *http.Request) (bool, error) {
+	v, rest, err := vocabularyForPath(db, r.URL.Path)
+	if err != nil || v == nil {
+		return false, err
+	}
+
+	segments := []string{}
+	if rest != "" {
+		segments = strings.Split(rest, "/")
+	}
+	page := 1
+	switch {
+	case len(segments) == 3 && segments[1] == "page":
+		if page, err = strconv.Atoi(segments[2]); err != nil || page < 1 {
+			return false, nil
+		}
+	case len(segments) > 1:
+		return false, nil
+	}
+	slug := ""
+	if len(segments) > 0 {
+		slug = segments[0]
+	}
+
+	view, err := termView(db, *v, slug, page)
+	if err != nil || view == nil {
+		return false, err
+	}
+
+	layout, err := getPage(db, *v.ListPageID)
+	if err != nil {
+		return false, fmt.Errorf("layout page %d: %w", *v.ListPageID, err)
+	}
+	rd := newRenderer(db, cfg)
+	if err := rd.loadCodeBlocks(&layout); err != nil {
+		return false, err
+	}
+	layout.Title = view.Title
+	layout.Url = view.URL
+	layout.CanonicalURL = nil
+	if view.Term != nil && view.Term.Description != nil && *view.Term.Description != "" {
+		layout.MetaDescription = view.Term.Description
+	}
+	rd.term = view
+
+	html, err := rd.renderPage(&layout)
+	if err != nil {
+		return false, err
+	}
+	writeHTML(w, r, html)
+	return true, nil
+}
+
+// renderedObject is the page or post a render is for, which is the post
+// rather than its layout page on collection detail pages
+func (rd *renderer) renderedObject(page *Page) (string, int) {
+	if rd.post != nil {
+		return TermObjectPost, rd.post.ID
+	}
+	return TermObjectPage, page.ID
+}
@@ -0,0 +1,537 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/settings"
+)
+
+// PageTranslation is a page's title, URL and SEO text in another locale. URL
+// is the path within the locale; the page is served at /{locale}{url}.
+type PageTranslation struct {
+	PageID          int     `json:"page_id"`
+	Locale          string  `json:"locale"`
+	Title           string  `json:"title"`
+	URL             string  `json:"url"`
+	MetaTitle       *string `json:"meta_title"`
+	MetaDescription *string `json:"meta_description"`
+	UpdatedAt       string  `json:"updated_at"`
+}
+
+// CodeBlockTranslation is a code block's content in another locale
+type CodeBlockTranslation struct {
+	CodeBlockID int    `json:"codeblock_id"`
+	Locale      string `json:"locale"`
+	Content     string `json:"content"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// localeURL is the public URL of a path in a non-default locale
+func localeURL(locale, url string) string {
+	if url == "" || url == "/" {
+		return "/" + locale
+	}
+	return "/" + locale + url
+}
+
+// splitLocale separates a non-default locale prefix from a request path,
+// returning an empty locale for default-locale paths
+func splitLocale(locales settings.Locales, path string) (string, string) {
+	for _, locale := range locales.Translated() {
+		prefix := "/" + locale
+		if path == prefix || path == prefix+"/" {
+			return locale, "/"
+		}
+		if strings.HasPrefix(path, prefix+"/") {
+			return locale, strings.TrimPrefix(path, prefix)
+		}
+	}
+	return "", path
+}
+
+const pageTranslationColumns = "page_id, locale, title, url, meta_title, meta_description, updated_at"
+
+func scanPageTranslation(row interface{ Scan(...interface{}) error }) (PageTranslation, error) {
+	var t PageTranslation
+	err := row.Scan(&t.PageID, &t.Locale, &t.Title, &t.URL, &t.MetaTitle, &t.MetaDescription, &t.UpdatedAt)
+	return t, err
+}
+
+// pageTranslations returns a page's translations into the configured locales
+func pageTranslations(db *sql.DB, locales settings.Locales, pageID int) ([]PageTranslation, error) {
+	rows, err := db.Query("SELECT "+pageTranslationColumns+" FROM page_translations WHERE page_id = ? ORDER BY locale", pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := []PageTranslation{}
+	for rows.Next() {
+		t, err := scanPageTranslation(rows)
+		if err != nil {
+			return nil, err
+		}
+		if locales.Has(t.Locale) && t.Locale != locales.Default {
+			translations = append(translations, t)
+		}
+	}
+	return translations, rows.Err()
+}
+
+// translatePage returns a copy of page with its text swapped for the
+// translation's. A canonical URL set on the page points at the default
+// locale's version, so it doesn't carry over.
+func translatePage(page Page, t PageTranslation) Page {
+	page.Title = t.Title
+	page.Url = localeURL(t.Locale, t.URL)
+	page.MetaTitle = t.MetaTitle
+	page.MetaDescription = t.MetaDescription
+	page.CanonicalURL = nil
+	return page
+}
+
+// hreflangLinks lists every language version of a page, including its own,
+// for search engines. Pages without translations get none. Collection and
+// term listings aren't translated, so their layout pages get none either.
+func (rd *renderer) hreflangLinks(page *Page) (string, error) {
+	if len(rd.cfg.Locales.Available) < 2 || rd.current != nil || rd.term != nil {
+		return "", nil
+	}
+	translations, err := pageTranslations(rd.db, rd.cfg.Locales, page.ID)
+	if err != nil || len(translations) == 0 {
+		return "", err
+	}
+	var defaultURL string
+	if err := rd.db.QueryRow("SELECT url FROM pages WHERE id = ?", page.ID).Scan(&defaultURL); err != nil {
+		return "", err
+	}
+
+	link := func(lang, url string) string {
+		return fmt.Sprintf(`<link rel="alternate" hreflang="%s" href="%s">`,
+			template.HTMLEscapeString(lang), template.HTMLEscapeString(absoluteURL(rd.cfg, url)))
+	}
+	tags := []string{link(rd.cfg.Locales.Default, defaultURL)}
+	for _, t := range translations {
+		tags = append(tags, link(t.Locale, localeURL(t.Locale, t.URL)))
+	}
+	tags = append(tags, link("x-default", defaultURL))
+	return strings.Join(tags, "\n"), nil
+}
+
+// publishedTranslation is one locale's rendered version of a page, and the
+// bundles it links to
+type publishedTranslation struct {
+	Locale, URL, Title, HTML string
+	Bundles                  []assetBundle
+}
+
+// renderTranslations renders a page in each locale it has been translated
+// into. page must already have its code blocks loaded.
+func renderTranslations(db *sql.DB, cfg *settings.Settings, page Page) ([]publishedTranslation, error) {
+	translations, err := pageTranslations(db, cfg.Locales, page.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered []publishedTranslation
+	for _, t := range translations {
+		translated := translatePage(page, t)
+		rd := newRenderer(db, cfg)
+		rd.locale = t.Locale
+		rd.stored = true
+		html, err := rd.renderPage(&translated)
+		if err != nil {
+			return nil, fmt.Errorf("%s translation: %w", t.Locale, err)
+		}
+		rendered = append(rendered, publishedTranslation{Locale: t.Locale, URL: translated.Url, Title: translated.Title, HTML: html, Bundles: rd.bundles})
+	}
+	return rendered, nil
+}
+
+// serveTranslation answers locale-prefixed paths with a published
+// translation. A path with no translation falls back to a redirect to the
+// default locale's page at the same path, if there is one.
+func serveTranslation(db *sql.DB, cfg *settings.Settings, w http.ResponseWriter, r *http.Request) (bool, error) {
+	locale, path := splitLocale(cfg.Locales, r.URL.Path)
+	if locale == "" {
+		return false, nil
+	}
+
+	var html string
+	var link sql.NullString
+	err := db.QueryRow(`
+		SELECT pt.html, p.link
+		FROM published_translations pt
+		JOIN pages p ON p.id = pt.page_id
+		WHERE pt.url = ? AND pt.locale = ? AND p.active = 1
+		LIMIT 1`, localeURL(locale, path), locale).Scan(&html, &link)
+	if err == sql.ErrNoRows {
+		var published int
+		err := db.QueryRow(`
+			SELECT COUNT(*) FROM published_pages pp
+			JOIN pages p ON p.id = pp.page_id
+			WHERE pp.url = ? AND p.active = 1`, path).Scan(&published)
+		if err != nil || published == 0 {
+			return false, err
+		}
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, path, http.StatusFound)
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if link.Valid && link.String != "" {
+		http.Redirect(w, r, link.String, http.StatusMovedPermanently)
+		return true, nil
+	}
+	writeHTML(w, r, html)
+	return true, nil
+}
+
+// translatedLocale checks the locale in the URL is one pages can be
+// translated into, writing the error response if not
+func translatedLocale(cfg *settings.Settings, w http.ResponseWriter, r *http.Request) (string, bool) {
+	locale := chi.URLParam(r, "locale")
+	if !cfg.Locales.Has(locale) || locale == cfg.Locales.Default {
+		http.Error(w, fmt.Sprintf("Locale must be one of %v", cfg.Locales.Translated()), http.StatusBadRequest)
+		return "", false
+	}
+	return locale, true
+}
+
+// republish refreshes a page on the public site if it is published, so
+// translation changes show up straight away
+func republish(db *sql.DB, cfg *settings.Settings, pageID int) error {
+	var published int
+	db.QueryRow("SELECT COUNT(*) FROM published_pages WHERE page_id = ?", pageID).Scan(&published)
+	if published == 0 {
+		return nil
+	}
+	return Publish(db, cfg, pageID)
+}
+
+func GetPageTranslations(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pageID, err := strconv.Atoi(chi.URLParam(r, "pageID"))
+		if err != nil {
+			http.Error(w, "Invalid page ID", http.StatusBadRequest)
+			return
+		}
+
+		translations, err := pageTranslations(db, cfg.Locales, pageID)
+		if err != nil {
+			http.Error(w, "Failed to retrieve translations: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(translations)
+	}
+}
+
+// UpdatePageTranslation creates or replaces a page's translation into one
+// locale. Changing the translated URL redirects the old one, as it does for
+// pages, and a published page is republished.
+func UpdatePageTranslation(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locale, ok := translatedLocale(cfg, w, r)
+		if !ok {
+			return
+		}
+		page, err := getPage(db, chi.URLParam(r, "pageID"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Page not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve page", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var input PageTranslation
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Title == "" {
+			http.Error(w, "Title is required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(input.URL, "/") {
+			http.Error(w, "URL must start with /", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to save translation", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var oldURL string
+		err = tx.QueryRow("SELECT url FROM page_translations WHERE page_id = ? AND locale = ?", page.ID, locale).Scan(&oldURL)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Failed to retrieve translation", http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec(`
+			INSERT INTO page_translations (page_id, locale, title, url, meta_title, meta_description, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT (page_id, locale) DO UPDATE SET
+				title = excluded.title,
+				url = excluded.url,
+				meta_title = excluded.meta_title,
+				meta_description = excluded.meta_description,
+				updated_at = excluded.updated_at`,
+			page.ID, locale, input.Title, input.URL, input.MetaTitle, input.MetaDescription)
+		if err != nil {
+			http.Error(w, "Failed to save translation: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if oldURL != "" && oldURL != input.URL {
+			if err := redirectPageURL(tx, localeURL(locale, oldURL), localeURL(locale, input.URL)); err != nil {
+				http.Error(w, "Failed to add redirect: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to save translation", http.StatusInternalServerError)
+			return
+		}
+
+		if err := republish(db, cfg, page.ID); err != nil {
+			http.Error(w, "Translation saved but failed to republish: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		t, err := scanPageTranslation(db.QueryRow("SELECT "+pageTranslationColumns+" FROM page_translations WHERE page_id = ? AND locale = ?", page.ID, locale))
+		if err != nil {
+			http.Error(w, "Failed to load translation", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+func DeletePageTranslation(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locale, ok := translatedLocale(cfg, w, r)
+		if !ok {
+			return
+		}
+		pageID, err := strconv.Atoi(chi.URLParam(r, "pageID"))
+		if err != nil {
+			http.Error(w, "Invalid page ID", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM page_translations WHERE page_id = ? AND locale = ?", pageID, locale)
+		if err != nil {
+			http.Error(w, "Failed to delete translation", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Translation not found", http.StatusNotFound)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM published_translations WHERE page_id = ? AND locale = ?", pageID, locale); err != nil {
+			http.Error(w, "Translation deleted but could not be unpublished", http.StatusInternalServerError)
+			return
+		}
+		// The other versions' hreflang links still list this one
+		if err := republish(db, cfg, pageID); err != nil {
+			http.Error(w, "Translation deleted but failed to republish: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Translation deleted successfully"))
+	}
+}
+
+func GetCodeBlockTranslations(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT codeblock_id, locale, content, updated_at FROM code_block_translations WHERE codeblock_id = ? ORDER BY locale",
+			chi.URLParam(r, "codeBlockID"))
+		if err != nil {
+			http.Error(w, "Failed to retrieve translations", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		translations := []CodeBlockTranslation{}
+		for rows.Next() {
+			var t CodeBlockTranslation
+			if err := rows.Scan(&t.CodeBlockID, &t.Locale, &t.Content, &t.UpdatedAt); err != nil {
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			translations = append(translations, t)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(translations)
+	}
+}
+
+// UpdateCodeBlockTranslation creates or replaces a code block's content in one
+// locale. Like edits to the block itself, it shows on the public site once the
+// pages using it are republished.
+func UpdateCodeBlockTranslation(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locale, ok := translatedLocale(cfg, w, r)
+		if !ok {
+			return
+		}
+		codeBlockID, err := strconv.Atoi(chi.URLParam(r, "codeBlockID"))
+		if err != nil {
+			http.Error(w, "Invalid code block ID", http.StatusBadRequest)
+			return
+		}
+		var blockType string
+		err = db.QueryRow("SELECT type FROM code_blocks WHERE id = ?", codeBlockID).Scan(&blockType)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Code block not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to retrieve code block", http.StatusInternalServerError)
+			return
+		}
+
+		var input struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		rendered, hash, _, err := markdownCache(blockType, input.Content)
+		if err != nil {
+			http.Error(w, "Invalid Markdown: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO code_block_translations (codeblock_id, locale, content, rendered, rendered_hash, updated_at)
+			VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT (codeblock_id, locale) DO UPDATE SET
+				content = excluded.content,
+				rendered = excluded.rendered,
+				rendered_hash = excluded.rendered_hash,
+				updated_at = excluded.updated_at`,
+			codeBlockID, locale, input.Content, rendered, hash)
+		if err != nil {
+			http.Error(w, "Failed to save translation: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Translation saved successfully"))
+	}
+}
+
+func DeleteCodeBlockTranslation(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locale, ok := translatedLocale(cfg, w, r)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM code_block_translations WHERE codeblock_id = ? AND locale = ?", chi.URLParam(r, "codeBlockID"), locale)
+		if err != nil {
+			http.Error(w, "Failed to delete translation", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Translation not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Translation deleted successfully"))
+	}
+}
+
+// untranslated is what one locale is missing
+type untranslated struct {
+	Locale     string             `json:"locale"`
+	Pages      []untranslatedItem `json:"pages"`
+	CodeBlocks []untranslatedItem `json:"code_blocks"`
+}
+
+type untranslatedItem struct {
+	ID    int     `json:"id"`
+	Title string  `json:"title"`
+	URL   *string `json:"url,omitempty"`
+}
+
+// GetMissingTranslations lists, for each translated locale (or just
+// ?locale=), the pages and HTML and Markdown code blocks with no translation
+// into it.
+// CSS and JS blocks are shared by every locale so they're left out.
+func GetMissingTranslations(db *sql.DB, cfg *settings.Settings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locales := cfg.Locales.Translated()
+		if locale := r.URL.Query().Get("locale"); locale != "" {
+			if !cfg.Locales.Has(locale) || locale == cfg.Locales.Default {
+				http.Error(w, fmt.Sprintf("Locale must be one of %v", locales), http.StatusBadRequest)
+				return
+			}
+			locales = []string{locale}
+		}
+
+		list := func(query, locale string) ([]untranslatedItem, error) {
+			rows, err := db.Query(query, locale)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+
+			items := []untranslatedItem{}
+			for rows.Next() {
+				var item untranslatedItem
+				if err := rows.Scan(&item.ID, &item.Title, &item.URL); err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			return items, rows.Err()
+		}
+
+		missing := []untranslated{}
+		for _, locale := range locales {
+			pages, err := list(`
+				SELECT id, title, url FROM pages
+				WHERE id NOT IN (SELECT page_id FROM page_translations WHERE locale = ?)
+				ORDER BY id`, locale)
+			if err != nil {
+				http.Error(w, "Failed to list pages: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			blocks, err := list(`
+				SELECT id, title, NULL FROM code_blocks
+				WHERE IFNULL(type, 'html') IN ('html', 'template', 'markdown')
+					AND id NOT IN (SELECT codeblock_id FROM code_block_translations WHERE locale = ?)
+				ORDER BY id`, locale)
+			if err != nil {
+				http.Error(w, "Failed to list code blocks: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			missing = append(missing, untranslated{Locale: locale, Pages: pages, CodeBlocks: blocks})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(missing)
+	}
+}
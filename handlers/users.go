@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/sites"
+)
+
+// userInput is the body of create and update requests; nil fields are left
+// unchanged on update
+type userInput struct {
+	Username  *string `json:"username"`
+	Password  *string `json:"password"`
+	Superuser *int    `json:"superuser"`
+	Sites     *[]int  `json:"sites"`
+}
+
+// saveUserSites replaces the sites a user has been granted
+func saveUserSites(tx *sql.Tx, userID int64, siteIDs []int) error {
+	if _, err := tx.Exec("DELETE FROM user_sites WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, siteID := range siteIDs {
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM sites WHERE id = ?", siteID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return fmt.Errorf("site %d not found", siteID)
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO user_sites (user_id, site_id) VALUES (?, ?)", userID, siteID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetUsers(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := reg.Main().Query("SELECT id FROM users ORDER BY username")
+		if err != nil {
+			http.Error(w, "Failed to retrieve users", http.StatusInternalServerError)
+			return
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				http.Error(w, "Failed to scan row", http.StatusInternalServerError)
+				return
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		users := []sites.User{}
+		for _, id := range ids {
+			u, err := sites.GetUser(reg.Main(), id)
+			if err != nil {
+				http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
+				return
+			}
+			users = append(users, u)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	}
+}
+
+// NewUser is an admin user to add
+type NewUser struct {
+	Username  string
+	Password  string
+	Superuser int
+	Sites     []int
+}
+
+// CheckNewUser validates a user before AddUser. The first user must be a
+// superuser, since creating it closes the admin API to everyone else.
+func CheckNewUser(database *sql.DB, u NewUser) error {
+	if !sites.ValidUsername(u.Username) {
+		return fmt.Errorf("username must be lowercase letters, digits and . _ @ -")
+	}
+	if len(u.Password) < sites.MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", sites.MinPasswordLength)
+	}
+	var existing int
+	if err := database.QueryRow("SELECT COUNT(*) FROM users").Scan(&existing); err != nil {
+		return err
+	}
+	if existing == 0 && u.Superuser != 1 {
+		return fmt.Errorf("the first user must be a superuser")
+	}
+	var taken int
+	if err := database.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", u.Username).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return fmt.Errorf("user %s already exists", u.Username)
+	}
+	for _, siteID := range u.Sites {
+		var exists int
+		if err := database.QueryRow("SELECT COUNT(*) FROM sites WHERE id = ?", siteID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return fmt.Errorf("site %d not found", siteID)
+		}
+	}
+	return nil
+}
+
+// AddUser creates a user that passed CheckNewUser
+func AddUser(database *sql.DB, u NewUser) (sites.User, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return sites.User{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO users (username, password_hash, superuser) VALUES (?, ?, ?)",
+		u.Username, sites.HashPassword(u.Password), u.Superuser)
+	if err != nil {
+		return sites.User{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return sites.User{}, err
+	}
+	if err := saveUserSites(tx, id, u.Sites); err != nil {
+		return sites.User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return sites.User{}, err
+	}
+	return sites.GetUser(database, int(id))
+}
+
+// SetPassword changes a user's password and signs them out everywhere
+func SetPassword(database *sql.DB, id int, password string) error {
+	if len(password) < sites.MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", sites.MinPasswordLength)
+	}
+	result, err := database.Exec("UPDATE users SET password_hash = ? WHERE id = ?", sites.HashPassword(password), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	sites.ForgetLogins()
+	return nil
+}
+
+// CreateUser adds an admin user
+func CreateUser(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input userInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var u NewUser
+		if input.Username != nil {
+			u.Username = *input.Username
+		}
+		if input.Password != nil {
+			u.Password = *input.Password
+		}
+		if input.Superuser != nil {
+			u.Superuser = *input.Superuser
+		}
+		if input.Sites != nil {
+			u.Sites = *input.Sites
+		}
+		if err := CheckNewUser(reg.Main(), u); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		created, err := AddUser(reg.Main(), u)
+		if err != nil {
+			http.Error(w, "Failed to create user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// UpdateUser changes a user's password, superuser flag or site access. The
+// last superuser can't be demoted.
+func UpdateUser(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "userID"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		u, err := sites.GetUser(reg.Main(), id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var input userInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Username != nil && *input.Username != u.Username {
+			http.Error(w, "Usernames can't be changed", http.StatusBadRequest)
+			return
+		}
+		if input.Password != nil && len(*input.Password) < sites.MinPasswordLength {
+			http.Error(w, fmt.Sprintf("Password must be at least %d characters", sites.MinPasswordLength), http.StatusBadRequest)
+			return
+		}
+		if input.Superuser != nil && *input.Superuser != 1 && u.Superuser == 1 {
+			var superusers int
+			reg.Main().QueryRow("SELECT COUNT(*) FROM users WHERE superuser = 1").Scan(&superusers)
+			if superusers <= 1 {
+				http.Error(w, "The last superuser can't be demoted", http.StatusBadRequest)
+				return
+			}
+		}
+
+		tx, err := reg.Main().Begin()
+		if err != nil {
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if input.Password != nil {
+			if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", sites.HashPassword(*input.Password), id); err != nil {
+				http.Error(w, "Failed to update password", http.StatusInternalServerError)
+				return
+			}
+		}
+		if input.Superuser != nil {
+			if _, err := tx.Exec("UPDATE users SET superuser = ? WHERE id = ?", *input.Superuser, id); err != nil {
+				http.Error(w, "Failed to update user", http.StatusInternalServerError)
+				return
+			}
+		}
+		if input.Sites != nil {
+			if err := saveUserSites(tx, int64(id), *input.Sites); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			return
+		}
+		if input.Password != nil {
+			sites.ForgetLogins()
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("User updated successfully"))
+	}
+}
+
+func DeleteUser(reg *sites.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "userID"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		u, err := sites.GetUser(reg.Main(), id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
+			}
+			return
+		}
+		if u.Superuser == 1 {
+			var superusers int
+			reg.Main().QueryRow("SELECT COUNT(*) FROM users WHERE superuser = 1").Scan(&superusers)
+			if superusers <= 1 {
+				http.Error(w, "The last superuser can't be deleted", http.StatusBadRequest)
+				return
+			}
+		}
+
+		tx, err := reg.Main().Begin()
+		if err != nil {
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM user_sites WHERE user_id = ?", id); err != nil {
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM users WHERE id = ?", id); err != nil {
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			return
+		}
+		sites.ForgetLogins()
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("User deleted successfully"))
+	}
+}
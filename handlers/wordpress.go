@@ -0,0 +1,985 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cms/imaging"
+	"cms/settings"
+	"cms/storage"
+	"cms/utils"
+	"cms/wordpress"
+)
+
+// WordPressOptions choose where the content of a WordPress export goes
+type WordPressOptions struct {
+	// Template given to every imported page
+	TemplateID int
+	// Collection posts are imported into; without one posts are skipped
+	Collection string
+	// Position of each page's content block among its template's blocks
+	Ordering int
+	// A copy of the old site's wp-content/uploads to read attachments from
+	MediaDir string
+	// Fetch attachments missing from MediaDir from the old site. Only URLs on
+	// the exported site's own host that resolve to public addresses are
+	// fetched.
+	Download bool
+}
+
+// WordPressItem is one item of the export and what became of it
+type WordPressItem struct {
+	WordPressID int    `json:"wordpress_id"`
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	ID          int    `json:"id,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Note        string `json:"note,omitempty"`
+}
+
+// WordPressShortcode is a shortcode that was removed from imported content
+type WordPressShortcode struct {
+	Name  string   `json:"name"`
+	Uses  int      `json:"uses"`
+	Items []string `json:"items"`
+}
+
+// WordPressReport describes a WordPress import
+type WordPressReport struct {
+	Pages      []WordPressItem      `json:"pages"`
+	Posts      []WordPressItem      `json:"posts"`
+	Media      []WordPressItem      `json:"media"`
+	Redirects  []Redirect           `json:"redirects"`
+	Skipped    []WordPressItem      `json:"skipped"`
+	Shortcodes []WordPressShortcode `json:"shortcodes"`
+	// Terms created, by vocabulary. Categories go into "categories" and
+	// custom taxonomies into a vocabulary of the same name.
+	Terms map[string]int `json:"terms"`
+	// Counts of what has no place in the CMS: comments, other post types and
+	// terms of taxonomies whose names can't be vocabulary names
+	Unsupported map[string]int `json:"unsupported"`
+	// Links to uploads that weren't imported, left pointing at the old site
+	MissingMedia []string `json:"missing_media"`
+}
+
+// Where page content goes among the template's blocks unless chosen
+const DefaultWordPressOrdering = 50
+
+// Longest a single attachment download may take
+const wordPressDownloadTimeout = time.Minute
+
+// checkWordPressOptions makes sure the template and collection exist
+func checkWordPressOptions(db *sql.DB, opts WordPressOptions) error {
+	var id int
+	err := db.QueryRow("SELECT id FROM templates WHERE id = ?", opts.TemplateID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("template %d not found", opts.TemplateID)
+	} else if err != nil {
+		return err
+	}
+	if opts.Collection != "" {
+		if _, err := getCollection(db, opts.Collection); err == sql.ErrNoRows {
+			return fmt.Errorf("collection %s not found", opts.Collection)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type wordPressImport struct {
+	db     *sql.DB
+	cfg    *settings.Settings
+	store  storage.Storage
+	export *wordpress.Export
+	opts   WordPressOptions
+	report *WordPressReport
+
+	collection *Collection
+	items      map[int]wordpress.Item
+	// New URLs of pages and posts, the IDs of imported pages and the media
+	// attachments became, by WordPress ID
+	urls    map[int]string
+	renamed map[int]bool
+	pages   map[int]int
+	media   map[int]Media
+	// Media by path under wp-content/uploads
+	uploads map[string]Media
+	// Old permalink paths to new URLs, for rewriting links
+	moved map[string]string
+	// Keys of files stored by this import, removed again if it fails, and
+	// their checksums
+	saved      []string
+	fetched    map[string]bool
+	shortcodes map[string]*WordPressShortcode
+	// Vocabularies by WordPress taxonomy; nil for taxonomies not imported
+	vocabularies map[string]*Vocabulary
+	downloader   *http.Client
+}
+
+// ImportWordPress creates pages, posts and media from a WordPress export.
+// Pages keep their hierarchy and slugs and get the chosen template, with
+// their content in a code block of their own. Published items are published
+// here too and their old permalinks redirected to their new URLs.
+func ImportWordPress(db *sql.DB, cfg *settings.Settings, store storage.Storage, export *wordpress.Export, opts WordPressOptions) (*WordPressReport, error) {
+	if err := checkWordPressOptions(db, opts); err != nil {
+		return nil, err
+	}
+	im := &wordPressImport{
+		db:     db,
+		cfg:    cfg,
+		store:  store,
+		export: export,
+		opts:   opts,
+		report: &WordPressReport{
+			Pages:        []WordPressItem{},
+			Posts:        []WordPressItem{},
+			Media:        []WordPressItem{},
+			Redirects:    []Redirect{},
+			Skipped:      []WordPressItem{},
+			Shortcodes:   []WordPressShortcode{},
+			Terms:        map[string]int{},
+			Unsupported:  map[string]int{},
+			MissingMedia: []string{},
+		},
+		items:      map[int]wordpress.Item{},
+		urls:       map[int]string{},
+		renamed:    map[int]bool{},
+		pages:      map[int]int{},
+		media:      map[int]Media{},
+		uploads:    map[string]Media{},
+		moved:      map[string]string{},
+		fetched:    map[string]bool{},
+		shortcodes: map[string]*WordPressShortcode{},
+
+		vocabularies: map[string]*Vocabulary{},
+	}
+	if opts.Collection != "" {
+		c, err := getCollection(db, opts.Collection)
+		if err != nil {
+			return nil, err
+		}
+		im.collection = &c
+	}
+
+	var pages, posts, attachments []wordpress.Item
+	for _, it := range export.Items {
+		im.items[it.ID] = it
+		switch {
+		case it.Type == wordpress.TypeAttachment:
+			attachments = append(attachments, it)
+		case it.Type != wordpress.TypePage && it.Type != wordpress.TypePost:
+			im.report.Unsupported[it.Type]++
+		case it.Status == wordpress.StatusTrash || it.Status == "auto-draft" || it.Status == "inherit":
+			im.skip(it, "status "+it.Status+" isn't imported")
+		case it.Type == wordpress.TypePost && im.collection == nil:
+			im.skip(it, "no collection was chosen for posts")
+		case it.Type == wordpress.TypePage:
+			pages = append(pages, it)
+		default:
+			posts = append(posts, it)
+		}
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			for _, key := range im.saved {
+				store.Delete(key)
+			}
+		}
+	}()
+
+	// Files are read or downloaded and stored before the transaction starts,
+	// so slow downloads don't hold the site's write lock
+	var files []*wordPressFile
+	for _, it := range attachments {
+		f, err := im.fetchAttachment(it)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %d: %w", it.ID, err)
+		}
+		if f != nil {
+			files = append(files, f)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, f := range files {
+		if err := im.importAttachment(tx, f); err != nil {
+			return nil, fmt.Errorf("attachment %d: %w", f.item.ID, err)
+		}
+	}
+	if err := im.planPages(tx, pages); err != nil {
+		return nil, err
+	}
+	if err := im.planPosts(tx, posts); err != nil {
+		return nil, err
+	}
+	for _, it := range sortParentsFirst(pages) {
+		if err := im.importPage(tx, it); err != nil {
+			return nil, fmt.Errorf("page %d: %w", it.ID, err)
+		}
+	}
+	for _, it := range posts {
+		if err := im.importPost(tx, it); err != nil {
+			return nil, fmt.Errorf("post %d: %w", it.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	committed = true
+
+	for i, p := range im.report.Pages {
+		if p.Status != wordpress.StatusPublish {
+			continue
+		}
+		if err := Publish(db, cfg, p.ID); err != nil {
+			im.report.Pages[i].Note = "not published: " + err.Error()
+		}
+	}
+	if err := im.addRedirects(attachments); err != nil {
+		return im.report, fmt.Errorf("adding redirects: %w", err)
+	}
+
+	for _, sc := range im.shortcodes {
+		im.report.Shortcodes = append(im.report.Shortcodes, *sc)
+	}
+	sort.Slice(im.report.Shortcodes, func(i, j int) bool { return im.report.Shortcodes[i].Name < im.report.Shortcodes[j].Name })
+	return im.report, nil
+}
+
+func (im *wordPressImport) skip(it wordpress.Item, reason string) {
+	im.report.Skipped = append(im.report.Skipped, WordPressItem{WordPressID: it.ID, Type: it.Type, Title: it.Title, Status: it.Status, Note: reason})
+}
+
+// wordPressFile is an attachment's file, read and checked, and stored unless
+// the site already has it
+type wordPressFile struct {
+	item       wordpress.Item
+	uploadPath string
+	filename   string
+	checksum   string
+	mimeType   string
+	width      *int
+	height     *int
+	// Empty when the site, or an earlier attachment, already has the file
+	key  string
+	size int64
+}
+
+// fetchAttachment reads an attachment's file and stores it, unless media with
+// the same content exists. Attachments that can't be imported are skipped,
+// returning nil.
+func (im *wordPressImport) fetchAttachment(it wordpress.Item) (*wordPressFile, error) {
+	f := &wordPressFile{item: it, uploadPath: it.UploadPath()}
+	data, err := im.attachmentFile(it, f.uploadPath)
+	if err != nil {
+		im.skip(it, err.Error())
+		return nil, nil
+	}
+
+	f.filename = path.Base(f.uploadPath)
+	if f.uploadPath == "" {
+		f.filename = path.Base(it.AttachmentURL)
+	}
+	sum := sha256.Sum256(data)
+	f.checksum = hex.EncodeToString(sum[:])
+
+	var existing int
+	if err := im.db.QueryRow("SELECT COUNT(*) FROM media WHERE checksum = ?", f.checksum).Scan(&existing); err != nil {
+		return nil, err
+	}
+	if existing > 0 || im.fetched[f.checksum] {
+		return f, nil
+	}
+
+	f.mimeType = detectMediaType(data, f.filename)
+	if !allowedMediaTypes[f.mimeType] {
+		im.skip(it, "unsupported file type "+f.mimeType)
+		return nil, nil
+	}
+	if strings.HasPrefix(f.mimeType, "image/") {
+		if wd, ht, err := imaging.Dimensions(bytes.NewReader(data), f.mimeType); err == nil {
+			f.width, f.height = &wd, &ht
+		}
+	}
+
+	created := it.Published()
+	if created.IsZero() {
+		created = time.Now()
+	}
+	key := mediaStorageKey(f.filename, f.checksum, created)
+	if f.size, err = im.store.Save(key, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	im.saved = append(im.saved, key)
+	im.fetched[f.checksum] = true
+	f.key = key
+	return f, nil
+}
+
+// importAttachment adds a fetched attachment to the media library, reusing
+// media the site already has with the same content
+func (im *wordPressImport) importAttachment(tx *sql.Tx, f *wordPressFile) error {
+	it := f.item
+	item := WordPressItem{WordPressID: it.ID, Type: it.Type, Title: it.Title, Status: it.Status}
+
+	m, err := scanMedia(tx.QueryRow("SELECT "+mediaColumns+" FROM media WHERE checksum = ?", f.checksum))
+	if err == nil {
+		item.Note = "already in the media library"
+	} else if err != sql.ErrNoRows {
+		return err
+	} else if f.key == "" {
+		im.skip(it, "the media it matched was deleted during the import")
+		return nil
+	} else {
+		var altText *string
+		if alt := it.MetaValue("_wp_attachment_image_alt"); alt != "" {
+			altText = &alt
+		}
+		result, err := tx.Exec(`
+			INSERT INTO media (filename, storage_key, mime_type, size, width, height, alt_text, checksum)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			f.filename, f.key, f.mimeType, f.size, f.width, f.height, altText, f.checksum)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if m, err = scanMedia(tx.QueryRow("SELECT "+mediaColumns+" FROM media WHERE id = ?", id)); err != nil {
+			return err
+		}
+	}
+
+	im.media[it.ID] = m
+	if f.uploadPath != "" {
+		im.uploads[f.uploadPath] = m
+	}
+	item.ID, item.URL = m.ID, m.URL
+	im.report.Media = append(im.report.Media, item)
+	return nil
+}
+
+// attachmentFile reads an attachment from the uploads copy, or downloads it
+func (im *wordPressImport) attachmentFile(it wordpress.Item, uploadPath string) ([]byte, error) {
+	maxBytes := im.cfg.Media.MaxUploadSizeMB << 20
+	if im.opts.MediaDir != "" && uploadPath != "" {
+		file := filepath.Join(im.opts.MediaDir, filepath.FromSlash(path.Clean("/"+uploadPath)))
+		if data, err := os.ReadFile(file); err == nil {
+			if int64(len(data)) > maxBytes {
+				return nil, fmt.Errorf("file is larger than %d MB", im.cfg.Media.MaxUploadSizeMB)
+			}
+			return data, nil
+		}
+	}
+	if !im.opts.Download || it.AttachmentURL == "" {
+		return nil, fmt.Errorf("file not found; give a copy of wp-content/uploads or download it")
+	}
+
+	if err := im.checkDownload(it.AttachmentURL); err != nil {
+		return nil, fmt.Errorf("not downloaded: %w", err)
+	}
+	resp, err := im.client().Get(it.AttachmentURL)
+	if err != nil {
+		return nil, fmt.Errorf("downloading: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("downloading: %w", err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("file is larger than %d MB", im.cfg.Media.MaxUploadSizeMB)
+	}
+	return data, nil
+}
+
+// checkDownload only lets attachments be downloaded over HTTP(S) from the
+// exported site itself. The export is uploaded by whoever runs the import, so
+// its URLs can't be trusted to point anywhere else.
+func (im *wordPressImport) checkDownload(link string) error {
+	u, err := url.Parse(link)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s isn't an http or https URL", link)
+	}
+	if !im.export.Hosts()[u.Host] {
+		return fmt.Errorf("%s isn't on the exported site", link)
+	}
+	return nil
+}
+
+// client downloads attachments. It only connects to public addresses, so
+// that an export naming an internal host can't have the server fetch from
+// its own network, and follows redirects only within the exported site.
+func (im *wordPressImport) client() *http.Client {
+	if im.downloader != nil {
+		return im.downloader
+	}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip, err := netip.ParseAddr(host); err != nil || !publicAddr(ip) {
+				return fmt.Errorf("%s isn't a public address", host)
+			}
+			return nil
+		},
+	}
+	im.downloader = &http.Client{
+		Timeout:   wordPressDownloadTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			return im.checkDownload(req.URL.String())
+		},
+	}
+	return im.downloader
+}
+
+// Shared address space (RFC 6598), used inside carrier and cloud networks
+var sharedAddrs = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether ip is reachable on the internet rather than
+// being loopback, private, link-local (cloud metadata services live there)
+// or otherwise reserved
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !sharedAddrs.Contains(ip)
+}
+
+// planPages works out every page's URL from its slug and its ancestors',
+// the way WordPress builds page permalinks, before any content is written so
+// links between pages can be pointed at the new URLs
+func (im *wordPressImport) planPages(tx *sql.Tx, pages []wordpress.Item) error {
+	for _, it := range sortParentsFirst(pages) {
+		// Parents come first, so theirs is already settled
+		url := "/" + wordPressSlug(it)
+		if parent, ok := im.urls[it.Parent]; ok {
+			url = parent + url
+		}
+		free, err := im.freeURL(tx, url)
+		if err != nil {
+			return err
+		}
+		im.urls[it.ID] = free
+		im.renamed[it.ID] = free != url
+		im.remember(it, free)
+	}
+	return nil
+}
+
+// planPosts gives every post a slug that's free in the collection
+func (im *wordPressImport) planPosts(tx *sql.Tx, posts []wordpress.Item) error {
+	taken := map[string]bool{}
+	for _, it := range posts {
+		base := wordPressSlug(it)
+		slug := base
+		for n := 2; ; n++ {
+			var count int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM posts WHERE collection_id = ? AND slug = ?", im.collection.ID, slug).Scan(&count); err != nil {
+				return err
+			}
+			if count == 0 && !taken[slug] {
+				break
+			}
+			slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken[slug] = true
+		im.renamed[it.ID] = slug != base
+		im.urls[it.ID] = im.collection.BasePath + "/" + slug
+		im.remember(it, im.urls[it.ID])
+	}
+	return nil
+}
+
+// remember records where an item's old permalink now lives
+func (im *wordPressImport) remember(it wordpress.Item, url string) {
+	if old := it.Path(); old != "" {
+		im.moved[old] = url
+		im.moved[strings.TrimSuffix(old, "/")] = url
+	}
+}
+
+// freeURL returns url, or url-2, url-3... if a page or an earlier item of
+// the import already has it
+func (im *wordPressImport) freeURL(tx *sql.Tx, url string) (string, error) {
+	claimed := map[string]bool{}
+	for _, u := range im.urls {
+		claimed[u] = true
+	}
+	candidate := url
+	for n := 2; ; n++ {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM pages WHERE url = ?", candidate).Scan(&count); err != nil {
+			return "", err
+		}
+		if count == 0 && !claimed[candidate] {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", url, n)
+	}
+}
+
+func (im *wordPressImport) importPage(tx *sql.Tx, it wordpress.Item) error {
+	url := im.urls[it.ID]
+	published := it.Status == wordpress.StatusPublish
+	parent := -1
+	if id, ok := im.pages[it.Parent]; ok {
+		parent = id
+	}
+
+	active, hidden := 0, 1
+	if published {
+		active, hidden = 1, 0
+	}
+	result, err := tx.Exec("INSERT INTO pages (title, url, hidden, active, parent_page, template_id, sort_order) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		it.Title, url, hidden, active, parent, im.opts.TemplateID, it.MenuOrder)
+	if err != nil {
+		return err
+	}
+	pageID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	im.pages[it.ID] = int(pageID)
+
+	content := im.content(it)
+	title, err := freeCodeBlockTitle(tx, it.Title+" content")
+	if err != nil {
+		return err
+	}
+	result, err = tx.Exec("INSERT INTO code_blocks (title, description, content, type) VALUES (?, ?, ?, ?)",
+		title, fmt.Sprintf("Imported from WordPress page %d", it.ID), content, CodeBlockHTML)
+	if err != nil {
+		return err
+	}
+	blockID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO codeblocks_ordering (page_id, template_id, codeblock_id, ordering, active) VALUES (?, -1, ?, ?, 1)",
+		pageID, blockID, im.opts.Ordering)
+	if err != nil {
+		return err
+	}
+	if err := im.importTerms(tx, TermObjectPage, int(pageID), it); err != nil {
+		return err
+	}
+
+	item := WordPressItem{WordPressID: it.ID, Type: it.Type, Title: it.Title, ID: int(pageID), URL: url, Status: it.Status}
+	if im.renamed[it.ID] {
+		item.Note = "URL was taken, renamed"
+	}
+	im.report.Pages = append(im.report.Pages, item)
+	return nil
+}
+
+func (im *wordPressImport) importPost(tx *sql.Tx, it wordpress.Item) error {
+	url := im.urls[it.ID]
+	slug := strings.TrimPrefix(url, im.collection.BasePath+"/")
+
+	var author *string
+	for _, a := range im.export.Authors {
+		if a.Login == it.Creator && a.DisplayName != "" {
+			author = &a.DisplayName
+		}
+	}
+	if author == nil && it.Creator != "" {
+		author = &it.Creator
+	}
+	var excerpt *string
+	if e := strings.TrimSpace(it.Excerpt()); e != "" {
+		excerpt = &e
+	}
+
+	// Tags go in the post's own list; categories and custom taxonomies
+	// become terms once the post has an ID
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, name := range it.TermNames("post_tag") {
+		if tag := utils.Slugify(name); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	rawTags, _ := json.Marshal(tags)
+
+	var imageID *int
+	if thumb, err := strconv.Atoi(it.MetaValue("_thumbnail_id")); err == nil {
+		if m, ok := im.media[thumb]; ok {
+			imageID = &m.ID
+		}
+	}
+
+	status := PostDraft
+	if it.Status == wordpress.StatusPublish || it.Status == wordpress.StatusFuture {
+		status = PostPublished
+	}
+	published := it.Published()
+	if published.IsZero() {
+		published = time.Now().UTC()
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO posts (collection_id, title, slug, author, excerpt, body, tags, image_id, status, published_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		im.collection.ID, it.Title, slug, author, excerpt, im.content(it), string(rawTags), imageID, status, published.Format(sqliteTime))
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := im.importTerms(tx, TermObjectPost, int(id), it); err != nil {
+		return err
+	}
+
+	item := WordPressItem{WordPressID: it.ID, Type: it.Type, Title: it.Title, ID: int(id), URL: url, Status: it.Status}
+	if im.renamed[it.ID] {
+		item.Note = "slug was taken, renamed"
+	}
+	im.report.Posts = append(im.report.Posts, item)
+	return nil
+}
+
+// importTerms gives an imported page or post its categories and custom
+// taxonomy terms. Tags are kept with the post instead, and WordPress's
+// default "uncategorized" category is left out.
+func (im *wordPressImport) importTerms(tx *sql.Tx, objectType string, objectID int, it wordpress.Item) error {
+	input := map[string][]string{}
+	for _, t := range it.Terms {
+		if t.Domain == "post_tag" || (t.Domain == "category" && t.Nicename == "uncategorized") {
+			continue
+		}
+		v, err := im.vocabulary(tx, t.Domain)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			im.report.Unsupported["term:"+t.Domain]++
+			continue
+		}
+		slug, _, err := im.term(tx, *v, t.Domain, t.Nicename, t.Name, map[string]bool{})
+		if err != nil {
+			return err
+		}
+		if slug != "" {
+			input[v.Name] = append(input[v.Name], slug)
+		}
+	}
+	return assignObjectTerms(tx, objectType, objectID, input)
+}
+
+// vocabulary returns the vocabulary a taxonomy's terms go into, creating it
+// the first time. A site's existing vocabulary of the same name is used.
+func (im *wordPressImport) vocabulary(tx *sql.Tx, taxonomy string) (*Vocabulary, error) {
+	if v, ok := im.vocabularies[taxonomy]; ok {
+		return v, nil
+	}
+	name, title := strings.ReplaceAll(taxonomy, "-", "_"), taxonomy
+	if taxonomy == "category" {
+		name, title = "categories", "Categories"
+	}
+	if !contentName.MatchString(name) {
+		im.vocabularies[taxonomy] = nil
+		return nil, nil
+	}
+
+	v, err := scanVocabulary(tx.QueryRow("SELECT "+vocabularyColumns+" FROM vocabularies WHERE name = ?", name))
+	if err == sql.ErrNoRows {
+		hierarchical := 0
+		if im.export.Hierarchical(taxonomy) {
+			hierarchical = 1
+		}
+		if _, err := tx.Exec("INSERT INTO vocabularies (name, title, hierarchical) VALUES (?, ?, ?)", name, title, hierarchical); err != nil {
+			return nil, err
+		}
+		v, err = scanVocabulary(tx.QueryRow("SELECT "+vocabularyColumns+" FROM vocabularies WHERE name = ?", name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	im.vocabularies[taxonomy] = &v
+	return &v, nil
+}
+
+// term returns the slug and ID of a taxonomy's term in v, creating the term,
+// and in a hierarchical vocabulary the parents it's declared with, if the
+// site doesn't have it. seen stops parent loops.
+func (im *wordPressImport) term(tx *sql.Tx, v Vocabulary, taxonomy, nicename, name string, seen map[string]bool) (string, int, error) {
+	slug := utils.Slugify(nicename)
+	if slug == "" {
+		slug = utils.Slugify(name)
+	}
+	if slug == "" {
+		return "", -1, nil
+	}
+	var id int
+	err := tx.QueryRow("SELECT id FROM terms WHERE vocabulary_id = ? AND slug = ?", v.ID, slug).Scan(&id)
+	if err == nil {
+		return slug, id, nil
+	} else if err != sql.ErrNoRows {
+		return "", -1, err
+	}
+	seen[nicename] = true
+
+	declared, parentName, _ := im.export.TermDeclaration(taxonomy, nicename)
+	if declared != "" {
+		name = declared
+	}
+	if name == "" {
+		name = nicename
+	}
+	parentID := -1
+	if v.Hierarchical && parentName != "" && !seen[parentName] {
+		if _, parentID, err = im.term(tx, v, taxonomy, parentName, "", seen); err != nil {
+			return "", -1, err
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO terms (vocabulary_id, name, slug, parent_id) VALUES (?, ?, ?, ?)", v.ID, name, slug, parentID)
+	if err != nil {
+		return "", -1, err
+	}
+	newID, err := result.LastInsertId()
+	if err != nil {
+		return "", -1, err
+	}
+	im.report.Terms[v.Name]++
+	return slug, int(newID), nil
+}
+
+// content converts an item's content to HTML, pointing links to uploads and
+// to other imported items at their new URLs and noting what was left out
+func (im *wordPressImport) content(it wordpress.Item) string {
+	html, removed := wordpress.Convert(it.Content())
+	for _, name := range removed {
+		sc, ok := im.shortcodes[name]
+		if !ok {
+			sc = &WordPressShortcode{Name: name, Items: []string{}}
+			im.shortcodes[name] = sc
+		}
+		sc.Uses++
+		if len(sc.Items) == 0 || sc.Items[len(sc.Items)-1] != it.Title {
+			sc.Items = append(sc.Items, it.Title)
+		}
+	}
+
+	html, missing := wordpress.RewriteUploads(html, func(uploadPath string) (string, bool) {
+		m, ok := im.uploads[uploadPath]
+		return m.URL, ok
+	})
+	for _, link := range missing {
+		if !containsString(im.report.MissingMedia, link) {
+			im.report.MissingMedia = append(im.report.MissingMedia, link)
+		}
+	}
+	html = im.export.RewriteLinks(html, func(p string) (string, bool) {
+		url, ok := im.moved[p]
+		return url, ok
+	})
+
+	if n := len(it.Comments); n > 0 {
+		im.report.Unsupported["comments"] += n
+	}
+	return html
+}
+
+// addRedirects sends the old permalinks of published pages and posts, and
+// the old links to uploads, to their new URLs. Paths that already have a
+// page or a redirect rule are left alone.
+func (im *wordPressImport) addRedirects(attachments []wordpress.Item) error {
+	type move struct{ from, to string }
+	var moves []move
+	for _, list := range [][]WordPressItem{im.report.Pages, im.report.Posts} {
+		for _, item := range list {
+			if item.Status != wordpress.StatusPublish && item.Status != wordpress.StatusFuture {
+				continue
+			}
+			if old := im.items[item.WordPressID].Path(); old != "" {
+				moves = append(moves, move{old, item.URL})
+			}
+		}
+	}
+	for _, it := range attachments {
+		if m, ok := im.media[it.ID]; ok && it.UploadPath() != "" {
+			moves = append(moves, move{"/wp-content/uploads/" + it.UploadPath(), m.URL})
+		}
+	}
+
+	for _, mv := range moves {
+		if mv.from == mv.to {
+			continue
+		}
+		var taken int
+		err := im.db.QueryRow("SELECT (SELECT COUNT(*) FROM pages WHERE url = ?) + (SELECT COUNT(*) FROM redirects WHERE source = ?)", mv.from, mv.from).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			continue
+		}
+		rule := Redirect{Source: mv.from, Target: mv.to}
+		if validateRedirect(im.db, &rule) != nil {
+			continue
+		}
+		result, err := im.db.Exec("INSERT INTO redirects (source, target, status_code) VALUES (?, ?, ?)", rule.Source, rule.Target, rule.StatusCode)
+		if err != nil {
+			return err
+		}
+		id, _ := result.LastInsertId()
+		if rule, err = scanRedirect(im.db.QueryRow("SELECT "+redirectColumns+" FROM redirects WHERE id = ?", id)); err != nil {
+			return err
+		}
+		im.report.Redirects = append(im.report.Redirects, rule)
+	}
+	return nil
+}
+
+// wordPressSlug is the item's slug, made from its title for drafts that
+// never got one
+func wordPressSlug(it wordpress.Item) string {
+	if slug := utils.Slugify(it.Name); slug != "" {
+		return slug
+	}
+	if slug := utils.Slugify(it.Title); slug != "" {
+		return slug
+	}
+	return fmt.Sprintf("%s-%d", it.Type, it.ID)
+}
+
+// sortParentsFirst orders pages so every page comes after its parent
+func sortParentsFirst(pages []wordpress.Item) []wordpress.Item {
+	byID := map[int]wordpress.Item{}
+	for _, it := range pages {
+		byID[it.ID] = it
+	}
+	var sorted []wordpress.Item
+	done := map[int]bool{}
+	var visit func(it wordpress.Item, depth int)
+	visit = func(it wordpress.Item, depth int) {
+		if done[it.ID] {
+			return
+		}
+		if parent, ok := byID[it.Parent]; ok && depth < 50 {
+			visit(parent, depth+1)
+		}
+		if !done[it.ID] {
+			done[it.ID] = true
+			sorted = append(sorted, it)
+		}
+	}
+	for _, it := range pages {
+		visit(it, 0)
+	}
+	return sorted
+}
+
+// freeCodeBlockTitle returns title, or "title (2)" and so on if a code block
+// already has it
+func freeCodeBlockTitle(tx *sql.Tx, title string) (string, error) {
+	candidate := title
+	for n := 2; ; n++ {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM code_blocks WHERE title = ?", candidate).Scan(&count); err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s (%d)", title, n)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportWordPressExport imports a WordPress export (WXR) posted as the
+// request body into the current site. ?template_id= is required;
+// ?collection= names the collection posts go into, ?ordering= (default 50)
+// places each page's content block among its template's, and ?download=1
+// fetches attachments from the old site.
+func ImportWordPressExport(db *sql.DB, cfg *settings.Settings, store storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		opts := WordPressOptions{
+			Ordering:   DefaultWordPressOrdering,
+			Collection: q.Get("collection"),
+			Download:   q.Get("download") == "1" || q.Get("download") == "true",
+		}
+		var err error
+		if opts.TemplateID, err = strconv.Atoi(q.Get("template_id")); err != nil {
+			http.Error(w, "template_id is required", http.StatusBadRequest)
+			return
+		}
+		if o := q.Get("ordering"); o != "" {
+			if opts.Ordering, err = strconv.Atoi(o); err != nil {
+				http.Error(w, "ordering must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := checkWordPressOptions(db, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		export, err := wordpress.Parse(http.MaxBytesReader(w, r.Body, maxImportSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report, err := ImportWordPress(db, cfg, store, export, opts)
+		if err != nil {
+			http.Error(w, "Failed to import: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"cms/wordpress"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.5", false},
+		{"172.16.3.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		// IPv4 addresses written as IPv6 are checked as IPv4
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:93.184.216.34", true},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckDownload(t *testing.T) {
+	im := &wordPressImport{export: &wordpress.Export{
+		Link:        "https://blog.example.com",
+		BaseSiteURL: "https://example.com",
+	}}
+	tests := []struct {
+		link string
+		ok   bool
+	}{
+		{"https://blog.example.com/wp-content/uploads/2024/01/a.jpg", true},
+		{"http://example.com/wp-content/uploads/a.jpg", true},
+		{"https://cdn.example.com/a.jpg", false},
+		{"https://example.com.evil.net/a.jpg", false},
+		{"https://example.com:8080/a.jpg", false},
+		{"https://evil.net/?u=https://example.com/a.jpg", false},
+		{"https://user@evil.net/a.jpg", false},
+		{"file:///etc/passwd", false},
+		{"ftp://example.com/a.jpg", false},
+		{"//example.com/a.jpg", false},
+		{"/wp-content/uploads/a.jpg", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://[::1]/a.jpg", false},
+	}
+	for _, tt := range tests {
+		err := im.checkDownload(tt.link)
+		if tt.ok && err != nil {
+			t.Errorf("checkDownload(%q): %v", tt.link, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("checkDownload(%q) allowed the download", tt.link)
+		}
+	}
+}
+
+func TestDownloadClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+
+	// An export naming a host on the server's own network
+	im := &wordPressImport{export: &wordpress.Export{Link: server.URL}}
+	if err := im.checkDownload(server.URL + "/a.jpg"); err != nil {
+		t.Fatalf("checkDownload: %v", err)
+	}
+	if resp, err := im.client().Get(server.URL + "/a.jpg"); err == nil {
+		resp.Body.Close()
+		t.Error("the client connected to a loopback address")
+	}
+
+	// Redirects are followed only within the exported site
+	from, _ := url.Parse(server.URL + "/a.jpg")
+	for link, ok := range map[string]bool{
+		server.URL + "/b.jpg":                      true,
+		"http://169.254.169.254/latest/meta-data/": false,
+		"https://evil.net/a.jpg":                   false,
+	} {
+		to, _ := url.Parse(link)
+		err := im.client().CheckRedirect(&http.Request{URL: to}, []*http.Request{{URL: from}})
+		if ok && err != nil {
+			t.Errorf("redirect to %s: %v", link, err)
+		} else if !ok && err == nil {
+			t.Errorf("redirect to %s was followed", link)
+		}
+	}
+	via := make([]*http.Request, 5)
+	to, _ := url.Parse(server.URL + "/b.jpg")
+	if err := im.client().CheckRedirect(&http.Request{URL: to}, via); err == nil {
+		t.Error("a sixth redirect was followed")
+	}
+}
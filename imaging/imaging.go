@@ -0,0 +1,127 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Variant is a resized, re-encoded copy of an image
+type Variant struct {
+	Data     []byte
+	MimeType string
+	Width    int
+	Height   int
+}
+
+// CanResize reports whether images of this MIME type can be decoded for resizing
+func CanResize(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// MaxPixels is the largest image Resize decodes. A small file can declare
+// huge dimensions, and decoding allocates memory for every pixel.
+const MaxPixels = 50_000_000
+
+// ErrTooLarge is returned by Resize for images of more than MaxPixels
+var ErrTooLarge = errors.New("image is too large to resize")
+
+// Fits reports whether an image of this size is small enough to resize
+func Fits(width, height int) bool {
+	return width > 0 && height > 0 && int64(width)*int64(height) <= MaxPixels
+}
+
+// Resize decodes src, scales it down to width (keeping the aspect ratio),
+// applies any EXIF orientation and re-encodes it. Photos come out as JPEG,
+// PNG and GIF sources as PNG so transparency survives.
+func Resize(src []byte, mimeType string, width int, jpegQuality int) (*Variant, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	if !Fits(cfg.Width, cfg.Height) {
+		return nil, ErrTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	orientation := 1
+	if mimeType == "image/jpeg" {
+		orientation = jpegOrientation(src)
+	}
+
+	// Orientations 5-8 turn the image on its side, so the displayed width
+	// is the stored height
+	b := img.Bounds()
+	srcWidth, srcHeight := b.Dx(), b.Dy()
+	if orientation >= 5 {
+		srcWidth, srcHeight = srcHeight, srcWidth
+	}
+	if width <= 0 || width > srcWidth {
+		width = srcWidth
+	}
+	height := srcHeight * width / srcWidth
+	if height < 1 {
+		height = 1
+	}
+
+	// Scale first, so only the small copy is rotated
+	scaled := image.Rect(0, 0, width, height)
+	if orientation >= 5 {
+		scaled = image.Rect(0, 0, height, width)
+	}
+	dst := image.NewRGBA(scaled)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	out := applyOrientation(dst, orientation)
+
+	v := &Variant{Width: width, Height: height, MimeType: OutputType(mimeType)}
+	var buf bytes.Buffer
+	if v.MimeType == "image/png" {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, out)
+	} else {
+		err = jpeg.Encode(&buf, out, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encoding image: %w", err)
+	}
+	v.Data = buf.Bytes()
+	return v, nil
+}
+
+// Dimensions returns the displayed width and height of an image, taking EXIF
+// orientation into account for JPEGs
+func Dimensions(r io.Reader, mimeType string) (int, int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	if mimeType == "image/jpeg" && jpegOrientation(data) >= 5 {
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// OutputType returns the MIME type Resize produces for a source type
+func OutputType(mimeType string) string {
+	if mimeType == "image/png" || mimeType == "image/gif" {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
@@ -0,0 +1,182 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cms/settings"
+)
+
+// ErrQueueFull is returned by Enqueue when messages arrive faster than they
+// can be sent
+var ErrQueueFull = errors.New("mailer: queue is full")
+
+// Message is a plain text email
+type Message struct {
+	From    string
+	To      []string
+	ReplyTo string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New returns the mailer selected by the settings' driver
+func New(cfg settings.Mail) (Mailer, error) {
+	if cfg.From != "" {
+		if _, err := mail.ParseAddress(cfg.From); err != nil {
+			return nil, fmt.Errorf("mail from address %q: %w", cfg.From, err)
+		}
+	}
+	switch cfg.Driver {
+	case "smtp":
+		if cfg.SMTPHost == "" {
+			return nil, errors.New("mail driver smtp needs smtp_host")
+		}
+		return &SMTP{Host: cfg.SMTPHost, Port: cfg.SMTPPort, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.FileDir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating mail directory %s: %w", cfg.FileDir, err)
+		}
+		return &File{Dir: cfg.FileDir}, nil
+	case "log":
+		return Log{}, nil
+	}
+	return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+}
+
+// File writes each message to its own .eml file in Dir instead of sending it
+type File struct {
+	Dir string
+}
+
+func (f *File) Send(msg Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102-150405") + "-" + randomHex(4) + ".eml"
+	return os.WriteFile(filepath.Join(f.Dir, name), data, 0o644)
+}
+
+// Log writes messages to the server log instead of sending them
+type Log struct{}
+
+func (Log) Send(msg Message) error {
+	log.Printf("mail to %s: %s\n%s", strings.Join(msg.To, ", "), msg.Subject, msg.Body)
+	return nil
+}
+
+// Bytes formats the message as RFC 5322 text. Header values have line
+// breaks removed so submitted text can't add headers of its own.
+func (m Message) Bytes() ([]byte, error) {
+	if len(m.To) == 0 {
+		return nil, errors.New("mailer: message has no recipients")
+	}
+
+	var b bytes.Buffer
+	header := func(name, value string) {
+		value = strings.NewReplacer("\r", "", "\n", " ").Replace(value)
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	header("From", m.From)
+	header("To", strings.Join(m.To, ", "))
+	if m.ReplyTo != "" {
+		header("Reply-To", m.ReplyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+randomHex(16)+"@"+messageIDHost(m.From)+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	b.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func messageIDHost(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			return addr.Address[i+1:]
+		}
+	}
+	return "localhost"
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Queue sends messages in the background so requests don't wait on the mail
+// server
+type Queue struct {
+	mailer   Mailer
+	messages chan Message
+}
+
+// NewQueue returns a queue holding up to size unsent messages
+func NewQueue(m Mailer, size int) *Queue {
+	return &Queue{mailer: m, messages: make(chan Message, size)}
+}
+
+// Enqueue hands msg to the sender without blocking
+func (q *Queue) Enqueue(msg Message) error {
+	select {
+	case q.messages <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Run sends queued messages until ctx is cancelled, then sends whatever is
+// still queued before returning
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		select {
+		case msg := <-q.messages:
+			q.send(msg)
+		case <-ctx.Done():
+			for {
+				select {
+				case msg := <-q.messages:
+					q.send(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *Queue) send(msg Message) {
+	if err := q.mailer.Send(msg); err != nil {
+		log.Printf("Failed to send mail to %s: %v", strings.Join(msg.To, ", "), err)
+	}
+}
@@ -0,0 +1,88 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// How long one delivery may take, from connecting to QUIT
+const smtpTimeout = 30 * time.Second
+
+// SMTP sends through a mail server. Port 465 uses implicit TLS; on other
+// ports STARTTLS is used whenever the server offers it.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func (s *SMTP) Send(msg Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	tlsConfig := &tls.Config{ServerName: s.Host}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	if s.Port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && s.Port != 465 {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		rcpt, err := mail.ParseAddress(to)
+		if err != nil {
+			return err
+		}
+		if err := c.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
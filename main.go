@@ -1,108 +1,120 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
 	"log"
-	"mime"
 	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
 	"cms/db"
-	"cms/handlers"
+	"cms/mailer"
+	"cms/server"
+	"cms/settings"
+	"cms/sites"
 )
 
-// curl -X POST -H "Content-Type: application/json" -d '{"content":"<h1>Example!!</h1>","title":"Main Headline","description": "Example." "active":1}' http://localhost:8080/code_blocks
-// curl -X POST -H "Content-Type: application/json" -d '{"title":"Main Template", "parent_template_id": -1, "active": 1}' http://localhost:8080/templates
-// curl -X POST -H "Content-Type: application/json" -d '{"title":"Homepage","url":"/home", "hidden": -1, "active": 1, "parent_page": -1, "template_id": 1}' http://localhost:8080/pages
-// curl -X POST -H "Content-Type: application/json" -d '{"title":"Homepage","url":"/home", "hidden": -1, "active": 1, "parent_page": -1, "template_id": 1}' http://localhost:8080/pages
-
 func main() {
-	database := db.Connect()
-	defer database.Close()
+	os.Exit(runCommand(os.Args[1:]))
+}
 
-	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+// serveCommand runs the server until SIGINT or SIGTERM
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "", "address to listen on, overriding server.http_addr in the settings")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "cms serve: unexpected arguments")
+		return exitUsage
+	}
 
-	r.Get("/home", func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-		log.Println("Path: " + path)
-		// Get the file extension
+	cfg, err := settings.Load(settingsFile)
+	if err != nil {
+		log.Printf("Failed to load settings: %v", err)
+		return exitError
+	}
+	if *addr != "" {
+		cfg.Server.HTTPAddr = *addr
+	}
 
-		// Detect the MIME type based on file extension
-		mimeType := mime.TypeByExtension(filepath.Ext(path))
-		if mimeType != "" {
-			w.Header().Set("Content-Type", mimeType)
+	// Load the certificate before touching the database so a bad path fails fast
+	var certs *server.CertReloader
+	if cfg.Security.SSLEnabled {
+		certs, err = server.NewCertReloader(cfg.Security.SSLCertificate, cfg.Security.SSLKey)
+		if err != nil {
+			log.Printf("Failed to start server: %v", err)
+			return exitError
 		}
+	}
 
-		http.ServeFile(w, r, "./front-end/index.html")
-	})
+	// Cancelled on SIGINT/SIGTERM, which starts the graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-	// 	path := r.URL.Path
-	// 	if path == "/" {
-	// 		path = "/index.html" // Default to index.html
-	// 	}
-
-	// // Get the file extension
-	// ext := strings.ToLower(filepath.Ext(path))
-	// switch ext {
-	// case ".js":
-	// 	w.Header().Set("Content-Type", "application/javascript")
-	// case ".css":
-	// 	w.Header().Set("Content-Type", "text/css")
-	// case ".html":
-	// 	w.Header().Set("Content-Type", "text/html")
-	// }
-	// 	log.Println("Path" + path)
-	// 	http.ServeFile(w, r, "./front-end"+path)
-	// })
-
-	// Pages Routes
-	r.Route("/pages", func(r chi.Router) {
-		// Create
-		r.Post("/", handlers.CreatePage(database))
-		// Read
-		r.Get("/", handlers.GetPages(database))
-		r.Get("/{pageID}", handlers.RenderPage(database))
-		// Update
-		r.Patch("/{pageID}", handlers.UpdatePage(database))
-		// Delete
-		r.Delete("/{pageID}", handlers.DeletePage(database))
-	})
+	var background server.Background
 
-	// Templates Routes
-	r.Route("/templates", func(r chi.Router) {
-		// Create
-		r.Post("/", handlers.CreateTemplate(database))
-		r.Post("/duplicate/{templateID}", handlers.DuplicateTemplate(database))
-		// Read
-		r.Get("/", handlers.GetTemplates(database))
-		r.Get("/{templateID}", handlers.GetTemplate(database))
-		// Update
-		r.Patch("/{templateID}/name", handlers.UpdateTemplate(database))
-		// Delete
-		r.Delete("/{templateID}", handlers.DeleteTemplate(database))
-	})
+	database := db.Connect()
 
-	// Code Blocks Routes
-	r.Route("/code_blocks", func(r chi.Router) {
-		// Create
-		r.Post("/", handlers.CreateCodeBlock(database))
-		// Read
-		r.Get("/", handlers.GetCodeBlocks(database))
-		r.Get("/{codeBlockID}", handlers.GetCodeBlock(database))
-		// Update
-		r.Patch("/{codeBlockID}", handlers.UpdateCodeBlock(database))
-		// Delete
-		r.Delete("/{codeBlockID}", handlers.DeleteCodeBlock(database))
+	mail, err := mailer.New(cfg.Mail)
+	if err != nil {
+		log.Printf("Failed to set up mail: %v", err)
+		database.Close()
+		return exitError
+	}
+	mailQueue := mailer.NewQueue(mail, 100)
+	background.Go(ctx, mailQueue.Run)
+
+	// Each site gets its own routes, built from its database and settings
+	// the first time it's requested
+	var registry *sites.Registry
+	registry, err = sites.NewRegistry(database, "cms.db", cfg, func(site sites.Site, siteDB *sql.DB, siteCfg *settings.Settings) (http.Handler, error) {
+		store, err := registry.Storage(site, siteCfg)
+		if err != nil {
+			return nil, fmt.Errorf("setting up media storage: %w", err)
+		}
+		return routes(siteDB, siteCfg, store, mailQueue, registry), nil
 	})
+	if err != nil {
+		log.Printf("Failed to set up sites: %v", err)
+		stop()
+		background.Wait()
+		database.Close()
+		return exitError
+	}
+	r := middleware.Logger(registry)
 
-	// Settings Routes (add later)
+	var servers []*http.Server
+	if certs == nil {
+		servers = append(servers, server.New(cfg.Server.HTTPAddr, r, cfg.Server))
+	} else {
+		background.Go(ctx, certs.WatchSIGHUP)
 
-	log.Println("Starting server on :8080")
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		https := server.New(cfg.Server.HTTPSAddr, r, cfg.Server)
+		https.TLSConfig = certs.TLSConfig()
+		servers = append(servers, https, server.New(cfg.Server.HTTPAddr, server.RedirectToHTTPS(cfg.Server.HTTPSAddr), cfg.Server))
+	}
+
+	err = server.Run(ctx, cfg.Server.ShutdownTimeout.Duration, servers...)
+
+	// Everything below runs on both clean and failed exits so the database is always closed
+	stop()
+	background.Wait()
+	registry.Close()
+	if cerr := database.Close(); cerr != nil {
+		log.Printf("Failed to close database: %v", cerr)
+	}
+	if err != nil {
+		log.Printf("Server error: %v", err)
+		return exitError
 	}
+	log.Println("Server stopped")
+	return exitOK
 }
@@ -0,0 +1,105 @@
+// Package markdown renders Markdown code blocks: CommonMark with tables and
+// footnotes, preceded by optional front matter. Raw HTML in the source is
+// dropped and links with dangerous schemes (javascript: and the like) are
+// emptied, so the output is safe to place on a page as is.
+package markdown
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// Version goes up whenever a change here renders the same source differently,
+// so cached output made by older releases is thrown away
+const Version = 1
+
+var md = goldmark.New(goldmark.WithExtensions(extension.Table, extension.Footnote))
+
+var frontMatterKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Result is a rendered block
+type Result struct {
+	HTML string
+	// The front matter's keys and values. A class or id wraps the HTML in a
+	// <div> carrying them.
+	Meta map[string]string
+}
+
+// Render turns a block's source into HTML
+func Render(source string) (Result, error) {
+	meta, body, err := splitFrontMatter(source)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var buf bytes.Buffer
+	if err := md.Convert([]byte(body), &buf); err != nil {
+		return Result{}, err
+	}
+	out := buf.String()
+	if meta["class"] != "" || meta["id"] != "" {
+		var attrs string
+		if meta["id"] != "" {
+			attrs += fmt.Sprintf(` id="%s"`, html.EscapeString(meta["id"]))
+		}
+		if meta["class"] != "" {
+			attrs += fmt.Sprintf(` class="%s"`, html.EscapeString(meta["class"]))
+		}
+		out = "<div" + attrs + ">\n" + out + "</div>\n"
+	}
+	return Result{HTML: out, Meta: meta}, nil
+}
+
+// Hash identifies a source and the renderer version, to tell whether cached
+// output is still current
+func Hash(source string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s", Version, source)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// splitFrontMatter separates the front matter, "key: value" lines between a
+// leading pair of --- lines, from the Markdown after it. Without a closing
+// line the --- is an ordinary thematic break.
+func splitFrontMatter(source string) (map[string]string, string, error) {
+	meta := map[string]string{}
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	if !strings.HasPrefix(source, "---\n") {
+		return meta, source, nil
+	}
+	lines := strings.Split(source[len("---\n"):], "\n")
+	end := -1
+	for i, line := range lines {
+		if t := strings.TrimRight(line, " \t"); t == "---" || t == "..." {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return meta, source, nil
+	}
+
+	for i, line := range lines[:end] {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || !frontMatterKey.MatchString(key) {
+			return nil, "", fmt.Errorf("front matter line %d: expected key: value", i+2)
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		meta[key] = value
+	}
+	return meta, strings.Join(lines[end+1:], "\n"), nil
+}
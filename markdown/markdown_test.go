@@ -0,0 +1,82 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderSanitizes(t *testing.T) {
+	tests := []struct {
+		source, want string
+	}{
+		{"<script>alert(1)</script>", "<!-- raw HTML omitted -->\n"},
+		{"hi <img src=x onerror=alert(1)> there", "<p>hi <!-- raw HTML omitted --> there</p>\n"},
+		{"<!-- c --><a href=x>y</a>", "<!-- raw HTML omitted -->\n"},
+		{"| a |\n|---|\n| <b>x</b> |", "<td><!-- raw HTML omitted -->x<!-- raw HTML omitted --></td>"},
+		{"x[^1]\n\n[^1]: <script>y</script>", "<li id=\"fn:1\">\n<!-- raw HTML omitted -->"},
+		{"`<script>`", "<p><code>&lt;script&gt;</code></p>\n"},
+		{"[a](javascript:alert(1))", `<a href="">a</a>`},
+		{"[a](JaVaScRiPt:alert(1))", `<a href="">a</a>`},
+		{"[a](&#106;avascript:alert(1))", `<a href="">a</a>`},
+		{"[a]( javascript:alert(1))", `<a href="">a</a>`},
+		{"[a](<javascript:alert(1)>)", `<a href="">a</a>`},
+		{"[a](vbscript:x)", `<a href="">a</a>`},
+		{"[a](data:text/html;base64,PHNjcmlwdD4=)", `<a href="">a</a>`},
+		{"[a]: javascript:alert(1)\n\n[x][a]", `<a href="">x</a>`},
+		{"<javascript:alert(1)>", `<a href="">javascript:alert(1)</a>`},
+		{"![a](javascript:alert(1))", `<img src="" alt="a">`},
+		{`[a](/x "t\" onmouseover=alert(1)")`, `<a href="/x" title="t&quot; onmouseover=alert(1)">a</a>`},
+		// Safe links are kept
+		{"[a](https://example.com/?q=1&r=2)", `<a href="https://example.com/?q=1&amp;r=2">a</a>`},
+		{"[a](/about)", `<a href="/about">a</a>`},
+		{"[a](mailto:team@example.com)", `<a href="mailto:team@example.com">a</a>`},
+		{"![a](data:image/png;base64,AAAA)", `<img src="data:image/png;base64,AAAA" alt="a">`},
+	}
+	for _, tt := range tests {
+		r, err := Render(tt.source)
+		if err != nil {
+			t.Errorf("Render(%q): %v", tt.source, err)
+			continue
+		}
+		if !strings.Contains(r.HTML, tt.want) {
+			t.Errorf("Render(%q) = %q, want it to contain %q", tt.source, r.HTML, tt.want)
+		}
+		if strings.Contains(strings.ToLower(r.HTML), "<script") || strings.Contains(r.HTML, "onerror") {
+			t.Errorf("Render(%q) = %q", tt.source, r.HTML)
+		}
+	}
+}
+
+func TestRenderFrontMatter(t *testing.T) {
+	tests := []struct {
+		source, want string
+		meta         map[string]string
+	}{
+		{"---\nclass: intro wide\nid: top\n---\n# Hi", "<div id=\"top\" class=\"intro wide\">\n<h1>Hi</h1>\n</div>\n",
+			map[string]string{"class": "intro wide", "id": "top"}},
+		{"---\r\ntitle: 'Quoted: yes'\r\n...\r\nBody", "<p>Body</p>\n", map[string]string{"title": "Quoted: yes"}},
+		// Front matter values end up in attributes
+		{"---\nclass: x\" onclick=\"alert(1)\nid: <b>\n---\nBody", "<div id=\"&lt;b&gt;\" class=\"x&#34; onclick=&#34;alert(1)\">\n<p>Body</p>\n</div>\n", nil},
+		// Without a closing line the --- is a thematic break
+		{"---\nBody", "<hr>\n<p>Body</p>\n", map[string]string{}},
+	}
+	for _, tt := range tests {
+		r, err := Render(tt.source)
+		if err != nil {
+			t.Errorf("Render(%q): %v", tt.source, err)
+			continue
+		}
+		if r.HTML != tt.want {
+			t.Errorf("Render(%q) = %q, want %q", tt.source, r.HTML, tt.want)
+		}
+		for k, v := range tt.meta {
+			if r.Meta[k] != v {
+				t.Errorf("Render(%q) meta %s = %q, want %q", tt.source, k, r.Meta[k], v)
+			}
+		}
+	}
+
+	if _, err := Render("---\nnot front matter\n---\nBody"); err == nil {
+		t.Error("a front matter line without a key was accepted")
+	}
+}
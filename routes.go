@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/handlers"
+	"cms/mailer"
+	"cms/settings"
+	"cms/sites"
+	"cms/storage"
+)
+
+// routes builds the handler serving one site from its database and settings.
+// The admin API needs a user with access to the site; everything else is the
+// public site.
+func routes(database *sql.DB, cfg *settings.Settings, store storage.Storage, mailQueue *mailer.Queue, registry *sites.Registry) http.Handler {
+	r := chi.NewRouter()
+
+	// Public site
+	r.Get("/uploads/*", handlers.ServeMediaFile(store))
+	r.Get("/images/{width}/*", handlers.ServeImageVariant(database, store, cfg.Media))
+	r.Get("/assets/{bundle}", handlers.ServeAsset(database))
+
+	r.Get("/search", handlers.Search(database))
+	r.Get("/sitemap.xml", handlers.Sitemap(database, cfg))
+	r.Get("/sitemap-{part}", handlers.SitemapPart(database, cfg))
+	r.Get("/robots.txt", handlers.Robots(cfg))
+	r.Get("/feeds/{feed}", handlers.PageFeed(database, cfg))
+
+	// Public endpoint the rendered forms post to
+	r.Post("/forms/{formName}/submit", handlers.SubmitForm(database, cfg, mailQueue))
+	r.NotFound(handlers.ServePublishedPage(database, cfg))
+
+	// Admin API
+	r.Group(func(r chi.Router) {
+		r.Use(handlers.RequireAdminCSRF)
+		r.Use(registry.RequireAccess)
+
+		r.Get("/csrf", handlers.AdminCSRFToken)
+
+		r.Get("/home", func(w http.ResponseWriter, r *http.Request) {
+			path := r.URL.Path
+			log.Println("Path: " + path)
+			// Get the file extension
+
+			// Detect the MIME type based on file extension
+			mimeType := mime.TypeByExtension(filepath.Ext(path))
+			if mimeType != "" {
+				w.Header().Set("Content-Type", mimeType)
+			}
+
+			http.ServeFile(w, r, "./front-end/index.html")
+		})
+
+		// http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// 	path := r.URL.Path
+		// 	if path == "/" {
+		// 		path = "/index.html" // Default to index.html
+		// 	}
+
+		// // Get the file extension
+		// ext := strings.ToLower(filepath.Ext(path))
+		// switch ext {
+		// case ".js":
+		// 	w.Header().Set("Content-Type", "application/javascript")
+		// case ".css":
+		// 	w.Header().Set("Content-Type", "text/css")
+		// case ".html":
+		// 	w.Header().Set("Content-Type", "text/html")
+		// }
+		// 	log.Println("Path" + path)
+		// 	http.ServeFile(w, r, "./front-end"+path)
+		// })
+
+		// Pages Routes
+		r.Route("/pages", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreatePage(database))
+			r.Post("/reorder", handlers.ReorderPages(database))
+			// Read
+			r.Get("/", handlers.GetPages(database))
+			r.Get("/{pageID}", handlers.RenderPage(database, cfg))
+			r.Get("/{pageID}/ancestors", handlers.GetPageAncestors(database))
+			r.Get("/{pageID}/terms", handlers.GetPageTerms(database))
+			r.Get("/{pageID}/translations", handlers.GetPageTranslations(database, cfg))
+			// Update
+			r.Patch("/{pageID}", handlers.UpdatePage(database, cfg))
+			r.Put("/{pageID}/terms", handlers.UpdatePageTerms(database))
+			r.Put("/{pageID}/translations/{locale}", handlers.UpdatePageTranslation(database, cfg))
+			r.Post("/{pageID}/publish", handlers.PublishPage(database, cfg))
+			r.Delete("/{pageID}/publish", handlers.UnpublishPage(database))
+			// Delete
+			r.Delete("/{pageID}", handlers.DeletePage(database))
+			r.Delete("/{pageID}/translations/{locale}", handlers.DeletePageTranslation(database, cfg))
+		})
+
+		// Templates Routes
+		r.Route("/templates", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreateTemplate(database))
+			r.Post("/duplicate/{templateID}", handlers.DuplicateTemplate(database))
+			// Read
+			r.Get("/", handlers.GetTemplates(database))
+			r.Get("/{templateID}", handlers.GetTemplate(database))
+			// Update
+			r.Patch("/{templateID}/name", handlers.UpdateTemplate(database))
+			// Delete
+			r.Delete("/{templateID}", handlers.DeleteTemplate(database))
+		})
+
+		// Code Blocks Routes
+		r.Route("/code_blocks", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreateCodeBlock(database))
+			// Read
+			r.Get("/", handlers.GetCodeBlocks(database))
+			r.Get("/{codeBlockID}", handlers.GetCodeBlock(database))
+			r.Get("/{codeBlockID}/translations", handlers.GetCodeBlockTranslations(database))
+			// Update
+			r.Patch("/{codeBlockID}", handlers.UpdateCodeBlock(database))
+			r.Delete("/{codeBlockID}/override", handlers.RevertCodeBlock(database, cfg, registry))
+			r.Put("/{codeBlockID}/translations/{locale}", handlers.UpdateCodeBlockTranslation(database, cfg))
+			// Delete
+			r.Delete("/{codeBlockID}", handlers.DeleteCodeBlock(database))
+			r.Delete("/{codeBlockID}/translations/{locale}", handlers.DeleteCodeBlockTranslation(database, cfg))
+		})
+
+		// Shared Code Block Routes; every site can use the library, superusers edit it
+		r.Route("/shared_blocks", func(r chi.Router) {
+			// Create
+			r.With(sites.RequireSuperuser).Post("/", handlers.CreateSharedBlock(registry))
+			r.Post("/{sharedID}/link", handlers.LinkSharedBlock(database, registry))
+			// Read
+			r.Get("/", handlers.GetSharedBlocks(registry))
+			r.Get("/{sharedID}", handlers.GetSharedBlock(registry))
+			r.With(sites.RequireSuperuser).Get("/{sharedID}/usage", handlers.GetSharedBlockUsage(registry))
+			// Update
+			r.With(sites.RequireSuperuser).Patch("/{sharedID}", handlers.UpdateSharedBlock(registry))
+			// Delete
+			r.With(sites.RequireSuperuser).Delete("/{sharedID}", handlers.DeleteSharedBlock(registry))
+		})
+
+		// Translations still to be done, per locale
+		r.Get("/translations/missing", handlers.GetMissingTranslations(database, cfg))
+
+		// Menu Routes
+		r.Route("/menus", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreateMenu(database))
+			// Read
+			r.Get("/", handlers.GetMenus(database))
+			r.Get("/{name}", handlers.GetMenu(database))
+			// Update
+			r.Put("/{name}/items", handlers.UpdateMenuItems(database))
+			// Delete
+			r.Delete("/{name}", handlers.DeleteMenu(database))
+		})
+
+		// Content Type Routes
+		r.Route("/content_types", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreateContentType(database))
+			// Read
+			r.Get("/", handlers.GetContentTypes(database))
+			r.Get("/{typeName}", handlers.GetContentType(database))
+			// Update
+			r.Patch("/{typeName}", handlers.UpdateContentType(database))
+			// Delete
+			r.Delete("/{typeName}", handlers.DeleteContentType(database))
+
+			r.Route("/{typeName}/entries", func(r chi.Router) {
+				// Create
+				r.Post("/", handlers.CreateEntry(database))
+				// Read
+				r.Get("/", handlers.GetEntries(database))
+				r.Get("/{entryID}", handlers.GetEntry(database))
+				// Update
+				r.Patch("/{entryID}", handlers.UpdateEntry(database))
+				// Delete
+				r.Delete("/{entryID}", handlers.DeleteEntry(database))
+			})
+		})
+
+		// Collection Routes
+		r.Route("/collections", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreateCollection(database))
+			// Read
+			r.Get("/", handlers.GetCollections(database))
+			r.Get("/{collectionName}", handlers.GetCollection(database))
+			// Update
+			r.Patch("/{collectionName}", handlers.UpdateCollection(database))
+			// Delete
+			r.Delete("/{collectionName}", handlers.DeleteCollection(database))
+
+			r.Route("/{collectionName}/posts", func(r chi.Router) {
+				// Create
+				r.Post("/", handlers.CreatePost(database))
+				// Read
+				r.Get("/", handlers.GetPosts(database))
+				r.Get("/{postID}", handlers.GetPost(database))
+				r.Get("/{postID}/terms", handlers.GetPostTerms(database))
+				// Update
+				r.Patch("/{postID}", handlers.UpdatePost(database))
+				r.Put("/{postID}/terms", handlers.UpdatePostTerms(database))
+				// Delete
+				r.Delete("/{postID}", handlers.DeletePost(database))
+			})
+		})
+
+		// Taxonomy Routes
+		r.Route("/taxonomies", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreateVocabulary(database))
+			// Read
+			r.Get("/", handlers.GetVocabularies(database))
+			r.Get("/{vocabulary}", handlers.GetVocabulary(database))
+			// Update
+			r.Patch("/{vocabulary}", handlers.UpdateVocabulary(database))
+			// Delete
+			r.Delete("/{vocabulary}", handlers.DeleteVocabulary(database))
+
+			r.Route("/{vocabulary}/terms", func(r chi.Router) {
+				// Create
+				r.Post("/", handlers.CreateTerm(database))
+				// Read
+				r.Get("/", handlers.GetTerms(database))
+				// Update
+				r.Patch("/{termID}", handlers.UpdateTerm(database))
+				// Delete
+				r.Delete("/{termID}", handlers.DeleteTerm(database))
+			})
+		})
+
+		// Form Routes
+		r.Route("/forms", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreateForm(database))
+			// Read
+			r.Get("/", handlers.GetForms(database))
+			r.Get("/{formName}", handlers.GetForm(database))
+			r.Get("/{formName}/submissions", handlers.GetSubmissions(database))
+			r.Get("/{formName}/submissions.csv", handlers.ExportSubmissions(database))
+			// Update
+			r.Patch("/{formName}", handlers.UpdateForm(database))
+			// Delete
+			r.Delete("/{formName}", handlers.DeleteForm(database))
+			r.Delete("/{formName}/submissions/{submissionID}", handlers.DeleteSubmission(database))
+		})
+
+		// Redirect Routes
+		r.Route("/redirects", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.CreateRedirect(database))
+			// Read
+			r.Get("/", handlers.GetRedirects(database))
+			// Update
+			r.Patch("/{redirectID}", handlers.UpdateRedirect(database))
+			// Delete
+			r.Delete("/{redirectID}", handlers.DeleteRedirect(database))
+		})
+
+		// Media Routes
+		r.Route("/media", func(r chi.Router) {
+			// Create
+			r.Post("/", handlers.UploadMedia(database, store, cfg.Media))
+			// Read
+			r.Get("/", handlers.GetMediaList(database))
+			r.Get("/{mediaID}", handlers.GetMedia(database))
+			// Update
+			r.Patch("/{mediaID}", handlers.UpdateMedia(database))
+			// Delete
+			r.Delete("/{mediaID}", handlers.DeleteMedia(database, store))
+		})
+
+		// Settings Routes
+		r.Get("/settings", handlers.GetSettings(registry))
+		r.Patch("/settings", handlers.UpdateSettings(registry))
+
+		// Export and Import Routes
+		r.Get("/export", handlers.ExportSite(registry))
+		r.Post("/import", handlers.ImportSite(registry))
+		r.Post("/import/wordpress", handlers.ImportWordPressExport(database, cfg, store))
+
+		// Instance-wide routes, for superusers only
+		r.Group(func(r chi.Router) {
+			r.Use(sites.RequireSuperuser)
+
+			// Site Routes
+			r.Route("/sites", func(r chi.Router) {
+				// Create
+				r.Post("/", handlers.CreateSite(registry))
+				// Read
+				r.Get("/", handlers.GetSites(registry))
+				r.Get("/{siteID}", handlers.GetSite(registry))
+				// Update
+				r.Patch("/{siteID}", handlers.UpdateSite(registry))
+				// Delete
+				r.Delete("/{siteID}", handlers.DeleteSite(registry))
+			})
+
+			// User Routes
+			r.Route("/users", func(r chi.Router) {
+				// Create
+				r.Post("/", handlers.CreateUser(registry))
+				// Read
+				r.Get("/", handlers.GetUsers(registry))
+				// Update
+				r.Patch("/{userID}", handlers.UpdateUser(registry))
+				// Delete
+				r.Delete("/{userID}", handlers.DeleteUser(registry))
+			})
+		})
+	})
+
+	return r
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cms/settings"
+)
+
+// New builds an http.Server with the timeouts from the settings file
+func New(addr string, handler http.Handler, cfg settings.Server) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+	}
+}
+
+// Run serves every server until ctx is cancelled or one of them fails, then
+// shuts all of them down, giving in-flight requests up to shutdownTimeout to finish.
+// Servers with a TLSConfig are served over TLS.
+func Run(ctx context.Context, shutdownTimeout time.Duration, servers ...*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			var err error
+			if srv.TLSConfig != nil {
+				log.Println("Starting HTTPS server on " + srv.Addr)
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				log.Println("Starting server on " + srv.Addr)
+				err = srv.ListenAndServe()
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			errs <- err
+		}(srv)
+	}
+
+	// Wait for a shutdown signal or for a listener to die on its own
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Println("Shutting down, waiting for in-flight requests")
+	case runErr = <-errs:
+		log.Printf("Server stopped unexpectedly: %v", runErr)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Forced shutdown of %s: %v", srv.Addr, err)
+			srv.Close()
+		}
+	}
+
+	return runErr
+}
+
+// Background tracks long-running goroutines (certificate watchers, schedulers,
+// cache warmers) so shutdown can wait for them to return.
+type Background struct {
+	wg sync.WaitGroup
+}
+
+// Go runs fn in a goroutine. fn must return once ctx is cancelled.
+func (b *Background) Go(ctx context.Context, fn func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		fn(ctx)
+	}()
+}
+
+// Wait blocks until every goroutine started with Go has returned
+func (b *Background) Wait() {
+	b.wg.Wait()
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// CertReloader holds the TLS certificate loaded from disk and lets it be
+// swapped out while the server keeps running.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertReloader loads the certificate and key, returning an error that names
+// the offending file if either can't be read.
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	c := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate files again. On failure the previously loaded
+// certificate stays in use.
+func (c *CertReloader) Reload() error {
+	for _, path := range []string{c.certPath, c.keyPath} {
+		if path == "" {
+			return fmt.Errorf("ssl_certificate and ssl_key must both be set when ssl_enabled is true")
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("cannot read TLS file: %w", err)
+		}
+		f.Close()
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("invalid TLS certificate/key pair (%s, %s): %w", c.certPath, c.keyPath, err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate so every handshake picks
+// up the most recently loaded certificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// WatchSIGHUP reloads the certificate every time the process receives SIGHUP,
+// until ctx is cancelled
+func (c *CertReloader) WatchSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := c.Reload(); err != nil {
+				log.Printf("TLS reload failed, keeping current certificate: %v", err)
+				continue
+			}
+			log.Println("TLS certificate reloaded")
+		}
+	}
+}
+
+// TLSConfig returns a tls.Config that serves certificates from the reloader
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// RedirectToHTTPS sends every request to the same host and path on the HTTPS address
+func RedirectToHTTPS(httpsAddr string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
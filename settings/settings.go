@@ -0,0 +1,355 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Settings mirrors the structure of website_settings.json
+type Settings struct {
+	SiteName        string            `json:"site_name"`
+	SiteDescription string            `json:"site_description"`
+	SiteURL         string            `json:"site_url"`
+	AdminEmail      string            `json:"admin_email"`
+	ContactEmail    string            `json:"contact_email"`
+	SocialMedia     map[string]string `json:"social_media"`
+	Analytics       Analytics         `json:"analytics"`
+	Security        Security          `json:"security"`
+	Database        Database          `json:"database"`
+	Server          Server            `json:"server"`
+	Media           Media             `json:"media"`
+	Assets          Assets            `json:"assets"`
+	Sitemap         Sitemap           `json:"sitemap"`
+	Robots          Robots            `json:"robots"`
+	SEO             SEO               `json:"seo"`
+	Feeds           []Feed            `json:"feeds"`
+	Mail            Mail              `json:"mail"`
+	Locales         Locales           `json:"locales"`
+}
+
+type Analytics struct {
+	GoogleAnalyticsID string `json:"google_analytics_id"`
+}
+
+type Security struct {
+	SSLEnabled     bool   `json:"ssl_enabled"`
+	SSLCertificate string `json:"ssl_certificate"`
+	SSLKey         string `json:"ssl_key"`
+}
+
+type Database struct {
+	Host         string `json:"host"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	DatabaseName string `json:"database_name"`
+}
+
+// Server holds the listen addresses and timeouts. HTTPSAddr is only used when
+// SSL is enabled, in which case HTTPAddr serves redirects to HTTPS.
+type Server struct {
+	HTTPAddr          string   `json:"http_addr"`
+	HTTPSAddr         string   `json:"https_addr"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	// How long in-flight requests get to finish once a shutdown starts
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// Media configures where uploads are kept, how large they may be and which
+// resized variants are generated for images
+type Media struct {
+	StorageDir      string `json:"storage_dir"`
+	MaxUploadSizeMB int64  `json:"max_upload_size_mb"`
+	ImageWidths     []int  `json:"image_widths"`
+	JPEGQuality     int    `json:"jpeg_quality"`
+	// Generate every width at upload time instead of on first request
+	ResizeOnUpload bool `json:"resize_on_upload"`
+}
+
+// Assets controls how CSS and JS code blocks are bundled
+type Assets struct {
+	Minify bool `json:"minify"`
+}
+
+// Sitemap limits how many URLs go in one sitemap file before it's split
+// behind a sitemap index (the protocol allows at most 50,000)
+type Sitemap struct {
+	MaxURLs int `json:"max_urls"`
+}
+
+// Robots is rendered as /robots.txt. DisallowAll blocks every crawler, e.g. on
+// a staging copy of the site.
+type Robots struct {
+	DisallowAll bool     `json:"disallow_all"`
+	Allow       []string `json:"allow"`
+	Disallow    []string `json:"disallow"`
+}
+
+// SEO holds the defaults pages inherit when their own SEO fields are empty.
+// The default description is site_description.
+type SEO struct {
+	TitleSuffix      string `json:"title_suffix"`
+	DefaultOGImageID int    `json:"default_og_image_id"`
+	TwitterSite      string `json:"twitter_site"`
+}
+
+// Feed publishes the pages below ParentPage (at any depth) as RSS and Atom at
+// /feeds/{name}.rss and /feeds/{name}.atom
+type Feed struct {
+	Name       string `json:"name"`
+	Title      string `json:"title"`
+	ParentPage int    `json:"parent_page"`
+	Limit      int    `json:"limit"`
+}
+
+// Mail configures how notification emails are sent. Driver is "smtp", "file"
+// (one .eml file per message in FileDir, for testing) or "log", the default,
+// which only writes messages to the server log.
+type Mail struct {
+	Driver       string `json:"driver"`
+	From         string `json:"from"`
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     int    `json:"smtp_port"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+	FileDir      string `json:"file_dir"`
+}
+
+// Locales lists the languages pages can be translated into. Pages' own fields
+// are in Default, served without a prefix; the other locales are served
+// under /{locale}/.
+type Locales struct {
+	Default   string   `json:"default"`
+	Available []string `json:"available"`
+}
+
+// Translated returns the locales other than the default
+func (l Locales) Translated() []string {
+	var locales []string
+	for _, locale := range l.Available {
+		if locale != l.Default {
+			locales = append(locales, locale)
+		}
+	}
+	return locales
+}
+
+// Has reports whether locale is configured
+func (l Locales) Has(locale string) bool {
+	for _, available := range l.Available {
+		if available == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// Duration is a time.Duration written as a string such as "15s" in the settings file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("duration must be a string like \"15s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Load reads and parses the settings file, filling in defaults for anything
+// left out. With several sites it holds the defaults each site's own settings
+// are applied over.
+func Load(path string) (*Settings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading settings file %s: %w", path, err)
+	}
+
+	var s Settings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing settings file %s: %w", path, err)
+	}
+	s.setDefaults()
+	return &s, nil
+}
+
+// ForSite returns a copy of the settings with one site's overrides, a JSON
+// object shaped like the settings file, applied on top. The server, security,
+// database and mail delivery settings and the media directory belong to the
+// whole instance, so a site can't change them; it can only set its own mail
+// "from" address.
+func (s *Settings) ForSite(overrides []byte) (*Settings, error) {
+	// Round-trip through JSON so the copy shares no maps or slices with s
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var site Settings
+	if err := json.Unmarshal(data, &site); err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 {
+		if err := json.Unmarshal(overrides, &site); err != nil {
+			return nil, fmt.Errorf("parsing site settings: %w", err)
+		}
+	}
+
+	from := site.Mail.From
+	site.Server, site.Security, site.Database, site.Mail = s.Server, s.Security, s.Database, s.Mail
+	site.Mail.From = from
+	site.Media.StorageDir = s.Media.StorageDir
+	site.setDefaults()
+	return &site, nil
+}
+
+// instanceSettings are the settings ForSite keeps at the instance's values,
+// as paths into the settings file
+var instanceSettings = [][]string{
+	{"server"},
+	{"security"},
+	{"database"},
+	{"media", "storage_dir"},
+	{"mail", "driver"},
+	{"mail", "smtp_host"},
+	{"mail", "smtp_port"},
+	{"mail", "smtp_username"},
+	{"mail", "smtp_password"},
+	{"mail", "file_dir"},
+}
+
+// StripInstance removes the settings that belong to the whole instance from
+// a site's overrides, returning what's left and the dotted names of the
+// settings removed, such as media.storage_dir
+func StripInstance(overrides []byte) ([]byte, []string, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(overrides, &obj); err != nil || obj == nil {
+		return nil, nil, fmt.Errorf("settings must be a JSON object")
+	}
+	var removed []string
+	for _, keys := range instanceSettings {
+		parent := obj
+		for _, key := range keys[:len(keys)-1] {
+			parent, _ = parent[key].(map[string]interface{})
+		}
+		last := keys[len(keys)-1]
+		if _, ok := parent[last]; ok {
+			delete(parent, last)
+			removed = append(removed, strings.Join(keys, "."))
+		}
+	}
+	if len(removed) == 0 {
+		return overrides, nil, nil
+	}
+	stripped, err := json.Marshal(obj)
+	return stripped, removed, err
+}
+
+// MergeOverrides applies changes to a site's overrides, both JSON objects
+// shaped like the settings file. Objects are merged key by key and a null
+// removes a setting, so the site goes back to the settings file's value.
+func MergeOverrides(overrides, changes []byte) ([]byte, error) {
+	var current, update map[string]interface{}
+	if len(overrides) > 0 {
+		if err := json.Unmarshal(overrides, &current); err != nil {
+			return nil, fmt.Errorf("parsing site settings: %w", err)
+		}
+	}
+	if current == nil {
+		current = map[string]interface{}{}
+	}
+	if err := json.Unmarshal(changes, &update); err != nil || update == nil {
+		return nil, fmt.Errorf("settings must be a JSON object")
+	}
+	mergeObjects(current, update)
+	return json.Marshal(current)
+}
+
+func mergeObjects(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		srcObj, srcIsObj := value.(map[string]interface{})
+		dstObj, dstIsObj := dst[key].(map[string]interface{})
+		if srcIsObj && dstIsObj {
+			mergeObjects(dstObj, srcObj)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// setDefaults fills in anything left out of the settings
+func (s *Settings) setDefaults() {
+	if s.Server.HTTPAddr == "" {
+		s.Server.HTTPAddr = ":8080"
+	}
+	if s.Server.HTTPSAddr == "" {
+		s.Server.HTTPSAddr = ":8443"
+	}
+	if s.Media.StorageDir == "" {
+		s.Media.StorageDir = "uploads"
+	}
+	if s.Media.MaxUploadSizeMB == 0 {
+		s.Media.MaxUploadSizeMB = 20
+	}
+	if len(s.Media.ImageWidths) == 0 {
+		s.Media.ImageWidths = []int{320, 640, 1024, 1600, 2048}
+	}
+	if s.Media.JPEGQuality == 0 {
+		s.Media.JPEGQuality = 82
+	}
+	if s.Sitemap.MaxURLs <= 0 || s.Sitemap.MaxURLs > 50000 {
+		s.Sitemap.MaxURLs = 50000
+	}
+	for i := range s.Feeds {
+		if s.Feeds[i].Limit <= 0 {
+			s.Feeds[i].Limit = 20
+		}
+	}
+	if s.Mail.Driver == "" {
+		s.Mail.Driver = "log"
+	}
+	if s.Mail.From == "" {
+		s.Mail.From = s.AdminEmail
+	}
+	if s.Mail.SMTPPort == 0 {
+		s.Mail.SMTPPort = 587
+	}
+	if s.Mail.FileDir == "" {
+		s.Mail.FileDir = "mail"
+	}
+	if s.Locales.Default == "" {
+		s.Locales.Default = "en"
+	}
+	if !s.Locales.Has(s.Locales.Default) {
+		s.Locales.Available = append([]string{s.Locales.Default}, s.Locales.Available...)
+	}
+	setDefaultDuration(&s.Server.ReadTimeout, 15*time.Second)
+	setDefaultDuration(&s.Server.ReadHeaderTimeout, 5*time.Second)
+	setDefaultDuration(&s.Server.WriteTimeout, 30*time.Second)
+	setDefaultDuration(&s.Server.IdleTimeout, 120*time.Second)
+	setDefaultDuration(&s.Server.ShutdownTimeout, 20*time.Second)
+}
+
+func setDefaultDuration(d *Duration, def time.Duration) {
+	if d.Duration == 0 {
+		d.Duration = def
+	}
+}
@@ -0,0 +1,138 @@
+package sites_test
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"cms/db"
+	"cms/handlers"
+	"cms/settings"
+	"cms/sites"
+)
+
+// newRegistry sets up an instance in a temporary directory whose sites only
+// serve their uploads
+func newRegistry(t *testing.T) (*sites.Registry, *settings.Settings) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sites' databases are created relative to the working directory
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	main := db.Connect()
+	t.Cleanup(func() { main.Close() })
+	base := &settings.Settings{SiteName: "Main"}
+	base.Media.StorageDir = "uploads"
+
+	var reg *sites.Registry
+	reg, err = sites.NewRegistry(main, "cms.db", base, func(s sites.Site, _ *sql.DB, cfg *settings.Settings) (http.Handler, error) {
+		store, err := reg.Storage(s, cfg)
+		if err != nil {
+			return nil, err
+		}
+		r := chi.NewRouter()
+		r.Get("/uploads/*", handlers.ServeMediaFile(store))
+		return r, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(reg.Close)
+	return reg, base
+}
+
+// saveMedia stores a file in a site's media
+func saveMedia(t *testing.T, reg *sites.Registry, hostname, key, content string) {
+	t.Helper()
+	s, err := reg.Lookup(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := reg.Settings(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := reg.Storage(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save(key, bytes.NewReader([]byte(content))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(reg *sites.Registry, host, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Host = host
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, r)
+	return w
+}
+
+func TestSiteMediaIsolated(t *testing.T) {
+	reg, _ := newRegistry(t)
+	if _, err := reg.Main().Exec("INSERT INTO sites (hostname, name, database) VALUES ('shop.example.com', 'Shop', 'site_data/shop.example.com.db')"); err != nil {
+		t.Fatal(err)
+	}
+	saveMedia(t, reg, "shop.example.com", "2024/01/private.pdf", "shop")
+	saveMedia(t, reg, sites.FallbackHost, "2024/01/public.pdf", "main")
+
+	tests := []struct {
+		host, path string
+		want       int
+	}{
+		{"shop.example.com", "/uploads/2024/01/private.pdf", http.StatusOK},
+		{"example.org", "/uploads/2024/01/public.pdf", http.StatusOK},
+		// The fallback site's uploads sit above the other sites' media
+		{"example.org", "/uploads/sites/shop.example.com/2024/01/private.pdf", http.StatusNotFound},
+		{"example.org", "/uploads/sites/../sites/shop.example.com/2024/01/private.pdf", http.StatusNotFound},
+		{"example.org", "/uploads/shop.example.com/2024/01/private.pdf", http.StatusNotFound},
+		{"shop.example.com", "/uploads/2024/01/public.pdf", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := get(reg, tt.host, tt.path)
+		if w.Code != tt.want {
+			t.Errorf("GET %s%s = %d, want %d", tt.host, tt.path, w.Code, tt.want)
+		}
+	}
+	if w := get(reg, "shop.example.com", "/uploads/2024/01/private.pdf"); w.Body.String() != "shop" {
+		t.Errorf("shop's file = %q", w.Body)
+	}
+}
+
+func TestSiteMediaMoved(t *testing.T) {
+	reg, _ := newRegistry(t)
+	if _, err := reg.Main().Exec("INSERT INTO sites (hostname, name, database) VALUES ('shop.example.com', 'Shop', 'site_data/shop.example.com.db')"); err != nil {
+		t.Fatal(err)
+	}
+	// Media kept where earlier releases put it
+	old := filepath.Join("uploads", "shop.example.com", "2024", "01")
+	if err := os.MkdirAll(old, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(old, "a.pdf"), []byte("shop"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := get(reg, "shop.example.com", "/uploads/2024/01/a.pdf"); w.Code != http.StatusOK || w.Body.String() != "shop" {
+		t.Errorf("shop's moved file = %d %q", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join("uploads", "shop.example.com")); !os.IsNotExist(err) {
+		t.Errorf("the old media directory is still there: %v", err)
+	}
+	if w := get(reg, "example.org", "/uploads/shop.example.com/2024/01/a.pdf"); w.Code != http.StatusNotFound {
+		t.Errorf("the fallback site served the shop's file: %d", w.Code)
+	}
+}
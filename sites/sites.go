@@ -0,0 +1,404 @@
+package sites
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"cms/db"
+	"cms/settings"
+	"cms/storage"
+)
+
+// FallbackHost is the hostname of the site that answers any host no other
+// site claims. It is created with the main database on first start, so a
+// single-site install keeps working as before.
+const FallbackHost = "*"
+
+// Where new sites' databases are created, as {dir}/{hostname}.db
+const databaseDir = "site_data"
+
+// Where sites other than the main one keep their media, as
+// {media.storage_dir}/{dir}/{hostname}. The main site's store refuses keys
+// under it, so its /uploads/ never serves another site's files.
+const mediaDir = "sites"
+
+// Site is one website served by this instance, with its own database, media
+// and settings
+type Site struct {
+	ID       int             `json:"id"`
+	Hostname string          `json:"hostname"`
+	Name     string          `json:"name"`
+	Aliases  []string        `json:"aliases"`
+	Database string          `json:"database"`
+	Settings json.RawMessage `json:"settings"`
+	Active   int             `json:"active"`
+
+	CreatedAt string `json:"created_at"`
+}
+
+// hostnamePattern accepts lowercase DNS names such as "www.example.com"
+var hostnamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// ValidHostname reports whether host can name a site
+func ValidHostname(host string) bool {
+	return host == FallbackHost || (len(host) <= 253 && hostnamePattern.MatchString(host))
+}
+
+// DatabasePath is where a new site's database goes by default
+func DatabasePath(hostname string) string {
+	return filepath.Join(databaseDir, hostname+".db")
+}
+
+const Columns = "id, hostname, name, aliases, database, settings, IFNULL(active, 1), created_at"
+
+// Scan reads a row selected with Columns
+func Scan(row interface{ Scan(...interface{}) error }) (Site, error) {
+	var s Site
+	var aliases, siteSettings string
+	if err := row.Scan(&s.ID, &s.Hostname, &s.Name, &aliases, &s.Database, &siteSettings, &s.Active, &s.CreatedAt); err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal([]byte(aliases), &s.Aliases); err != nil {
+		return s, fmt.Errorf("site %s has invalid aliases: %w", s.Hostname, err)
+	}
+	s.Settings = json.RawMessage(siteSettings)
+	return s, nil
+}
+
+// Builder creates the routes serving one site from its database and settings
+type Builder func(site Site, database *sql.DB, cfg *settings.Settings) (http.Handler, error)
+
+// Registry routes each request to its site by Host header. Sites' databases
+// are opened and their routes built on first use, then kept until Reload.
+type Registry struct {
+	main     *sql.DB
+	mainPath string
+	base     *settings.Settings
+	build    Builder
+
+	mu    sync.Mutex
+	hosts map[string]int
+	sites map[int]*loaded
+	dbs   map[string]*sql.DB
+}
+
+type loaded struct {
+	site    Site
+	handler http.Handler
+}
+
+// NewRegistry serves the sites listed in the main database, whose path is
+// mainPath. base holds the settings every site starts from.
+func NewRegistry(main *sql.DB, mainPath string, base *settings.Settings, build Builder) (*Registry, error) {
+	_, err := main.Exec("INSERT OR IGNORE INTO sites (hostname, name, database) VALUES (?, ?, ?)",
+		FallbackHost, base.SiteName, mainPath)
+	if err != nil {
+		return nil, fmt.Errorf("creating the default site: %w", err)
+	}
+	reg := &Registry{
+		main:     main,
+		mainPath: mainPath,
+		base:     base,
+		build:    build,
+		hosts:    map[string]int{},
+		sites:    map[int]*loaded{},
+		dbs:      map[string]*sql.DB{mainPath: main},
+	}
+	if exist, err := reg.usersExist(); err == nil && !exist {
+		log.Println("No admin users yet: add a superuser with ./cms user add -superuser, or POST /users")
+	}
+	return reg, nil
+}
+
+// Main is the main database, which holds the sites and users tables
+func (reg *Registry) Main() *sql.DB {
+	return reg.main
+}
+
+// Base is the settings file every site's settings are applied over
+func (reg *Registry) Base() *settings.Settings {
+	return reg.base
+}
+
+// IsMain reports whether a site keeps its content in the main database
+func (reg *Registry) IsMain(s Site) bool {
+	return s.Database == reg.mainPath
+}
+
+// Settings resolves a site's settings: the settings file with the site's
+// overrides on top. Sites other than the main one keep their media in their
+// own directory under the instance's.
+func (reg *Registry) Settings(s Site) (*settings.Settings, error) {
+	cfg, err := reg.base.ForSite(s.Settings)
+	if err != nil {
+		return nil, err
+	}
+	if !reg.IsMain(s) {
+		cfg.Media.StorageDir = filepath.Join(reg.base.Media.StorageDir, mediaDir, s.Hostname)
+	}
+	// Saved before addresses were checked, or the site's hostnames changed
+	if err := reg.CheckMailFrom(s, cfg.Mail.From); err != nil {
+		log.Printf("Site %s: %v, sending as %s instead", s.Hostname, err, reg.base.Mail.From)
+		cfg.Mail.From = reg.base.Mail.From
+	}
+	return cfg, nil
+}
+
+// CheckMailFrom makes sure a site's own mail "from" address is at one of its
+// hostnames or a subdomain of one. Mail goes out through the instance's
+// account, so a site sending as any address could pass for someone else.
+// The fallback site may also use the instance's domain.
+func (reg *Registry) CheckMailFrom(s Site, from string) error {
+	if from == reg.base.Mail.From {
+		return nil
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("mail.from must be an email address")
+	}
+	hosts := append([]string{s.Hostname}, s.Aliases...)
+	if s.Hostname == FallbackHost {
+		if base, err := mail.ParseAddress(reg.base.Mail.From); err == nil {
+			hosts = append(hosts, addressDomain(base.Address))
+		}
+	}
+	domain := addressDomain(addr.Address)
+	for _, host := range hosts {
+		if domain == host || strings.HasSuffix(domain, "."+host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("mail.from must be an address at one of the site's own hostnames")
+}
+
+func addressDomain(address string) string {
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// Storage opens a site's media store in the directory its settings name.
+// Media kept directly under the instance's directory by earlier releases is
+// moved into place first.
+func (reg *Registry) Storage(s Site, cfg *settings.Settings) (*storage.Local, error) {
+	if reg.IsMain(s) {
+		store, err := storage.NewLocal(cfg.Media.StorageDir)
+		if err != nil {
+			return nil, err
+		}
+		store.Reserved = []string{mediaDir}
+		return store, nil
+	}
+
+	old := filepath.Join(reg.base.Media.StorageDir, s.Hostname)
+	if _, err := os.Stat(cfg.Media.StorageDir); errors.Is(err, os.ErrNotExist) {
+		if info, err := os.Stat(old); err == nil && info.IsDir() {
+			if err := os.MkdirAll(filepath.Dir(cfg.Media.StorageDir), 0o755); err != nil {
+				return nil, err
+			}
+			if err := os.Rename(old, cfg.Media.StorageDir); err != nil {
+				return nil, fmt.Errorf("moving %s's media to %s: %w", s.Hostname, cfg.Media.StorageDir, err)
+			}
+			log.Printf("Moved %s's media from %s to %s", s.Hostname, old, cfg.Media.StorageDir)
+		}
+	}
+	return storage.NewLocal(cfg.Media.StorageDir)
+}
+
+// Lookup finds a site by its hostname, "*" being the fallback site
+func (reg *Registry) Lookup(hostname string) (Site, error) {
+	return Scan(reg.main.QueryRow("SELECT "+Columns+" FROM sites WHERE hostname = ?", hostname))
+}
+
+// SaveSettings replaces a site's settings overrides, after checking they
+// parse and give an address the site may send as, and reloads the site so they take effect
+func (reg *Registry) SaveSettings(s Site, overrides []byte) error {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(overrides, &obj); err != nil || obj == nil {
+		return fmt.Errorf("settings must be a JSON object")
+	}
+	cfg, err := reg.base.ForSite(overrides)
+	if err != nil {
+		return err
+	}
+	if err := reg.CheckMailFrom(s, cfg.Mail.From); err != nil {
+		return err
+	}
+	if _, err := reg.main.Exec("UPDATE sites SET settings = ? WHERE id = ?", string(overrides), s.ID); err != nil {
+		return err
+	}
+	reg.Reload(s.ID)
+	return nil
+}
+
+// Reload drops what was loaded for a site so the next request picks up its
+// changed hostname, aliases or settings
+func (reg *Registry) Reload(siteID int) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.sites, siteID)
+	reg.hosts = map[string]int{}
+}
+
+// Close closes every site database except the main one
+func (reg *Registry) Close() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for path, database := range reg.dbs {
+		if path != reg.mainPath {
+			if err := database.Close(); err != nil {
+				log.Printf("Failed to close database %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// normalizeHost strips the port and any trailing dot from a Host header
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// siteID finds the active site for a host, falling back to the site named
+// FallbackHost
+func (reg *Registry) siteID(host string) (int, error) {
+	reg.mu.Lock()
+	id, ok := reg.hosts[host]
+	reg.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var hostname string
+	err := reg.main.QueryRow(`
+		SELECT id, hostname FROM sites
+		WHERE IFNULL(active, 1) = 1
+			AND (hostname IN (?, ?) OR EXISTS (SELECT 1 FROM json_each(aliases) WHERE value = ?))
+		ORDER BY hostname = ?
+		LIMIT 1`, host, FallbackHost, host, FallbackHost).Scan(&id, &hostname)
+	if err != nil {
+		return 0, err
+	}
+
+	// Any Host header reaches the fallback, so only real matches are cached
+	if hostname != FallbackHost {
+		reg.mu.Lock()
+		reg.hosts[host] = id
+		reg.mu.Unlock()
+	}
+	return id, nil
+}
+
+// load returns a site's routes, opening its database and building them the
+// first time
+func (reg *Registry) load(id int) (*loaded, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if l, ok := reg.sites[id]; ok {
+		return l, nil
+	}
+
+	s, err := Scan(reg.main.QueryRow("SELECT "+Columns+" FROM sites WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := reg.Settings(s)
+	if err != nil {
+		return nil, err
+	}
+
+	database, err := reg.open(s)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := reg.build(s, database, cfg)
+	if err != nil {
+		return nil, err
+	}
+	l := &loaded{site: s, handler: handler}
+	reg.sites[id] = l
+	return l, nil
+}
+
+// open returns a site's database, opening it the first time. reg.mu must be
+// held.
+func (reg *Registry) open(s Site) (*sql.DB, error) {
+	if database, ok := reg.dbs[s.Database]; ok {
+		return database, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Database), 0o755); err != nil {
+		return nil, err
+	}
+	database, err := db.Open(s.Database)
+	if err != nil {
+		return nil, fmt.Errorf("opening database %s: %w", s.Database, err)
+	}
+	reg.dbs[s.Database] = database
+	return database, nil
+}
+
+// Database is a site's database, for work that spans sites
+func (reg *Registry) Database(s Site) (*sql.DB, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.open(s)
+}
+
+// Sites lists every site, active or not
+func (reg *Registry) Sites() ([]Site, error) {
+	rows, err := reg.main.Query("SELECT " + Columns + " FROM sites ORDER BY hostname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Site
+	for rows.Next() {
+		s, err := Scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := reg.siteID(normalizeHost(r.Host))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Unknown site", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to look up site", http.StatusInternalServerError)
+		return
+	}
+
+	l, err := reg.load(id)
+	if err != nil {
+		log.Printf("Failed to load site %d: %v", id, err)
+		http.Error(w, "Failed to load site", http.StatusInternalServerError)
+		return
+	}
+	l.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), siteKey{}, l.site)))
+}
+
+type siteKey struct{}
+
+// FromContext is the site a request is for
+func FromContext(ctx context.Context) (Site, bool) {
+	s, ok := ctx.Value(siteKey{}).(Site)
+	return s, ok
+}
@@ -0,0 +1,67 @@
+package sites
+
+import (
+	"encoding/json"
+	"testing"
+
+	"cms/settings"
+)
+
+func TestCheckMailFrom(t *testing.T) {
+	base := &settings.Settings{}
+	base.Mail.From = "cms@host.example.net"
+	reg := &Registry{base: base, mainPath: "cms.db"}
+	shop := Site{Hostname: "shop.example.com", Aliases: []string{"shop.example.org"}, Database: "site_data/shop.example.com.db"}
+	fallback := Site{Hostname: FallbackHost, Database: "cms.db"}
+
+	tests := []struct {
+		site Site
+		from string
+		ok   bool
+	}{
+		{shop, "cms@host.example.net", true},
+		{shop, "orders@shop.example.com", true},
+		{shop, "Shop <orders@SHOP.example.com>", true},
+		{shop, "orders@mail.shop.example.com", true},
+		{shop, "orders@shop.example.org", true},
+		{shop, "ceo@example.com", false},
+		{shop, "orders@evilshop.example.com", false},
+		{shop, "orders@shop.example.com.evil.net", false},
+		{shop, "someone@host.example.net", false},
+		{shop, "not an address", false},
+		{shop, "", false},
+		{fallback, "news@host.example.net", true},
+		{fallback, "news@other.example.net", false},
+	}
+	for _, tt := range tests {
+		err := reg.CheckMailFrom(tt.site, tt.from)
+		if tt.ok && err != nil {
+			t.Errorf("%s sending as %q: %v", tt.site.Hostname, tt.from, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s may send as %q", tt.site.Hostname, tt.from)
+		}
+	}
+}
+
+func TestSettingsMailFrom(t *testing.T) {
+	base := &settings.Settings{AdminEmail: "admin@host.example.net"}
+	base.Mail.From = "cms@host.example.net"
+	reg := &Registry{base: base, mainPath: "cms.db"}
+
+	for overrides, want := range map[string]string{
+		`{}`: "cms@host.example.net",
+		`{"mail": {"from": "orders@shop.example.com"}}`: "orders@shop.example.com",
+		// Stored before addresses were checked
+		`{"mail": {"from": "ceo@bank.example"}}`:                    "cms@host.example.net",
+		`{"admin_email": "ceo@bank.example", "mail": {"from": ""}}`: "cms@host.example.net",
+	} {
+		s := Site{Hostname: "shop.example.com", Database: "site_data/shop.example.com.db", Settings: json.RawMessage(overrides)}
+		cfg, err := reg.Settings(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Mail.From != want {
+			t.Errorf("with %s the site sends as %q, want %q", overrides, cfg.Mail.From, want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package sites
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBadCredentials is returned when a username or password is wrong
+var ErrBadCredentials = errors.New("sites: wrong username or password")
+
+// User is an admin who can manage the sites they've been granted, or every
+// site and the users themselves when Superuser is set
+type User struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	Superuser int    `json:"superuser"`
+	Sites     []int  `json:"sites"`
+	CreatedAt string `json:"created_at"`
+}
+
+// CanAccess reports whether the user may manage a site
+func (u User) CanAccess(siteID int) bool {
+	if u.Superuser == 1 {
+		return true
+	}
+	for _, id := range u.Sites {
+		if id == siteID {
+			return true
+		}
+	}
+	return false
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._@-]{0,63}$`)
+
+// ValidUsername reports whether name can be used to sign in
+func ValidUsername(name string) bool {
+	return usernamePattern.MatchString(name)
+}
+
+// MinPasswordLength is the shortest password accepted
+const MinPasswordLength = 10
+
+// PBKDF2-HMAC-SHA256 work factor for new password hashes
+const passwordIterations = 600000
+
+// HashPassword returns the string to store for a password
+func HashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// checkPassword reports whether password matches a stored hash
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	want, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations), want) == 1
+}
+
+// pbkdf2SHA256 derives a 32-byte key as in RFC 8018, which for a key the
+// size of the hash is a single block
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// GetUser loads a user along with the sites they've been granted
+func GetUser(database *sql.DB, id int) (User, error) {
+	var u User
+	err := database.QueryRow("SELECT id, username, IFNULL(superuser, 0), created_at FROM users WHERE id = ?", id).
+		Scan(&u.ID, &u.Username, &u.Superuser, &u.CreatedAt)
+	if err != nil {
+		return u, err
+	}
+
+	rows, err := database.Query("SELECT site_id FROM user_sites WHERE user_id = ? ORDER BY site_id", id)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+	u.Sites = []int{}
+	for rows.Next() {
+		var siteID int
+		if err := rows.Scan(&siteID); err != nil {
+			return u, err
+		}
+		u.Sites = append(u.Sites, siteID)
+	}
+	return u, rows.Err()
+}
+
+// Successful sign-ins are remembered for a while so that HTTP basic auth
+// doesn't rehash the password on every request
+const loginCacheTTL = 5 * time.Minute
+
+type loginCache struct {
+	mu     sync.Mutex
+	logins map[[32]byte]cachedLogin
+}
+
+type cachedLogin struct {
+	userID  int
+	expires time.Time
+}
+
+var logins = loginCache{logins: map[[32]byte]cachedLogin{}}
+
+func loginKey(username, password string) [32]byte {
+	return sha256.Sum256([]byte(username + "\x00" + password))
+}
+
+// ForgetLogins drops remembered sign-ins, for use after a password changes
+// or a user is deleted
+func ForgetLogins() {
+	logins.mu.Lock()
+	logins.logins = map[[32]byte]cachedLogin{}
+	logins.mu.Unlock()
+}
+
+// Authenticate checks a username and password
+func (reg *Registry) Authenticate(username, password string) (User, error) {
+	key := loginKey(username, password)
+	logins.mu.Lock()
+	cached, ok := logins.logins[key]
+	logins.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		u, err := GetUser(reg.main, cached.userID)
+		if err == sql.ErrNoRows {
+			return u, ErrBadCredentials
+		}
+		return u, err
+	}
+
+	var id int
+	var hash string
+	err := reg.main.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", username).Scan(&id, &hash)
+	if err == sql.ErrNoRows {
+		// Spend the same time as a real check so usernames can't be probed
+		checkPassword(dummyHash(), password)
+		return User{}, ErrBadCredentials
+	} else if err != nil {
+		return User{}, err
+	}
+	if !checkPassword(hash, password) {
+		return User{}, ErrBadCredentials
+	}
+
+	logins.mu.Lock()
+	logins.logins[key] = cachedLogin{userID: id, expires: time.Now().Add(loginCacheTTL)}
+	logins.mu.Unlock()
+	return GetUser(reg.main, id)
+}
+
+// dummyHash is checked against when a username doesn't exist
+var dummyHash = sync.OnceValue(func() string { return HashPassword("not a real password") })
+
+// usersExist reports whether any admin users have been created. Until one
+// is, the admin API only lets the first superuser be added.
+func (reg *Registry) usersExist() (bool, error) {
+	var n int
+	err := reg.main.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	return n > 0, err
+}
+
+type userKey struct{}
+
+// bootstrapKey marks the request adding the first user
+type bootstrapKey struct{}
+
+// UserFromContext is the signed-in user, if there is one
+func UserFromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(userKey{}).(User)
+	return u, ok
+}
+
+// bootstrapRequest reports whether a request adds a user, the only admin
+// request allowed before any user exists
+func bootstrapRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && (r.URL.Path == "/users" || r.URL.Path == "/users/")
+}
+
+// RequireAccess lets through requests signed in, with HTTP basic auth, as a
+// user who may manage the request's site. Until a user exists the only
+// request let through is the one adding the first superuser.
+func (reg *Registry) RequireAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exist, err := reg.usersExist()
+		if err != nil {
+			http.Error(w, "Failed to check users", http.StatusInternalServerError)
+			return
+		}
+		if !exist {
+			if !bootstrapRequest(r) {
+				http.Error(w, "No admin users yet: add a superuser with POST /users or ./cms user add -superuser", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), bootstrapKey{}, true)))
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="CoreCMS", charset="UTF-8"`)
+			http.Error(w, "Sign in required", http.StatusUnauthorized)
+			return
+		}
+		user, err := reg.Authenticate(username, password)
+		if err == ErrBadCredentials {
+			w.Header().Set("WWW-Authenticate", `Basic realm="CoreCMS", charset="UTF-8"`)
+			http.Error(w, "Wrong username or password", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+			return
+		}
+
+		site, _ := FromContext(r.Context())
+		if !user.CanAccess(site.ID) {
+			http.Error(w, "You don't have access to this site", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// RequireSuperuser limits routes to superusers. It must run after
+// RequireAccess, which it relies on to sign the user in.
+func RequireSuperuser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		// Adding the first user needs no one signed in; CheckNewUser makes it a superuser
+		bootstrap, _ := r.Context().Value(bootstrapKey{}).(bool)
+		if !bootstrap && (!ok || user.Superuser != 1) {
+			http.Error(w, "Only superusers can do this", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
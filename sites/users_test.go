@@ -0,0 +1,203 @@
+package sites
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// The first 32 bytes of the PBKDF2-HMAC-SHA256 vectors in RFC 7914
+	// section 11, and the RFC 6070 inputs run with SHA-256
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations))
+		if got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+// testHash builds a stored hash with few iterations, to keep tests fast
+func testHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := pbkdf2SHA256([]byte(password), salt, 10)
+	return fmt.Sprintf("pbkdf2-sha256$10$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash := testHash("correct horse")
+	tests := []struct {
+		hash, password string
+		want           bool
+	}{
+		{hash, "correct horse", true},
+		{hash, "correct horse ", false},
+		{hash, "", false},
+		{"", "correct horse", false},
+		{"bcrypt$10$c2FsdA$a2V5", "correct horse", false},
+		{"pbkdf2-sha256$0$c2FsdA$a2V5", "correct horse", false},
+		{"pbkdf2-sha256$ten$c2FsdA$a2V5", "correct horse", false},
+		{"pbkdf2-sha256$10$not base64$a2V5", "correct horse", false},
+		{"pbkdf2-sha256$10$c2FsdA", "correct horse", false},
+	}
+	for _, tt := range tests {
+		if got := checkPassword(tt.hash, tt.password); got != tt.want {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash := HashPassword("correct horse")
+	if !checkPassword(hash, "correct horse") {
+		t.Errorf("checkPassword rejects the password HashPassword hashed: %s", hash)
+	}
+	if checkPassword(hash, "wrong horse") {
+		t.Errorf("checkPassword accepts the wrong password for %s", hash)
+	}
+	if HashPassword("correct horse") == hash {
+		t.Error("HashPassword gave the same hash twice; the salt isn't random")
+	}
+}
+
+// openUsers creates a main database holding only the users tables
+func openUsers(t *testing.T) *sql.DB {
+	t.Helper()
+	database, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "cms.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	_, err = database.Exec(`
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			superuser INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE user_sites (user_id INTEGER NOT NULL, site_id INTEGER NOT NULL);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func TestAuthenticate(t *testing.T) {
+	database := openUsers(t)
+	if _, err := database.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", "jo", testHash("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.Exec("INSERT INTO user_sites (user_id, site_id) VALUES (1, 2)"); err != nil {
+		t.Fatal(err)
+	}
+
+	ForgetLogins()
+	defer ForgetLogins()
+	reg := &Registry{main: database}
+
+	u, err := reg.Authenticate("jo", "correct horse")
+	if err != nil {
+		t.Fatalf("Authenticate with the right password: %v", err)
+	}
+	if u.ID != 1 || u.Username != "jo" || !u.CanAccess(2) || u.CanAccess(3) {
+		t.Errorf("Authenticate returned %+v", u)
+	}
+
+	for _, login := range [][2]string{{"jo", "wrong horse"}, {"jo", ""}, {"nobody", "correct horse"}} {
+		if _, err := reg.Authenticate(login[0], login[1]); err != ErrBadCredentials {
+			t.Errorf("Authenticate(%q, %q) = %v, want ErrBadCredentials", login[0], login[1], err)
+		}
+	}
+
+	// A remembered sign-in stops working once the user is gone
+	if _, err := database.Exec("DELETE FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Authenticate("jo", "correct horse"); err != ErrBadCredentials {
+		t.Errorf("Authenticate for a deleted user = %v, want ErrBadCredentials", err)
+	}
+}
+
+func TestRequireAccessBootstrap(t *testing.T) {
+	database := openUsers(t)
+	reg := &Registry{main: database}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	admin := reg.RequireAccess(ok)
+	superuser := reg.RequireAccess(RequireSuperuser(ok))
+
+	// With no users, only adding one gets through, superuser routes included
+	tests := []struct {
+		h            http.Handler
+		method, path string
+		want         int
+	}{
+		{superuser, http.MethodPost, "/users", http.StatusOK},
+		{superuser, http.MethodPost, "/users/", http.StatusOK},
+		{superuser, http.MethodGet, "/users", http.StatusUnauthorized},
+		{superuser, http.MethodPatch, "/users/1", http.StatusUnauthorized},
+		{superuser, http.MethodPost, "/sites", http.StatusUnauthorized},
+		{admin, http.MethodPost, "/import/wordpress", http.StatusUnauthorized},
+		{admin, http.MethodGet, "/pages", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s with no users = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+
+	// Once a user exists, adding another needs a superuser signed in
+	if _, err := database.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", "jo", testHash("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	// The requests carry no site, which reads as site 0
+	if _, err := database.Exec("INSERT INTO user_sites (user_id, site_id) VALUES (1, 0)"); err != nil {
+		t.Fatal(err)
+	}
+	ForgetLogins()
+	defer ForgetLogins()
+	w := httptest.NewRecorder()
+	superuser.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /users signed out = %d, want 401", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/users", nil)
+	r.SetBasicAuth("jo", "correct horse")
+	w = httptest.NewRecorder()
+	superuser.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Only superusers") {
+		t.Errorf("POST /users as a plain user = %d %q, want 403 for superusers only", w.Code, w.Body)
+	}
+}
+
+func TestRequireSuperuserWithoutUser(t *testing.T) {
+	// Left out of RequireAccess by mistake, the route stays closed
+	w := httptest.NewRecorder()
+	RequireSuperuser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sites", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("RequireSuperuser with no one signed in = %d, want 403", w.Code)
+	}
+}
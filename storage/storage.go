@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when a key has no stored file
+var ErrNotFound = errors.New("storage: file not found")
+
+// Storage is where uploaded media files live. Keys are slash-separated
+// relative paths such as "2024/05/ab12cd-photo.jpg".
+type Storage interface {
+	// Save writes the contents of r under key, replacing any existing file,
+	// and returns the number of bytes written
+	Save(key string, r io.Reader) (int64, error)
+	Open(key string) (io.ReadSeekCloser, error)
+	Delete(key string) error
+	Exists(key string) bool
+	// List returns the names of the files and directories directly under
+	// the key prefix dir, or none if there is nothing there
+	List(dir string) ([]string, error)
+}
+
+// Local stores files in a directory on local disk
+type Local struct {
+	Dir string
+	// Reserved lists top-level directories of Dir that belong to something
+	// else, such as other sites' media. Keys inside them are refused, and
+	// opening one finds nothing.
+	Reserved []string
+}
+
+var errReserved = errors.New("storage: key is in a reserved directory")
+
+// NewLocal creates the directory if needed and returns a Local storage rooted there
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating storage directory %s: %w", dir, err)
+	}
+	return &Local{Dir: dir}, nil
+}
+
+// path resolves a key inside Dir, refusing keys that would escape it
+func (l *Local) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	top, _, _ := strings.Cut(strings.TrimPrefix(filepath.ToSlash(clean), "/"), "/")
+	for _, dir := range l.Reserved {
+		if top == dir {
+			return "", fmt.Errorf("%w: %q", errReserved, key)
+		}
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(clean)), nil
+}
+
+func (l *Local) Save(key string, r io.Reader) (int64, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+
+	// Write to a temp file first so readers never see a half-written file
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (l *Local) Open(key string) (io.ReadSeekCloser, error) {
+	path, err := l.path(key)
+	if errors.Is(err, errReserved) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (l *Local) Delete(key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) Exists(key string) bool {
+	path, err := l.path(key)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func (l *Local) List(dir string) ([]string, error) {
+	path, err := l.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
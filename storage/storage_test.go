@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	l := &Local{Dir: filepath.FromSlash("/srv/uploads")}
+	tests := []struct {
+		key  string
+		want string // relative to Dir, or "" when the key is refused
+	}{
+		{"2024/05/photo.jpg", "2024/05/photo.jpg"},
+		{"/2024/photo.jpg", "2024/photo.jpg"},
+		{"a//b/./c.jpg", "a/b/c.jpg"},
+		{"../etc/passwd", "etc/passwd"},
+		{"/a/../../b", "b"},
+		{"a/../../../../b/c", "b/c"},
+		{"", ""},
+		{"/", ""},
+		{".", ""},
+		{"..", ""},
+		{"../..", ""},
+		{`a\b.jpg`, ""},
+		{`..\..\etc\passwd`, ""},
+	}
+	for _, tt := range tests {
+		got, err := l.path(tt.key)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("path(%q) = %q, want an error", tt.key, got)
+			}
+			continue
+		}
+		want := filepath.Join(l.Dir, filepath.FromSlash(tt.want))
+		if err != nil || got != want {
+			t.Errorf("path(%q) = %q, %v, want %q", tt.key, got, err, want)
+		}
+	}
+}
+
+func TestLocalRoundTrip(t *testing.T) {
+	l, err := NewLocal(filepath.Join(t.TempDir(), "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := l.Save("2024/05/a.txt", strings.NewReader("first")); err != nil || n != 5 {
+		t.Fatalf("Save = %d, %v", n, err)
+	}
+	if _, err := l.Save("2024/05/a.txt", strings.NewReader("second")); err != nil {
+		t.Fatalf("Save over an existing file: %v", err)
+	}
+	if _, err := l.Save("2024/05/b.txt", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := l.Open("2024/05/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "second" {
+		t.Errorf("Open read %q, %v, want %q", data, err, "second")
+	}
+
+	// The temp files Save writes through must not be left behind
+	names, err := l.List("2024/05")
+	if err != nil || !reflect.DeepEqual(names, []string{"a.txt", "b.txt"}) {
+		t.Errorf("List = %q, %v", names, err)
+	}
+	if names, err := l.List("missing"); err != nil || names != nil {
+		t.Errorf("List of a missing dir = %q, %v, want nothing", names, err)
+	}
+
+	if !l.Exists("2024/05/a.txt") || l.Exists("2024/05/c.txt") || l.Exists("") {
+		t.Error("Exists disagrees with what was saved")
+	}
+	if err := l.Delete("2024/05/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("2024/05/a.txt"); err != nil {
+		t.Errorf("Delete of a missing file = %v, want nil", err)
+	}
+	if _, err := l.Open("2024/05/a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open after Delete = %v, want ErrNotFound", err)
+	}
+	if _, err := l.Save("../escape.txt", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Exists("escape.txt") {
+		t.Error("a key starting with .. wasn't kept inside Dir")
+	}
+}
+
+func TestLocalReserved(t *testing.T) {
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &Local{Dir: filepath.Join(l.Dir, "sites", "shop")}
+	if _, err := other.Save("a.txt", strings.NewReader("shop")); err != nil {
+		t.Fatal(err)
+	}
+	l.Reserved = []string{"sites"}
+
+	for _, key := range []string{"sites/shop/a.txt", "/sites/shop/a.txt", "x/../sites/shop/a.txt", "sites"} {
+		if _, err := l.Open(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Open(%q) = %v, want ErrNotFound", key, err)
+		}
+		if l.Exists(key) {
+			t.Errorf("Exists(%q) = true", key)
+		}
+		if _, err := l.Save(key, strings.NewReader("x")); err == nil {
+			t.Errorf("Save(%q) succeeded", key)
+		}
+		if err := l.Delete(key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+	}
+	if !other.Exists("a.txt") {
+		t.Error("the reserved directory's file is gone")
+	}
+	if _, err := l.Save("sitesmap/a.txt", strings.NewReader("x")); err != nil {
+		t.Errorf("a key merely starting with a reserved name was refused: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"strings"
+)
+
+// MinifyCSS strips comments and collapses whitespace in a stylesheet. Quoted
+// strings are copied untouched.
+func MinifyCSS(css string) string {
+	out := make([]byte, 0, len(css))
+	isSpace := func(c byte) bool { return strings.IndexByte(" \t\n\r\f", c) >= 0 }
+
+	pendingSpace := false
+	for i := 0; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case c == '/' && i+1 < len(css) && css[i+1] == '*':
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				i = len(css)
+			} else {
+				i += end + 3
+			}
+			pendingSpace = true
+		case isSpace(c):
+			pendingSpace = true
+		case strings.IndexByte("{};,>", c) >= 0:
+			// No whitespace is needed on either side of these
+			pendingSpace = false
+			if c == '}' && len(out) > 0 && out[len(out)-1] == ';' {
+				// Drop the last semicolon of a rule
+				out = out[:len(out)-1]
+			}
+			out = append(out, c)
+			for i+1 < len(css) && isSpace(css[i+1]) {
+				i++
+			}
+		default:
+			// A space before ':' is kept since "a :hover" differs from "a:hover"
+			if pendingSpace && len(out) > 0 && strings.IndexByte("{};,>", out[len(out)-1]) < 0 {
+				out = append(out, ' ')
+			}
+			pendingSpace = false
+
+			if c == '"' || c == '\'' {
+				j := i + 1
+				for j < len(css) && css[j] != c {
+					if css[j] == '\\' {
+						j++
+					}
+					j++
+				}
+				if j >= len(css) {
+					j = len(css) - 1
+				}
+				out = append(out, css[i:j+1]...)
+				i = j
+				continue
+			}
+
+			out = append(out, c)
+			if c == ':' {
+				for i+1 < len(css) && isSpace(css[i+1]) {
+					i++
+				}
+			}
+		}
+	}
+	return string(out)
+}
+
+// MinifyJS does a conservative minification: it trims each line and drops
+// blank lines. Anything smarter needs a real parser to be safe around strings,
+// regular expressions and automatic semicolon insertion.
+func MinifyJS(js string) string {
+	lines := strings.Split(js, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"html"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 // IntSliceToString converts a slice of integers to a comma-separated string.
@@ -30,3 +32,77 @@ func StringToIntSlice(str string) ([]int, error) {
 	}
 	return intSlice, nil
 }
+
+// HTMLToText extracts the visible text from an HTML document, dropping tags,
+// comments and the contents of head, script, style and template elements.
+func HTMLToText(doc string) string {
+	var b strings.Builder
+	skipUntil := ""
+
+	for len(doc) > 0 {
+		lt := strings.IndexByte(doc, '<')
+		if lt < 0 {
+			if skipUntil == "" {
+				b.WriteString(doc)
+			}
+			break
+		}
+		if skipUntil == "" {
+			b.WriteString(doc[:lt])
+		}
+		doc = doc[lt:]
+
+		if strings.HasPrefix(doc, "<!--") {
+			end := strings.Index(doc, "-->")
+			if end < 0 {
+				break
+			}
+			doc = doc[end+3:]
+			continue
+		}
+
+		gt := strings.IndexByte(doc, '>')
+		if gt < 0 {
+			break
+		}
+		tag := strings.ToLower(strings.TrimLeft(doc[1:gt], "/"))
+		if i := strings.IndexAny(tag, " \t\n\r/"); i >= 0 {
+			tag = tag[:i]
+		}
+		closing := strings.HasPrefix(doc, "</")
+		doc = doc[gt+1:]
+
+		switch {
+		case skipUntil != "":
+			if closing && tag == skipUntil {
+				skipUntil = ""
+			}
+		case !closing && (tag == "head" || tag == "script" || tag == "style" || tag == "template"):
+			skipUntil = tag
+		default:
+			// Tags separate words even when the markup has no whitespace
+			b.WriteByte(' ')
+		}
+	}
+
+	return strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+}
+
+// Slugify turns a title into a lowercase, hyphen-separated URL segment,
+// e.g. "Hello, World!" becomes "hello-world".
+func Slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	return b.String()
+}
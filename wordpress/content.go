@@ -0,0 +1,169 @@
+package wordpress
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Where WordPress keeps uploads, relative to the site root
+const uploadsDir = "/wp-content/uploads/"
+
+var (
+	blockComment = regexp.MustCompile(`<!--\s*/?wp:[^>]*?-->`)
+	captionCode  = regexp.MustCompile(`(?s)\[caption([^\]]*)\](.*?)\[/caption\]`)
+	captionImage = regexp.MustCompile(`(?s)^\s*((?:<a[^>]*>\s*)?<img[^>]*>(?:\s*</a>)?)(.*)$`)
+	embedCode    = regexp.MustCompile(`(?s)\[embed[^\]]*\](.*?)\[/embed\]`)
+	// [[name]] is how WordPress writes a literal [name]
+	shortcode      = regexp.MustCompile(`(\[?)\[(/?)([a-z][a-z0-9_-]*)((?:\s[^\]]*)?)/?\](\]?)`)
+	shortcodeAttr  = regexp.MustCompile(`(\w+)\s*=\s*"([^"]*)"`)
+	paragraphBreak = regexp.MustCompile(`\n\s*\n`)
+	preformatted   = regexp.MustCompile(`(?is)<(pre|script|style)\b.*?</(?:pre|script|style)>`)
+	blockStart     = regexp.MustCompile(`(?i)^(?:<(?:/?)(?:p|div|h[1-6]|ul|ol|li|dl|dt|dd|table|thead|tbody|tfoot|tr|td|th|caption|blockquote|figure|figcaption|pre|hr|form|fieldset|section|article|aside|header|footer|nav|main|address|iframe|video|audio|details|summary|script|style|!--)\b|\x00)`)
+	uploadURL      = regexp.MustCompile(`(?:(?:https?:)?//[^/"'\s<>]+)?` + regexp.QuoteMeta(uploadsDir) + `([^"'\s?#<>)]+)`)
+	// Resized copies are named photo-300x200.jpg after photo.jpg
+	sizeSuffix = regexp.MustCompile(`-\d+x\d+(\.[A-Za-z0-9]+)$`)
+	hrefAttr   = regexp.MustCompile(`(?i)(href\s*=\s*")([^"]*)(")`)
+)
+
+// Convert turns WordPress post content into plain HTML. Block editor comments
+// are dropped, paragraphs are added the way WordPress adds them on display,
+// [caption] and [embed] become HTML and any other shortcode is removed,
+// keeping whatever it wraps. It returns the names of the shortcodes removed,
+// once per use.
+func Convert(content string) (string, []string) {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = blockComment.ReplaceAllString(content, "")
+
+	content = captionCode.ReplaceAllStringFunc(content, func(m string) string {
+		parts := captionCode.FindStringSubmatch(m)
+		attrs := shortcodeAttrs(parts[1])
+		image, text := parts[2], attrs["caption"]
+		if p := captionImage.FindStringSubmatch(parts[2]); p != nil {
+			image = p[1]
+			if strings.TrimSpace(p[2]) != "" {
+				text = strings.TrimSpace(p[2])
+			}
+		}
+		class := "wp-caption"
+		if attrs["align"] != "" {
+			class += " " + html.EscapeString(attrs["align"])
+		}
+		return fmt.Sprintf(`<figure class="%s">%s<figcaption>%s</figcaption></figure>`, class, image, text)
+	})
+	content = embedCode.ReplaceAllStringFunc(content, func(m string) string {
+		link := html.EscapeString(strings.TrimSpace(embedCode.FindStringSubmatch(m)[1]))
+		return fmt.Sprintf(`<p><a href="%s">%s</a></p>`, link, link)
+	})
+
+	var removed []string
+	content = shortcode.ReplaceAllStringFunc(content, func(m string) string {
+		parts := shortcode.FindStringSubmatch(m)
+		if parts[1] == "[" && parts[5] == "]" {
+			return m[1 : len(m)-1]
+		}
+		if parts[2] == "" {
+			removed = append(removed, parts[3])
+		}
+		return parts[1] + parts[5]
+	})
+
+	return autop(content), removed
+}
+
+func shortcodeAttrs(s string) map[string]string {
+	attrs := map[string]string{}
+	for _, m := range shortcodeAttr.FindAllStringSubmatch(s, -1) {
+		attrs[m[1]] = html.UnescapeString(m[2])
+	}
+	return attrs
+}
+
+// autop wraps text separated by blank lines in paragraphs and turns single
+// line breaks into <br>, leaving block-level HTML and preformatted text alone
+func autop(content string) string {
+	var kept []string
+	content = preformatted.ReplaceAllStringFunc(content, func(m string) string {
+		kept = append(kept, m)
+		return fmt.Sprintf("\x00%d\x00", len(kept)-1)
+	})
+
+	var out []string
+	for _, chunk := range paragraphBreak.Split(content, -1) {
+		chunk = strings.TrimSpace(chunk)
+		if chunk == "" {
+			continue
+		}
+		if blockStart.MatchString(chunk) {
+			out = append(out, chunk)
+			continue
+		}
+		out = append(out, "<p>"+strings.ReplaceAll(chunk, "\n", "<br>\n")+"</p>")
+	}
+	content = strings.Join(out, "\n")
+
+	for i, m := range kept {
+		content = strings.Replace(content, fmt.Sprintf("\x00%d\x00", i), m, 1)
+	}
+	return content
+}
+
+// RewriteUploads replaces links to files under wp-content/uploads, on any
+// host, with what replace returns for the file's path there, such as
+// 2020/05/photo.jpg. Resized copies (photo-300x200.jpg) are looked up by the
+// original's path. Links replace doesn't know are left as they are and
+// returned.
+func RewriteUploads(content string, replace func(uploadPath string) (string, bool)) (string, []string) {
+	var missing []string
+	content = uploadURL.ReplaceAllStringFunc(content, func(m string) string {
+		p := uploadURL.FindStringSubmatch(m)[1]
+		if to, ok := replace(p); ok {
+			return to
+		}
+		if to, ok := replace(OriginalUpload(p)); ok {
+			return to
+		}
+		missing = append(missing, m)
+		return m
+	})
+	return content, missing
+}
+
+// OriginalUpload strips the size WordPress adds to resized copies of an image
+func OriginalUpload(uploadPath string) string {
+	return sizeSuffix.ReplaceAllString(uploadPath, "$1")
+}
+
+// Hosts are the hosts, with any port, the exported site's URLs name
+func (e *Export) Hosts() map[string]bool {
+	hosts := map[string]bool{}
+	for _, s := range []string{e.Link, e.BaseSiteURL, e.BaseBlogURL} {
+		if u, err := url.Parse(s); err == nil && u.Host != "" {
+			hosts[u.Host] = true
+		}
+	}
+	return hosts
+}
+
+// RewriteLinks replaces href links to the exported site, relative or on its
+// host, with what replace returns for their path
+func (e *Export) RewriteLinks(content string, replace func(path string) (string, bool)) string {
+	hosts := e.Hosts()
+	return hrefAttr.ReplaceAllStringFunc(content, func(m string) string {
+		parts := hrefAttr.FindStringSubmatch(m)
+		u, err := url.Parse(html.UnescapeString(parts[2]))
+		if err != nil || (u.Host != "" && !hosts[u.Host]) || !strings.HasPrefix(u.Path, "/") {
+			return m
+		}
+		to, ok := replace(u.Path)
+		if !ok {
+			return m
+		}
+		if u.Fragment != "" {
+			to += "#" + u.Fragment
+		}
+		return parts[1] + html.EscapeString(to) + parts[3]
+	})
+}
@@ -0,0 +1,232 @@
+// Package wordpress reads WordPress eXtended RSS (WXR) exports, the XML file
+// WordPress writes from Tools → Export, and turns their post content into
+// plain HTML.
+package wordpress
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Item types and statuses as WordPress names them
+const (
+	TypePage       = "page"
+	TypePost       = "post"
+	TypeAttachment = "attachment"
+
+	StatusPublish = "publish"
+	StatusFuture  = "future"
+	StatusDraft   = "draft"
+	StatusPending = "pending"
+	StatusPrivate = "private"
+	StatusTrash   = "trash"
+)
+
+// Export is a parsed WXR file. Element names are matched without their
+// namespace, so every WXR version (1.0 to 1.2) reads the same way.
+type Export struct {
+	Title       string     `xml:"channel>title"`
+	Link        string     `xml:"channel>link"`
+	Version     string     `xml:"channel>wxr_version"`
+	BaseSiteURL string     `xml:"channel>base_site_url"`
+	BaseBlogURL string     `xml:"channel>base_blog_url"`
+	Authors     []Author   `xml:"channel>author"`
+	Categories  []Category `xml:"channel>category"`
+	Tags        []Tag      `xml:"channel>tag"`
+	Terms       []Term     `xml:"channel>term"`
+	Items       []Item     `xml:"channel>item"`
+}
+
+type Author struct {
+	Login       string `xml:"author_login"`
+	Email       string `xml:"author_email"`
+	DisplayName string `xml:"author_display_name"`
+}
+
+type Category struct {
+	Nicename string `xml:"category_nicename"`
+	Parent   string `xml:"category_parent"`
+	Name     string `xml:"cat_name"`
+}
+
+type Tag struct {
+	Slug string `xml:"tag_slug"`
+	Name string `xml:"tag_name"`
+}
+
+// Term is an entry of a custom taxonomy
+type Term struct {
+	Taxonomy string `xml:"term_taxonomy"`
+	Slug     string `xml:"term_slug"`
+	Parent   string `xml:"term_parent"`
+	Name     string `xml:"term_name"`
+}
+
+// Item is a post, page, attachment or any other post type
+type Item struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Creator       string     `xml:"creator"`
+	ID            int        `xml:"post_id"`
+	Date          string     `xml:"post_date"`
+	DateGMT       string     `xml:"post_date_gmt"`
+	Name          string     `xml:"post_name"`
+	Status        string     `xml:"status"`
+	Parent        int        `xml:"post_parent"`
+	MenuOrder     int        `xml:"menu_order"`
+	Type          string     `xml:"post_type"`
+	AttachmentURL string     `xml:"attachment_url"`
+	Terms         []ItemTerm `xml:"category"`
+	Meta          []Meta     `xml:"postmeta"`
+	Comments      []struct{} `xml:"comment"`
+
+	// content:encoded and excerpt:encoded only differ by namespace
+	Encoded []encoded `xml:"encoded"`
+}
+
+// ItemTerm is a category, tag or custom taxonomy term given to an item
+type ItemTerm struct {
+	Domain   string `xml:"domain,attr"`
+	Nicename string `xml:"nicename,attr"`
+	Name     string `xml:",chardata"`
+}
+
+type Meta struct {
+	Key   string `xml:"meta_key"`
+	Value string `xml:"meta_value"`
+}
+
+type encoded struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+// Parse reads a WXR export
+func Parse(r io.Reader) (*Export, error) {
+	var e Export
+	dec := xml.NewDecoder(r)
+	// Exports from misconfigured sites aren't always valid UTF-8 or entity-clean
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := dec.Decode(&e); err != nil {
+		return nil, fmt.Errorf("reading WXR: %w", err)
+	}
+	if e.Version == "" {
+		return nil, fmt.Errorf("not a WordPress export: no wxr_version")
+	}
+	return &e, nil
+}
+
+// Content is the item's body
+func (it Item) Content() string {
+	return it.encoded("/content/")
+}
+
+// Excerpt is the item's hand-written excerpt, if any
+func (it Item) Excerpt() string {
+	return it.encoded("/excerpt/")
+}
+
+func (it Item) encoded(space string) string {
+	for _, e := range it.Encoded {
+		if strings.Contains(e.XMLName.Space, space) {
+			return e.Text
+		}
+	}
+	return ""
+}
+
+// MetaValue returns the value of the item's first postmeta with the key
+func (it Item) MetaValue(key string) string {
+	for _, m := range it.Meta {
+		if m.Key == key {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+// TermDeclaration returns the name and parent slug a category or custom
+// taxonomy term is declared with at the top of the export, if it is
+func (e *Export) TermDeclaration(taxonomy, slug string) (name, parent string, ok bool) {
+	if taxonomy == "category" {
+		for _, c := range e.Categories {
+			if c.Nicename == slug {
+				return c.Name, c.Parent, true
+			}
+		}
+		return "", "", false
+	}
+	for _, t := range e.Terms {
+		if t.Taxonomy == taxonomy && t.Slug == slug {
+			return t.Name, t.Parent, true
+		}
+	}
+	return "", "", false
+}
+
+// Hierarchical reports whether a taxonomy nests its terms. Categories always
+// do; custom taxonomies are taken to when any declared term has a parent.
+func (e *Export) Hierarchical(taxonomy string) bool {
+	if taxonomy == "category" {
+		return true
+	}
+	for _, t := range e.Terms {
+		if t.Taxonomy == taxonomy && t.Parent != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// TermNames returns the slugs of the item's terms in a taxonomy, such as
+// "category" or "post_tag"
+func (it Item) TermNames(domain string) []string {
+	var names []string
+	for _, t := range it.Terms {
+		if t.Domain == domain {
+			names = append(names, t.Nicename)
+		}
+	}
+	return names
+}
+
+// Published is when the item was published, in UTC. Drafts carry a zero date
+// in post_date_gmt, so the local post_date is used for them.
+func (it Item) Published() time.Time {
+	for _, s := range []string{it.DateGMT, it.Date} {
+		if t, err := time.Parse("2006-01-02 15:04:05", s); err == nil && t.Year() > 1 {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Path is the path part of the item's permalink, e.g. /2020/05/hello-world/.
+// Links that only carry a query string (?p=12, ?page_id=3) have none.
+func (it Item) Path() string {
+	u, err := url.Parse(it.Link)
+	if err != nil || u.Path == "" || u.Path == "/" && u.RawQuery != "" {
+		return ""
+	}
+	return u.Path
+}
+
+// UploadPath is an attachment's file path under wp-content/uploads, e.g.
+// 2020/05/photo.jpg
+func (it Item) UploadPath() string {
+	if p := it.MetaValue("_wp_attached_file"); p != "" {
+		return strings.TrimPrefix(p, "/")
+	}
+	if _, p, ok := strings.Cut(it.AttachmentURL, uploadsDir); ok {
+		return p
+	}
+	return ""
+}